@@ -0,0 +1,100 @@
+package main
+
+/*
+ * Test responses only go out in test mode but during the rally proper
+ * riders want to know their claims arrived too. With Acknowledge set, in
+ * the settings held in rallyparams or from the dashboard, each stored claim
+ * is acknowledged by a short email to its sender:-
+ *
+ *		Claim received: entrant 12, bonus A4, odo 10423, time 17:13, 2 photos
+ *
+ * To save a rider's inbox, and my mail server, an entrant gets at most one
+ * acknowledgement every AckEvery, default 5m. Claims arriving meanwhile
+ * aren't acknowledged themselves but the next acknowledgement says how
+ * many there were. ThrottleResponses stops acknowledgements during a rush
+ * of claims as it does test responses.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAckEvery = 5 * time.Minute
+
+var acks = struct {
+	mu   sync.Mutex
+	last map[int]time.Time
+	held map[int]int
+}{last: make(map[int]time.Time), held: make(map[int]int)}
+
+func ackEvery() time.Duration {
+
+	if cfg.AckEvery > 0 {
+		return cfg.AckEvery
+	}
+	return defaultAckEvery
+
+}
+
+// ackDue decides whether an entrant's claim is to be acknowledged now,
+// returning how many claims have gone unacknowledged since the last one.
+func ackDue(entrant int, now time.Time) (bool, int) {
+
+	acks.mu.Lock()
+	defer acks.mu.Unlock()
+	if last, ok := acks.last[entrant]; ok && now.Sub(last) < ackEvery() {
+		acks.held[entrant]++
+		return false, 0
+	}
+	held := acks.held[entrant]
+	acks.last[entrant] = now
+	delete(acks.held, entrant)
+	return true, held
+
+}
+
+// ackText describes a stored claim for its acknowledgement.
+func ackText(f4 *fourFields, numphotos int, held int) (string, string) {
+
+	subject := "Claim received"
+	if cfg.RallyTitle != "" {
+		subject = cfg.RallyTitle + ": " + subject
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Claim received: entrant %v, bonus %v, odo %v, time %v, ", f4.EntrantID, f4.BonusID, f4.OdoReading, f4.ClaimTime.Format("15:04"))
+	if numphotos == 1 {
+		sb.WriteString("1 photo\n")
+	} else {
+		fmt.Fprintf(&sb, "%v photos\n", numphotos)
+	}
+	if held == 1 {
+		sb.WriteString("\nAlso 1 other claim since my last acknowledgement.\n")
+	} else if held > 1 {
+		fmt.Fprintf(&sb, "\nAlso %v other claims since my last acknowledgement.\n", held)
+	}
+	sb.WriteString("\nThis only confirms your claim arrived, it hasn't been scored yet.\n")
+	return subject, sb.String()
+
+}
+
+// acknowledgeClaim tells the sender of a live claim that it's been stored,
+// if acknowledgements are wanted and one is due.
+func acknowledgeClaim(from string, f4 *fourFields, numphotos int, rateAnomaly bool) {
+
+	if !cfg.Acknowledge || cfg.TestMode || (rateAnomaly && cfg.ThrottleResponses) {
+		return
+	}
+	due, held := ackDue(f4.EntrantID, time.Now())
+	if !due {
+		return
+	}
+	subject, body := ackText(f4, numphotos, held)
+	if sendPlainMail(from, subject, body) == nil && debugging(debugSMTP) {
+		fmt.Printf("%v acknowledged claim to %v\n", logts(), from)
+	}
+
+}
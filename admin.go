@@ -0,0 +1,164 @@
+package main
+
+/*
+ * The organiser can manage me from a phone by emailing commands, in the
+ * Subject, from one of cfg.AdminAddresses:-
+ *
+ *		STATUS          reply with what I'm doing
+ *		PAUSE           stop processing claims, they wait in the mailbox
+ *		RESUME          carry on
+ *		TESTMODE ON     switch test mode on, or OFF, until restarted
+ *
+ * Each command is acknowledged by email. Anything else from those
+ * addresses is treated as an ordinary claim.
+ *
+ * From is trivially forged so, STATUS apart, whose reply only goes to the
+ * admin, commands are only obeyed if the email proves where it came from:
+ * its DKIM signature, or a trusted server, vouches for the sender, see
+ * senderauth.go, or the Subject ends "secret=" and cfg.AdminSecret, eg
+ * "PAUSE secret=xyz". Others are refused and the admin told.
+ *
+ */
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync/atomic"
+)
+
+var adminTestMode *bool // Set by TESTMODE, overrides the configured value
+
+// Changes of test mode waiting for the main loop, in pendingTestMode
+const (
+	testModeUnchanged int32 = iota
+	testModeOff
+	testModeOn
+	testModeForgotten // Back to the configured value
+)
+
+var pendingTestMode int32
+
+// isAdminAddress checks the sender against cfg.AdminAddresses.
+func isAdminAddress(from string) bool {
+
+	v, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+	for _, a := range cfg.AdminAddresses {
+		if strings.EqualFold(strings.TrimSpace(a), v.Address) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// adminProof removes any secret from an admin's Subject, reporting whether
+// the secret or the sender's authentication proves who sent it.
+func adminProof(m Email, raw []byte) (string, bool) {
+
+	subject := m.Subject
+	if s := overrideSecretRE.FindStringSubmatch(subject); s != nil {
+		subject = strings.TrimSpace(overrideSecretRE.ReplaceAllString(subject, ""))
+		if sameSecret(s[1], cfg.AdminSecret) {
+			return subject, true
+		}
+	}
+	return subject, senderAuth(m.Header, raw).Pass
+
+}
+
+// adminCommand carries out a command, if proven, returning a description of
+// what was done, or false if the subject isn't a command.
+func adminCommand(subject string, proven bool) (string, bool) {
+
+	words := strings.Fields(strings.ToUpper(subject))
+	if len(words) < 1 {
+		return "", false
+	}
+	switch {
+	case (words[0] == "STATUS" || words[0] == "PAUSE" || words[0] == "RESUME") && len(words) == 1:
+	case words[0] == "TESTMODE" && len(words) == 2 && (words[1] == "ON" || words[1] == "OFF"):
+	default:
+		return "", false
+	}
+	if !proven && words[0] != "STATUS" {
+		return words[0] + " not obeyed, the sender couldn't be authenticated. Send it from a DKIM-signed account or add secret= and the AdminSecret", true
+	}
+	switch words[0] {
+	case "PAUSE":
+		atomic.StoreInt32(&paused, 1)
+		return "Claim processing paused", true
+	case "RESUME":
+		atomic.StoreInt32(&paused, 0)
+		return "Claim processing resumed", true
+	case "TESTMODE":
+		setTestMode(words[1] == "ON")
+		return "Test mode " + strings.ToLower(words[1]), true
+	}
+	return "Status", true
+
+}
+
+// setTestMode switches test mode on or off until I'm restarted. The API
+// and admin commands call this while emails are being processed so the
+// switch is left for the main loop to make, between cycles, and it's woken
+// to make it.
+func setTestMode(tm bool) {
+
+	if tm {
+		atomic.StoreInt32(&pendingTestMode, testModeOn)
+	} else {
+		atomic.StoreInt32(&pendingTestMode, testModeOff)
+	}
+	signalMail()
+
+}
+
+// forgetTestMode drops any TESTMODE once the setting itself is changed.
+func forgetTestMode() {
+
+	atomic.StoreInt32(&pendingTestMode, testModeForgotten)
+
+}
+
+// applyTestMode makes any switch of test mode asked for, reporting whether
+// there was one. Only the main loop calls this.
+func applyTestMode() bool {
+
+	switch change := atomic.SwapInt32(&pendingTestMode, testModeUnchanged); change {
+	case testModeOn, testModeOff:
+		tm := change == testModeOn
+		adminTestMode = &tm
+		cfg.TestMode = tm
+	case testModeForgotten:
+		adminTestMode = nil
+	default:
+		return false
+	}
+	return true
+
+}
+
+// statusText summarises my state for humans.
+func statusText() string {
+
+	st := currentState()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v v%v monitoring %v for %v\n\n", apptitle, appversion, cfg.ImapLogin, cfg.RallyTitle)
+	fmt.Fprintf(&sb, "Monitoring: %v\nPaused: %v\nTest mode: %v\n", st.Monitoring, st.Paused, st.TestMode)
+	fmt.Fprintf(&sb, "Last check: %v\n", st.LastCycle)
+	if st.LastError != "" {
+		fmt.Fprintf(&sb, "Last error: %v\n", st.LastError)
+	}
+	fmt.Fprintf(&sb, "Claims stored since start: %v, skipped: %v\n", st.TotalClaimed, st.TotalSkipped)
+	return sb.String()
+
+}
+
+// sendAdminReply acknowledges a command.
+func sendAdminReply(to string, done string) {
+	sendPlainMail(to, apptitle+": "+done, done+"\n\n"+statusText())
+}
@@ -0,0 +1,182 @@
+package main
+
+/*
+ * Things going wrong mid-rally need a human to know about them before the
+ * riders do. I email AlertAddresses, or the AdminAddresses if none are
+ * given, when:-
+ *
+ *		imap	I've failed to reach the mailbox AlertImapFailures times running, default 3
+ *		quiet	no claims have arrived for AlertQuietFor during the rally, off by default
+ *		db	writes to the database have failed for good AlertDBFailures times, default 1
+ *		parse	an email had a Content-Type I don't understand
+ *
+ * A flapping condition mustn't bury anyone in email so each kind of alert
+ * is sent at most once every AlertEvery, default 1h. Alerts are logged
+ * whether or not they're sent. A negative AlertImapFailures or
+ * AlertDBFailures turns that alert off.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of alert
+const (
+	alertImap  = "imap"
+	alertQuiet = "quiet"
+	alertDB    = "db"
+	alertParse = "parse"
+)
+
+const defaultAlertEvery = time.Hour
+const defaultAlertImapFailures = 3
+const defaultAlertDBFailures = 1
+
+// runStarted is when I started, claims can't have been seen before then.
+var runStarted = time.Now()
+
+var alerts = struct {
+	mu           sync.Mutex
+	last         map[string]time.Time
+	imapFailures int
+	dbFailures   int
+	lastClaim    time.Time
+}{last: make(map[string]time.Time)}
+
+// alertSend sends an alert, replaced when testing.
+var alertSend = sendPlainMail
+
+func alertEvery() time.Duration {
+
+	if cfg.AlertEvery > 0 {
+		return cfg.AlertEvery
+	}
+	return defaultAlertEvery
+
+}
+
+// alertRecipients lists who's told.
+func alertRecipients() []string {
+
+	if len(cfg.AlertAddresses) > 0 {
+		return cfg.AlertAddresses
+	}
+	return cfg.AdminAddresses
+
+}
+
+// alertDue records that an alert of this kind is wanted now, reporting
+// whether it's been long enough since the last one to send it.
+func alertDue(kind string, now time.Time) bool {
+
+	alerts.mu.Lock()
+	defer alerts.mu.Unlock()
+	if last, ok := alerts.last[kind]; ok && now.Sub(last) < alertEvery() {
+		return false
+	}
+	alerts.last[kind] = now
+	return true
+
+}
+
+// raiseAlert logs an alert and, unless one of its kind went recently, sends it.
+func raiseAlert(kind string, msg string) {
+
+	logAt(levelError, "alert %v: %v", kind, msg)
+	if !alertDue(kind, time.Now()) {
+		return
+	}
+	to := alertRecipients()
+	for _, a := range to {
+		alertSend(a, fmt.Sprintf("%v alert: %v", apptitle, kind), msg)
+	}
+	if len(to) > 0 && !*silent {
+		fmt.Printf("%v sent %v alert to %v\n", logts(), kind, strings.Join(to, ", "))
+	}
+
+}
+
+// alertLimit returns the configured threshold, or its default if unset.
+func alertLimit(n int, def int) int {
+
+	if n == 0 {
+		return def
+	}
+	return n
+
+}
+
+// noteImapResult counts consecutive failures to reach the mailbox.
+func noteImapResult(err error) {
+
+	limit := alertLimit(cfg.AlertImapFailures, defaultAlertImapFailures)
+	alerts.mu.Lock()
+	if err == nil {
+		alerts.imapFailures = 0
+	} else {
+		alerts.imapFailures++
+	}
+	n := alerts.imapFailures
+	alerts.mu.Unlock()
+	if err != nil && limit > 0 && n >= limit {
+		raiseAlert(alertImap, fmt.Sprintf("I've failed to reach %v on %v %v times running, most recently: %v", source.Name(), cfg.ImapServer, n, err))
+	}
+
+}
+
+// noteClaimArrived records when the latest claim was stored.
+func noteClaimArrived(now time.Time) {
+
+	alerts.mu.Lock()
+	alerts.lastClaim = now
+	alerts.mu.Unlock()
+
+}
+
+// quietSince returns when claims should last have been seen, if the rally
+// is underway and AlertQuietFor is set.
+func quietSince(now time.Time) (time.Time, bool) {
+
+	if cfg.AlertQuietFor <= 0 || cfg.TestMode || cfg.RallyStart.IsZero() || now.Before(cfg.RallyStart) || now.After(cfg.RallyFinish) {
+		return time.Time{}, false
+	}
+	alerts.mu.Lock()
+	since := alerts.lastClaim
+	alerts.mu.Unlock()
+	if since.Before(cfg.RallyStart) {
+		since = cfg.RallyStart
+	}
+	if since.Before(runStarted) {
+		since = runStarted
+	}
+	return since, now.Sub(since) >= cfg.AlertQuietFor
+
+}
+
+// checkQuiet alerts if no claims have arrived for AlertQuietFor during the rally.
+func checkQuiet(now time.Time) {
+
+	if since, quiet := quietSince(now); quiet {
+		raiseAlert(alertQuiet, fmt.Sprintf("No claims have arrived since %v, %v ago.", since.Format("15:04"), now.Sub(since).Round(time.Minute)))
+	}
+
+}
+
+// noteDBFailure counts writes to the database which have failed for good.
+// It's called by the writer so the alert is sent without holding it up.
+func noteDBFailure(err error) {
+
+	limit := alertLimit(cfg.AlertDBFailures, defaultAlertDBFailures)
+	alerts.mu.Lock()
+	alerts.dbFailures++
+	n := alerts.dbFailures
+	alerts.mu.Unlock()
+	if limit > 0 && n >= limit {
+		go raiseAlert(alertDB, fmt.Sprintf("Writing to the database has failed %v times, most recently: %v", n, err))
+	}
+
+}
@@ -0,0 +1,431 @@
+package main
+
+/*
+ * Emails which caught me out at a real rally make the best test cases but
+ * they're full of riders' personal details. This:-
+ *
+ *		ebcfetch anonymise -from quarantine -to testdata/corpus
+ *
+ * copies each .eml file keeping its MIME structure, Subject, dates and
+ * filenames but replacing addresses and names with stand-ins, consistently
+ * across the whole set, scrubbing phone numbers and addresses from text,
+ * reducing Received headers to their dates, dropping signatures and
+ * tracking headers and replacing every photo with a plain grey one of
+ * similar shape which keeps only the original's EXIF capture time.
+ * Other attachments are replaced by a line of text.
+ *
+ * It's a scrub, not a guarantee: look at the results before committing them.
+ *
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Headers carrying addresses, which are replaced by stand-ins
+var anonAddressHeaders = []string{"From", "To", "Cc", "Bcc", "Reply-To", "Sender", "Return-Path", "Delivered-To",
+	"X-Original-To", "Resent-From", "Resent-To", "Disposition-Notification-To"}
+
+// Headers which identify people, servers or accounts and tell me nothing useful
+var anonDroppedHeaders = []string{"DKIM-Signature", "ARC-Seal", "ARC-Message-Signature", "ARC-Authentication-Results",
+	"Authentication-Results", "Received-SPF", "X-Received", "X-Google-DKIM-Signature", "X-Google-Smtp-Source",
+	"X-Gm-Message-State", "X-Gm-Gg", "X-Originating-IP", "X-Apple-UUID", "X-Apple-Mail-Remote-Attachments"}
+
+var anonEmailRE = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+var anonPhoneRE = regexp.MustCompile(`\+\d[\d \-]{8,14}\d|\b0\d{3,4}[ \-]?\d{3}[ \-]?\d{3,4}\b`)
+
+const anonDomain = "example.com"
+
+// headerField is one header, unfolded, in its original place.
+type headerField struct {
+	Key   string
+	Value string
+}
+
+// anonymiser remembers the stand-ins used so far.
+type anonymiser struct {
+	addrs map[string]string // Real address to stand-in
+	names map[string]string // Real name to stand-in
+}
+
+func newAnonymiser() *anonymiser {
+
+	return &anonymiser{addrs: make(map[string]string), names: make(map[string]string)}
+
+}
+
+// splitHeader separates the header of a message or part from its body.
+func splitHeader(raw []byte) ([]headerField, []byte) {
+
+	var fields []headerField
+	body := []byte{}
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	for i, ln := range lines {
+		s := strings.TrimRight(string(ln), "\r\n")
+		if s == "" {
+			body = bytes.Join(lines[i+1:], nil)
+			break
+		}
+		if (s[0] == ' ' || s[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += " " + strings.TrimSpace(s)
+			continue
+		}
+		if kv := strings.SplitN(s, ":", 2); len(kv) == 2 {
+			fields = append(fields, headerField{Key: kv[0], Value: strings.TrimSpace(kv[1])})
+		}
+	}
+	return fields, body
+
+}
+
+func headerValue(fields []headerField, key string) string {
+
+	for _, f := range fields {
+		if strings.EqualFold(f.Key, key) {
+			return f.Value
+		}
+	}
+	return ""
+
+}
+
+func containsFold(list []string, s string) bool {
+
+	for _, x := range list {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// address returns the stand-in for a real address, learning the name that goes with it.
+func (a *anonymiser) address(addr *mail.Address) *mail.Address {
+
+	key := strings.ToLower(addr.Address)
+	standin, ok := a.addrs[key]
+	if !ok {
+		standin = fmt.Sprintf("rider%d@%s", len(a.addrs)+1, anonDomain)
+		a.addrs[key] = standin
+	}
+	res := &mail.Address{Address: standin}
+	if addr.Name != "" {
+		if _, ok := a.names[addr.Name]; !ok {
+			a.names[addr.Name] = fmt.Sprintf("Rider %d", len(a.names)+1)
+		}
+		res.Name = a.names[addr.Name]
+	}
+	return res
+
+}
+
+// text scrubs known names, any addresses and phone numbers from some text.
+func (a *anonymiser) text(s string) string {
+
+	s = anonEmailRE.ReplaceAllStringFunc(s, func(x string) string {
+		return a.address(&mail.Address{Address: x}).Address
+	})
+	s = anonPhoneRE.ReplaceAllString(s, "07700 900000")
+	names := make([]string, 0, len(a.names))
+	for n := range a.names {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) }) // Longest first
+	for _, n := range names {
+		s = strings.ReplaceAll(s, n, a.names[n])
+		for _, w := range strings.Fields(n) {
+			if len(w) >= 3 {
+				s = strings.ReplaceAll(s, w, a.names[n])
+			}
+		}
+	}
+	return s
+
+}
+
+// header scrubs a message's or part's header fields.
+func (a *anonymiser) header(fields []headerField) []headerField {
+
+	var res []headerField
+	for _, f := range fields {
+		switch {
+		case containsFold(anonDroppedHeaders, f.Key):
+			continue
+		case containsFold(anonAddressHeaders, f.Key):
+			list, err := mail.ParseAddressList(decodeMimeSentence(f.Value))
+			if err != nil {
+				f.Value = "<" + a.address(&mail.Address{Address: f.Value}).Address + ">"
+				break
+			}
+			var out []string
+			for _, addr := range list {
+				out = append(out, a.address(addr).String())
+			}
+			f.Value = strings.Join(out, ", ")
+		case strings.EqualFold(f.Key, "Received"):
+			// Only the date matters, it's used to work out when the claim was sent
+			if parts := strings.SplitN(f.Value, ";", 2); len(parts) == 2 {
+				f.Value = "from anonymised by anonymised; " + strings.TrimSpace(parts[1])
+			} else {
+				continue
+			}
+		case containsFold([]string{"Message-ID", "In-Reply-To", "References"}, f.Key):
+			var ids []string
+			for _, id := range strings.Fields(f.Value) {
+				sum := sha256.Sum256([]byte(id))
+				ids = append(ids, "<"+hex.EncodeToString(sum[:8])+"@anonymised>")
+			}
+			f.Value = strings.Join(ids, " ")
+		case strings.EqualFold(f.Key, "Subject"):
+			f.Value = mime.QEncoding.Encode("utf-8", a.text(decodeMimeSentence(f.Value)))
+		}
+		res = append(res, f)
+	}
+	return res
+
+}
+
+// decodePart undoes a part's transfer encoding.
+func decodePart(body []byte, cte string) []byte {
+
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		clean := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(body))
+		res, err := base64.StdEncoding.DecodeString(clean)
+		if err == nil {
+			return res
+		}
+	case "quoted-printable":
+		res, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err == nil {
+			return res
+		}
+	}
+	return body
+
+}
+
+func base64Lines(data []byte) []byte {
+
+	enc := base64.StdEncoding.EncodeToString(data)
+	var sb strings.Builder
+	for len(enc) > 76 {
+		sb.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	sb.WriteString(enc + "\r\n")
+	return []byte(sb.String())
+
+}
+
+// placeholderPhoto makes a grey JPEG the shape of the original, no more
+// than 640 pixels across, carrying its capture time if it had one.
+func placeholderPhoto(pic []byte) []byte {
+
+	w, h := 640, 480
+	if ic, _, err := image.DecodeConfig(bytes.NewReader(pic)); err == nil && ic.Width > 0 && ic.Height > 0 {
+		w, h = ic.Width, ic.Height
+		for w > 640 {
+			w, h = w/2, h/2
+		}
+	}
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 128
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 50})
+	jpg := buf.Bytes()
+
+	ex, ok := readExif(pic)
+	if !ok || ex.CaptureTime.IsZero() {
+		return jpg
+	}
+	// A TIFF structure holding just IFD0 -> Exif IFD -> DateTimeOriginal
+	le := binary.LittleEndian
+	tiff := make([]byte, 44)
+	copy(tiff, []byte{'I', 'I', 42, 0, 8, 0, 0, 0})
+	le.PutUint16(tiff[8:], 1) // IFD0, one entry, pointing at
+	le.PutUint16(tiff[10:], exifTagExifIFD)
+	le.PutUint16(tiff[12:], 4)
+	le.PutUint32(tiff[14:], 1)
+	le.PutUint32(tiff[18:], 26)
+	le.PutUint32(tiff[22:], 0)
+	le.PutUint16(tiff[26:], 1) // Exif IFD, one entry, the date
+	le.PutUint16(tiff[28:], exifTagDateTimeOriginal)
+	le.PutUint16(tiff[30:], 2)
+	le.PutUint32(tiff[32:], 20)
+	le.PutUint32(tiff[36:], 44)
+	le.PutUint32(tiff[40:], 0)
+	tiff = append(tiff, ex.CaptureTime.Format(exifTimeFormat)+"\x00"...)
+	app1 := append([]byte{0xFF, 0xE1, 0, 0}, "Exif\x00\x00"...)
+	app1 = append(app1, tiff...)
+	binary.BigEndian.PutUint16(app1[2:4], uint16(len(app1)-2))
+	return append(append(append([]byte{}, jpg[:2]...), app1...), jpg[2:]...)
+
+}
+
+// writeHeader writes header fields, folding nothing.
+func writeHeader(w io.Writer, fields []headerField) {
+
+	for _, f := range fields {
+		fmt.Fprintf(w, "%s: %s\r\n", f.Key, f.Value)
+	}
+	io.WriteString(w, "\r\n")
+
+}
+
+func setHeader(fields []headerField, key, value string) []headerField {
+
+	for i := range fields {
+		if strings.EqualFold(fields[i].Key, key) {
+			fields[i].Value = value
+			return fields
+		}
+	}
+	return append(fields, headerField{Key: key, Value: value})
+
+}
+
+// entity anonymises a message or MIME part, header and body.
+func (a *anonymiser) entity(raw []byte) []byte {
+
+	fields, body := splitHeader(raw)
+	fields = a.header(fields)
+	var out bytes.Buffer
+
+	mt, params, _ := mime.ParseMediaType(headerValue(fields, "Content-Type"))
+	if mt == "" {
+		mt = "text/plain"
+	}
+	cte := headerValue(fields, "Content-Transfer-Encoding")
+	switch {
+	case strings.HasPrefix(mt, "multipart/") && params["boundary"] != "":
+		writeHeader(&out, fields)
+		mw := multipart.NewWriter(&out)
+		mw.SetBoundary(params["boundary"])
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				break
+			}
+			var ph bytes.Buffer
+			for k, vv := range p.Header {
+				for _, v := range vv {
+					fmt.Fprintf(&ph, "%s: %s\r\n", k, v)
+				}
+			}
+			content, _ := io.ReadAll(p)
+			sub := a.entity(append(append(ph.Bytes(), "\r\n"...), content...))
+			subFields, subBody := splitHeader(sub)
+			h := make(textproto.MIMEHeader)
+			for _, f := range subFields {
+				h.Add(f.Key, f.Value)
+			}
+			pw, _ := mw.CreatePart(h)
+			pw.Write(subBody)
+		}
+		mw.Close()
+	case strings.HasPrefix(mt, "text/"):
+		text := a.text(string(decodePart(body, cte)))
+		fields = setHeader(fields, "Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(&out, fields)
+		qw := quotedprintable.NewWriter(&out)
+		qw.Write([]byte(text))
+		qw.Close()
+		io.WriteString(&out, "\r\n")
+	case strings.HasPrefix(mt, "image/"):
+		fields = setHeader(fields, "Content-Transfer-Encoding", "base64")
+		writeHeader(&out, fields)
+		out.Write(base64Lines(placeholderPhoto(decodePart(body, cte))))
+	case mt == "message/rfc822":
+		writeHeader(&out, fields)
+		out.Write(a.entity(decodePart(body, cte)))
+	default:
+		fields = setHeader(fields, "Content-Transfer-Encoding", "7bit")
+		writeHeader(&out, fields)
+		io.WriteString(&out, "Anonymised attachment\r\n")
+	}
+	return out.Bytes()
+
+}
+
+// message anonymises a whole email, learning the sender's name first so
+// that it's scrubbed wherever it appears.
+func (a *anonymiser) message(raw []byte) []byte {
+
+	fields, _ := splitHeader(raw)
+	for _, h := range anonAddressHeaders {
+		if list, err := mail.ParseAddressList(decodeMimeSentence(headerValue(fields, h))); err == nil {
+			for _, addr := range list {
+				a.address(addr)
+			}
+		}
+	}
+	return a.entity(raw)
+
+}
+
+func runAnonymise(args []string) int {
+
+	fs := flag.NewFlagSet("anonymise", flag.ContinueOnError)
+	from := fs.String("from", "", "Folder of .eml files to anonymise")
+	to := fs.String("to", "", "Folder for the anonymised copies")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	if *from == "" || *to == "" {
+		fmt.Printf("%s: anonymise needs -from and -to\n", apptitle)
+		return 1
+	}
+	files, _ := filepath.Glob(filepath.Join(*from, "*.eml"))
+	sort.Strings(files)
+	if err := os.MkdirAll(*to, 0755); err != nil {
+		fmt.Printf("%s: anonymise %v\n", apptitle, err)
+		return 1
+	}
+	a := newAnonymiser()
+	for i, fn := range files {
+		raw, err := os.ReadFile(fn)
+		if err != nil {
+			fmt.Printf("%s: anonymise %v\n", apptitle, err)
+			return 1
+		}
+		out := filepath.Join(*to, fmt.Sprintf("corpus-%03d.eml", i+1))
+		if err = os.WriteFile(out, a.message(raw), 0644); err != nil {
+			fmt.Printf("%s: anonymise %v\n", apptitle, err)
+			return 1
+		}
+		if !*silent {
+			fmt.Printf("%s: %v -> %v\n", apptitle, filepath.Base(fn), out)
+		}
+	}
+	return 0
+
+}
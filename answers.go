@@ -0,0 +1,69 @@
+package main
+
+/*
+ * Some bonuses ask a question, "what number is on the plaque?", which the
+ * rider answers in the extra text after the claim. Where bonuses.ExpectedAnswer
+ * holds the answer I compare it with what was sent and flag the claim
+ * accordingly. Alternative answers may be separated by |, and the
+ * comparison ignores case, spaces and punctuation.
+ *
+ */
+
+import (
+	"strings"
+	"unicode"
+)
+
+// expectedAnswer returns the answer needed for a bonus, if any.
+func expectedAnswer(bonus string) string {
+
+	if !hasColumn("bonuses", "ExpectedAnswer") {
+		return ""
+	}
+	var res string
+	dbh.QueryRow("SELECT IfNull("+col("bonuses", "ExpectedAnswer")+",'') FROM bonuses WHERE "+col("bonuses", "BonusID")+"=?", bonus).Scan(&res)
+	return strings.TrimSpace(res)
+
+}
+
+// normaliseAnswer keeps only the letters and digits of an answer, in lowercase.
+func normaliseAnswer(s string) string {
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+
+}
+
+// answerMatches reports whether the extra text contains any of the expected answers.
+func answerMatches(extra string, expected string) bool {
+
+	x := normaliseAnswer(extra)
+	for _, a := range strings.Split(expected, "|") {
+		if a = normaliseAnswer(a); a != "" && strings.Contains(x, a) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// checkAnswer flags a claim whose bonus expects an answer, reporting
+// whether an answer was needed and whether it was right.
+func checkAnswer(f4 fourFields, flags *claimFlags) (bool, bool) {
+
+	expected := expectedAnswer(f4.BonusID)
+	if expected == "" {
+		return false, false
+	}
+	if answerMatches(f4.Extra, expected) {
+		flags.add(flagAnswerOk)
+		return true, true
+	}
+	flags.add(flagAnswerMismatch)
+	return true, false
+
+}
@@ -0,0 +1,307 @@
+package main
+
+/*
+ * The rulebook says claim evidence is kept for a while after the event, in
+ * case of appeals, but the working folders are needed again for the next
+ * rally. "ebcfetch archive" bundles everything into one dated file:-
+ *
+ *		claims.csv		every row of ebclaims
+ *		images/...		the ImageFolder
+ *		emails/...		the EmailsFolder, if raw claim emails are being kept
+ *		receipts/...	the ReceiptsFolder, if set
+ *		quarantine/...	emails which couldn't be processed
+ *
+ * as a zip or a gzipped tar. With -prune the images are then removed from the
+ * ImageFolder, but only once the archive has been written successfully.
+ *
+ * If cfg.EmailsFolder is set, the raw text of each email stored as a claim
+ * is saved there as EmailID.eml.
+ *
+ */
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// archiveWriter is what's needed of a zip or tar writer.
+type archiveWriter interface {
+	add(name string, modtime time.Time, data []byte) error
+	Close() error
+}
+
+type zipArchive struct{ zw *zip.Writer }
+
+func (a zipArchive) add(name string, modtime time.Time, data []byte) error {
+
+	w, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modtime})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+
+}
+
+func (a zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (a tarArchive) add(name string, modtime time.Time, data []byte) error {
+
+	err := a.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modtime, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = a.tw.Write(data)
+	return err
+
+}
+
+func (a tarArchive) Close() error {
+
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+
+}
+
+// saveRawEmail keeps the raw text of a claim email if cfg.EmailsFolder is set.
+func saveRawEmail(uid uint32, raw []byte) {
+
+	if cfg.EmailsFolder == "" {
+		return
+	}
+	dir := filepath.Join(cfg.Path2SM, cfg.EmailsFolder)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, strconv.FormatUint(uint64(uid), 10)+".eml"), raw, 0644)
+	}
+	if err != nil {
+		fmt.Printf("%s can't save email [%v] %v\n", logts(), uid, err)
+	}
+
+}
+
+// claimsCSV exports the whole of ebclaims, whatever its columns.
+func claimsCSV() ([]byte, error) {
+
+	rows, err := dbh.Query("SELECT * FROM ebclaims ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(cols)
+	vals := make([]sql.NullString, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		rec := make([]string, len(cols))
+		for i, v := range vals {
+			rec[i] = v.String
+		}
+		w.Write(rec)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+
+}
+
+// archiveFolder adds the files in dir, and any subfolders, under prefix,
+// returning the paths of the files added.
+func archiveFolder(a archiveWriter, dir string, prefix string) ([]string, error) {
+
+	var added []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if err := a.add(prefix+"/"+filepath.ToSlash(rel), info.ModTime(), data); err != nil {
+			return err
+		}
+		added = append(added, path)
+		return nil
+	})
+	return added, err
+
+}
+
+// writeArchive bundles the evidence into fn, returning the images included.
+func writeArchive(fn string, format string) ([]string, error) {
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var a archiveWriter
+	if format == "zip" {
+		a = zipArchive{zip.NewWriter(f)}
+	} else {
+		gz := gzip.NewWriter(f)
+		a = tarArchive{tar.NewWriter(gz), gz}
+	}
+
+	csvdata, err := claimsCSV()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.add("claims.csv", time.Now(), csvdata); err != nil {
+		return nil, err
+	}
+	images, err := archiveFolder(a, filepath.Join(cfg.Path2SM, cfg.ImageFolder), "images")
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range [][2]string{{"emails", cfg.EmailsFolder}, {"receipts", cfg.ReceiptsFolder}} {
+		if x[1] == "" {
+			continue
+		}
+		if _, err := archiveFolder(a, filepath.Join(cfg.Path2SM, x[1]), x[0]); err != nil {
+			return nil, err
+		}
+	}
+	quarantine := cfg.QuarantineFolder
+	if quarantine == "" {
+		quarantine = defaultQuarantineFolder
+	}
+	if _, err := archiveFolder(a, quarantine, "quarantine"); err != nil {
+		return nil, err
+	}
+	if err := a.Close(); err != nil {
+		return nil, err
+	}
+	return images, f.Close()
+
+}
+
+// runArchive bundles the rally's evidence into a dated archive file.
+func runArchive(args []string) int {
+
+	fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+	to := fs.String("to", ".", "Folder to write the archive in")
+	format := fs.String("format", "zip", "zip or tar, a gzipped tar")
+	prune := fs.Bool("prune", false, "Remove the images from the image folder once archived")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	ext := map[string]string{"zip": ".zip", "tar": ".tar.gz"}[*format]
+	if ext == "" {
+		fmt.Printf("%s: archive format must be zip or tar, not %v\n", apptitle, *format)
+		return 1
+	}
+	if err := os.MkdirAll(*to, 0755); err != nil {
+		fmt.Printf("%s: can't create %v %v\n", apptitle, *to, err)
+		return 1
+	}
+	fn := filepath.Join(*to, "ebcfetch-archive-"+time.Now().Format("2006-01-02")+ext)
+	images, err := writeArchive(fn, *format)
+	if err != nil {
+		fmt.Printf("%s: archive failed %v\n", apptitle, err)
+		os.Remove(fn)
+		return 1
+	}
+	if !*silent {
+		fmt.Printf("%s: archived %v images to %v\n", apptitle, len(images), fn)
+	}
+	if !*prune {
+		return 0
+	}
+	// Nothing is removed unless I can read it all back
+	names, err := archiveContents(fn)
+	if err != nil || len(names) < len(images)+1 {
+		fmt.Printf("%s: can't verify %v, nothing pruned %v\n", apptitle, fn, err)
+		return 1
+	}
+	pruned := 0
+	for _, img := range images {
+		if err := os.Remove(img); err != nil {
+			fmt.Printf("%s: can't remove %v %v\n", apptitle, img, err)
+			continue
+		}
+		pruned++
+	}
+	if !*silent {
+		fmt.Printf("%s: removed %v archived images\n", apptitle, pruned)
+	}
+	return 0
+
+}
+
+// archiveContents lists the files in an archive written by writeArchive.
+func archiveContents(fn string) ([]string, error) {
+
+	var names []string
+	if filepath.Ext(fn) == ".zip" {
+		zr, err := zip.OpenReader(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		return names, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, h.Name)
+	}
+
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+ * Not everything attached to a claim is a photo. Fuel receipts arrive as
+ * PDFs and some rest bonuses want a short video. Rather than store them as
+ * if they were JPGs I keep them, named att-entrant-bonus-n.ext, in
+ * PDFFolder and VideoFolder, by default pdf and video within the
+ * ImageFolder, and record them in ebcattachments. They don't count as
+ * photos for the claim but test responses list them so riders know they
+ * arrived.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Kinds of attachment other than photos
+const (
+	attachmentPDF   = "pdf"
+	attachmentVideo = "video"
+)
+
+var videoExts = []string{".mp4", ".mov", ".m4v", ".3gp", ".avi", ".webm", ".mkv"}
+
+// videoBrands are the ISO media brands of videos, HEICs have their own.
+var videoBrands = []string{"qt  ", "isom", "iso2", "mp41", "mp42", "avc1", "M4V ", "3gp4", "3gp5", "3gp6"}
+
+// attachmentKind says what an attachment is, "" meaning a photo.
+func attachmentKind(p emailPhoto) string {
+
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(p.ContentType, ";")[0]))
+	ext := strings.ToLower(filepath.Ext(p.Name))
+	switch {
+	case ct == "application/pdf" || ext == ".pdf" || bytes.HasPrefix(p.Data, []byte("%PDF-")):
+		return attachmentPDF
+	case strings.HasPrefix(ct, "video/") || containsFold(videoExts, ext):
+		return attachmentVideo
+	case len(p.Data) >= 12 && string(p.Data[4:8]) == "ftyp" && containsFold(videoBrands, string(p.Data[8:12])):
+		return attachmentVideo
+	}
+	return ""
+
+}
+
+// splitAttachments separates photos from everything else attached.
+func splitAttachments(all []emailPhoto) (photos []emailPhoto, others []emailPhoto) {
+
+	for _, p := range all {
+		if p.Kind == "" {
+			photos = append(photos, p)
+		} else {
+			others = append(others, p)
+		}
+	}
+	return
+
+}
+
+// attachmentFolder is where attachments of a kind are kept, within the ScoreMaster folder.
+func attachmentFolder(kind string) string {
+
+	if kind == attachmentPDF {
+		if cfg.PDFFolder != "" {
+			return cfg.PDFFolder
+		}
+		return filepath.Join(cfg.ImageFolder, "pdf")
+	}
+	if cfg.VideoFolder != "" {
+		return cfg.VideoFolder
+	}
+	return filepath.Join(cfg.ImageFolder, "video")
+
+}
+
+// attachmentExt is the extension an attachment is stored with.
+func attachmentExt(p emailPhoto) string {
+
+	ext := strings.ToLower(filepath.Ext(p.Name))
+	switch {
+	case p.Kind == attachmentPDF:
+		return ".pdf"
+	case containsFold(videoExts, ext):
+		return ext
+	case len(p.Data) >= 12 && string(p.Data[8:12]) == "qt  ":
+		return ".mov"
+	}
+	return ".mp4"
+
+}
+
+// describeAttachment names an attachment for riders.
+func describeAttachment(p emailPhoto) string {
+
+	what := "PDF"
+	if p.Kind == attachmentVideo {
+		what = "Video"
+	}
+	if p.Name != "" {
+		what += " " + p.Name
+	}
+	return fmt.Sprintf("%v (%vKB)", what, (len(p.Data)+1023)/1024)
+
+}
+
+// storeAttachment files a PDF or video belonging to a claim.
+func storeAttachment(entrant int, bonus string, emailid uint32, p emailPhoto) error {
+
+	res, err := dbExec("INSERT INTO ebcattachments (EntrantID,BonusID,EmailID,Kind,ContentType,Filename,Bytes,Received) VALUES(?,?,?,?,?,?,?,?)",
+		entrant, bonus, emailid, p.Kind, p.ContentType, p.Name, len(p.Data), time.Now().Format(myTimeFormat))
+	if err != nil {
+		return err
+	}
+	rowid, _ := res.LastInsertId()
+	folder := attachmentFolder(p.Kind)
+	fname := filepath.Join(folder, "att-"+fmt.Sprint(entrant)+"-"+bonus+"-"+fmt.Sprint(rowid)+attachmentExt(p))
+	err = os.MkdirAll(filepath.Join(cfg.Path2SM, folder), 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(cfg.Path2SM, fname), p.Data, 0644)
+	}
+	if err != nil {
+		dbExec("DELETE FROM ebcattachments WHERE rowid=?", rowid)
+		return err
+	}
+	_, err = dbExec("UPDATE ebcattachments SET Path=? WHERE rowid=?", fname, rowid)
+	return err
+
+}
+
+// storeAttachments files those of others belonging to a claim, listing them
+// for the test response. In test mode nothing is stored.
+func storeAttachments(entrant int, bonus string, emailid uint32, others []emailPhoto, mine []int) []string {
+
+	var res []string
+	for _, ox := range mine {
+		p := others[ox]
+		if p.Err != nil {
+			continue
+		}
+		if !cfg.TestMode {
+			if err := storeAttachment(entrant, bonus, emailid, p); err != nil {
+				fmt.Printf("%s can't store %v %v\n", logts(), p.Kind, err)
+				continue
+			}
+		}
+		res = append(res, describeAttachment(p))
+	}
+	return res
+
+}
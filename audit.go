@@ -0,0 +1,93 @@
+package main
+
+/*
+ * I record what happened to every email I consider, in ebcaudit, so that
+ * the rally team can see why without trawling back through the console:
+ * claims stored, flagged or not, emails rejected, ignored or left to be
+ * retried and why. Being a plain table ScoreMaster, or anything else, can
+ * query it and the dashboard serves it as /api/audit?uid=1234 or
+ * ?after=rowid.
+ *
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Decisions recorded in ebcaudit
+const (
+	auditIgnored     = "ignored"
+	auditRejected    = "rejected"
+	auditAdmin       = "admin"
+	auditCancelled   = "cancelled"
+	auditStatus      = "status"
+	auditOdo         = "odo"
+	auditFuel        = "fuel"
+	auditQuarantined = "quarantined"
+	auditPhotos      = "photos"
+	auditClaimed     = "claimed"
+	auditRetry       = "retry"
+	auditTest        = "test"
+)
+
+// auditEntry is one decision, as served by /api/audit.
+type auditEntry struct {
+	RowID    int64
+	LoggedAt string
+	EmailID  uint32
+	Source   string
+	From     string
+	Subject  string
+	Decision string
+	Reason   string
+}
+
+// writeAudit records a single decision about an incoming email.
+func writeAudit(emailid uint32, from string, subject string, decision string, reason string) {
+
+	sqlx := "INSERT INTO ebcaudit (LoggedAt,EmailID,FromAddr,Subject,Decision,Reason,Source) VALUES(?,?,?,?,?,?,?)"
+	_, err := dbExec(sqlx, storeTimeDB(time.Now()), emailid, from, subject, decision, reason, source.Name())
+	if err != nil && !*silent {
+		fmt.Printf("%s can't record audit [%v] %v\n", logts(), emailid, err)
+	}
+
+}
+
+// auditFlags adds the flags a claim was given to the reason recorded.
+func auditFlags(reason string, flags claimFlags) string {
+
+	if f := flags.String(); f != "" {
+		return reason + ", flagged " + f
+	}
+	return reason
+
+}
+
+// fetchAudit returns the decisions about one email, or those recorded after the given rowid.
+func fetchAudit(uid uint32, after int64) []auditEntry {
+
+	res := []auditEntry{}
+	sqlx := "SELECT rowid,IfNull(LoggedAt,''),EmailID,IfNull(Source,''),IfNull(FromAddr,''),IfNull(Subject,''),Decision,IfNull(Reason,'') FROM ebcaudit"
+	args := []interface{}{after}
+	if uid > 0 {
+		sqlx += " WHERE EmailID=?"
+		args = []interface{}{uid}
+	} else {
+		sqlx += " WHERE rowid>?"
+	}
+	sqlx += " ORDER BY rowid LIMIT " + strconv.Itoa(dashboardClaimsLimit)
+	rows, err := dbh.Query(sqlx, args...)
+	if err != nil {
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a auditEntry
+		rows.Scan(&a.RowID, &a.LoggedAt, &a.EmailID, &a.Source, &a.From, &a.Subject, &a.Decision, &a.Reason)
+		res = append(res, a)
+	}
+	return res
+
+}
@@ -0,0 +1,40 @@
+package main
+
+/*
+ * Riders' phones and email accounts are often set to reply automatically
+ * while they're away riding. Replies to my test responses and alerts would
+ * otherwise land in the manual pile so I recognise them and quietly file them.
+ *
+ */
+
+import (
+	"regexp"
+	"strings"
+)
+
+// autoReplySubjectRE matches the Subject lines produced by common vacation responders.
+var autoReplySubjectRE = regexp.MustCompile(`(?i)^\s*(out of (the )?office|automatic reply|auto[- ]?reply|autoreply|auto:|autosvar|abwesenheitsnotiz|r[ée]ponse automatique|respuesta autom[aá]tica|risposta automatica|vacation|away from (my )?(email|office))`)
+
+// isAutoReply decides whether an email was generated automatically rather
+// than by a human being, returning a short reason if it was.
+func isAutoReply(m Email) (bool, string) {
+
+	as := strings.ToLower(strings.TrimSpace(m.Header.Get("Auto-Submitted")))
+	if as != "" && as != "no" {
+		return true, "Auto-Submitted: " + as
+	}
+	for _, h := range []string{"X-Autoreply", "X-Autorespond", "X-Autoresponder", "X-Auto-Response"} {
+		if m.Header.Get(h) != "" {
+			return true, h
+		}
+	}
+	prec := strings.ToLower(strings.TrimSpace(m.Header.Get("Precedence")))
+	if prec == "auto_reply" {
+		return true, "Precedence: " + prec
+	}
+	if autoReplySubjectRE.MatchString(m.Subject) {
+		return true, "Subject"
+	}
+	return false, ""
+
+}
@@ -0,0 +1,80 @@
+package main
+
+/*
+ * An instance left running after the rally goes on answering whatever
+ * turns up in the mailbox for weeks. With AutoStopAfter set I stop fetching
+ * that long after the rally finishes, send the riders their summaries if
+ * they're due and haven't gone, tell the AdminAddresses what was collected
+ * and then either exit, with AutoStopExit, or sit idle with the dashboard
+ * still up. The stop is recorded in ebcautostop so a restart doesn't
+ * repeat the report.
+ *
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// autoStopDue reports whether monitoring should have stopped by now.
+func autoStopDue(now time.Time) bool {
+
+	if cfg.AutoStopAfter <= 0 || cfg.RallyFinish.IsZero() {
+		return false
+	}
+	return now.After(cfg.RallyFinish.Add(cfg.AutoStopAfter))
+
+}
+
+// autoStopped reports whether the final report has already been sent.
+func autoStopped() bool {
+
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM ebcautostop").Scan(&n)
+	return n > 0
+
+}
+
+// finalReport describes what was collected during the rally.
+func finalReport(now time.Time) string {
+
+	st := fetchClaimStats(now)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v finished at %v and I've stopped monitoring %v.\n\n", cfg.RallyTitle, cfg.RallyFinish.Format(myTimeFormat), cfg.ImapLogin)
+	fmt.Fprintf(&sb, "Claims stored: %v from %v entrants\n", st.ClaimsTotal, len(st.EntrantTotals))
+	fmt.Fprintf(&sb, "Claims rejected by the judges: %v\n", st.Rejected)
+	var decisions []string
+	for d := range st.NotClaims {
+		decisions = append(decisions, d)
+	}
+	sort.Strings(decisions)
+	for _, d := range decisions {
+		fmt.Fprintf(&sb, "Emails %v: %v\n", d, st.NotClaims[d])
+	}
+	return sb.String()
+
+}
+
+// autoStop winds up monitoring after the rally.
+func autoStop() {
+
+	if !*silent {
+		fmt.Printf("%s rally finished at %v, stopping monitoring\n", logts(), cfg.RallyFinish.Format(myTimeFormat))
+	}
+	if autoStopped() {
+		return
+	}
+	if cfg.SendSummaries && !summariesDone && !cfg.TestMode {
+		sendSummaries(false)
+		summariesDone = true
+	}
+	now := time.Now()
+	report := finalReport(now)
+	for _, a := range cfg.AdminAddresses {
+		sendPlainMail(a, apptitle+": monitoring stopped for "+cfg.RallyTitle, report)
+	}
+	dbExec("INSERT INTO ebcautostop (StoppedAt) VALUES(?)", storeTimeDB(now))
+
+}
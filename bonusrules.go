@@ -0,0 +1,82 @@
+package main
+
+/*
+ * Not every bonus needs the same evidence. Columns in the bonuses table say
+ * what each one requires:
+ *
+ *		PhotoRequired	1 unless the bonus can be claimed without a photo
+ *		OdoRequired	1 unless the odo reading may be omitted
+ *		AnswerRequired	1 if the rider must say something in the extra text
+ *		RestMinutes	minimum minutes since the entrant's previous claim, for rest bonuses
+ *
+ * Unmet requirements are flagged for the judges and shown in test responses.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bonusRequirements is what a claim for a particular bonus must include.
+type bonusRequirements struct {
+	Photo       bool
+	Odo         bool
+	Answer      bool
+	RestMinutes int
+}
+
+// defaultRequirements apply where the bonuses table doesn't say otherwise.
+var defaultRequirements = bonusRequirements{Photo: true, Odo: true}
+
+// fetchBonusRequirements reads the requirements for a bonus.
+func fetchBonusRequirements(bonus string) bonusRequirements {
+
+	res := defaultRequirements
+	var cols []string
+	var dest []interface{}
+	var photo, odo, answer int
+	for _, c := range []struct {
+		name string
+		dest *int
+	}{{"PhotoRequired", &photo}, {"OdoRequired", &odo}, {"AnswerRequired", &answer}, {"RestMinutes", &res.RestMinutes}} {
+		if hasColumn("bonuses", c.name) {
+			cols = append(cols, col("bonuses", c.name))
+			dest = append(dest, c.dest)
+		}
+	}
+	if len(cols) < 4 {
+		return res // Columns are added on startup so this is someone's mapping gone wrong
+	}
+	sqlx := "SELECT " + strings.Join(cols, ",") + " FROM bonuses WHERE " + col("bonuses", "BonusID") + "=?"
+	if err := dbh.QueryRow(sqlx, bonus).Scan(dest...); err != nil {
+		return res
+	}
+	res.Photo, res.Odo, res.Answer = photo != 0, odo != 0, answer != 0
+	return res
+
+}
+
+// checkRequirements flags a claim lacking what its bonus requires.
+func checkRequirements(req bonusRequirements, f4 fourFields, photos int, flags *claimFlags) {
+
+	if req.Photo && photos < 1 {
+		flags.add(flagPhotoMissing)
+	}
+	if req.Odo && !f4.OdoOk {
+		flags.add(flagOdoMissing)
+	}
+	if req.Answer && strings.TrimSpace(f4.Extra) == "" {
+		flags.add(flagAnswerMismatch)
+	}
+	if req.RestMinutes > 0 && !f4.ClaimTime.IsZero() {
+		_, prev, ok := neighbourClaim(f4.EntrantID, f4.ClaimTime, true)
+		if ok && f4.ClaimTime.Sub(prev).Minutes() < float64(req.RestMinutes) {
+			if *verbose {
+				fmt.Printf("%s entrant %v rested %.0f of %v minutes\n", logts(), f4.EntrantID, f4.ClaimTime.Sub(prev).Minutes(), req.RestMinutes)
+			}
+			flags.add(flagRestShort)
+		}
+	}
+
+}
@@ -0,0 +1,118 @@
+package main
+
+/*
+ * Some bonuses can only be claimed at certain times, a cafe's opening
+ * hours or a one-day event. Columns in the bonuses table describe the window:
+ *
+ *		AvailableFrom	first moment it can be claimed, eg 2026-06-01T08:00
+ *		AvailableUntil	last moment it can be claimed
+ *		OpensAt		daily opening time, eg 09:00
+ *		ClosesAt	daily closing time, may be earlier than OpensAt to span midnight
+ *
+ * Any may be left empty. Claims outside the window are flagged.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// bonusWindow is when a bonus may be claimed.
+type bonusWindow struct {
+	From   time.Time
+	Until  time.Time
+	Opens  string // hhmm
+	Closes string // hhmm
+}
+
+// fetchBonusWindow reads a bonus's availability window.
+func fetchBonusWindow(bonus string) bonusWindow {
+
+	var res bonusWindow
+	for _, c := range []string{"AvailableFrom", "AvailableUntil", "OpensAt", "ClosesAt"} {
+		if !hasColumn("bonuses", c) {
+			return res
+		}
+	}
+	var from, until string
+	sqlx := "SELECT IfNull(" + col("bonuses", "AvailableFrom") + ",''),IfNull(" + col("bonuses", "AvailableUntil") + ",'')"
+	sqlx += ",IfNull(" + col("bonuses", "OpensAt") + ",''),IfNull(" + col("bonuses", "ClosesAt") + ",'')"
+	sqlx += " FROM bonuses WHERE " + col("bonuses", "BonusID") + "=?"
+	if dbh.QueryRow(sqlx, bonus).Scan(&from, &until, &res.Opens, &res.Closes) != nil {
+		return res
+	}
+	res.From, _ = time.ParseInLocation("2006-01-02T15:04", from, cfg.LocalTZ)
+	res.Until, _ = time.ParseInLocation("2006-01-02T15:04", until, cfg.LocalTZ)
+	res.Opens = normaliseTime(res.Opens)
+	res.Closes = normaliseTime(res.Closes)
+	return res
+
+}
+
+// isSet reports whether the window restricts anything.
+func (w bonusWindow) isSet() bool {
+	return !w.From.IsZero() || !w.Until.IsZero() || (w.Opens != "" && w.Closes != "")
+}
+
+// contains reports whether a claim time falls within the window.
+func (w bonusWindow) contains(ct time.Time) bool {
+
+	if !w.From.IsZero() && ct.Before(w.From) {
+		return false
+	}
+	if !w.Until.IsZero() && ct.After(w.Until) {
+		return false
+	}
+	if w.Opens == "" || w.Closes == "" {
+		return true
+	}
+	hhmm := ct.In(cfg.LocalTZ).Format("1504")
+	if w.Opens <= w.Closes {
+		return hhmm >= w.Opens && hhmm <= w.Closes
+	}
+	return hhmm >= w.Opens || hhmm <= w.Closes
+
+}
+
+// String describes the window for riders.
+func (w bonusWindow) String() string {
+
+	var res []string
+	switch {
+	case !w.From.IsZero() && !w.Until.IsZero():
+		res = append(res, w.From.Format("Mon 2 Jan 15:04")+" to "+w.Until.Format("Mon 2 Jan 15:04"))
+	case !w.From.IsZero():
+		res = append(res, "from "+w.From.Format("Mon 2 Jan 15:04"))
+	case !w.Until.IsZero():
+		res = append(res, "until "+w.Until.Format("Mon 2 Jan 15:04"))
+	}
+	if w.Opens != "" && w.Closes != "" {
+		res = append(res, fmt.Sprintf("%v-%v daily", clockTime(w.Opens), clockTime(w.Closes)))
+	}
+	return strings.Join(res, ", ")
+
+}
+
+// clockTime shows hhmm as hh:mm.
+func clockTime(hhmm string) string {
+
+	if len(hhmm) != 4 {
+		return hhmm
+	}
+	return hhmm[:2] + ":" + hhmm[2:]
+
+}
+
+// validateBonusWindow flags claims made while the bonus wasn't available.
+func validateBonusWindow(w bonusWindow, f4 fourFields, flags *claimFlags) {
+
+	if !w.isSet() || f4.ClaimTime.IsZero() {
+		return
+	}
+	if !w.contains(f4.ClaimTime) {
+		flags.add(flagOutsideWindow)
+	}
+
+}
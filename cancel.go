@@ -0,0 +1,87 @@
+package main
+
+/*
+ * A rider can withdraw a mistaken claim by sending
+ *
+ *		CANCEL 12 A4
+ *
+ * from their registered address. The entrant's latest claim for that bonus
+ * is marked as cancelled, never deleted, and flagged for the scorer, who is
+ * also told by email if cfg.ScorerAddress is set. The rider gets a reply
+ * confirming what happened.
+ *
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var cancelRE = regexp.MustCompile(`(?i)^\s*CANCEL\s+(\S+)\s+([a-zA-Z0-9\-]+)\s*$`)
+
+// parseCancel recognises a cancellation request.
+func parseCancel(subject string) (int, string, bool) {
+
+	x := cancelRE.FindStringSubmatch(subject)
+	if x == nil {
+		return 0, "", false
+	}
+	return extractEntrantID(x[1]), strings.ToUpper(x[2]), true
+
+}
+
+// cancelClaim marks the entrant's latest live claim for the bonus as cancelled.
+func cancelClaim(entrant int, bonus string) (int64, bool) {
+
+	var rowid int64
+	err := dbh.QueryRow("SELECT rowid FROM ebclaims WHERE EntrantID=? AND BonusID=? AND IfNull(RiderCancelled,0)=0 ORDER BY rowid DESC LIMIT 1", entrant, bonus).Scan(&rowid)
+	if err != nil {
+		return 0, false
+	}
+	_, err = dbExec("UPDATE ebclaims SET RiderCancelled=1 WHERE rowid=?", rowid)
+	if err != nil {
+		fmt.Printf("%s can't cancel claim %v %v\n", logts(), rowid, err)
+		return 0, false
+	}
+	addStoredFlag(rowid, flagCancelled)
+	refreshLeaderboard(rowid)
+	return rowid, true
+
+}
+
+// handleCancel deals with a cancellation email, reporting whether it was
+// from someone entitled to send it.
+func handleCancel(emailid uint32, from string, subject string, entrant int, bonus string) bool {
+
+	_, vea, _ := validateEntrant(fourFields{EntrantID: entrant}, from)
+	if !vea {
+		if !*silent {
+			fmt.Printf("%s ignoring [ %v ] from %v, not registered for entrant %v\n", logts(), subject, from, entrant)
+		}
+		writeAudit(emailid, from, subject, auditRejected, "cancellation from unregistered address")
+		return false
+	}
+	if cfg.TestMode {
+		sendPlainMail(from, "EBC test: "+subject, fmt.Sprintf("In a live rally your latest claim for bonus %v would now be cancelled.", bonus))
+		return true
+	}
+	rowid, ok := cancelClaim(entrant, bonus)
+	if !ok {
+		writeAudit(emailid, from, subject, auditRejected, "no claim to cancel")
+		sendPlainMail(from, "Not cancelled: "+subject, fmt.Sprintf("I can't find a claim for bonus %v from entrant %v to cancel.", bonus, entrant))
+		return true
+	}
+	if !*silent {
+		fmt.Printf("%s cancelled claim %v [ %v ]\n", logts(), rowid, subject)
+	}
+	writeAudit(emailid, from, subject, auditCancelled, fmt.Sprintf("claim %v cancelled", rowid))
+	fireHook(hookEvent{Event: hookClaimCancelled, EmailID: emailid, From: from, Subject: subject, EntrantID: entrant, BonusID: bonus})
+	if cfg.ScorerAddress != "" {
+		sendPlainMail(cfg.ScorerAddress, fmt.Sprintf("Claim cancelled: entrant %v bonus %v", entrant, bonus),
+			fmt.Sprintf("Entrant %v has cancelled their claim for bonus %v (ebclaims row %v).", entrant, bonus, rowid))
+	}
+	sendPlainMail(from, "Cancelled: "+subject, fmt.Sprintf("Your claim for bonus %v has been cancelled.", bonus))
+	return true
+
+}
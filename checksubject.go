@@ -0,0 +1,170 @@
+package main
+
+/*
+ * A Subject regex which doesn't compile used to stop me with a panic and
+ * one which compiles but names its groups wrongly, (?P<odometer>...) say,
+ * quietly leaves that field empty in every claim. I check the subject,
+ * subjects and strict regexes before starting and refuse to run if any is
+ * broken, saying which.
+ *
+ * To see exactly how a Subject line would be parsed under the current
+ * configuration:-
+ *
+ *		ebcfetch -db sm/ScoreMaster.db -checksubject "1 A1 1234 1530"
+ *
+ * shows which regex matched, or that the tokeniser was used, the fields
+ * picked out and what they were made of, then exits.
+ *
+ */
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// subjectFieldNames are the names a Subject regex's groups may have.
+var subjectFieldNames = []string{"entrant", "bonus", "odo", "time", "extra"}
+
+// subjectPattern is one configured Subject regex and where it came from.
+type subjectPattern struct {
+	Name string // eg subjects[2]
+	Text string
+}
+
+// subjectPatterns lists the configured Subject regexes in the order they're tried.
+func subjectPatterns(formal bool) []subjectPattern {
+
+	if formal {
+		return []subjectPattern{{"strict", cfg.Strict}}
+	}
+	res := []subjectPattern{{"subject", cfg.Subject}}
+	for i, s := range cfg.Subjects {
+		res = append(res, subjectPattern{fmt.Sprintf("subjects[%v]", i+1), s})
+	}
+	return res
+
+}
+
+// checkSubjectRE compiles a Subject regex, refusing groups named other than
+// for the fields and, if any are named, one without entrant or bonus.
+func checkSubjectRE(sp subjectPattern) (*regexp.Regexp, error) {
+
+	re, err := regexp.Compile(sp.Text)
+	if err != nil {
+		return nil, fmt.Errorf("%v %v", sp.Name, err)
+	}
+	var named []string
+	for _, n := range re.SubexpNames() {
+		if n == "" {
+			continue
+		}
+		if !containsFold(subjectFieldNames, n) {
+			return nil, fmt.Errorf("%v has a group named %q, names must be %v", sp.Name, n, strings.Join(subjectFieldNames, ", "))
+		}
+		named = append(named, n)
+	}
+	if len(named) > 0 && !(containsFold(named, "entrant") && containsFold(named, "bonus")) {
+		return nil, fmt.Errorf("%v names its groups but has no entrant or bonus", sp.Name)
+	}
+	return re, nil
+
+}
+
+// compileSubjects sets up the Subject regexes, returning what's wrong with
+// the first broken one if any.
+func compileSubjects() error {
+
+	if cfg.Subject == "" && len(cfg.Subjects) > 0 {
+		cfg.Subject, cfg.Subjects = cfg.Subjects[0], cfg.Subjects[1:]
+	}
+	var res []*regexp.Regexp
+	for _, sp := range append(subjectPatterns(true), subjectPatterns(false)...) {
+		re, err := checkSubjectRE(sp)
+		if err != nil {
+			return err
+		}
+		res = append(res, re)
+	}
+	cfg.StrictRE, cfg.SubjectRE, cfg.SubjectREs = res[0], res[1], res[2:]
+	return nil
+
+}
+
+// matchingSubject returns the regex a Subject line matches, named as in
+// subjectPatterns, and the fields it picks out, or nil if none match.
+func matchingSubject(s string, formal bool) (string, *regexp.Regexp, map[string]string) {
+
+	s = stripSubjectPrefixes(s)
+	res := append([]*regexp.Regexp{cfg.SubjectRE}, cfg.SubjectREs...)
+	if formal {
+		res = []*regexp.Regexp{cfg.StrictRE}
+	}
+	for i, re := range res {
+		if ff := re.FindStringSubmatch(s); ff != nil {
+			name := "subject"
+			if formal {
+				name = "strict"
+			} else if i > 0 {
+				name = fmt.Sprintf("subjects[%v]", i)
+			}
+			return name, re, subjectFields(re, ff)
+		}
+	}
+	return "", nil, nil
+
+}
+
+// explainSubject describes how a Subject line is parsed.
+func explainSubject(w io.Writer, s string) {
+
+	fmt.Fprintf(w, "Subject  %q\n", s)
+	if x := stripSubjectPrefixes(s); x != s {
+		fmt.Fprintf(w, "Stripped %q\n", x)
+	}
+	name, re, fields := matchingSubject(s, false)
+	switch {
+	case re != nil:
+		fmt.Fprintf(w, "Matched  %v '%v'\n", name, re)
+	default:
+		if fields = tokeniseSubject(stripSubjectPrefixes(s)); fields != nil {
+			fmt.Fprintf(w, "Matched  no regex, split into tokens\n")
+		} else {
+			fmt.Fprintf(w, "Matched  nothing, this isn't a claim\n")
+		}
+	}
+	for _, n := range subjectFieldNames {
+		if v, ok := fields[n]; ok {
+			fmt.Fprintf(w, "  %-8v %q\n", n, v)
+		}
+	}
+	f4 := parseSubject(s, false)
+	fmt.Fprintf(w, "Valid    %v\n", f4.ok)
+	if !f4.ok {
+		return
+	}
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM entrants WHERE "+col("entrants", "EntrantID")+"=?", f4.EntrantID).Scan(&n)
+	unless := func(ok bool, why string) string {
+		if ok {
+			return ""
+		}
+		return ", " + why
+	}
+	fmt.Fprintf(w, "Entrant  %v%v\n", f4.EntrantID, unless(n > 0, "not in this rally"))
+	fmt.Fprintf(w, "Bonus    %v%v\n", f4.BonusID, unless(knownBonus(f4.BonusID), "no such bonus"))
+	if f4.OdoText != "" || f4.HHmm != "" {
+		fmt.Fprintf(w, "Odo      %v%v\n", f4.OdoValue, unless(f4.OdoOk, "not a valid reading"))
+		fmt.Fprintf(w, "Time     %02d:%02d%v\n", f4.TimeHH, f4.TimeMM, unless(f4.TimeOk, "not a valid time"))
+	}
+	if f4.Extra != "" {
+		fmt.Fprintf(w, "Extra    %q\n", f4.Extra)
+	}
+	if _, re, _ := matchingSubject(s, true); re != nil {
+		fmt.Fprintf(w, "Strict   yes\n")
+	} else {
+		fmt.Fprintf(w, "Strict   no\n")
+	}
+
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+ * Claim flags are warnings and hints attached to a stored claim for the
+ * benefit of the judges. They never cause a claim to be rejected, that's a
+ * job for a human being, but they are shown in test responses and stored as
+ * a comma separated list of codes in ebclaims.EbcFlags.
+ *
+ */
+
+import "strings"
+
+const (
+	flagOutsideLegs = "LEG" // Claim time isn't within any leg of the rally
+	flagWrongLeg    = "BLG" // Bonus is only available in a different leg
+
+	flagOdoPhotoOk       = "OCR" // Claimed odo reading was found in the photo
+	flagOdoPhotoMismatch = "OCX" // Photo shows numbers but not the claimed odo
+
+	flagQRCodeOk       = "QRC" // Photo shows the bonus's QR code
+	flagQRCodeMismatch = "QRX" // Photo shows a QR code, but not this bonus's
+
+	flagSpeed = "SPD" // Implausible average speed from/to neighbouring claim
+
+	flagTeamDuplicate = "TMD" // Another member of the team has claimed this bonus
+	flagClaimRate     = "RAT" // One of too many claims from this entrant in a short time
+
+	flagNameMatched = "NAM" // Entrant identified by name rather than number
+	flagOrganiser   = "ORG" // Entered by the organisers using OVERRIDE
+	flagPillion     = "PIL" // Sent under the pillion's own entrant number
+
+	flagCorrection       = "COR" // Corrects an earlier claim, see CorrectsRowID
+	flagCorrected        = "CRD" // Corrected by a later claim
+	flagCorrectionOrphan = "CRX" // Correction but no earlier claim found
+	flagCancelled        = "CAN" // Withdrawn by the rider using CANCEL
+
+	flagAnswerOk       = "ANS" // Extra matches the bonus's ExpectedAnswer
+	flagAnswerMismatch = "ANX" // Extra doesn't match the bonus's ExpectedAnswer
+
+	flagPhotoMissing = "PHX" // Bonus requires a photo but none was sent
+	flagOdoMissing   = "ODX" // Bonus requires an odo reading but none was sent
+	flagRestShort    = "RST" // Too soon after the previous claim for a rest bonus
+
+	flagOutsideWindow = "WIN" // Claim time is outside the bonus's availability window
+	flagDarkness      = "DRK" // Daylight-only bonus claimed between sunset and sunrise
+
+	flagExifTime = "EXT" // Claim time adjusted to agree with the photo's EXIF
+
+	flagMapPinOk  = "PIN" // Map pin link sent with the claim is at the bonus
+	flagMapPinFar = "PNX" // Map pin link sent with the claim is away from the bonus
+
+	flagFollowUpPhotos = "FUP" // Photos arrived in a separate email
+
+	flagSenderAuth = "AUX" // Receiving server couldn't vouch for the From address
+
+	flagBeforeStart  = "EAR" // Claim time is before the rally started
+	flagAfterFinish  = "LAT" // Claim time is after the rally finished
+	flagOdoBackwards = "ODB" // Odo reading is less than at the entrant's previous claim
+)
+
+var flagDescriptions = map[string]string{
+	flagOutsideLegs: "Claim time is outside all leg windows",
+	flagWrongLeg:    "Bonus is not available in this leg",
+
+	flagOdoPhotoOk:       "Odo reading confirmed by photo",
+	flagOdoPhotoMismatch: "Odo reading not recognised in photo",
+
+	flagQRCodeOk:       "Bonus QR code found in photo",
+	flagQRCodeMismatch: "QR code in photo doesn't match the bonus",
+
+	flagSpeed: "Implausible average speed since/until neighbouring claim",
+
+	flagTeamDuplicate: "Bonus also claimed by another member of the team",
+	flagClaimRate:     "Entrant is sending an unusual number of claims",
+
+	flagNameMatched: "Entrant identified by name, not number",
+	flagOrganiser:   "Claim entered by the organisers",
+	flagPillion:     "Claim sent by the pillion, credited to the rider",
+
+	flagCorrection:       "Correction of an earlier claim",
+	flagCorrected:        "Corrected by a later claim",
+	flagCorrectionOrphan: "Correction, but no earlier claim for this bonus",
+	flagCancelled:        "Cancelled by the rider",
+
+	flagAnswerOk:       "Answer to the bonus question is correct",
+	flagAnswerMismatch: "Answer to the bonus question is missing or wrong",
+
+	flagPhotoMissing: "This bonus needs a photo",
+	flagOdoMissing:   "This bonus needs an odo reading",
+	flagRestShort:    "Rest period is too short",
+
+	flagOutsideWindow: "Bonus was not available at the claim time",
+	flagDarkness:      "Daylight-only bonus claimed in darkness",
+
+	flagExifTime: "Claim time taken from the photo",
+
+	flagMapPinOk:  "Map pin is at the bonus",
+	flagMapPinFar: "Map pin is some distance from the bonus",
+
+	flagFollowUpPhotos: "Photos sent separately from the claim",
+
+	flagSenderAuth: "Sender's address not confirmed by DKIM, SPF or DMARC",
+
+	flagBeforeStart:  "Claim time is before the start of the rally",
+	flagAfterFinish:  "Claim time is after the end of the rally",
+	flagOdoBackwards: "Odo reading is lower than at the previous claim",
+}
+
+// claimFlags accumulates warnings about a single claim.
+type claimFlags []string
+
+func (cf *claimFlags) add(flag string) {
+
+	for _, f := range *cf {
+		if f == flag {
+			return
+		}
+	}
+	*cf = append(*cf, flag)
+
+}
+
+func (cf claimFlags) has(flag string) bool {
+
+	for _, f := range cf {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+
+}
+
+// String gives the form stored in the database.
+func (cf claimFlags) String() string {
+	return strings.Join(cf, ",")
+}
+
+// describe returns human readable versions for use in responses.
+func (cf claimFlags) describe() []string {
+
+	var res []string
+	for _, f := range cf {
+		d, ok := flagDescriptions[f]
+		if !ok {
+			d, ok = ruleDescription(f)
+		}
+		if !ok {
+			d = f
+		}
+		res = append(res, d)
+	}
+	return res
+
+}
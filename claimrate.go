@@ -0,0 +1,77 @@
+package main
+
+/*
+ * A rush of claims from one entrant, say 15 in 10 minutes, usually means a
+ * mail client stuck resending its outbox and occasionally something worse.
+ * If ClaimRateLimit is set, claims beyond that many within ClaimRateWindow
+ * are flagged and the AdminAddresses told, once per window. With
+ * ThrottleResponses, test responses stop until the rush is over so that I
+ * don't feed a loop.
+ *
+ */
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultClaimRateWindow = 10 * time.Minute
+
+var claimRate = struct {
+	mu      sync.Mutex
+	seen    map[int][]time.Time
+	alerted map[int]time.Time
+}{seen: make(map[int][]time.Time), alerted: make(map[int]time.Time)}
+
+func claimRateWindow() time.Duration {
+
+	if cfg.ClaimRateWindow > 0 {
+		return cfg.ClaimRateWindow
+	}
+	return defaultClaimRateWindow
+
+}
+
+// noteClaimRate records a claim's arrival, reporting whether the entrant's
+// rate is anomalous and, if so, whether the admins need telling.
+func noteClaimRate(entrant int, now time.Time) (bool, bool) {
+
+	if cfg.ClaimRateLimit < 1 {
+		return false, false
+	}
+	claimRate.mu.Lock()
+	defer claimRate.mu.Unlock()
+	since := now.Add(-claimRateWindow())
+	var recent []time.Time
+	for _, t := range claimRate.seen[entrant] {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	claimRate.seen[entrant] = recent
+	if len(recent) <= cfg.ClaimRateLimit {
+		return false, false
+	}
+	if claimRate.alerted[entrant].After(since) {
+		return true, false
+	}
+	claimRate.alerted[entrant] = now
+	return true, true
+
+}
+
+// alertClaimRate tells the admins about an entrant's rush of claims.
+func alertClaimRate(entrant int, from string) {
+
+	msg := fmt.Sprintf("Entrant %v (%v) has sent more than %v claims in %v. Their claims are being flagged %v.",
+		entrant, from, cfg.ClaimRateLimit, claimRateWindow(), flagClaimRate)
+	if !*silent {
+		fmt.Printf("%s %v\n", logts(), msg)
+	}
+	for _, a := range cfg.AdminAddresses {
+		sendPlainMail(a, fmt.Sprintf("%v: claim rate alert, entrant %v", apptitle, entrant), msg)
+	}
+
+}
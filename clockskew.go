@@ -0,0 +1,68 @@
+package main
+
+/*
+ * A phone whose clock is wrong gives a Date header to match, so claims sent
+ * around midnight get dated the wrong day and hhmm looks wildly out. I
+ * compare each claim's Date with the time the first server received it and
+ * keep the difference in ebcclockskew.
+ *
+ * Delays only ever make Date look earlier, an email can sit in an outbox for
+ * hours with no signal, so the best estimate of the clock's error is the
+ * largest difference among an entrant's last few claims. A fast clock shows
+ * up straight away but I don't call a clock slow until I've seen a few
+ * claims. In test mode the rider is told if it's out by ClockSkewWarn or more.
+ *
+ */
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	defaultClockSkewWarn = 2 * time.Minute
+	clockSkewSamples     = 5 // How many recent claims the estimate is based on
+	clockSkewSlowSamples = 3 // How many are needed before calling a clock slow
+)
+
+// recordClockSkew notes the difference between a claim's Date and its receipt.
+func recordClockSkew(entrant int, emailid uint32, sent, received time.Time) {
+
+	if entrant < 1 || sent.IsZero() || received.IsZero() {
+		return
+	}
+	skew := sent.Sub(received).Round(time.Second)
+	dbExec("INSERT INTO ebcclockskew (LoggedAt,EmailID,EntrantID,SkewSeconds) VALUES(?,?,?,?)",
+		storeTimeDB(time.Now()), emailid, entrant, int(skew.Seconds()))
+
+}
+
+// entrantClockSkew estimates how far out an entrant's clock is and how many
+// claims the estimate is based on.
+func entrantClockSkew(entrant int) (time.Duration, int) {
+
+	var skew, n int
+	dbh.QueryRow(`SELECT IfNull(Max(SkewSeconds),0),count(*) FROM
+		(SELECT SkewSeconds FROM ebcclockskew WHERE EntrantID=? ORDER BY rowid DESC LIMIT ?)`, entrant, clockSkewSamples).Scan(&skew, &n)
+	return time.Duration(skew) * time.Second, n
+
+}
+
+// clockSkewAdvice tells the rider their clock is wrong, if it is.
+func clockSkewAdvice(skew time.Duration, samples int) string {
+
+	warn := cfg.ClockSkewWarn
+	if warn <= 0 {
+		warn = defaultClockSkewWarn
+	}
+	mins := int(math.Round(math.Abs(skew.Minutes())))
+	switch {
+	case skew >= warn:
+		return fmt.Sprintf("Your phone's clock appears to be %v minutes fast. Please set it to update automatically from the network.", mins)
+	case -skew >= warn && samples >= clockSkewSlowSamples:
+		return fmt.Sprintf("Your phone's clock appears to be %v minutes slow. Please set it to update automatically from the network.", mins)
+	}
+	return ""
+
+}
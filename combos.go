@@ -0,0 +1,102 @@
+package main
+
+/*
+ * ScoreMaster scores combinations, ComboIDs in its combinations table, by
+ * itself once their constituent bonuses, listed in combinations.Bonuses,
+ * have been claimed. Riders sometimes claim a combo's code as if it were a
+ * bonus, which can never score, or don't realise which bonuses count
+ * towards one. Test responses say so, so they find out before the rally.
+ *
+ */
+
+import (
+	"strconv"
+	"strings"
+)
+
+// comboInfo is one of ScoreMaster's combinations.
+type comboInfo struct {
+	ComboID   string
+	BriefDesc string
+	Bonuses   []string
+	Minimum   int // Bonuses needed if not all of them
+}
+
+// loadCombos reads the combinations table, if there is one.
+func loadCombos() []comboInfo {
+
+	if !tableExists("combinations") {
+		return nil
+	}
+	sqlx := "SELECT " + col("combinations", "ComboID") + ",IfNull(" + col("combinations", "BriefDesc") + ",'')"
+	sqlx += ",IfNull(" + col("combinations", "Bonuses") + ",''),IfNull(" + col("combinations", "MinimumTicks") + ",0)"
+	sqlx += " FROM combinations"
+	rows, err := dbh.Query(sqlx)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var res []comboInfo
+	for rows.Next() {
+		var ci comboInfo
+		var bonuses string
+		rows.Scan(&ci.ComboID, &ci.BriefDesc, &bonuses, &ci.Minimum)
+		for _, b := range strings.Split(bonuses, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				ci.Bonuses = append(ci.Bonuses, strings.ToUpper(b))
+			}
+		}
+		res = append(res, ci)
+	}
+	return res
+
+}
+
+// fetchCombo finds the combination with this code.
+func fetchCombo(code string) (comboInfo, bool) {
+
+	for _, ci := range loadCombos() {
+		if strings.EqualFold(ci.ComboID, code) {
+			return ci, true
+		}
+	}
+	return comboInfo{}, false
+
+}
+
+// combosContaining lists the combinations a bonus counts towards.
+func combosContaining(bonus string) []comboInfo {
+
+	var res []comboInfo
+	for _, ci := range loadCombos() {
+		if containsFold(ci.Bonuses, bonus) {
+			res = append(res, ci)
+		}
+	}
+	return res
+
+}
+
+// needs describes what a combination is made of.
+func (ci comboInfo) needs() string {
+
+	list := strings.Join(ci.Bonuses, ", ")
+	if n := len(ci.Bonuses); n > 1 {
+		list = strings.Join(ci.Bonuses[:n-1], ", ") + " and " + ci.Bonuses[n-1]
+	}
+	if ci.Minimum > 0 && ci.Minimum < len(ci.Bonuses) {
+		return "any " + strconv.Itoa(ci.Minimum) + " of " + list
+	}
+	return list
+
+}
+
+// String names a combination.
+func (ci comboInfo) String() string {
+
+	if ci.BriefDesc == "" {
+		return ci.ComboID
+	}
+	return ci.ComboID + " - " + ci.BriefDesc
+
+}
@@ -0,0 +1,70 @@
+package main
+
+/*
+ * Subcommands follow the usual flags on the commandline, eg:-
+ *
+ *		ebcfetch -db sm/ScoreMaster.db gc -dryrun
+ *
+ * Without a subcommand I just monitor the mailbox.
+ *
+ */
+
+import "fmt"
+
+const commandsHelp = `
+Subcommands:
+  gc [-dryrun]    Remove images not belonging to any stored claim
+  retry-flagged   Rerun emails previously flagged for manual attention
+  reparse [-apply] Reparse stored claims under the current configuration
+  summaries [-resend] Email each entrant a list of their recorded claims
+  check           Parse the SubjectExamples and show the results
+  loadtest [-n 300] [-photo 1600] [-inject] Time a burst of synthetic claims
+  rehearse -from folder [-speed 10] [-out rehearsal] [-keep] Replay saved claim emails into a copy of the database
+  dryrun -from folder [-responses responses] [-scratch folder [-live]] Process .eml files or a Maildir, writing emails instead of sending them
+  anonymise -from folder -to folder Scrub saved emails into a shareable test corpus
+  archive [-to .] [-format zip|tar] [-prune] Bundle images, emails and claims into a dated archive
+  maintain        Check the database's integrity, ANALYZE and incremental VACUUM
+  state export -to file | state import -from file Move my state to another machine mid-rally
+  preview-response [--good] [--bad] [-out file.html] [-to address] Show the test response to a made up claim
+  reprocess [-uid 1234-1300] [-since 2025-07-01] [-dryrun] Put emails through again whatever became of them
+  oauth           Authorize IMAP logins using OAuth2, see OAuthProvider`
+
+// runCommand carries out a subcommand and returns the exit code.
+func runCommand(args []string) int {
+
+	switch args[0] {
+	case "gc":
+		return runGC(args[1:])
+	case "retry-flagged":
+		return runRetryFlagged(args[1:])
+	case "reparse":
+		return runReparse(args[1:])
+	case "summaries":
+		return runSummaries(args[1:])
+	case "check":
+		return runCheck(args[1:])
+	case "loadtest":
+		return runLoadTest(args[1:])
+	case "dryrun":
+		return runDryRun(args[1:])
+	case "rehearse":
+		return runRehearse(args[1:])
+	case "anonymise":
+		return runAnonymise(args[1:])
+	case "archive":
+		return runArchive(args[1:])
+	case "maintain":
+		return runMaintain(args[1:])
+	case "state":
+		return runState(args[1:])
+	case "preview-response":
+		return runPreviewResponse(args[1:])
+	case "reprocess":
+		return runReprocess(args[1:])
+	case "oauth":
+		return runOAuth(args[1:])
+	}
+	fmt.Printf("%s: unknown command %v\n%v\n", apptitle, args[0], commandsHelp)
+	return 1
+
+}
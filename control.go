@@ -0,0 +1,186 @@
+package main
+
+/*
+ * ScoreMaster's web UI used to change what I do by writing config rows and
+ * waiting for me to notice them on my next cycle. The control API lets it
+ * act, and show my state, at once:-
+ *
+ *		GET  /api/health                 version, uptime and state, 503 if unwell
+ *		POST /api/pause, /api/resume     as before
+ *		POST /api/fetch                  fetch now rather than at the next poll
+ *		POST /api/testmode?on=true       switch test mode, until restarted
+ *
+ * These are served by the dashboard, with the rest of /api, and also, if
+ * ControlAddr is set, on their own by a listener confined to the loopback
+ * interface so the web UI on the same machine can use them without the
+ * dashboard running. That listener won't start without an APIToken.
+ *
+ * Loopback is no protection from a page on some other site getting the HQ
+ * browser to post a form to 127.0.0.1, so requests changing anything
+ * must carry the APIToken as a bearer token or, if there isn't one, an
+ * X-EBCFetch-Control header, neither of which a form can send, and are
+ * refused outright if the browser's Origin says they came from elsewhere.
+ *
+ */
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// controlHeader must be sent with requests to change things if there's no APIToken
+const controlHeader = "X-EBCFetch-Control"
+
+var startedAt = time.Now()
+
+// apiHealth is what /api/health reports.
+type apiHealth struct {
+	Healthy bool
+	Version string
+	Started string
+	Uptime  int64 // seconds
+	State   apiState
+}
+
+// currentHealth reports whether I'm working properly. I'm unwell if the last
+// attempt to reach the mailbox failed.
+func currentHealth() apiHealth {
+
+	st := currentState()
+	return apiHealth{Healthy: st.LastError == "", Version: appversion, Started: storeTimeDB(startedAt),
+		Uptime: int64(time.Since(startedAt).Seconds()), State: st}
+
+}
+
+// apiRoutes adds the API to a mux.
+func apiRoutes(mux *http.ServeMux) {
+
+	mux.HandleFunc("/api/claims", apiClaims)
+	mux.HandleFunc("/api/state", apiGetState)
+	mux.HandleFunc("/api/health", apiGetHealth)
+	mux.HandleFunc("/api/audit", apiAudit)
+	mux.HandleFunc("/api/pause", apiPauser(1))
+	mux.HandleFunc("/api/resume", apiPauser(0))
+	mux.HandleFunc("/api/fetch", apiFetchNow)
+	mux.HandleFunc("/api/testmode", apiTestMode)
+
+}
+
+// apiControlAllowed checks a request to change something, answering it if it isn't allowed.
+func apiControlAllowed(w http.ResponseWriter, r *http.Request) bool {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return false
+	}
+	if crossSiteRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if !apiAuthorised(r) || (cfg.APIToken == "" && r.Header.Get(controlHeader) == "") {
+		http.Error(w, "Unauthorised", http.StatusUnauthorized)
+		return false
+	}
+	return true
+
+}
+
+// crossSiteRequest reports whether a browser sent a request from a page on
+// some other site.
+func crossSiteRequest(r *http.Request) bool {
+
+	if strings.EqualFold(r.Header.Get("Sec-Fetch-Site"), "cross-site") {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false // Not a browser, or an old one which sends no Origin with forms
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+
+}
+
+func apiGetHealth(w http.ResponseWriter, r *http.Request) {
+
+	h := currentHealth()
+	if !h.Healthy {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, h)
+
+}
+
+func apiFetchNow(w http.ResponseWriter, r *http.Request) {
+
+	if !apiControlAllowed(w, r) {
+		return
+	}
+	if !*silent {
+		fmt.Printf("%s fetch requested by %v\n", logts(), r.RemoteAddr)
+	}
+	signalMail()
+	writeJSON(w, currentState())
+
+}
+
+func apiTestMode(w http.ResponseWriter, r *http.Request) {
+
+	if !apiControlAllowed(w, r) {
+		return
+	}
+	on, err := strconv.ParseBool(r.FormValue("on"))
+	if err != nil {
+		http.Error(w, "on must be true or false", http.StatusBadRequest)
+		return
+	}
+	setTestMode(on)
+	if !*silent {
+		fmt.Printf("%s test mode %v set by %v\n", logts(), on, r.RemoteAddr)
+	}
+	st := currentState()
+	st.TestMode = on // As it will be once the main loop has switched it
+	writeJSON(w, st)
+
+}
+
+// controlListenAddr confines the control API to the loopback interface.
+func controlListenAddr(addr string) string {
+
+	if isLoopbackAddr(addr) {
+		return addr
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return net.JoinHostPort("127.0.0.1", addr) // Just a port
+
+}
+
+// startControlAPI serves the API alone on cfg.ControlAddr.
+func startControlAPI(addr string) {
+
+	if cfg.APIToken == "" {
+		fmt.Printf("%s: ControlAddr needs an APIToken, control API not started\n", apptitle)
+		return
+	}
+	mux := http.NewServeMux()
+	apiRoutes(mux)
+	addr = controlListenAddr(addr)
+	go func() {
+		err := http.ListenAndServe(addr, requireAuth(mux))
+		if err != nil {
+			fmt.Printf("%s: control API on %v failed %v\n", apptitle, addr, err)
+		}
+	}()
+	if !*silent {
+		fmt.Printf("%s: Control API available on %v\n", apptitle, addr)
+	}
+
+}
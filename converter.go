@@ -0,0 +1,101 @@
+package main
+
+/*
+ * Images which aren't JPGs can be converted using external utilities.
+ *
+ * A converter is specified as a command template in which {in}, {out} and
+ * {quality} are replaced by the original filename, the JPG filename and
+ * cfg.JpegQuality. For example:-
+ *
+ *		magick {in} -quality {quality} {out}
+ *		heif-convert -q {quality} {in} {out}
+ *
+ * A template without any placeholders is called as:- cmd in out
+ *
+ * cfg.Heic2jpg, or whatever else validateHeicHandler finds, is used for
+ * HEIC/HEIF files; cfg.Converters maps other file extensions, eg ".png",
+ * onto their own templates.
+ *
+ */
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultJpegQuality = 85
+
+var imageExtRE = regexp.MustCompile(`(?i)\.(heic|heif|jpe?g|png|gif|webp|tiff?|bmp)\b`)
+
+// imageExt returns the lowercased image extension found in a filename or
+// Content-Disposition header, or "" if there isn't one.
+func imageExt(filename string) string {
+
+	x := imageExtRE.FindStringSubmatch(filename)
+	if x == nil {
+		return ""
+	}
+	return "." + strings.ToLower(x[1])
+
+}
+
+func isHeicExt(ext string) bool {
+	return ext == ".heic" || ext == ".heif"
+}
+
+// converterFor returns the template used to convert files with this extension,
+// if any. A blank template in cfg.Converters means none.
+func converterFor(ext string) string {
+
+	if tmpl, ok := cfg.Converters[ext]; ok {
+		return strings.TrimSpace(tmpl)
+	}
+	if isHeicExt(ext) && cfg.ConvertHeic {
+		return heicTemplate()
+	}
+	return ""
+
+}
+
+// jpegQuality is the quality JPGs are written at.
+func jpegQuality() int {
+
+	if cfg.JpegQuality < 1 || cfg.JpegQuality > 100 {
+		return defaultJpegQuality
+	}
+	return cfg.JpegQuality
+
+}
+
+// converterCommand builds the command line from a converter template.
+func converterCommand(tmpl string, in string, out string) *exec.Cmd {
+
+	q := jpegQuality()
+	args := strings.Fields(tmpl)
+	if len(args) < 1 {
+		return exec.Command("") // Fails to run rather than running the photo itself
+	}
+	if !strings.Contains(tmpl, "{in}") && !strings.Contains(tmpl, "{out}") {
+		args = append(args, in, out)
+	}
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{in}", in)
+		args[i] = strings.ReplaceAll(args[i], "{out}", out)
+		args[i] = strings.ReplaceAll(args[i], "{quality}", strconv.Itoa(q))
+	}
+	return exec.Command(args[0], args[1:]...)
+
+}
+
+// converterName is the executable part of a template.
+func converterName(tmpl string) string {
+
+	args := strings.Fields(tmpl)
+	if len(args) < 1 {
+		return ""
+	}
+	return args[0]
+
+}
@@ -0,0 +1,78 @@
+package main
+
+/*
+ * A rider who gets a claim wrong can send it again prefixed by CORRECTION:-
+ *
+ *		CORRECTION 12 A4 10423 1715
+ *
+ * The new claim is stored as usual but linked, by ebclaims.CorrectsRowID, to
+ * the entrant's latest earlier claim for the same bonus, and both are
+ * flagged so that the scorer deals with them together.
+ *
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// stripKeyword removes a leading keyword, eg CORRECTION, from a subject.
+func stripKeyword(subject string, keyword string) (string, bool) {
+
+	re := regexp.MustCompile(`(?i)^\s*` + regexp.QuoteMeta(keyword) + `\b:?\s*(.*)$`)
+	x := re.FindStringSubmatch(subject)
+	if x == nil {
+		return subject, false
+	}
+	return x[1], true
+
+}
+
+// previousClaim finds the rowid of the entrant's latest claim for the bonus.
+func previousClaim(entrant int, bonus string) int64 {
+
+	var rowid int64
+	dbh.QueryRow("SELECT rowid FROM ebclaims WHERE EntrantID=? AND BonusID=? ORDER BY rowid DESC LIMIT 1", entrant, bonus).Scan(&rowid)
+	return rowid
+
+}
+
+// addStoredFlag adds a flag to a claim already in the database.
+func addStoredFlag(rowid int64, flag string) {
+
+	err := dbWriteTx(func(tx *sql.Tx) error { return flagStoredClaim(tx, rowid, flag) })
+	if err != nil && !*silent {
+		fmt.Printf("%s can't flag claim %v %v\n", logts(), rowid, err)
+	}
+
+}
+
+// flagStoredClaim adds a flag to a claim within tx.
+func flagStoredClaim(tx *sql.Tx, rowid int64, flag string) error {
+
+	var stored string
+	tx.QueryRow("SELECT IfNull(EbcFlags,'') FROM ebclaims WHERE rowid=?", rowid).Scan(&stored)
+	var flags claimFlags
+	for _, f := range strings.Split(stored, ",") {
+		if f != "" {
+			flags.add(f)
+		}
+	}
+	flags.add(flag)
+	_, err := tx.Exec("UPDATE ebclaims SET EbcFlags=? WHERE rowid=?", flags.String(), rowid)
+	return err
+
+}
+
+// linkCorrection ties a correction to the claim it corrects, within the
+// transaction storing the correction.
+func linkCorrection(tx *sql.Tx, rowid int64, corrects int64) error {
+
+	if _, err := tx.Exec("UPDATE ebclaims SET CorrectsRowID=? WHERE rowid=?", corrects, rowid); err != nil {
+		return err
+	}
+	return flagStoredClaim(tx, corrects, flagCorrected)
+
+}
@@ -0,0 +1,175 @@
+package main
+
+/*
+ * A small web dashboard for the scoring team, served on cfg.DashboardAddr.
+ *
+ * The claim photo browser lists recent claims and shows the photos stored
+ * for each, so photo quality can be spot-checked as claims arrive.
+ *
+ * /api/stats serves the claim counters as JSON, see stats.go, and the
+ * integration API lives under /api too, see api.go. /settings changes the
+ * switchable settings, see settingsedit.go. Who may use any of it is
+ * decided in webauth.go.
+ *
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const dashboardClaimsLimit = 200
+
+type dashClaim struct {
+	RowID     int
+	EntrantID int
+	BonusID   string
+	ClaimTime string
+	Subject   string
+	Flags     string
+	Photos    []dashPhoto
+}
+
+type dashPhoto struct {
+	PhotoID     int
+	Image       string
+	Camera      string
+	Width       int
+	Height      int
+	Unconverted bool
+	Taken       string
+	Location    string // lat,lon from EXIF GPS
+}
+
+var dashTemplates = template.Must(template.New("claims").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>body{font-family:sans-serif} td{padding:2px 8px;vertical-align:top} img{height:120px;margin:2px} .full img{height:auto;max-width:100%}</style>
+</head><body>
+<h1>{{.Title}}</h1>
+<p><a href="/settings">Settings</a></p>
+{{if .Claim}}{{with .Claim}}
+<p><a href="/">&larr; all claims</a></p>
+<table>
+<tr><td>Entrant</td><td>{{.EntrantID}}</td></tr>
+<tr><td>Bonus</td><td>{{.BonusID}}</td></tr>
+<tr><td>Claim time</td><td>{{.ClaimTime}}</td></tr>
+<tr><td>Subject</td><td>{{.Subject}}</td></tr>
+<tr><td>Flags</td><td>{{.Flags}}</td></tr>
+</table>
+<div class="full">{{range .Photos}}<p><a href="/img/{{.Image}}"><img src="/img/{{.Image}}" alt="{{.Image}}"></a><br>{{.Width}}x{{.Height}} {{.Camera}}{{if .Taken}} taken {{.Taken}}{{end}}{{if .Location}} at {{.Location}}{{end}}{{if .Unconverted}} (not converted yet){{end}}</p>{{else}}<p>No photos</p>{{end}}</div>
+{{end}}{{else}}
+<table>
+<tr><th>Entrant</th><th>Bonus</th><th>Claim time</th><th>Photos</th></tr>
+{{range $c := .Claims}}<tr><td>{{$c.EntrantID}}</td><td><a href="/claim?id={{$c.RowID}}">{{$c.BonusID}}</a></td><td>{{$c.ClaimTime}}</td>
+<td>{{range $c.Photos}}<a href="/claim?id={{$c.RowID}}"><img src="/img/{{.Image}}" alt="{{.Image}}"></a>{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+</body></html>
+`))
+
+// startDashboard runs the web dashboard in the background.
+func startDashboard(addr string) {
+
+	mux := http.NewServeMux()
+	imgdir := filepath.Join(cfg.Path2SM, cfg.ImageFolder)
+	mux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir(imgdir))))
+	mux.HandleFunc("/claim", dashClaimPage)
+	mux.HandleFunc("/settings", dashSettingsPage)
+	mux.HandleFunc("/api/stats", dashStatsAPI)
+	apiRoutes(mux)
+	mux.HandleFunc("/", dashClaimsPage)
+
+	addr = dashboardListenAddr(addr)
+	warnOpenDashboard(addr)
+	go func() {
+		err := http.ListenAndServe(addr, requireAuth(mux))
+		if err != nil {
+			fmt.Printf("%s: dashboard on %v failed %v\n", apptitle, addr, err)
+		}
+	}()
+	if !*silent {
+		fmt.Printf("%s: Dashboard available on %v\n", apptitle, addr)
+	}
+
+}
+
+// fetchClaimPhotos lists the photos stored for a claim.
+func fetchClaimPhotos(emailid int, entrant int, bonus string) []dashPhoto {
+
+	var res []dashPhoto
+	rows, err := dbh.Query("SELECT rowid,IfNull(image,''),IfNull(CameraModel,''),IfNull(Width,0),IfNull(Height,0),IfNull(Unconverted,0),IfNull(CaptureTime,''),Latitude,Longitude FROM ebcphotos WHERE EmailID=? AND EntrantID=? AND BonusID=? ORDER BY rowid", emailid, entrant, bonus)
+	if err != nil {
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p dashPhoto
+		var lat, lon sql.NullFloat64
+		rows.Scan(&p.PhotoID, &p.Image, &p.Camera, &p.Width, &p.Height, &p.Unconverted, &p.Taken, &lat, &lon)
+		if lat.Valid && lon.Valid {
+			p.Location = fmt.Sprintf("%.5f,%.5f", lat.Float64, lon.Float64)
+		}
+		// image is stored relative to the ScoreMaster folder, I serve the image folder itself
+		p.Image = strings.TrimPrefix(filepath.ToSlash(p.Image), filepath.ToSlash(cfg.ImageFolder)+"/")
+		res = append(res, p)
+	}
+	return res
+
+}
+
+// fetchDashClaims loads claims, most recent first, optionally just the one.
+func fetchDashClaims(rowid int) []dashClaim {
+
+	sqlx := "SELECT rowid,EntrantID,BonusID,IfNull(ClaimTime,''),IfNull(Subject,''),IfNull(EbcFlags,''),EmailID FROM ebclaims"
+	if rowid > 0 {
+		sqlx += " WHERE rowid=" + strconv.Itoa(rowid)
+	}
+	sqlx += " ORDER BY rowid DESC LIMIT " + strconv.Itoa(dashboardClaimsLimit)
+	rows, err := dbh.Query(sqlx)
+	if err != nil {
+		fmt.Printf("%s dashboard %v\n", logts(), err)
+		return nil
+	}
+	var res []dashClaim
+	var emailids []int
+	for rows.Next() {
+		var c dashClaim
+		var emailid int
+		rows.Scan(&c.RowID, &c.EntrantID, &c.BonusID, &c.ClaimTime, &c.Subject, &c.Flags, &emailid)
+		res = append(res, c)
+		emailids = append(emailids, emailid)
+	}
+	rows.Close()
+	for i := range res {
+		res[i].Photos = fetchClaimPhotos(emailids[i], res[i].EntrantID, res[i].BonusID)
+	}
+	return res
+
+}
+
+func dashClaimsPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	dashTemplates.Execute(w, map[string]interface{}{"Title": cfg.RallyTitle + " claims", "Claims": fetchDashClaims(0)})
+
+}
+
+func dashClaimPage(w http.ResponseWriter, r *http.Request) {
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	claims := fetchDashClaims(id)
+	if id < 1 || len(claims) < 1 {
+		http.NotFound(w, r)
+		return
+	}
+	dashTemplates.Execute(w, map[string]interface{}{"Title": cfg.RallyTitle + " claim", "Claim": claims[0]})
+
+}
@@ -0,0 +1,92 @@
+package main
+
+/*
+ * Bonuses marked bonuses.DaylightOnly must be claimed between sunrise and
+ * sunset. I work these out for the bonus's own Latitude and Longitude or,
+ * if it has none, for cfg.RallyLatitude and cfg.RallyLongitude, using the
+ * usual sunrise equation which is good to a minute or two. Claims made in
+ * darkness are flagged.
+ *
+ */
+
+import (
+	"math"
+	"time"
+)
+
+const julianUnixEpoch = 2440587.5 // Julian date of 1970-01-01 00:00 UTC
+const julian2000 = 2451545.0      // Julian date of 2000-01-01 12:00 UTC
+
+func julianDate(t time.Time) float64 {
+	return float64(t.Unix())/86400 + julianUnixEpoch
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(int64(math.Round((j-julianUnixEpoch)*86400)), 0)
+}
+
+// sunTimes returns sunrise and sunset on the given day at a place, west
+// longitudes negative. ok is false during polar day or night, when dark says which.
+func sunTimes(day time.Time, lat float64, lon float64) (rise time.Time, set time.Time, ok bool, dark bool) {
+
+	rad := math.Pi / 180
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	n := math.Ceil(julianDate(midnight) - julian2000 + 0.0008)
+	jstar := n - lon/360
+	m := math.Mod(357.5291+0.98560028*jstar, 360)
+	c := 1.9148*math.Sin(m*rad) + 0.02*math.Sin(2*m*rad) + 0.0003*math.Sin(3*m*rad)
+	lambda := math.Mod(m+c+180+102.9372, 360)
+	transit := julian2000 + jstar + 0.0053*math.Sin(m*rad) - 0.0069*math.Sin(2*lambda*rad)
+	sindec := math.Sin(lambda*rad) * math.Sin(23.4397*rad)
+	cosdec := math.Cos(math.Asin(sindec))
+	cosw := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*sindec) / (math.Cos(lat*rad) * cosdec)
+	if cosw > 1 {
+		return rise, set, false, true
+	}
+	if cosw < -1 {
+		return rise, set, false, false
+	}
+	w := math.Acos(cosw) / rad
+	return fromJulian(transit - w/360), fromJulian(transit + w/360), true, false
+
+}
+
+// bonusLocation returns where a daylight-only bonus is, or false if it isn't one.
+func bonusLocation(bonus string) (float64, float64, bool) {
+
+	if !hasColumn("bonuses", "DaylightOnly") {
+		return 0, 0, false
+	}
+	var daylight int
+	var lat, lon float64
+	sqlx := "SELECT IfNull(" + col("bonuses", "DaylightOnly") + ",0),IfNull(" + col("bonuses", "Latitude") + ",0),IfNull(" + col("bonuses", "Longitude") + ",0)"
+	sqlx += " FROM bonuses WHERE " + col("bonuses", "BonusID") + "=?"
+	if dbh.QueryRow(sqlx, bonus).Scan(&daylight, &lat, &lon) != nil || daylight == 0 {
+		return 0, 0, false
+	}
+	if lat == 0 && lon == 0 {
+		lat, lon = cfg.RallyLatitude, cfg.RallyLongitude
+	}
+	return lat, lon, lat != 0 || lon != 0
+
+}
+
+// validateDaylight flags daylight-only bonuses claimed in darkness.
+func validateDaylight(f4 fourFields, flags *claimFlags) {
+
+	if f4.ClaimTime.IsZero() {
+		return
+	}
+	lat, lon, ok := bonusLocation(f4.BonusID)
+	if !ok {
+		return
+	}
+	rise, set, ok, dark := sunTimes(f4.ClaimTime.In(cfg.LocalTZ), lat, lon)
+	if ok {
+		dark = f4.ClaimTime.Before(rise) || f4.ClaimTime.After(set)
+	}
+	if dark {
+		flags.add(flagDarkness)
+	}
+
+}
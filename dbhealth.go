@@ -0,0 +1,144 @@
+package main
+
+/*
+ * SQLite corruption mid-rally has happened before and wasn't noticed until
+ * final scoring, by which time the evidence was a day old. Every
+ * MaintenanceEvery, and whenever "ebcfetch maintain" is run, I check the
+ * database's integrity, refresh the query planner's statistics with ANALYZE
+ * and give free pages back with an incremental VACUUM, which only does
+ * anything if the database has auto_vacuum=INCREMENTAL. Each run is recorded
+ * in ebcmaintenance and a failure is reported to the AdminAddresses.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	maintenanceOK     = "ok"
+	maintenanceFailed = "FAILED"
+)
+
+// integrityProblems runs integrity_check and returns whatever it complains of.
+func integrityProblems() ([]string, error) {
+
+	rows, err := dbh.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		if s != "ok" {
+			res = append(res, s)
+		}
+	}
+	return res, rows.Err()
+
+}
+
+// maintainDatabase does the checks and tidying, returning a report and
+// whether all was well.
+func maintainDatabase() (string, bool) {
+
+	var report []string
+	ok := true
+	problems, err := integrityProblems()
+	switch {
+	case err != nil:
+		report, ok = append(report, fmt.Sprintf("integrity_check failed: %v", err)), false
+	case len(problems) > 0:
+		report, ok = append(report, "integrity_check: "+strings.Join(problems, "; ")), false
+	default:
+		report = append(report, "integrity_check: ok")
+	}
+	if _, err := dbExec("ANALYZE"); err != nil {
+		report, ok = append(report, fmt.Sprintf("ANALYZE failed: %v", err)), false
+	} else {
+		report = append(report, "ANALYZE: ok")
+	}
+
+	var mode, before, after int
+	dbh.QueryRow("PRAGMA auto_vacuum").Scan(&mode)
+	if mode != 2 {
+		report = append(report, "incremental vacuum: not enabled")
+	} else {
+		dbh.QueryRow("PRAGMA freelist_count").Scan(&before)
+		rows, err := dbh.Query("PRAGMA incremental_vacuum")
+		if err == nil {
+			for rows.Next() {
+			}
+			err = rows.Err()
+			rows.Close()
+		}
+		if err != nil {
+			report, ok = append(report, fmt.Sprintf("incremental vacuum failed: %v", err)), false
+		} else {
+			dbh.QueryRow("PRAGMA freelist_count").Scan(&after)
+			report = append(report, fmt.Sprintf("incremental vacuum: freed %v pages", before-after))
+		}
+	}
+	return strings.Join(report, "\n"), ok
+
+}
+
+// lastMaintenance returns when maintenance was last run.
+func lastMaintenance() time.Time {
+
+	var s string
+	dbh.QueryRow("SELECT IfNull(max(RunAt),'') FROM ebcmaintenance").Scan(&s)
+	t, _ := time.Parse(timefmt, s)
+	return t
+
+}
+
+// maintenanceDue reports whether it's time for the periodic maintenance.
+func maintenanceDue(now time.Time) bool {
+
+	return cfg.MaintenanceEvery > 0 && now.Sub(lastMaintenance()) >= cfg.MaintenanceEvery
+
+}
+
+// runMaintenance maintains the database, records the outcome and sounds the
+// alarm if anything's wrong.
+func runMaintenance() (string, bool) {
+
+	report, ok := maintainDatabase()
+	result := maintenanceOK
+	if !ok {
+		result = maintenanceFailed
+	}
+	dbExec("INSERT INTO ebcmaintenance (RunAt,Result,Details) VALUES(?,?,?)", storeTimeDB(time.Now()), result, report)
+	if ok {
+		if *verbose {
+			fmt.Printf("%s database maintenance %v\n", logts(), strings.ReplaceAll(report, "\n", ", "))
+		}
+		return report, true
+	}
+	fmt.Printf("%s DATABASE MAINTENANCE FAILED\n%v\n", logts(), report)
+	msg := fmt.Sprintf("Maintenance of %v found a problem:-\n\n%v\n\nScoring shouldn't continue on this database until it's been checked.", *path2db, report)
+	for _, a := range cfg.AdminAddresses {
+		sendPlainMail(a, apptitle+": database maintenance failed", msg)
+	}
+	return report, false
+
+}
+
+// runMaintain is the maintain subcommand.
+func runMaintain(args []string) int {
+
+	report, ok := runMaintenance()
+	if !ok {
+		return 1
+	}
+	if !*silent {
+		fmt.Println(report)
+	}
+	return 0
+
+}
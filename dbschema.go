@@ -0,0 +1,316 @@
+package main
+
+/*
+ * I look after the tables owned by EBCFetch itself rather than by ScoreMaster.
+ *
+ * ScoreMaster creates ebclaims and ebcphotos; anything else I need is created
+ * here, on startup, if it isn't already present. Nothing is ever dropped.
+ *
+ * Column names in ScoreMaster's own tables drift between versions so, where
+ * they differ from what I expect, cfg.Columns maps "table.Column" onto the
+ * name actually used, or an expression when reading, eg
+ *
+ *		Columns:
+ *		  entrants.RiderName: RiderFirst || ' ' || RiderLast
+ *		  bonuses.BriefDesc: Description
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of database
+const (
+	dbSM3     = "ScoreMaster 3"
+	dbChasm   = "Chasm"
+	dbUnknown = "unknown"
+)
+
+// tableExists reports whether the database has the named table.
+func tableExists(table string) bool {
+
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&n)
+	return n > 0
+
+}
+
+// detectDBType works out which flavour of ScoreMaster database this is.
+func detectDBType() string {
+
+	switch {
+	case tableExists("rallyparams"):
+		return dbSM3
+	case tableExists("config"):
+		return dbChasm
+	}
+	return dbUnknown
+
+}
+
+// ebcTables lists the DDL for my own tables. All must be safe to rerun.
+var ebcTables = []string{
+	`CREATE TABLE IF NOT EXISTS ebcaudit (
+		LoggedAt TEXT,
+		EmailID INTEGER,
+		FromAddr TEXT,
+		Subject TEXT,
+		Decision TEXT,
+		Reason TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS legs (
+		Leg INTEGER PRIMARY KEY,
+		StartTime TEXT,
+		FinishTime TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS entrantaliases (
+		Alias TEXT PRIMARY KEY COLLATE NOCASE,
+		EntrantID INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS entrant_emails (
+		EntrantID INTEGER,
+		Email TEXT COLLATE NOCASE,
+		PRIMARY KEY (EntrantID,Email)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcdownloads (
+		FetchedAt TEXT,
+		EmailID INTEGER,
+		URL TEXT,
+		Bytes INTEGER,
+		ContentType TEXT,
+		Result TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcsummaries (
+		EntrantID INTEGER PRIMARY KEY,
+		SentAt TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcjsonclaims (
+		LoggedAt TEXT,
+		EmailID INTEGER,
+		FromAddr TEXT,
+		JSON TEXT,
+		Result TEXT,
+		Latitude REAL,
+		Longitude REAL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcfuellog (
+		LoggedAt TEXT,
+		EmailID INTEGER,
+		EntrantID INTEGER,
+		OdoReading INTEGER,
+		ClaimTime TEXT,
+		ReceiptTime TEXT,
+		Receipt TEXT,
+		Subject TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcretries (
+		EmailID INTEGER,
+		UidValidity INTEGER,
+		SkippedAt TEXT,
+		PRIMARY KEY (EmailID,UidValidity)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcclockskew (
+		LoggedAt TEXT,
+		EmailID INTEGER,
+		EntrantID INTEGER,
+		SkewSeconds INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcautostop (
+		StoppedAt TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcboardentrants (
+		EntrantID INTEGER PRIMARY KEY,
+		Claims INTEGER,
+		Bonuses INTEGER,
+		LastClaim TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcboardbonuses (
+		BonusID TEXT PRIMARY KEY,
+		Claims INTEGER,
+		Entrants INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcboardhours (
+		Hour TEXT PRIMARY KEY,
+		Claims INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcmaintenance (
+		RunAt TEXT,
+		Result TEXT,
+		Details TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcoverrides (
+		Setting TEXT PRIMARY KEY,
+		Value TEXT,
+		ChangedBy TEXT,
+		ChangedAt TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcsettingslog (
+		ChangedAt TEXT,
+		ChangedBy TEXT,
+		Setting TEXT,
+		OldValue TEXT,
+		NewValue TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcoauth (
+		Login TEXT PRIMARY KEY,
+		AccessToken TEXT,
+		RefreshToken TEXT,
+		Expiry TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcduplicates (
+		LoggedAt TEXT,
+		EmailID INTEGER,
+		Source TEXT,
+		FromAddr TEXT,
+		ClaimID INTEGER,
+		MatchedBy TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcinstance (
+		PID INTEGER,
+		Host TEXT,
+		Started TEXT,
+		Heartbeat TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcattachments (
+		EntrantID INTEGER,
+		BonusID TEXT,
+		EmailID INTEGER,
+		Kind TEXT,
+		ContentType TEXT,
+		Filename TEXT,
+		Bytes INTEGER,
+		Received TEXT,
+		Path TEXT DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcremotemail (
+		UID INTEGER PRIMARY KEY AUTOINCREMENT,
+		Source TEXT,
+		RemoteID TEXT,
+		State INTEGER DEFAULT -1,
+		FirstSeen TEXT,
+		UNIQUE (Source,RemoteID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ebcpaging (
+		UidValidity INTEGER,
+		LastUid INTEGER
+	)`,
+}
+
+// ebcColumns lists the columns I add to ScoreMaster's own tables.
+var ebcColumns = [][3]string{
+	{"ebclaims", "EbcFlags", "TEXT DEFAULT ''"},
+	{"ebclaims", "PhotoIDs", "TEXT DEFAULT ''"},
+	{"ebclaims", "CorrectsRowID", "INTEGER DEFAULT 0"},
+	{"ebclaims", "RiderCancelled", "INTEGER DEFAULT 0"},
+	{"ebclaims", "QRCode", "TEXT DEFAULT ''"},
+	{"ebclaims", "Fingerprint", "TEXT DEFAULT ''"},
+	{"ebclaims", "MessageID", "TEXT DEFAULT ''"},
+	{"ebclaims", "InReplyTo", "TEXT DEFAULT ''"},
+	{"ebclaims", "MsgReferences", "TEXT DEFAULT ''"},
+	{"ebclaims", "ResendOf", "INTEGER DEFAULT 0"},
+	{"ebclaims", "PinLatitude", "REAL"},
+	{"ebclaims", "PinLongitude", "REAL"},
+	{"entrants", "PillionOf", "INTEGER DEFAULT 0"},
+	{"bonuses", "ExpectedAnswer", "TEXT DEFAULT ''"},
+	{"bonuses", "QRCode", "TEXT DEFAULT ''"},
+	{"bonuses", "PhotoRequired", "INTEGER DEFAULT 1"},
+	{"bonuses", "OdoRequired", "INTEGER DEFAULT 1"},
+	{"bonuses", "AnswerRequired", "INTEGER DEFAULT 0"},
+	{"bonuses", "RestMinutes", "INTEGER DEFAULT 0"},
+	{"bonuses", "AvailableFrom", "TEXT DEFAULT ''"},
+	{"bonuses", "AvailableUntil", "TEXT DEFAULT ''"},
+	{"bonuses", "OpensAt", "TEXT DEFAULT ''"},
+	{"bonuses", "ClosesAt", "TEXT DEFAULT ''"},
+	{"bonuses", "DaylightOnly", "INTEGER DEFAULT 0"},
+	{"bonuses", "Latitude", "REAL"},
+	{"bonuses", "Longitude", "REAL"},
+	{"ebcphotos", "Width", "INTEGER DEFAULT 0"},
+	{"ebcphotos", "Height", "INTEGER DEFAULT 0"},
+	{"ebcphotos", "CameraModel", "TEXT DEFAULT ''"},
+	{"ebcphotos", "CaptureTime", "TEXT DEFAULT ''"},
+	{"ebcphotos", "SourceURL", "TEXT DEFAULT ''"},
+	{"ebcphotos", "Unconverted", "INTEGER DEFAULT 0"},
+	{"ebcretries", "Source", "TEXT DEFAULT ''"},
+	{"ebcpaging", "Source", "TEXT DEFAULT ''"},
+	{"ebclaims", "Source", "TEXT"},
+	{"ebcphotos", "Latitude", "REAL"},
+	{"ebcphotos", "Longitude", "REAL"},
+	{"ebclaims", "OdoValue", "REAL"},
+	{"ebclaims", "OdoText", "TEXT DEFAULT ''"},
+	{"ebclaims", "AuthOk", "INTEGER"},
+	{"ebcphotos", "Original", "TEXT DEFAULT ''"},
+	{"ebcaudit", "Source", "TEXT DEFAULT ''"},
+	{"ebclaims", "SanityFlags", "TEXT DEFAULT ''"},
+}
+
+// ensureEbcTables creates any of my tables that don't yet exist.
+func ensureEbcTables() {
+
+	for _, sqlx := range ebcTables {
+		_, err := dbh.Exec(sqlx)
+		if err != nil {
+			fmt.Printf("%s: can't create table [%v] %v\n", apptitle, strings.Fields(sqlx)[5], err)
+		}
+	}
+	for _, col := range ebcColumns {
+		addColumnIfMissing(col[0], col[1], col[2])
+	}
+
+}
+
+// col returns the name, or expression, to use for one of ScoreMaster's columns.
+func col(table string, column string) string {
+
+	if x, ok := cfg.Columns[table+"."+column]; ok && x != "" {
+		return x
+	}
+	if table == "entrants" && column == "RiderName" && !columnExists(table, column) && columnExists(table, "RiderFirst") {
+		return "RiderFirst || ' ' || IfNull(RiderLast,'')"
+	}
+	return column
+
+}
+
+// hasColumn reports whether an optional column is available, mapped or not.
+func hasColumn(table string, column string) bool {
+
+	if x, ok := cfg.Columns[table+"."+column]; ok && x != "" {
+		return true
+	}
+	return columnExists(table, column)
+
+}
+
+// columnExists reports whether the named table already has the named column.
+func columnExists(table string, column string) bool {
+
+	rows, err := dbh.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		if strings.EqualFold(name, column) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// addColumnIfMissing extends a ScoreMaster table with a column of my own.
+func addColumnIfMissing(table string, column string, decl string) {
+
+	if columnExists(table, column) {
+		return
+	}
+	_, err := dbh.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	if err != nil {
+		fmt.Printf("%s: can't add %v.%v %v\n", apptitle, table, column, err)
+	}
+
+}
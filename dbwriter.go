@@ -0,0 +1,170 @@
+package main
+
+/*
+ * ScoreMaster's web app shares the database and, on a busy scoring night,
+ * often holds the write lock just when I want to store a claim. Rather than
+ * each write failing and the email being skipped until next cycle, all my
+ * writes go through dbExec or dbWriteTx to a single writer goroutine. It
+ * takes whatever writes are waiting, up to dbBatchMax, and applies them in
+ * one transaction, each within its own savepoint so that one bad statement
+ * doesn't spoil the rest. If the database is busy or locked the whole batch
+ * is retried, backing off, for up to cfg.WriteRetryFor before the callers
+ * are given the error and the skip/retry machinery takes over.
+ *
+ * Callers wait for their own write to be done so reads which follow see it.
+ *
+ * A claim is written with its photos, fingerprint, thread and the like in a
+ * single dbWriteTx. The photo files are written beforehand under temporary
+ * names and only renamed once that's committed, or removed if it fails, so
+ * that the email is processed afresh when retried.
+ *
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	dbBatchMax           = 50
+	defaultWriteRetryFor = 30 * time.Second
+	dbWriterFirstBackoff = 50 * time.Millisecond
+	dbWriterMaxBackoff   = 2 * time.Second
+)
+
+// dbJob is one write waiting for the writer.
+type dbJob struct {
+	sqlx string
+	args []interface{}
+	fn   func(*sql.Tx) error // Instead of sqlx, several statements together
+	res  sql.Result
+	err  error
+	done chan struct{}
+}
+
+var dbJobs = make(chan *dbJob, dbBatchMax)
+var dbWriterStarted sync.Once
+
+// dbRetries counts the batches which had to wait for the database.
+var dbRetries int64
+
+// queueWrite hands a job to the writer and waits for it to be done.
+func queueWrite(j *dbJob) {
+
+	dbWriterStarted.Do(func() { go dbWriter() })
+	j.done = make(chan struct{})
+	dbJobs <- j
+	<-j.done
+
+}
+
+// dbExec is dbh.Exec by way of the writer.
+func dbExec(sqlx string, args ...interface{}) (sql.Result, error) {
+
+	j := &dbJob{sqlx: sqlx, args: args}
+	queueWrite(j)
+	return j.res, j.err
+
+}
+
+// dbWriteTx runs fn by way of the writer, all or nothing. fn mustn't read
+// using dbh, only tx, and may be run more than once.
+func dbWriteTx(fn func(*sql.Tx) error) error {
+
+	j := &dbJob{fn: fn}
+	queueWrite(j)
+	return j.err
+
+}
+
+// dbWriter applies the writes as they arrive.
+func dbWriter() {
+
+	for j := range dbJobs {
+		batch := []*dbJob{j}
+	gather:
+		for len(batch) < dbBatchMax {
+			select {
+			case j := <-dbJobs:
+				batch = append(batch, j)
+			default:
+				break gather
+			}
+		}
+		runBatch(batch)
+		for _, j := range batch {
+			close(j.done)
+		}
+	}
+
+}
+
+// runBatch applies a batch of writes, retrying while the database is busy.
+func runBatch(batch []*dbJob) {
+
+	retryFor := cfg.WriteRetryFor
+	if retryFor <= 0 {
+		retryFor = defaultWriteRetryFor
+	}
+	deadline := time.Now().Add(retryFor)
+	backoff := dbWriterFirstBackoff
+	for {
+		err := tryBatch(batch)
+		if err == nil {
+			return
+		}
+		if !isTransient(err) || time.Now().After(deadline) {
+			for _, j := range batch {
+				if j.err == nil {
+					j.err, j.res = err, nil
+				}
+			}
+			logAt(levelError, "can't write to database %v", err)
+			noteDBFailure(err)
+			return
+		}
+		dbRetries++
+		if debugging(debugDB) {
+			fmt.Printf("%s database busy, retrying %v writes in %v\n", logts(), len(batch), backoff)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > dbWriterMaxBackoff {
+			backoff = dbWriterMaxBackoff
+		}
+	}
+
+}
+
+// tryBatch applies a batch of writes in one transaction, returning an error
+// only if the transaction as a whole failed.
+func tryBatch(batch []*dbJob) error {
+
+	tx, err := dbh.Begin()
+	if err != nil {
+		return err
+	}
+	for _, j := range batch {
+		j.res, j.err = nil, nil
+		if _, err := tx.Exec("SAVEPOINT ebcjob"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if j.fn != nil {
+			j.err = j.fn(tx)
+		} else {
+			j.res, j.err = tx.Exec(j.sqlx, j.args...)
+		}
+		if isTransient(j.err) {
+			tx.Rollback()
+			return j.err
+		}
+		if j.err != nil {
+			tx.Exec("ROLLBACK TO ebcjob")
+		}
+		tx.Exec("RELEASE ebcjob")
+	}
+	return tx.Commit()
+
+}
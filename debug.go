@@ -0,0 +1,87 @@
+package main
+
+/*
+ * Logging detail is controlled by -v, which may be repeated. A single -v
+ * gives progress messages, -v -v (or -v=2) adds everything. In between,
+ * debug output can be limited to particular areas, listed in cfg.Debug or
+ * given with -debug, so a mailbox problem can be traced without drowning in
+ * photo logs.
+ *
+ */
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+)
+
+// Debug areas
+const (
+	debugIMAP   = "imap"
+	debugParse  = "parse"
+	debugPhotos = "photos"
+	debugDB     = "db"
+	debugSMTP   = "smtp"
+)
+
+// verbosityFlag counts the number of times -v is given.
+type verbosityFlag int
+
+func (v *verbosityFlag) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosityFlag) IsBoolFlag() bool { return true }
+
+func (v *verbosityFlag) Set(s string) error {
+
+	switch s {
+	case "true":
+		*v++
+	case "false":
+		*v = 0
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*v = verbosityFlag(n)
+	}
+	return nil
+
+}
+
+func newVerbosityFlag(name string, usage string) *verbosityFlag {
+
+	v := new(verbosityFlag)
+	flag.Var(v, name, usage)
+	return v
+
+}
+
+var verbosity = newVerbosityFlag("v", "Verbose, repeat for more detail")
+var verbose = new(bool) // Any level of verbosity, set after parsing flags
+var debugareas = flag.String("debug", "", "Debug areas: imap,parse,photos,db,smtp or all (overrides config)")
+
+// debugging reports whether detailed output for the area is wanted.
+func debugging(area string) bool {
+
+	if *verbosity >= 2 {
+		return true
+	}
+	areas := cfg.Debug
+	if *debugareas != "" {
+		areas = strings.Split(*debugareas, ",")
+	}
+	for _, a := range areas {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == area || a == "all" {
+			return true
+		}
+	}
+	return area == debugParse && cfg.DebugVerbose
+
+}
@@ -0,0 +1,56 @@
+package main
+
+/*
+ * Every year someone's phone is still set to the timezone of their last
+ * holiday and their claims are all an hour or three out. The Date header
+ * carries the sender's UTC offset so, in test mode, I compare it with the
+ * rally's own offset at that moment and tell the rider if they differ,
+ * before the rally starts rather than at final scoring.
+ *
+ * Some webmail services always send UTC whatever the user's timezone so an
+ * offset of zero gets a gentler warning.
+ *
+ */
+
+import (
+	"fmt"
+	"time"
+)
+
+// utcOffset describes an offset from UTC, eg UTC+1, UTC-3:30.
+func utcOffset(secs int) string {
+
+	if secs == 0 {
+		return "UTC"
+	}
+	sign := "+"
+	if secs < 0 {
+		sign, secs = "-", -secs
+	}
+	h, m := secs/3600, secs%3600/60
+	if m == 0 {
+		return fmt.Sprintf("UTC%v%v", sign, h)
+	}
+	return fmt.Sprintf("UTC%v%v:%02d", sign, h, m)
+
+}
+
+// deviceZoneAdvice compares the timezone of an email's Date with the
+// rally's, returning a warning for the rider if they differ.
+func deviceZoneAdvice(sent time.Time) string {
+
+	if sent.IsZero() || cfg.LocalTZ == nil {
+		return ""
+	}
+	_, theirs := sent.Zone()
+	_, ours := sent.In(cfg.LocalTZ).Zone()
+	if theirs == ours {
+		return ""
+	}
+	advice := fmt.Sprintf("Your phone appears to be set to %v, the rally runs on %v. Please check its timezone, or claim times may be misread.", utcOffset(theirs), utcOffset(ours))
+	if theirs == 0 {
+		advice += " If you sent this using webmail, which always says UTC, you can ignore this."
+	}
+	return advice
+
+}
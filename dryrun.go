@@ -0,0 +1,139 @@
+package main
+
+/*
+ * Before a rally the whole process can be tried out without going near
+ * the live mailbox:-
+ *
+ *		ebcfetch -db sm/ScoreMaster.db dryrun -from testclaims -responses responses
+ *
+ * takes the emails from a folder of .eml files or a Maildir, as if they'd
+ * just been fetched, and puts them through everything a real cycle would
+ * in test mode. Nothing is sent. Test responses and any other emails I'd
+ * have sent are written to the -responses folder as .eml files instead so
+ * they can be checked, and the log is as it would be for real.
+ *
+ * With -scratch the database is copied into that folder first, photos go
+ * there too, and -live stores the claims in the copy as a real rally would
+ * rather than running in test mode.
+ *
+ */
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// mailFolder, if set, is where emails are written instead of being sent.
+var mailFolder string
+
+var mailFiled struct {
+	sync.Mutex
+	n int
+}
+
+var unsafeFilenameRE = regexp.MustCompile(`[^A-Za-z0-9.@_-]+`)
+
+// fileMail writes an email to mailFolder rather than sending it.
+func fileMail(to string, subject string, contentType string, body string) error {
+
+	mailFiled.Lock()
+	mailFiled.n++
+	n := mailFiled.n
+	mailFiled.Unlock()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", cfg.ImapLogin, to, subject)
+	fmt.Fprintf(&sb, "Date: %s\r\nMIME-Version: 1.0\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "Content-Type: %s; charset=utf-8\r\n\r\n%s\r\n", contentType, body)
+	fn := filepath.Join(mailFolder, fmt.Sprintf("%04d-%s.eml", n, unsafeFilenameRE.ReplaceAllString(to, "_")))
+	err := os.WriteFile(fn, []byte(sb.String()), 0644)
+	if err != nil {
+		fmt.Printf("%v can't write email to %v because %v\n", logts(), to, err)
+	} else if !*silent {
+		fmt.Printf("%v email to %v written to %v\n", logts(), to, fn)
+	}
+	return err
+
+}
+
+// isMaildir reports whether a folder is a Maildir rather than holding .eml files.
+func isMaildir(folder string) bool {
+
+	for _, sub := range []string{"cur", "new"} {
+		if fi, err := os.Stat(filepath.Join(folder, sub)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+
+}
+
+// reportReplay lists what became of each email replayed.
+func reportReplay(emails []rehearsalEmail, claimed, dealtwith, ignored, skipped *imap.SeqSet) {
+
+	for i, re := range emails {
+		outcome, uid := "failed", uint32(i+1)
+		switch {
+		case claimed.Contains(uid):
+			outcome = "stored"
+		case dealtwith.Contains(uid):
+			outcome = "rejected"
+		case ignored.Contains(uid):
+			outcome = "ignored"
+		}
+		fmt.Printf("%s: %v %v\n", apptitle, re.Name, outcome)
+	}
+	fmt.Printf("%s: stored %v, rejected %v, ignored %v, failed %v\n", apptitle, seqSetLen(claimed), seqSetLen(dealtwith), seqSetLen(ignored), seqSetLen(skipped))
+
+}
+
+func runDryRun(args []string) int {
+
+	fs := flag.NewFlagSet("dryrun", flag.ContinueOnError)
+	from := fs.String("from", "", "Folder of .eml files, or a Maildir, to process")
+	responses := fs.String("responses", "responses", "Folder for the emails I'd have sent")
+	scratch := fs.String("scratch", "", "Folder for a copy of the database and its photos")
+	live := fs.Bool("live", false, "Store claims in the copy as a real rally would, needs -scratch")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	if *from == "" || (*live && *scratch == "") {
+		fmt.Printf("%s: dryrun needs -from, and -scratch if -live\n", apptitle)
+		return 1
+	}
+	emails, err := loadRehearsal(*from)
+	if err != nil || len(emails) == 0 {
+		fmt.Printf("%s: no emails to process in %v %v\n", apptitle, *from, err)
+		return 1
+	}
+	if err = os.MkdirAll(*responses, 0755); err != nil {
+		fmt.Printf("%s: dryrun %v\n", apptitle, err)
+		return 1
+	}
+	if *scratch != "" {
+		if err = os.MkdirAll(*scratch, 0755); err == nil {
+			err = useSandbox(*scratch)
+		}
+		if err != nil {
+			fmt.Printf("%s: dryrun can't copy database %v\n", apptitle, err)
+			return 1
+		}
+	}
+	cfg.TestMode = !*live
+	cfg.TrapMails, cfg.Hooks = false, nil
+	mailFolder = *responses
+
+	fmt.Printf("%s: processing %v email(s) from %v\n", apptitle, len(emails), *from)
+	claimed, dealtwith, ignored, skipped := replayEmails(emails, make([]time.Duration, len(emails)))
+	reportReplay(emails, claimed, dealtwith, ignored, skipped)
+	return 0
+
+}
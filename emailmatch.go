@@ -0,0 +1,195 @@
+package main
+
+/*
+ * Deciding whether a claim came from one of the entrant's addresses. Each
+ * address in entrant_emails is compared with the sender's by the rules in
+ * EmailMatching, in the order given, the first rule to match any address
+ * deciding it:-
+ *
+ *		exact		the same address, ignoring case
+ *		alias		the same mailbox, ignoring +tags, and dots for Gmail
+ *		domain		any address at a domain registered as "@domain"
+ *		account		the same account at any domain, my original fallback
+ *
+ * Without EmailMatching all four are used in that order. The account rule
+ * only applies once a claim has said which entrant it's for, I don't use it
+ * to recognise strangers. Test responses say which address matched, and how.
+ *
+ */
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Email matching rules
+const (
+	matchExact   = "exact"
+	matchAlias   = "alias"
+	matchDomain  = "domain"
+	matchAccount = "account"
+)
+
+var defaultEmailMatching = []string{matchExact, matchAlias, matchDomain, matchAccount}
+
+// emailMatching returns the rules in use, in order of precedence.
+func emailMatching() []string {
+
+	if len(cfg.EmailMatching) > 0 {
+		return cfg.EmailMatching
+	}
+	return defaultEmailMatching
+
+}
+
+// checkEmailMatching reports unknown rules in EmailMatching, at startup.
+func checkEmailMatching() {
+
+	for _, rule := range cfg.EmailMatching {
+		if !containsFold(defaultEmailMatching, rule) {
+			fmt.Printf("%s: EmailMatching rule %q unknown, use %v\n", apptitle, rule, strings.Join(defaultEmailMatching, ", "))
+		}
+	}
+
+}
+
+// splitAddress returns the account and domain parts of an address, lowercased.
+func splitAddress(addr string) (string, string) {
+
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		return addr[:at], addr[at+1:]
+	}
+	return addr, ""
+
+}
+
+// canonicalAddress is an address with any +tag removed and, for Gmail,
+// its dots too.
+func canonicalAddress(addr string) string {
+
+	account, domain := splitAddress(addr)
+	if plus := strings.Index(account, "+"); plus > 0 {
+		account = account[:plus]
+	}
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	if domain == "gmail.com" {
+		account = strings.ReplaceAll(account, ".", "")
+	}
+	return account + "@" + domain
+
+}
+
+// emailRuleMatches reports whether a sender's address matches one registered, by rule.
+func emailRuleMatches(rule string, from string, registered string) bool {
+
+	if from == "" || registered == "" {
+		return false
+	}
+	switch strings.ToLower(rule) {
+	case matchExact:
+		return strings.EqualFold(from, registered)
+	case matchAlias:
+		return !strings.HasPrefix(registered, "@") && canonicalAddress(from) == canonicalAddress(registered)
+	case matchDomain:
+		_, domain := splitAddress(from)
+		return strings.HasPrefix(registered, "@") && domain != "" && strings.EqualFold(domain, registered[1:])
+	case matchAccount:
+		a1, _ := splitAddress(from)
+		a2, _ := splitAddress(registered)
+		return a1 != "" && a1 == a2
+	}
+	return false
+
+}
+
+// matchEmail compares a sender's address with those registered, returning
+// the one matched and the rule which matched it, "" if none did.
+func matchEmail(from string, registered []string, rules []string) (string, string) {
+
+	for _, rule := range rules {
+		for _, em := range registered {
+			if *verbose {
+				fmt.Printf("%v comparing %v with %v [%v]\n", logts(), from, em, rule)
+			}
+			if emailRuleMatches(rule, from, em) {
+				return em, strings.ToLower(rule)
+			}
+		}
+	}
+	return "", ""
+
+}
+
+// strangerRules are the rules used to recognise a sender before knowing
+// which entrant the email is for.
+func strangerRules() []string {
+
+	var res []string
+	for _, rule := range emailMatching() {
+		if !strings.EqualFold(rule, matchAccount) {
+			res = append(res, rule)
+		}
+	}
+	return res
+
+}
+
+// entrantsMatching returns the entrants with an address matching from, for
+// when entrantsByEmail finds none registered exactly.
+func entrantsMatching(from string) []int {
+
+	rows, err := dbh.Query("SELECT EntrantID,Email FROM entrant_emails ORDER BY EntrantID")
+	if err != nil {
+		fmt.Printf("%v entrants by email %v\n", logts(), err)
+		return nil
+	}
+	byEntrant := make(map[int][]string)
+	var ids []int
+	for rows.Next() {
+		var id int
+		var em string
+		rows.Scan(&id, &em)
+		if _, ok := byEntrant[id]; !ok {
+			ids = append(ids, id)
+		}
+		byEntrant[id] = append(byEntrant[id], em)
+	}
+	rows.Close()
+	var res []int
+	for _, rule := range strangerRules() {
+		for _, id := range ids {
+			if m, _ := matchEmail(from, byEntrant[id], []string{rule}); m != "" {
+				res = append(res, id)
+			}
+		}
+		if len(res) > 0 {
+			break
+		}
+	}
+	return res
+
+}
+
+// describeEmailMatch says which address matched, for test responses.
+func describeEmailMatch(matched string, rule string) string {
+
+	if matched == "" {
+		return ""
+	}
+	return matched + " (" + rule + ")"
+
+}
+
+// senderAddress is the bare address an email was sent from.
+func senderAddress(from string) string {
+
+	if v, err := mail.ParseAddress(from); err == nil {
+		return v.Address
+	}
+	return strings.TrimSpace(from)
+
+}
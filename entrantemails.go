@@ -0,0 +1,118 @@
+package main
+
+/*
+ * Riders often send claims from more than one address: their own, their
+ * SPOT/inReach tracker, a spouse's phone. Rather than rely on a comma
+ * separated entrants.Email, addresses are held one per row in
+ * entrant_emails. Whatever is in entrants.Email is copied in on startup and
+ * whenever the rally data is reloaded; extra addresses can be added directly
+ * and are never removed by me.
+ *
+ */
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// splitEmails breaks up an entrants.Email value into its addresses.
+func splitEmails(s string) []string {
+
+	var res []string
+	if e, err := mail.ParseAddressList(s); err == nil {
+		for _, a := range e {
+			res = append(res, a.Address)
+		}
+		return res
+	}
+	// Not RFC 5322, organisers sometimes use semicolons or spaces
+	for _, a := range strings.FieldsFunc(s, func(c rune) bool { return c == ',' || c == ';' || c == ' ' }) {
+		if v, err := mail.ParseAddress(a); err == nil {
+			res = append(res, v.Address)
+		}
+	}
+	return res
+
+}
+
+// syncEntrantEmails copies any new addresses from entrants.Email into entrant_emails.
+func syncEntrantEmails() {
+
+	rows, err := dbh.Query("SELECT " + col("entrants", "EntrantID") + ",IfNull(" + col("entrants", "Email") + ",'') FROM entrants")
+	if err != nil {
+		fmt.Printf("%s: can't load entrant emails %v\n", apptitle, err)
+		return
+	}
+	emails := make(map[int][]string)
+	for rows.Next() {
+		var id int
+		var em string
+		rows.Scan(&id, &em)
+		emails[id] = splitEmails(em)
+	}
+	rows.Close()
+	for id, ee := range emails {
+		for _, em := range ee {
+			_, err = dbExec("INSERT OR IGNORE INTO entrant_emails (EntrantID,Email) VALUES(?,?)", id, em)
+			if err != nil {
+				fmt.Printf("%s: can't store email %v for entrant %v %v\n", apptitle, em, id, err)
+			}
+		}
+	}
+
+}
+
+// entrantEmails returns the addresses registered to any of the entrants, or all addresses if none given.
+func entrantEmails(entrants []int) []string {
+
+	sqlx := "SELECT Email FROM entrant_emails"
+	if len(entrants) > 0 {
+		var ids []string
+		for _, id := range entrants {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		sqlx += " WHERE EntrantID IN (" + strings.Join(ids, ",") + ")"
+	}
+	rows, err := dbh.Query(sqlx)
+	if err != nil {
+		fmt.Printf("%v entrant emails %v\n", logts(), err)
+		return nil
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var em string
+		rows.Scan(&em)
+		res = append(res, em)
+	}
+	return res
+
+}
+
+// entrantsByEmail returns the entrants an address is registered to.
+func entrantsByEmail(from string) []int {
+
+	var res []int
+	addr := from
+	if a, err := mail.ParseAddress(from); err == nil {
+		addr = a.Address
+	}
+	rows, err := dbh.Query("SELECT DISTINCT EntrantID FROM entrant_emails WHERE Email=? COLLATE NOCASE ORDER BY EntrantID", addr)
+	if err != nil {
+		fmt.Printf("%v entrants by email %v\n", logts(), err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		res = append(res, id)
+	}
+	if len(res) == 0 {
+		return entrantsMatching(addr)
+	}
+	return res
+
+}
@@ -0,0 +1,73 @@
+package main
+
+/*
+ * Some riders will insist on identifying themselves by name rather than by
+ * rider number. Where the entrant field contains no digits at all, I try to
+ * match it against the names of the entrants, accepting it only if exactly
+ * one entrant matches. Such claims are flagged for review.
+ *
+ * The organisers can also record aliases in the entrantaliases table. An alias
+ * is any text the rider habitually uses in place of their rider number, a
+ * nickname, a shortened name or last year's number, and maps directly onto
+ * an EntrantID without being flagged.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// entrantAlias looks up an alias recorded by the organisers.
+func entrantAlias(alias string) (int, bool) {
+
+	alias = strings.TrimSpace(alias)
+	if alias == "" {
+		return 0, false
+	}
+	var id int
+	err := dbh.QueryRow("SELECT EntrantID FROM entrantaliases WHERE Alias=?", alias).Scan(&id)
+	return id, err == nil
+
+}
+
+// entrantByName returns the EntrantID of the only entrant matching name,
+// either the full RiderName or just one part of it.
+func entrantByName(name string) (int, bool) {
+
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return 0, false
+	}
+	rows, err := dbh.Query("SELECT " + col("entrants", "EntrantID") + ",IfNull(" + col("entrants", "RiderName") + ",'') FROM entrants")
+	if err != nil {
+		fmt.Printf("%v entrantByName %v\n", logts(), err)
+		return 0, false
+	}
+	defer rows.Close()
+	var full, partial []int
+	for rows.Next() {
+		var id int
+		var rn string
+		rows.Scan(&id, &rn)
+		rn = strings.ToLower(rn)
+		if strings.Join(strings.Fields(rn), "") == strings.Join(strings.Fields(name), "") {
+			full = append(full, id)
+			continue
+		}
+		for _, p := range strings.Fields(rn) {
+			if p == name {
+				partial = append(partial, id)
+				break
+			}
+		}
+	}
+	if len(full) == 1 {
+		return full[0], true
+	}
+	if len(full) == 0 && len(partial) == 1 {
+		return partial[0], true
+	}
+	return 0, false
+
+}
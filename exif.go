@@ -0,0 +1,268 @@
+package main
+
+/*
+ * A minimal EXIF reader, just enough to tell the scorers what took a photo,
+ * when and where. I look inside JPGs and HEICs; anything else returns
+ * nothing.
+ *
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+const (
+	exifTagMake             = 0x010F
+	exifTagModel            = 0x0110
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagGPSLatitudeRef   = 0x0001
+	exifTagGPSLatitude      = 0x0002
+	exifTagGPSLongitudeRef  = 0x0003
+	exifTagGPSLongitude     = 0x0004
+	exifTagDateTimeOriginal = 0x9003
+	exifTagPixelXDimension  = 0xA002
+	exifTagPixelYDimension  = 0xA003
+)
+
+const exifTimeFormat = "2006:01:02 15:04:05"
+
+// exifInfo is the summary of EXIF data I care about.
+type exifInfo struct {
+	Make        string
+	Model       string
+	CaptureTime time.Time
+	Width       int
+	Height      int
+	HasGPS      bool
+	Latitude    float64 // Decimal degrees, south and west negative
+	Longitude   float64
+}
+
+// tiffReader reads IFDs from the TIFF structure embedded in EXIF data.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	Tag    uint16
+	Type   uint16
+	Count  uint32
+	Offset uint32 // Value itself if it fits in four bytes
+	raw    []byte // The four value/offset bytes
+}
+
+// exifSegment finds the TIFF data within a JPG's APP1 segment.
+func exifSegment(pic []byte) []byte {
+
+	if !bytes.HasPrefix(pic, []byte{0xFF, 0xD8}) {
+		return nil
+	}
+	i := 2
+	for i+4 <= len(pic) {
+		if pic[i] != 0xFF {
+			return nil
+		}
+		marker := pic[i+1]
+		if marker == 0xDA || marker == 0xD9 { // Start of scan, end of image
+			return nil
+		}
+		seglen := int(binary.BigEndian.Uint16(pic[i+2 : i+4]))
+		if seglen < 2 || i+2+seglen > len(pic) {
+			return nil
+		}
+		seg := pic[i+4 : i+2+seglen]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:]
+		}
+		i += 2 + seglen
+	}
+	return nil
+
+}
+
+// heifExif finds the TIFF data within a HEIC's Exif item. Rather than walk
+// the HEIF boxes I look for the Exif header which precedes it.
+func heifExif(pic []byte) []byte {
+
+	if len(pic) < 12 || string(pic[4:8]) != "ftyp" {
+		return nil
+	}
+	hdr := []byte("Exif\x00\x00")
+	for i := 0; i < len(pic); {
+		n := bytes.Index(pic[i:], hdr)
+		if n < 0 {
+			return nil
+		}
+		i += n + len(hdr)
+		if newTiffReader(pic[i:]) != nil {
+			return pic[i:]
+		}
+	}
+	return nil
+
+}
+
+func newTiffReader(data []byte) *tiffReader {
+
+	if len(data) < 8 {
+		return nil
+	}
+	tr := &tiffReader{data: data}
+	switch string(data[0:2]) {
+	case "II":
+		tr.order = binary.LittleEndian
+	case "MM":
+		tr.order = binary.BigEndian
+	default:
+		return nil
+	}
+	if tr.order.Uint16(data[2:4]) != 42 {
+		return nil
+	}
+	return tr
+
+}
+
+func (tr *tiffReader) firstIFD() uint32 {
+	return tr.order.Uint32(tr.data[4:8])
+}
+
+// readIFD returns the entries of the IFD at the given offset.
+func (tr *tiffReader) readIFD(off uint32) map[uint16]ifdEntry {
+
+	res := make(map[uint16]ifdEntry)
+	if int(off)+2 > len(tr.data) {
+		return res
+	}
+	n := int(tr.order.Uint16(tr.data[off : off+2]))
+	p := int(off) + 2
+	for i := 0; i < n && p+12 <= len(tr.data); i++ {
+		e := ifdEntry{
+			Tag:    tr.order.Uint16(tr.data[p : p+2]),
+			Type:   tr.order.Uint16(tr.data[p+2 : p+4]),
+			Count:  tr.order.Uint32(tr.data[p+4 : p+8]),
+			Offset: tr.order.Uint32(tr.data[p+8 : p+12]),
+			raw:    tr.data[p+8 : p+12],
+		}
+		res[e.Tag] = e
+		p += 12
+	}
+	return res
+
+}
+
+func (tr *tiffReader) ascii(e ifdEntry) string {
+
+	var b []byte
+	if e.Count <= 4 {
+		b = e.raw[:e.Count]
+	} else if int(e.Offset)+int(e.Count) <= len(tr.data) {
+		b = tr.data[e.Offset : e.Offset+e.Count]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+
+}
+
+func (tr *tiffReader) integer(e ifdEntry) int {
+
+	if e.Type == 3 { // SHORT
+		return int(tr.order.Uint16(e.raw[0:2]))
+	}
+	return int(e.Offset)
+
+}
+
+// rationals returns the values of a RATIONAL entry, nil if any is invalid.
+func (tr *tiffReader) rationals(e ifdEntry) []float64 {
+
+	if e.Type != 5 || int(e.Offset)+8*int(e.Count) > len(tr.data) {
+		return nil
+	}
+	var res []float64
+	for i := 0; i < int(e.Count); i++ {
+		p := int(e.Offset) + 8*i
+		num, den := tr.order.Uint32(tr.data[p:p+4]), tr.order.Uint32(tr.data[p+4:p+8])
+		if den == 0 {
+			return nil
+		}
+		res = append(res, float64(num)/float64(den))
+	}
+	return res
+
+}
+
+// gpsDegrees converts GPS degrees, minutes and seconds to decimal degrees.
+func (tr *tiffReader) gpsDegrees(gps map[uint16]ifdEntry, tag uint16, ref uint16, negative string) (float64, bool) {
+
+	e, ok := gps[tag]
+	if !ok {
+		return 0, false
+	}
+	dms := tr.rationals(e)
+	if len(dms) != 3 {
+		return 0, false
+	}
+	deg := dms[0] + dms[1]/60 + dms[2]/3600
+	if r, ok := gps[ref]; ok && strings.EqualFold(tr.ascii(r), negative) {
+		deg = -deg
+	}
+	return deg, true
+
+}
+
+// readExif summarises the EXIF data within a JPG or HEIC.
+func readExif(pic []byte) (exifInfo, bool) {
+
+	var res exifInfo
+	data := exifSegment(pic)
+	if data == nil {
+		data = heifExif(pic)
+	}
+	tr := newTiffReader(data)
+	if tr == nil {
+		return res, false
+	}
+	ifd0 := tr.readIFD(tr.firstIFD())
+	if e, ok := ifd0[exifTagMake]; ok {
+		res.Make = tr.ascii(e)
+	}
+	if e, ok := ifd0[exifTagModel]; ok {
+		res.Model = tr.ascii(e)
+	}
+	dt := ""
+	if e, ok := ifd0[exifTagDateTime]; ok {
+		dt = tr.ascii(e)
+	}
+	if e, ok := ifd0[exifTagExifIFD]; ok {
+		sub := tr.readIFD(e.Offset)
+		if e, ok := sub[exifTagDateTimeOriginal]; ok {
+			dt = tr.ascii(e)
+		}
+		if e, ok := sub[exifTagPixelXDimension]; ok {
+			res.Width = tr.integer(e)
+		}
+		if e, ok := sub[exifTagPixelYDimension]; ok {
+			res.Height = tr.integer(e)
+		}
+	}
+	if e, ok := ifd0[exifTagGPSIFD]; ok {
+		gps := tr.readIFD(e.Offset)
+		lat, latok := tr.gpsDegrees(gps, exifTagGPSLatitude, exifTagGPSLatitudeRef, "S")
+		lon, lonok := tr.gpsDegrees(gps, exifTagGPSLongitude, exifTagGPSLongitudeRef, "W")
+		if latok && lonok && lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180 {
+			res.HasGPS, res.Latitude, res.Longitude = true, lat, lon
+		}
+	}
+	if dt != "" {
+		// EXIF times carry no timezone, phones are assumed to be on rally time
+		res.CaptureTime, _ = time.ParseInLocation(exifTimeFormat, dt, cfg.LocalTZ)
+	}
+	return res, true
+
+}
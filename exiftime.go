@@ -0,0 +1,84 @@
+package main
+
+/*
+ * The photo is usually a better witness to when a bonus was visited than
+ * the time the rider typed. With cfg.ExifClaimTime set to:-
+ *
+ *		date	the claim's hhmm is kept but its date is whichever of the
+ *				day before, the day itself or the day after puts it nearest
+ *				the photo's EXIF capture time, so a claim typed just after
+ *				midnight about a photo taken just before lands on the right day
+ *		time	as for date, then if the photo was taken more than
+ *				ExifTimeTolerance away from that the capture time is used instead
+ *
+ * Only JPGs and HEICs carry EXIF I can read and only the claim's own photos are
+ * looked at, using the earliest capture time among them. A claim whose time
+ * has been changed is flagged so the judges know.
+ *
+ */
+
+import (
+	"strings"
+	"time"
+)
+
+const defaultExifTimeTolerance = 30 * time.Minute
+
+// photoCaptureTime returns the earliest EXIF capture time of the photos.
+func photoCaptureTime(photos []emailPhoto) (time.Time, bool) {
+
+	var res time.Time
+	for _, p := range photos {
+		ex, ok := readExif(p.Data)
+		if !ok || ex.CaptureTime.IsZero() {
+			continue
+		}
+		if res.IsZero() || ex.CaptureTime.Before(res) {
+			res = ex.CaptureTime
+		}
+	}
+	return res, !res.IsZero()
+
+}
+
+// exifClaimTime returns the claim time adjusted according to cfg.ExifClaimTime
+// and whether it was changed.
+func exifClaimTime(claimed time.Time, photos []emailPhoto) (time.Time, bool) {
+
+	mode := strings.ToLower(cfg.ExifClaimTime)
+	if (mode != "date" && mode != "time") || claimed.IsZero() {
+		return claimed, false
+	}
+	taken, ok := photoCaptureTime(photos)
+	if !ok {
+		return claimed, false
+	}
+	taken = taken.In(claimed.Location())
+
+	var res time.Time
+	for _, days := range []int{0, -1, 1} {
+		alt := time.Date(taken.Year(), taken.Month(), taken.Day()+days, claimed.Hour(), claimed.Minute(), 0, 0, claimed.Location())
+		if res.IsZero() || absDuration(alt.Sub(taken)) < absDuration(res.Sub(taken)) {
+			res = alt
+		}
+	}
+
+	tolerance := cfg.ExifTimeTolerance
+	if tolerance <= 0 {
+		tolerance = defaultExifTimeTolerance
+	}
+	if mode == "time" && absDuration(res.Sub(taken)) > tolerance {
+		res = taken.Truncate(time.Minute)
+	}
+	return res, !res.Equal(claimed)
+
+}
+
+func absDuration(d time.Duration) time.Duration {
+
+	if d < 0 {
+		return -d
+	}
+	return d
+
+}
@@ -0,0 +1,99 @@
+package main
+
+/*
+ * For privacy and mailbox quota reasons, emails successfully stored as
+ * claims can be deleted once they're more than ExpungeAfterDays old. This
+ * only happens if ExpungeProcessed is set; ExpungeDryRun just reports what
+ * would be deleted.
+ *
+ * If ArchiveMailbox is in use, everything in it is eligible, otherwise only
+ * emails in the INBOX whose UID is recorded in ebclaims.
+ *
+ */
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// How often to look for emails to expunge
+const expungeInterval = time.Hour
+
+var lastExpunge time.Time
+
+// claimedUID reports whether an email from the INBOX was stored as a claim.
+// UIDs are only unique within a mailbox so the claim's Source must be the
+// INBOX, or unrecorded as it was before there were other mailboxes.
+func claimedUID(uid uint32) bool {
+
+	var n int
+	dbh.QueryRow("SELECT Count(*) FROM ebclaims WHERE EmailID=? AND IfNull(Source,'') IN ('',?)", uid, mailSource{Mailbox: "INBOX"}.Name()).Scan(&n)
+	return n > 0
+
+}
+
+func expungeOldClaims() {
+
+	if !cfg.ExpungeProcessed || cfg.ExpungeAfterDays < 1 || time.Since(lastExpunge) < expungeInterval || !mainIsIMAP() {
+		return
+	}
+	lastExpunge = time.Now()
+
+	c, err := imapConnect()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer c.Logout()
+
+	mbox := "INBOX"
+	if cfg.ArchiveMailbox != "" {
+		mbox = cfg.ArchiveMailbox
+		if _, err = c.Select(mbox, false); err != nil {
+			log.Printf("Select: %v\n", err)
+			return
+		}
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Before = time.Now().AddDate(0, 0, -cfg.ExpungeAfterDays)
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		log.Printf("Search: %v\n", err)
+		return
+	}
+	old := new(imap.SeqSet)
+	n := 0
+	for _, uid := range uids {
+		if cfg.ArchiveMailbox != "" || claimedUID(uid) {
+			old.AddNum(uid)
+			n++
+		}
+	}
+	if old.Empty() {
+		return
+	}
+	if cfg.ExpungeDryRun {
+		if !*silent {
+			fmt.Printf("%s would expunge %v email(s) from %v [%v]\n", logts(), n, mbox, old)
+		}
+		return
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err = c.UidStore(old, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		log.Println(err)
+		return
+	}
+	if err = c.Expunge(nil); err != nil {
+		log.Println(err)
+		return
+	}
+	if !*silent {
+		fmt.Printf("%s expunged %v email(s) from %v\n", logts(), n, mbox)
+	}
+
+}
@@ -0,0 +1,60 @@
+package main
+
+/*
+ * When an email can't be handled it matters why. Some failures will go away
+ * by themselves, the database is busy or the network hiccupped, and the
+ * email should simply be tried again next cycle. Others never will, the
+ * message won't parse or the claim breaks a database constraint, and
+ * retrying just wastes effort every cycle so those go straight to
+ * quarantine with the reason recorded.
+ *
+ */
+
+import (
+	"errors"
+	"net"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// transientError marks a failure which is expected to clear by itself.
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+// retryLater marks an error as transient.
+func retryLater(err error) error {
+
+	if err == nil {
+		return nil
+	}
+	return transientError{err}
+
+}
+
+// isTransient reports whether the email which failed with err is worth
+// trying again later. Anything I don't recognise is treated as permanent.
+func isTransient(err error) bool {
+
+	if err == nil {
+		return false
+	}
+	var te transientError
+	if errors.As(err, &te) {
+		return true
+	}
+	var se sqlite3.Error
+	if errors.As(err, &se) {
+		switch se.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrIoErr, sqlite3.ErrFull, sqlite3.ErrCantOpen, sqlite3.ErrProtocol:
+			return true
+		}
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+
+}
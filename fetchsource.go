@@ -0,0 +1,226 @@
+package main
+
+/*
+ * Not every claims mailbox can be reached by IMAP. Some club-hosted ones
+ * only offer POP3 and Exchange Online tenants are turning IMAP off, leaving
+ * the Microsoft Graph API. MailProtocol, for the main account, and Protocol,
+ * for each of the ExtraAccounts, say which is used:-
+ *
+ *		imap	the default, everything as described elsewhere
+ *		pop3	ImapServer is the POP3 server, eg pop.club.org:995, see pop3.go
+ *		graph	Microsoft Graph using the OAuth settings, main account only, see graph.go
+ *
+ * IMAP keeps its own cycle, fetchNewClaims, with paging, CONDSTORE, flags,
+ * labels and the rest. The others are reached through a MailSource and all
+ * share fetchFromSource, which feeds what they fetch through the same
+ * prepareMessages and processMessages as IMAP and so the same checks and
+ * storage. Neither protocol has anything like a UID so each email is given
+ * one of my own, in ebcremotemail, which also remembers what became of it
+ * so that it isn't processed twice. Retries are simply left for next time.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Mail protocols
+const (
+	protocolIMAP  = "imap"
+	protocolPOP3  = "pop3"
+	protocolGraph = "graph"
+)
+
+// remoteEmail is an email waiting in a mailbox reached other than by IMAP.
+type remoteEmail struct {
+	ID       string    // The server's own, POP3's UIDL or Graph's message id
+	Num      int       // POP3 message number, this session only
+	Received time.Time // Zero if the server doesn't say, as with POP3
+}
+
+// MailSource is a mailbox reached other than by IMAP.
+type MailSource interface {
+	Connect() error
+	Waiting() ([]remoteEmail, error)        // Emails, oldest first, including those already dealt with
+	Retrieve(e remoteEmail) ([]byte, error) // The whole email as sent
+	Dispose(e remoteEmail, state int) error // Record what became of it, mailClaimed etc
+	Close() error                           // Commit anything Dispose did and log out
+}
+
+// protocol returns the protocol used to reach the source's mailbox.
+func (ms mailSource) protocol() string {
+
+	p := cfg.MailProtocol
+	if ms.account != nil {
+		p = ms.account.Protocol
+	}
+	p = strings.ToLower(strings.TrimSpace(p))
+	if p == "" {
+		return protocolIMAP
+	}
+	return p
+
+}
+
+// mainIsIMAP reports whether the main account is reached by IMAP, which
+// IDLE, expunging and the like need.
+func mainIsIMAP() bool {
+
+	return mailSource{Mailbox: "INBOX"}.protocol() == protocolIMAP
+
+}
+
+// fetcher returns the MailSource for a mailbox, nil for IMAP.
+func (ms mailSource) fetcher() MailSource {
+
+	switch ms.protocol() {
+	case protocolPOP3:
+		server, login, password := cfg.ImapServer, cfg.ImapLogin, cfg.ImapPassword
+		if ms.account != nil {
+			server, login, password = ms.account.Server, ms.account.Login, ms.account.Password
+		}
+		return &pop3Source{server: server, login: login, password: password}
+	case protocolGraph:
+		return &graphSource{mailbox: ms.Mailbox}
+	}
+	return nil
+
+}
+
+// checkMailProtocols reports protocols I can't use, at startup.
+func checkMailProtocols() {
+
+	known := []string{protocolIMAP, protocolPOP3, protocolGraph}
+	if p := (mailSource{Mailbox: "INBOX"}).protocol(); !containsFold(known, p) {
+		fmt.Printf("%s: MailProtocol %v unknown, use %v\n", apptitle, p, strings.Join(known, ", "))
+	} else if p == protocolGraph && !oauthConfigured() {
+		fmt.Printf("%s: MailProtocol graph needs OAuthProvider and OAuthClientID\n", apptitle)
+	}
+	for _, a := range cfg.ExtraAccounts {
+		p := mailSource{account: &a}.protocol()
+		if p != protocolIMAP && p != protocolPOP3 {
+			fmt.Printf("%s: extra account %v can't use %v, only imap or pop3\n", apptitle, a.Login, p)
+		}
+	}
+
+}
+
+// remoteUID returns the UID I've given an email, giving it one if it hasn't
+// one yet, and its state if it's been dealt with, otherwise -1.
+func remoteUID(id string) (uint32, int, error) {
+
+	var uid uint32
+	state := -1
+	err := dbh.QueryRow("SELECT UID,State FROM ebcremotemail WHERE Source=? AND RemoteID=?", source.Name(), id).Scan(&uid, &state)
+	if err == nil {
+		return uid, state, nil
+	}
+	res, err := dbExec("INSERT INTO ebcremotemail (Source,RemoteID,State,FirstSeen) VALUES(?,?,-1,?)", source.Name(), id, storeTimeDB(time.Now()))
+	if err != nil {
+		return 0, -1, err
+	}
+	n, _ := res.LastInsertId()
+	return uint32(n), -1, nil
+
+}
+
+// fetchFromSource is fetchNewClaims for mailboxes reached other than by IMAP.
+func fetchFromSource(ms MailSource) {
+
+	err := ms.Connect()
+	status.connected(err)
+	noteImapResult(err)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer func() {
+		if err := ms.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	waiting, err := ms.Waiting()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	byUID := make(map[uint32]remoteEmail)
+	var uids []uint32
+	for _, e := range waiting {
+		uid, state, err := remoteUID(e.ID)
+		if err != nil {
+			log.Printf("can't number %v %v\n", e.ID, err)
+			continue
+		}
+		if state >= 0 && state != mailRetry {
+			continue // Dealt with already
+		}
+		byUID[uid] = e
+		uids = append(uids, uid)
+	}
+	if len(uids) == 0 {
+		status.cycleDone(0, 0, 0, 0)
+		return
+	}
+	if *verbose {
+		fmt.Printf("%s fetching %v message(s) from %v\n", logts(), len(uids), source.Name())
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, 1)
+	go func() {
+		for _, uid := range uids {
+			if stopRequested() {
+				break
+			}
+			e := byUID[uid]
+			msg := &imap.Message{Uid: uid, InternalDate: e.Received}
+			if raw, err := ms.Retrieve(e); err != nil {
+				log.Printf("Retrieve %v: %v\n", e.ID, err) // No body, so it's retried
+			} else {
+				msg.Body = map[*imap.BodySectionName]imap.Literal{{}: bytes.NewBuffer(raw)}
+				if msg.InternalDate.IsZero() {
+					msg.InternalDate = receivedAt(raw)
+				}
+			}
+			messages <- msg
+		}
+		close(messages)
+	}()
+
+	skipped, dealtwith, ignored, claimed := new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet)
+	prepared := prepareMessages(messages, section)
+	for !processMessages(prepared, claimed, dealtwith, ignored, skipped) {
+		// One of them panicked, carry on with the rest
+	}
+	status.cycleDone(seqSetLen(claimed), seqSetLen(dealtwith), seqSetLen(ignored), seqSetLen(skipped))
+
+	// Test emails are just filed, whatever became of them, as for IMAP
+	if cfg.TestMode {
+		ignored.AddSet(claimed)
+		ignored.AddSet(dealtwith)
+		claimed, dealtwith = new(imap.SeqSet), new(imap.SeqSet)
+	}
+	for _, set := range []struct {
+		uids  *imap.SeqSet
+		state int
+	}{{claimed, mailClaimed}, {dealtwith, mailRejected}, {ignored, mailIgnored}, {skipped, mailRetry}} {
+		for _, uid := range seqSetNums(set.uids) {
+			if _, err := dbExec("UPDATE ebcremotemail SET State=? WHERE UID=?", set.state, uid); err != nil {
+				log.Printf("can't record state of %v %v\n", uid, err)
+				continue
+			}
+			if err := ms.Dispose(byUID[uid], set.state); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+}
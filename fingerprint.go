@@ -0,0 +1,110 @@
+package main
+
+/*
+ * The same claim sometimes arrives twice, forwarded from the pillion's
+ * phone or re-sent by a rider who thinks it got lost, and a new address or
+ * Message-ID hides that. So each stored claim gets a fingerprint made from
+ * its normalised Subject and the hashes of its photos and a later email
+ * with the same fingerprint is recognised as a duplicate and not stored
+ * again. An email with the same Message-ID as a claim for the same entrant
+ * and bonus, the same email delivered twice or bounced on with Resend, is
+ * a duplicate whatever it holds. Cancelled claims don't count so a rider
+ * can cancel and resend.
+ *
+ * Duplicates are recognised before their photos are stored. Each is noted
+ * in ebcduplicates against the claim it duplicates, whose photos stand for
+ * both, as well as in the audit log.
+ *
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What a duplicate was recognised by
+const (
+	dupByMessageID   = "message-id"
+	dupByFingerprint = "fingerprint"
+)
+
+// normaliseSubject reduces a subject to what matters for comparison.
+func normaliseSubject(subject string) string {
+
+	s := stripSubjectPrefixes(subject)
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+
+}
+
+// claimFingerprint identifies the content of a claim email.
+func claimFingerprint(subject string, photos []emailPhoto) string {
+
+	var hashes []string
+	for _, p := range photos {
+		h := p.Hash
+		if h == "" {
+			sum := sha256.Sum256(p.Data)
+			h = hex.EncodeToString(sum[:])
+		}
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	sum := sha256.Sum256([]byte(normaliseSubject(subject) + "\n" + strings.Join(hashes, "\n")))
+	return hex.EncodeToString(sum[:])
+
+}
+
+// fingerprintedClaim returns the rowid of a live claim with this
+// fingerprint, or 0 if there isn't one.
+func fingerprintedClaim(fp string) int64 {
+
+	var rowid int64
+	dbh.QueryRow("SELECT rowid FROM ebclaims WHERE Fingerprint=? AND IfNull(RiderCancelled,0)=0 ORDER BY rowid LIMIT 1", fp).Scan(&rowid)
+	return rowid
+
+}
+
+// messageIDClaim returns the rowid of the entrant's live claim for the bonus
+// from the email with this Message-ID, or 0 if there isn't one.
+func messageIDClaim(entrant int, bonus string, mid string) int64 {
+
+	var rowid int64
+	mid = strings.Trim(mid, "<> \t\r\n")
+	if mid == "" {
+		return 0
+	}
+	dbh.QueryRow("SELECT rowid FROM ebclaims WHERE EntrantID=? AND BonusID=? AND MessageID=? AND IfNull(RiderCancelled,0)=0 ORDER BY rowid LIMIT 1",
+		entrant, bonus, mid).Scan(&rowid)
+	return rowid
+
+}
+
+// duplicateClaim returns the rowid of the claim an email duplicates, and
+// how it was recognised, or 0.
+func duplicateClaim(entrant int, bonus string, mid string, fp string) (int64, string) {
+
+	if rowid := messageIDClaim(entrant, bonus, mid); rowid != 0 {
+		return rowid, dupByMessageID
+	}
+	if rowid := fingerprintedClaim(fp); rowid != 0 {
+		return rowid, dupByFingerprint
+	}
+	return 0, ""
+
+}
+
+// recordDuplicate links a duplicate email to the claim it duplicates.
+func recordDuplicate(uid uint32, from string, subject string, claim int64, matched string) {
+
+	_, err := dbExec("INSERT INTO ebcduplicates (LoggedAt,EmailID,Source,FromAddr,ClaimID,MatchedBy) VALUES(?,?,?,?,?,?)",
+		storeTimeDB(time.Now()), uid, source.Name(), from, claim, matched)
+	if err != nil && !*silent {
+		fmt.Printf("%s can't record duplicate of claim %v %v\n", logts(), claim, err)
+	}
+	writeAudit(uid, from, subject, auditIgnored, fmt.Sprintf("duplicate of claim %v by %v", claim, matched))
+
+}
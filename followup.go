@@ -0,0 +1,145 @@
+package main
+
+/*
+ * Riders often send the claim first and the photos in a separate email a
+ * minute or two later, or the other way round. An email which isn't a claim
+ * but has photos, from an address registered to an entrant, is taken to be
+ * the photos for that entrant's claim without any, if there's one sent within
+ * cfg.FollowUpPhotoMinutes either side. The photos are stored against the
+ * claim, which is flagged. If the claim hasn't arrived yet the email is left
+ * for the next cycle until the time's up, then handled as any other.
+ *
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultFollowUpPhotoMinutes = 10
+
+// What became of a photo-only email
+const (
+	followUpNone     = iota // Not a follow-up, handle it as usual
+	followUpAttached        // Photos added to an earlier claim
+	followUpWaiting         // No claim yet, try again next cycle
+)
+
+// followUpWindow is how far apart claim and photos may be sent.
+func followUpWindow() time.Duration {
+
+	mins := cfg.FollowUpPhotoMinutes
+	if mins == 0 {
+		mins = defaultFollowUpPhotoMinutes
+	}
+	if mins < 0 {
+		return 0
+	}
+	return time.Duration(mins) * time.Minute
+
+}
+
+// photolessClaim finds the latest claim without photos, from one of the
+// entrants, sent within the window around sent.
+func photolessClaim(entrants []int, sent time.Time, window time.Duration) (int64, int, string, uint32) {
+
+	var ids []string
+	for _, e := range entrants {
+		ids = append(ids, strconv.Itoa(e))
+	}
+	sqlx := "SELECT rowid,EntrantID,BonusID,EmailID,IfNull(DateTime,'') FROM ebclaims WHERE EntrantID IN (" + strings.Join(ids, ",") + ")"
+	sqlx += " AND IfNull(PhotoIDs,'')='' AND IfNull(RiderCancelled,0)=0 ORDER BY rowid DESC LIMIT 20"
+	rows, err := dbh.Query(sqlx)
+	if err != nil {
+		return 0, 0, "", 0
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rowid int64
+		var entrant int
+		var bonus, dt string
+		var emailid uint32
+		rows.Scan(&rowid, &entrant, &bonus, &emailid, &dt)
+		t, err := time.Parse(timefmt, dt)
+		if err != nil {
+			continue
+		}
+		if d := t.Sub(sent); d <= window && d >= -window {
+			return rowid, entrant, bonus, emailid
+		}
+	}
+	return 0, 0, "", 0
+
+}
+
+// attachFollowUpPhotos deals with an email which has photos but no claim.
+func attachFollowUpPhotos(uid uint32, from string, subject string, sent time.Time, photos []emailPhoto) int {
+
+	window := followUpWindow()
+	if window == 0 || len(photos) == 0 {
+		return followUpNone
+	}
+	entrants := entrantsByEmail(from)
+	if len(entrants) == 0 {
+		return followUpNone
+	}
+	rowid, entrant, bonus, emailid := photolessClaim(entrants, sent, window)
+	if rowid == 0 {
+		if time.Since(sent) < window {
+			return followUpWaiting
+		}
+		return followUpNone
+	}
+
+	var pending pendingPhotos
+	for _, p := range photos {
+		if pp := writePhoto(entrant, bonus, emailid, p); pp != nil {
+			pending = append(pending, pp)
+		}
+	}
+	if len(pending) == 0 {
+		return followUpNone
+	}
+
+	// The photos and the claim they're added to are written together
+	var photoids []string
+	err := dbWriteTx(func(tx *sql.Tx) error {
+		ids, err := pending.store(tx)
+		if err != nil {
+			return err
+		}
+		photoids = ids
+		photoid := 0
+		if len(pending) == 1 {
+			photoid = pending[0].id
+		}
+		var stored string
+		tx.QueryRow("SELECT IfNull(EbcFlags,'') FROM ebclaims WHERE rowid=?", rowid).Scan(&stored)
+		var flags claimFlags
+		for _, f := range strings.Split(stored, ",") {
+			if f != "" && f != flagPhotoMissing {
+				flags.add(f)
+			}
+		}
+		flags.add(flagFollowUpPhotos)
+		sqlx := "UPDATE ebclaims SET " + col("ebclaims", "PhotoID") + "=?,PhotoIDs=?,EbcFlags=? WHERE rowid=?"
+		_, err = tx.Exec(sqlx, photoid, strings.Join(photoids, ","), flags.String(), rowid)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("%s can't add photos to claim %v %v\n", logts(), rowid, err)
+		pending.discard()
+		return followUpWaiting // Try again next cycle
+	}
+	pending.keep()
+	reason := fmt.Sprintf("%v photo(s) added to claim %v, entrant %v bonus %v", len(photoids), rowid, entrant, bonus)
+	writeAudit(uid, from, subject, auditPhotos, reason)
+	if !*silent {
+		fmt.Printf("%s %v\n", logts(), reason)
+	}
+	return followUpAttached
+
+}
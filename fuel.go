@@ -0,0 +1,121 @@
+package main
+
+/*
+ * Rallies with fuel-log bonuses have riders send a receipt, photo or PDF,
+ * using a designated code in place of the bonus:
+ *
+ *		12 FUEL 10423 1432
+ *
+ * Each is stored in ebcfuellog rather than ebclaims, with the receipt
+ * saved alongside the claim photos. Where I can tell when the receipt was
+ * issued, from a photo's EXIF or a PDF's creation date, that's recorded
+ * too. Nothing happens unless cfg.FuelCode is set.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isFuelCode reports whether a bonus code is really a fuel receipt.
+func isFuelCode(bonus string) bool {
+	return cfg.FuelCode != "" && strings.EqualFold(bonus, cfg.FuelCode)
+}
+
+var pdfCreationRE = regexp.MustCompile(`/CreationDate\s*\(D:(\d{14})`)
+
+// receiptExt returns the extension to store a receipt under.
+func receiptExt(pic []byte, filename string) string {
+
+	if bytes.HasPrefix(pic, []byte("%PDF-")) {
+		return ".pdf"
+	}
+	if ext := contentImageExt(pic, filename); ext != "" {
+		return ext
+	}
+	return ".jpg"
+
+}
+
+// receiptTime works out when a receipt was issued, if possible.
+func receiptTime(pic []byte) (time.Time, bool) {
+
+	if x := pdfCreationRE.FindSubmatch(pic); x != nil {
+		t, err := time.ParseInLocation("20060102150405", string(x[1]), cfg.LocalTZ)
+		return t, err == nil
+	}
+	if ex, ok := readExif(pic); ok && !ex.CaptureTime.IsZero() {
+		return ex.CaptureTime, true
+	}
+	return time.Time{}, false
+
+}
+
+// storeFuelReceipt records a fuel receipt, returning its ebcfuellog rowid.
+func storeFuelReceipt(emailid uint32, subject string, f4 fourFields, p emailPhoto) (int64, error) {
+
+	receipted := ""
+	if t, ok := receiptTime(p.Data); ok {
+		receipted = storeTimeDB(t)
+	}
+	sqlx := "INSERT INTO ebcfuellog (LoggedAt,EmailID,EntrantID,OdoReading,ClaimTime,ReceiptTime,Subject) VALUES(?,?,?,?,?,?,?)"
+	res, err := dbExec(sqlx, storeTimeDB(time.Now()), emailid, f4.EntrantID, f4.OdoReading, storeTimeDB(f4.ClaimTime), receipted, subject)
+	if err != nil {
+		return 0, err
+	}
+	rowid, _ := res.LastInsertId()
+	fname := "fuel-" + strconv.Itoa(f4.EntrantID) + "-" + strconv.FormatInt(rowid, 10) + receiptExt(p.Data, p.Filename)
+	err = os.WriteFile(filepath.Join(cfg.Path2SM, cfg.ImageFolder, fname), p.Data, 0644)
+	if err != nil {
+		dbExec("DELETE FROM ebcfuellog WHERE rowid=?", rowid)
+		return 0, err
+	}
+	dbExec("UPDATE ebcfuellog SET Receipt=? WHERE rowid=?", filepath.Join(cfg.ImageFolder, fname), rowid)
+	return rowid, nil
+
+}
+
+// handleFuelClaim deals with a fuel receipt, reporting whether it was stored.
+func handleFuelClaim(emailid uint32, from string, subject string, f4 fourFields, photos []emailPhoto) bool {
+
+	var receipt *emailPhoto
+	for i := range photos {
+		if photos[i].Err == nil {
+			receipt = &photos[i]
+			break
+		}
+	}
+	if receipt == nil {
+		writeAudit(emailid, from, subject, auditRejected, "fuel claim without a receipt")
+		if cfg.TestMode {
+			sendPlainMail(from, "EBC test: "+subject, "A fuel claim must include a photo or PDF of the receipt.")
+		}
+		return false
+	}
+	if cfg.TestMode {
+		when := "I can't tell when the receipt was issued."
+		if t, ok := receiptTime(receipt.Data); ok {
+			when = "The receipt was issued at " + t.Format(myTimeFormat) + "."
+		}
+		sendPlainMail(from, "EBC test: "+subject, "In a live rally your fuel receipt would now be logged. "+when)
+		return true
+	}
+	rowid, err := storeFuelReceipt(emailid, subject, f4, *receipt)
+	if err != nil {
+		fmt.Printf("%s can't store fuel receipt [ %v ] %v\n", logts(), subject, err)
+		return false
+	}
+	if !*silent {
+		fmt.Printf("%s fuel receipt %v [ %v ]\n", logts(), rowid, subject)
+	}
+	writeAudit(emailid, from, subject, auditFuel, fmt.Sprintf("ebcfuellog %v", rowid))
+	return true
+
+}
@@ -8,8 +8,8 @@ require (
 	github.com/go-test/deep v1.1.0 // indirect
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/stretchr/testify v1.9.0 // indirect
-	github.com/toorop/go-dkim v0.0.0-20240103092955-90b7d1423f92 // indirect
+	github.com/toorop/go-dkim v0.0.0-20240103092955-90b7d1423f92
 	github.com/xhit/go-simple-mail/v2 v2.16.0
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/text v0.14.0
 	gopkg.in/yaml.v2 v2.4.0
 )
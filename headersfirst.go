@@ -0,0 +1,121 @@
+package main
+
+/*
+ * Over hotel Wi-Fi, downloading every multi-megabyte newsletter each cycle
+ * hurts. With cfg.HeadersFirst I fetch just the envelopes to begin with and
+ * only download the bodies of emails which might be claims or commands.
+ * The rest are marked as rejected, for a human to look at, without ever
+ * being downloaded.
+ *
+ * Whether or not HeadersFirst is set, emails larger than cfg.IgnoreOverKB,
+ * newsletters full of inline images, are filed as ignored without being
+ * downloaded unless the sender or the subject suggests they might be claims.
+ *
+ */
+
+import (
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Subjects beginning with these are always worth a look
+var commandSubjectRE = regexp.MustCompile(`(?i)^\s*(OVERRIDE|CORRECTION|CANCEL|STATUS|JSON|PAUSE|RESUME|TESTMODE)\b`)
+
+// knownSenderOrCommand reports whether an email is from someone I deal with or is a command.
+func knownSenderOrCommand(from string, subject string) bool {
+
+	if isAdminAddress(from) || smsGatewayPhone(from) != "" || len(entrantsByEmail(from)) > 0 {
+		return true
+	}
+	return commandSubjectRE.MatchString(subject)
+
+}
+
+// subjectMightBeClaim reports whether the subject parses as a claim, or might
+// be one sent in the body.
+func subjectMightBeClaim(subject string) bool {
+
+	if strings.TrimSpace(subject) == "" {
+		return cfg.AllowBody
+	}
+	return parseSubject(subject, false).ok
+
+}
+
+// looksLikeClaim decides from the sender and subject alone whether an email needs downloading.
+func looksLikeClaim(from string, subject string) bool {
+
+	if knownSenderOrCommand(from, subject) {
+		return true
+	}
+	if cfg.MatchEmail && !cfg.TestMode {
+		return false // Would be rejected anyway
+	}
+	return subjectMightBeClaim(subject)
+
+}
+
+// oversizeNonClaim reports whether an email is too big to download given
+// that it's clearly not a claim.
+func oversizeNonClaim(size uint32, from string, subject string) bool {
+
+	if cfg.IgnoreOverKB < 1 || size <= uint32(cfg.IgnoreOverKB)*1024 {
+		return false
+	}
+	return !knownSenderOrCommand(from, subject) && !subjectMightBeClaim(subject)
+
+}
+
+// claimCandidates fetches the envelopes of the emails with the UIDs in
+// uids, returning the UIDs of those worth downloading, of those to be
+// rejected unread and of those too big to bother with.
+func claimCandidates(c *client.Client, uids *imap.SeqSet) (*imap.SeqSet, *imap.SeqSet, *imap.SeqSet, error) {
+
+	wanted := new(imap.SeqSet)
+	unwanted := new(imap.SeqSet)
+	oversize := new(imap.SeqSet)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(uids, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchRFC822Size}, messages)
+	}()
+	dec := new(mime.WordDecoder)
+	for msg := range messages {
+		if msg.Envelope == nil {
+			wanted.AddNum(msg.Uid)
+			continue
+		}
+		from := ""
+		if len(msg.Envelope.From) > 0 {
+			from = msg.Envelope.From[0].Address()
+		}
+		subject, err := dec.DecodeHeader(msg.Envelope.Subject)
+		if err != nil {
+			subject = msg.Envelope.Subject
+		}
+		if oversizeNonClaim(msg.Size, from, subject) {
+			if *verbose {
+				fmt.Printf("%s ignoring [%v] %v from %v, %v bytes\n", logts(), msg.Uid, subject, from, msg.Size)
+			}
+			writeAudit(msg.Uid, from, subject, auditIgnored, fmt.Sprintf("not a claim and over %vKB", cfg.IgnoreOverKB))
+			oversize.AddNum(msg.Uid)
+			continue
+		}
+		if !cfg.HeadersFirst || looksLikeClaim(from, subject) {
+			wanted.AddNum(msg.Uid)
+			continue
+		}
+		if *verbose {
+			fmt.Printf("%s not downloading [%v] %v from %v, %v bytes\n", logts(), msg.Uid, subject, from, msg.Size)
+		}
+		writeAudit(msg.Uid, from, subject, auditRejected, "not a claim, judged from headers")
+		unwanted.AddNum(msg.Uid)
+	}
+	return wanted, unwanted, oversize, <-done
+
+}
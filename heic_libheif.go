@@ -0,0 +1,77 @@
+//go:build libheif
+// +build libheif
+
+package main
+
+/*
+ * HEIC decoding using libheif, built only with -tags libheif.
+ *
+ */
+
+// #cgo pkg-config: libheif
+// #include <stdlib.h>
+// #include <string.h>
+// #include <libheif/heif.h>
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+func init() {
+	heicDecoder = decodeHeic
+}
+
+// heifError turns a libheif error into a Go one.
+func heifError(err C.struct_heif_error) error {
+
+	if err.code == C.heif_error_Ok {
+		return nil
+	}
+	return fmt.Errorf("libheif: %v", C.GoString(err.message))
+
+}
+
+// decodeHeic decodes the primary image of a HEIC file.
+func decodeHeic(pic []byte) (image.Image, error) {
+
+	if len(pic) == 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+	data := C.CBytes(pic)
+	defer C.free(data)
+
+	ctx := C.heif_context_alloc()
+	defer C.heif_context_free(ctx)
+	if err := heifError(C.heif_context_read_from_memory_without_copy(ctx, data, C.size_t(len(pic)), nil)); err != nil {
+		return nil, err
+	}
+	var handle *C.struct_heif_image_handle
+	if err := heifError(C.heif_context_get_primary_image_handle(ctx, &handle)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_handle_release(handle)
+
+	var img *C.struct_heif_image
+	if err := heifError(C.heif_decode_image(handle, &img, C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, nil)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_release(img)
+
+	w := int(C.heif_image_get_width(img, C.heif_channel_interleaved))
+	h := int(C.heif_image_get_height(img, C.heif_channel_interleaved))
+	var stride C.int
+	plane := C.heif_image_get_plane_readonly(img, C.heif_channel_interleaved, &stride)
+	if plane == nil || w < 1 || h < 1 {
+		return nil, fmt.Errorf("libheif: no image data")
+	}
+	res := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := unsafe.Pointer(uintptr(unsafe.Pointer(plane)) + uintptr(y*int(stride)))
+		copy(res.Pix[y*res.Stride:y*res.Stride+w*4], C.GoBytes(row, C.int(w*4)))
+	}
+	return res, nil
+
+}
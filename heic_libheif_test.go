@@ -0,0 +1,89 @@
+//go:build libheif
+// +build libheif
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sampleHeic is a real HEIC, made with heif-enc from libheif's examples.
+func sampleHeic(t *testing.T) []byte {
+
+	enc, err := exec.LookPath("heif-enc")
+	if err != nil {
+		t.Fatalf("heif-enc, from libheif-examples, is needed to make a HEIC\n")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample.jpg")
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			img.Set(x, y, color.NRGBA{R: 200, G: 30, B: 30, A: 255})
+		}
+	}
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpeg.Encode(f, img, &jpeg.Options{Quality: 95})
+	f.Close()
+	out := filepath.Join(dir, "sample.heic")
+	if msg, err := exec.Command(enc, "-q", "90", "-o", out, src).CombinedOutput(); err != nil {
+		t.Fatalf("heif-enc failed %v %s\n", err, msg)
+	}
+	pic, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pic
+
+}
+
+func TestLibheif(t *testing.T) {
+
+	pic := sampleHeic(t)
+	if ext := contentImageExt(pic, "sample.bin"); !isHeicExt(ext) {
+		t.Fatalf("heif-enc's output taken for %q\n", ext)
+	}
+	img, err := decodeHeic(pic)
+	if err != nil {
+		t.Fatalf("Can't decode %v\n", err)
+	}
+	if b := img.Bounds(); b.Dx() != 128 || b.Dy() != 96 {
+		t.Errorf("Decoded as %v\n", b)
+	}
+	r, g, b, _ := img.At(64, 48).RGBA()
+	if r>>8 < 150 || g>>8 > 80 || b>>8 > 80 {
+		t.Errorf("Red decoded as %v,%v,%v\n", r>>8, g>>8, b>>8)
+	}
+	if _, err := decodeHeic([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00")); err == nil {
+		t.Errorf("Truncated HEIC decoded\n")
+	}
+
+	// And stored as a JPG without an external converter
+	useMemoryDB(t)
+	cfg.ConvertHeic = true
+	cfg.Converters = map[string]string{".heic": ""}
+	photoid := writeImage(1, "A1", 78, pic, "sample.heic")
+	var stored string
+	var unconverted int
+	dbh.QueryRow("SELECT image,Unconverted FROM ebcphotos WHERE rowid=?", photoid).Scan(&stored, &unconverted)
+	if !strings.HasSuffix(stored, ".jpg") || unconverted != 0 {
+		t.Errorf("HEIC stored as %v unconverted=%v\n", stored, unconverted)
+	}
+	jpg, err := os.ReadFile(filepath.Join(cfg.Path2SM, stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ic, err := jpeg.DecodeConfig(strings.NewReader(string(jpg))); err != nil || ic.Width != 128 {
+		t.Errorf("Converted JPG is %v wide %v\n", ic.Width, err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+/*
+ * iPhones send HEIC photos which ScoreMaster can't show, so they're
+ * converted to JPG by whatever suitable utility the server has. Which one
+ * that is varies: heif-convert from libheif, ImageMagick as magick or, in
+ * older versions, convert, or sips on a Mac. Unless cfg.Heic2jpg names one
+ * that's available I try each in turn at startup and use the first that
+ * works, checking again whenever the setting changes. If none does I say
+ * so and HEIC photos are stored as received, unless I was built with
+ * -tags libheif and can convert them myself (see heicnative.go).
+ *
+ */
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// heicConverter is a known HEIC converter and how to check it can read HEIC.
+type heicConverter struct {
+	Template string
+	Probe    []string // Arguments whose output must mention HEIC, if any
+	OS       string   // Only on this GOOS, if set
+}
+
+// heicChoice is the outcome of validating cfg.Heic2jpg, which can change
+// when the configuration is reloaded.
+var heicChoice struct {
+	checked    bool
+	configured string // cfg.Heic2jpg as validated
+	template   string // What's actually used, "" if nothing works
+}
+
+var heicConverters = []heicConverter{
+	{Template: "heif-convert -q {quality} {in} {out}"},
+	{Template: "magick {in} -quality {quality} {out}", Probe: []string{"-list", "format"}},
+	{Template: "sips -s format jpeg -s formatOptions {quality} {in} --out {out}", OS: "darwin"},
+	{Template: "convert {in} -quality {quality} {out}", Probe: []string{"-list", "format"}, OS: "!windows"}, // Windows has its own convert
+}
+
+// forThisOS reports whether the converter could be used here.
+func (hc heicConverter) forThisOS() bool {
+
+	if strings.HasPrefix(hc.OS, "!") {
+		return runtime.GOOS != hc.OS[1:]
+	}
+	return hc.OS == "" || hc.OS == runtime.GOOS
+
+}
+
+// heicConverterWorks reports whether a converter is installed and able to read HEIC.
+func heicConverterWorks(hc heicConverter) bool {
+
+	if _, err := exec.LookPath(converterName(hc.Template)); err != nil {
+		return false
+	}
+	if len(hc.Probe) == 0 {
+		return true
+	}
+	out, _ := exec.Command(converterName(hc.Template), hc.Probe...).CombinedOutput()
+	return strings.Contains(strings.ToUpper(string(out)), "HEIC")
+
+}
+
+// heicTemplate returns the HEIC converter template to use, "" if there's none.
+func heicTemplate() string {
+
+	if !heicChoice.checked || heicChoice.configured != cfg.Heic2jpg {
+		validateHeicHandler()
+	}
+	return heicChoice.template
+
+}
+
+// validateHeicHandler settles on the HEIC converter to use, if any.
+func validateHeicHandler() {
+
+	heicChoice.checked, heicChoice.configured, heicChoice.template = true, cfg.Heic2jpg, ""
+	if cfg.Heic2jpg != "" && !strings.EqualFold(cfg.Heic2jpg, "auto") {
+		if _, err := exec.LookPath(converterName(cfg.Heic2jpg)); err == nil {
+			heicChoice.template = cfg.Heic2jpg
+			return
+		}
+		fmt.Printf("%s: HEIC handler %v is not available, looking for another\n", apptitle, converterName(cfg.Heic2jpg))
+	}
+	var tried []string
+	for _, hc := range heicConverters {
+		if !hc.forThisOS() {
+			continue
+		}
+		if heicConverterWorks(hc) {
+			heicChoice.template = hc.Template
+			if !*silent {
+				fmt.Printf("%s: converting HEIC photos using %v\n", apptitle, converterName(hc.Template))
+			}
+			return
+		}
+		tried = append(tried, converterName(hc.Template))
+	}
+	if heicDecoder != nil {
+		return // Converted in-process, there's just no fallback
+	}
+	fmt.Printf("%s: no HEIC converter found (tried %v), HEIC photos will be stored unconverted\n", apptitle, strings.Join(tried, ", "))
+
+}
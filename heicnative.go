@@ -0,0 +1,71 @@
+package main
+
+/*
+ * Shelling out to a converter makes deployment fragile, Windows especially,
+ * so when built with a HEIC decoder, -tags libheif which needs libheif and
+ * cgo, HEIC photos are converted to JPG in-process and an external
+ * converter is only used if that fails. Without one, HEIC photos are
+ * converted as before, or stored unconverted and retried later.
+ *
+ * There's no pure-Go HEVC decoder to be had so the default build doesn't
+ * decode HEIC itself. The libheif build is made, and tested decoding a real
+ * HEIC, by .github/workflows/libheif.yml.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+)
+
+// heicDecoder decodes a HEIC image, nil if I wasn't built with one.
+var heicDecoder func([]byte) (image.Image, error)
+
+// nativeHeic reports whether I can convert photos with this extension myself.
+func nativeHeic(ext string) bool {
+	return isHeicExt(ext) && cfg.ConvertHeic && heicDecoder != nil
+}
+
+// convertHeicNative converts a stored HEIC to JPG, both paths within the
+// ScoreMaster folder.
+func convertHeicNative(original string, jpg string) error {
+
+	pic, err := os.ReadFile(filepath.Join(cfg.Path2SM, original))
+	if err != nil {
+		return err
+	}
+	img, err := heicDecoder(pic)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality()}); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cfg.Path2SM, jpg), buf.Bytes(), 0644)
+
+}
+
+// convertStored converts a stored original to JPG, in-process if I can,
+// otherwise using converter.
+func convertStored(ext string, converter string, original string, jpg string) error {
+
+	err := fmt.Errorf("no converter for %v", ext)
+	if nativeHeic(ext) {
+		if err = convertHeicNative(original, jpg); err == nil || converter == "" {
+			return err
+		}
+		if debugging(debugPhotos) {
+			fmt.Printf("%s can't decode %v in-process %v, trying %v\n", logts(), original, err, converterName(converter))
+		}
+	}
+	if converter != "" {
+		err = convertImage(converter, original, jpg)
+	}
+	return err
+
+}
@@ -0,0 +1,117 @@
+package main
+
+/*
+ * A converter can fail on a photo, the odd HEIC from a new phone it doesn't
+ * understand or a converter that's briefly missing say, but that's no reason
+ * to lose the claim. The original is stored as received, its ebcphotos row
+ * marked Unconverted, and the claim goes ahead. Failures are counted for
+ * /api/stats and, every conversionRetryEvery, a background job tries
+ * converting the unconverted photos again, replacing the image with the JPG
+ * once it works.
+ *
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const conversionRetryEvery = 5 * time.Minute
+
+// conversionFailures counts the photos which couldn't be converted.
+var conversionFailures int64
+
+var conversionRetrying int32
+var lastConversionRetry time.Time
+
+// convertImage converts a stored original, both paths within the ScoreMaster folder.
+func convertImage(converter string, original string, jpg string) error {
+
+	cmd := converterCommand(converter, filepath.Join(cfg.Path2SM, original), filepath.Join(cfg.Path2SM, jpg))
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		if _, err = os.Stat(filepath.Join(cfg.Path2SM, jpg)); err != nil {
+			err = fmt.Errorf("%v produced no image", converterName(converter))
+		}
+	} else if msg := strings.TrimSpace(string(out)); msg != "" {
+		err = fmt.Errorf("%v %v", err, msg)
+	}
+	return err
+
+}
+
+// conversionFailed records a photo stored as received.
+func conversionFailed(pp *pendingPhoto) {
+
+	atomic.AddInt64(&conversionFailures, 1)
+	pp.unconverted = true
+
+}
+
+// startConversionRetries runs retryConversions in the background, if
+// it's due and not already running.
+func startConversionRetries(now time.Time) {
+
+	if now.Sub(lastConversionRetry) < conversionRetryEvery {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&conversionRetrying, 0, 1) {
+		return
+	}
+	lastConversionRetry = now
+	go func() {
+		defer atomic.StoreInt32(&conversionRetrying, 0)
+		retryConversions()
+	}()
+
+}
+
+// retryConversions tries converting the unconverted photos again, returning
+// how many now are.
+func retryConversions() int {
+
+	type unconverted struct {
+		photoid int
+		image   string
+	}
+	var todo []unconverted
+	rows, err := dbh.Query("SELECT rowid,IfNull(image,'') FROM ebcphotos WHERE Unconverted=1 ORDER BY rowid")
+	if err != nil {
+		return 0
+	}
+	for rows.Next() {
+		var u unconverted
+		rows.Scan(&u.photoid, &u.image)
+		todo = append(todo, u)
+	}
+	rows.Close()
+
+	n := 0
+	for _, u := range todo {
+		ext := filepath.Ext(u.image)
+		converter := converterFor(strings.ToLower(ext))
+		if converter == "" && !nativeHeic(strings.ToLower(ext)) {
+			continue
+		}
+		jpg := strings.TrimSuffix(u.image, ext) + ".jpg"
+		if err := convertStored(strings.ToLower(ext), converter, u.image, jpg); err != nil {
+			if debugging(debugPhotos) {
+				fmt.Printf("%s photo %v still can't be converted %v\n", logts(), u.photoid, err)
+			}
+			continue
+		}
+		if _, err := dbExec("UPDATE ebcphotos SET image=?,Unconverted=0 WHERE rowid=?", jpg, u.photoid); err != nil {
+			continue
+		}
+		n++
+		if !*silent {
+			fmt.Printf("%s photo %v converted at last\n", logts(), u.photoid)
+		}
+	}
+	return n
+
+}
@@ -0,0 +1,74 @@
+package main
+
+/*
+ * Organisers can have their own commands run when things happen, without
+ * touching this code. cfg.Hooks maps an event name onto a command line; the
+ * command is given a JSON description of the event on stdin. Hooks run in
+ * the background and are killed if they take longer than hookTimeout.
+ *
+ *		Hooks:
+ *		  claim-stored: /usr/local/bin/notify-results
+ *		  photo-stored: python3 check_photo.py
+ *
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Hook events
+const (
+	hookClaimStored    = "claim-stored"
+	hookClaimRejected  = "claim-rejected"
+	hookPhotoStored    = "photo-stored"
+	hookClaimCancelled = "claim-cancelled"
+)
+
+const hookTimeout = 30 * time.Second
+
+// hookEvent is the payload passed to a hook, fields are omitted where they don't apply.
+type hookEvent struct {
+	Event      string
+	EmailID    uint32
+	From       string `json:",omitempty"`
+	Subject    string `json:",omitempty"`
+	EntrantID  int    `json:",omitempty"`
+	BonusID    string `json:",omitempty"`
+	OdoReading int    `json:",omitempty"`
+	ClaimTime  string `json:",omitempty"`
+	Flags      string `json:",omitempty"`
+	PhotoID    int    `json:",omitempty"`
+	PhotoIDs   string `json:",omitempty"`
+	Image      string `json:",omitempty"`
+	Reason     string `json:",omitempty"`
+}
+
+// fireHook runs the command configured for the event, if any.
+func fireHook(ev hookEvent) {
+
+	cmdline := strings.Fields(cfg.Hooks[ev.Event])
+	if len(cmdline) == 0 {
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
+		cmd.Stdin = bytes.NewReader(payload)
+		out, err := cmd.CombinedOutput()
+		if err != nil && !*silent {
+			fmt.Printf("%s hook %v failed %v %v\n", logts(), ev.Event, err, strings.TrimSpace(string(out)))
+		}
+	}()
+
+}
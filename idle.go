@@ -0,0 +1,142 @@
+package main
+
+/*
+ * Polling every SleepSeconds means a claim can sit in the INBOX for most of
+ * a cycle and every cycle logs in afresh whether or not anything's arrived.
+ * With cfg.UseIdle set, a second connection is kept open on the INBOX using
+ * IMAP IDLE and, as soon as the server reports new mail, the main loop is
+ * woken to fetch it. The main loop still polls, but only every
+ * cfg.IdlePollEvery, default 5m, or the usual interval if that's longer, in
+ * case a notification goes astray.
+ *
+ * If the server doesn't support IDLE I say so and carry on polling as usual.
+ * If the connection drops it's reopened after idleReconnectDelay, polling as
+ * usual meanwhile.
+ *
+ */
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	defaultIdlePollEvery = 5 * time.Minute
+	idleRestart          = 9 * time.Minute // Servers and routers drop IDLE left too long
+	idleReconnectDelay   = 30 * time.Second
+)
+
+// mailArrived wakes the main loop.
+var mailArrived = make(chan struct{}, 1)
+
+// idling is 1 while the watcher is idling.
+var idling int32
+
+// signalMail wakes the main loop, if it isn't already awake.
+func signalMail() {
+
+	select {
+	case mailArrived <- struct{}{}:
+	default:
+	}
+
+}
+
+// idleWait is how long the main loop waits before polling anyway.
+func idleWait(every time.Duration) time.Duration {
+
+	if atomic.LoadInt32(&idling) == 0 {
+		return every
+	}
+	safety := cfg.IdlePollEvery
+	if safety <= 0 {
+		safety = defaultIdlePollEvery
+	}
+	if every < safety {
+		return safety
+	}
+	return every
+
+}
+
+// waitForMail sleeps until the next poll is due or new mail is reported.
+func waitForMail(every time.Duration) {
+
+	t := time.NewTimer(idleWait(every))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-mailArrived:
+		if debugging(debugIMAP) {
+			fmt.Printf("%s new mail reported\n", logts())
+		}
+	case <-stopping:
+	}
+
+}
+
+// startIdleWatcher keeps watching the INBOX unless the server can't IDLE.
+func startIdleWatcher() {
+
+	go func() {
+		for idleWatch() {
+			time.Sleep(idleReconnectDelay)
+		}
+	}()
+
+}
+
+// idleWatch idles on the INBOX until the connection fails, returning false
+// if the server doesn't support IDLE.
+func idleWatch() bool {
+
+	if !monitoringOK() {
+		return true
+	}
+	c, err := imapLogin(mailSource{Mailbox: "INBOX"})
+	if err != nil {
+		if !*silent {
+			fmt.Printf("%s can't watch the INBOX %v\n", logts(), err)
+		}
+		return true
+	}
+	defer c.Logout()
+	if ok, _ := c.Support("IDLE"); !ok {
+		fmt.Printf("%s %v doesn't support IDLE, polling instead\n", logts(), cfg.ImapServer)
+		return false
+	}
+	updates := make(chan client.Update, 64) // Enough for whatever comes while logging out
+	c.Updates = updates
+	if _, err := c.Select("INBOX", true); err != nil {
+		return true
+	}
+	// IDLE is restarted before this runs out, a dead connection isn't waited on forever
+	c.Timeout = idleRestart + imapTimeout()
+
+	atomic.StoreInt32(&idling, 1)
+	defer atomic.StoreInt32(&idling, 0)
+	if debugging(debugIMAP) {
+		fmt.Printf("%s idling on INBOX\n", logts())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(make(chan struct{}), &client.IdleOptions{LogoutTimeout: idleRestart, PollInterval: -1})
+	}()
+	for {
+		select {
+		case u := <-updates:
+			if _, ok := u.(*client.MailboxUpdate); ok {
+				signalMail()
+			}
+		case err := <-done:
+			if err != nil && !*silent {
+				fmt.Printf("%s stopped idling %v\n", logts(), err)
+			}
+			return true
+		}
+	}
+
+}
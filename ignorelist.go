@@ -0,0 +1,62 @@
+package main
+
+/*
+ * Bounces, delivery reports and the like are never claims but without help
+ * they'd be flagged for someone to look at. IgnoreSubjects and IgnoreSenders
+ * are regexes, matched case-insensitively against the Subject and From
+ * address; anything matching either is filed as read without being flagged
+ * so that the manual queue holds only real riders' mail.
+ *
+ */
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var defaultIgnoreSubjects = []string{`^\s*delivery status notification`, `^\s*undeliver(able|ed)`, `^\s*mail delivery (failed|failure|system)`, `^\s*returned mail`}
+var defaultIgnoreSenders = []string{`^mailer-daemon@`, `^postmaster@`}
+
+// matchesAny reports which, if any, of a list of regexes matches s.
+func matchesAny(patterns []string, s string) (string, bool) {
+
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			if *verbose {
+				fmt.Printf("%s ignore pattern %v %v\n", logts(), p, err)
+			}
+			continue
+		}
+		if re.MatchString(s) {
+			return p, true
+		}
+	}
+	return "", false
+
+}
+
+// isIgnorable decides whether an email is routine non-claim mail,
+// returning the pattern responsible if it is.
+func isIgnorable(m Email) (bool, string) {
+
+	subjects, senders := cfg.IgnoreSubjects, cfg.IgnoreSenders
+	if subjects == nil {
+		subjects = defaultIgnoreSubjects
+	}
+	if senders == nil {
+		senders = defaultIgnoreSenders
+	}
+	if p, ok := matchesAny(subjects, m.Subject); ok {
+		return true, "Subject " + p
+	}
+	from := m.Header.Get("From")
+	if len(m.From) > 0 {
+		from = m.From[0].Address
+	}
+	if p, ok := matchesAny(senders, from); ok {
+		return true, "From " + p
+	}
+	return false, ""
+
+}
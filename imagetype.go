@@ -0,0 +1,61 @@
+package main
+
+/*
+ * Phones and mail clients don't always label images correctly, a JPEG
+ * called IMG_1234.HEIC isn't unusual, so I look at the first few bytes of
+ * the image itself before deciding how to handle it.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// heifBrands are the ISO-BMFF major brands used by HEIC/HEIF files.
+var heifBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "hevm", "hevs", "mif1", "msf1"}
+
+// sniffImageExt returns the extension matching the content of an image,
+// or "" if it isn't recognised.
+func sniffImageExt(pic []byte) string {
+
+	switch {
+	case bytes.HasPrefix(pic, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	case bytes.HasPrefix(pic, []byte{0x89, 'P', 'N', 'G'}):
+		return ".png"
+	case bytes.HasPrefix(pic, []byte("GIF8")):
+		return ".gif"
+	case len(pic) >= 12 && bytes.HasPrefix(pic, []byte("RIFF")) && string(pic[8:12]) == "WEBP":
+		return ".webp"
+	case bytes.HasPrefix(pic, []byte("II*\x00")) || bytes.HasPrefix(pic, []byte("MM\x00*")):
+		return ".tiff"
+	case bytes.HasPrefix(pic, []byte("BM")):
+		return ".bmp"
+	case len(pic) >= 12 && string(pic[4:8]) == "ftyp":
+		brand := string(pic[8:12])
+		for _, b := range heifBrands {
+			if brand == b {
+				return ".heic"
+			}
+		}
+	}
+	return ""
+
+}
+
+// contentImageExt chooses the extension by content, falling back on the
+// filename if the content isn't recognised.
+func contentImageExt(pic []byte, filename string) string {
+
+	named := imageExt(filename)
+	ext := sniffImageExt(pic)
+	if ext == "" {
+		return named
+	}
+	if ext != named && named != "" && !(ext == ".jpg" && named == ".jpeg") && *verbose {
+		fmt.Printf("%s image named %v is really %v\n", logts(), named, ext)
+	}
+	return ext
+
+}
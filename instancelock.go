@@ -0,0 +1,151 @@
+package main
+
+/*
+ * Two copies of me fetching into one database, left running on a laptop
+ * and started again on another say, store every claim twice. Whilst
+ * monitoring I keep a row in ebcinstance saying who I am and refresh its
+ * Heartbeat every minute. Another copy finding a fresh heartbeat from
+ * someone else refuses to start. A copy which crashed stops refreshing so
+ * its row is taken over once it's instanceStale old or, on the same host,
+ * as soon as its process has gone. A copy which was only stalled, its
+ * laptop asleep say, finds its row gone at its next heartbeat and claims
+ * the database afresh, or stops if the other copy still holds it.
+ *
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+const instanceHeartbeat = time.Minute
+const instanceStale = 5 * time.Minute
+
+// instanceOwner describes who holds the database.
+type instanceOwner struct {
+	PID       int
+	Host      string
+	Started   string
+	Heartbeat time.Time
+}
+
+func (owner instanceOwner) String() string {
+	return fmt.Sprintf("process %v on %v, started %v", owner.PID, owner.Host, owner.Started)
+}
+
+// processAlive reports whether a process on this host is still running.
+func processAlive(pid int) bool {
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true // FindProcess has opened it
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+
+}
+
+// instanceHeld reports whether the owner recorded is some other copy still running.
+func instanceHeld(owner instanceOwner, host string, now time.Time) bool {
+
+	if owner.PID == os.Getpid() && owner.Host == host {
+		return false
+	}
+	if now.Sub(owner.Heartbeat) >= instanceStale {
+		return false
+	}
+	return owner.Host != host || processAlive(owner.PID)
+
+}
+
+// claimInstance records me as the copy fetching into this database, unless
+// another copy is, returning that one.
+func claimInstance(now time.Time) (instanceOwner, error) {
+
+	host, _ := os.Hostname()
+	var held instanceOwner
+	err := dbWriteTx(func(tx *sql.Tx) error {
+		var owner instanceOwner
+		var hb string
+		err := tx.QueryRow("SELECT PID,Host,Started,Heartbeat FROM ebcinstance").Scan(&owner.PID, &owner.Host, &owner.Started, &hb)
+		if err == nil {
+			owner.Heartbeat, _ = time.Parse(time.RFC3339, hb)
+			if instanceHeld(owner, host, now) {
+				held = owner
+				return nil
+			}
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM ebcinstance"); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO ebcinstance (PID,Host,Started,Heartbeat) VALUES(?,?,?,?)",
+			os.Getpid(), host, now.Format(myTimeFormat), now.UTC().Format(time.RFC3339))
+		return err
+	})
+	return held, err
+
+}
+
+// heartbeat keeps my claim on the database fresh, claiming it again if my
+// row has gone. It returns whoever holds it instead of me, if anyone.
+func heartbeat(now time.Time) instanceOwner {
+
+	host, _ := os.Hostname()
+	res, err := dbExec("UPDATE ebcinstance SET Heartbeat=? WHERE PID=? AND Host=?", now.UTC().Format(time.RFC3339), os.Getpid(), host)
+	if err != nil {
+		return instanceOwner{} // Try again next time
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return instanceOwner{}
+	}
+	held, err := claimInstance(now)
+	if err != nil {
+		return instanceOwner{}
+	}
+	if held.PID == 0 {
+		fmt.Printf("%s my claim on %v had lapsed, claimed it again\n", logts(), *path2db)
+	}
+	return held
+
+}
+
+// lockInstance stops me if another copy is fetching into this database,
+// then keeps my claim fresh until I exit.
+func lockInstance() {
+
+	held, err := claimInstance(time.Now())
+	if err != nil {
+		fmt.Printf("%s: can't check for other copies of me %v\n", apptitle, err)
+		return
+	}
+	if held.PID != 0 {
+		fmt.Printf("%s: already running against %v as %v. Run aborted\n", apptitle, *path2db, held)
+		osExit(1)
+	}
+	go func() {
+		for range time.Tick(instanceHeartbeat) {
+			if held := heartbeat(time.Now()); held.PID != 0 {
+				fmt.Printf("%s %v has taken over %v, stopping\n", logts(), held, *path2db)
+				requestStop()
+				return
+			}
+		}
+	}()
+
+}
+
+// releaseInstance gives up my claim on the database.
+func releaseInstance() {
+
+	host, _ := os.Hostname()
+	dbExec("DELETE FROM ebcinstance WHERE PID=? AND Host=?", os.Getpid(), host)
+
+}
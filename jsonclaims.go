@@ -0,0 +1,131 @@
+package main
+
+/*
+ * Riders using automated tools, phone shortcuts and the like, may send a
+ * claim as JSON in the body of the email instead of typing the subject:-
+ *
+ *		{"entrant": 12, "bonus": "A4", "odo": 10423,
+ *		 "time": "2026-06-01T14:32:00+01:00", "extra": "1862",
+ *		 "gps": {"lat": 52.95, "lon": -1.15, "accuracy": 8}}
+ *
+ * The format is defined by schema/claim.schema.json and checked here to the
+ * same rules. Every JSON body received is archived in ebcjsonclaims, valid
+ * or not, before the claim goes through the normal process.
+ *
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type jsonGPS struct {
+	Lat      *float64 `json:"lat"`
+	Lon      *float64 `json:"lon"`
+	Accuracy float64  `json:"accuracy"`
+}
+
+type jsonClaim struct {
+	Entrant int      `json:"entrant"`
+	Bonus   string   `json:"bonus"`
+	Odo     *int     `json:"odo"`
+	Time    string   `json:"time"`
+	Extra   string   `json:"extra"`
+	GPS     *jsonGPS `json:"gps"`
+}
+
+var jsonBonusRE = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// isJSONClaim reports whether an email body looks like a JSON claim.
+func isJSONClaim(body string) bool {
+	return strings.HasPrefix(strings.TrimSpace(body), "{")
+}
+
+// parseJSONClaim decodes and validates a JSON claim.
+func parseJSONClaim(body string) (*jsonClaim, error) {
+
+	var jc jsonClaim
+	dec := json.NewDecoder(strings.NewReader(strings.TrimSpace(body)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&jc); err != nil {
+		return nil, err
+	}
+	switch {
+	case jc.Entrant < 1:
+		return nil, fmt.Errorf("entrant is missing")
+	case !jsonBonusRE.MatchString(jc.Bonus):
+		return nil, fmt.Errorf("bonus %q is missing or invalid", jc.Bonus)
+	case jc.Odo != nil && *jc.Odo < 0:
+		return nil, fmt.Errorf("odo %v is negative", *jc.Odo)
+	}
+	if _, err := time.Parse(time.RFC3339, jc.Time); err != nil {
+		return nil, fmt.Errorf("time %q isn't RFC 3339", jc.Time)
+	}
+	if g := jc.GPS; g != nil {
+		if g.Lat == nil || g.Lon == nil || *g.Lat < -90 || *g.Lat > 90 || *g.Lon < -180 || *g.Lon > 180 || g.Accuracy < 0 {
+			return nil, fmt.Errorf("gps is invalid")
+		}
+	}
+	return &jc, nil
+
+}
+
+// fourFields turns a valid JSON claim into the usual parsed form.
+func (jc *jsonClaim) fourFields() *fourFields {
+
+	ct, _ := time.Parse(time.RFC3339, jc.Time)
+	ct = ct.In(cfg.LocalTZ)
+	f4 := &fourFields{ok: true, EntrantID: jc.Entrant, BonusID: strings.ToUpper(jc.Bonus), ClaimTime: ct, Extra: jc.Extra}
+	if jc.Odo != nil {
+		f4.OdoReading, f4.OdoOk = *jc.Odo, true
+	}
+	f4.TimeHH, f4.TimeMM, f4.TimeOk = ct.Hour(), ct.Minute(), true
+	f4.HHmm = ct.Format("1504")
+	return f4
+
+}
+
+// subject gives the equivalent typed subject, for logs and the judges.
+func (jc *jsonClaim) subject() string {
+
+	res := []string{strconv.Itoa(jc.Entrant), strings.ToUpper(jc.Bonus)}
+	if jc.Odo != nil {
+		res = append(res, strconv.Itoa(*jc.Odo))
+	}
+	f4 := jc.fourFields()
+	res = append(res, f4.HHmm)
+	if jc.Extra != "" {
+		res = append(res, jc.Extra)
+	}
+	return strings.Join(res, " ")
+
+}
+
+// archiveJSONClaim keeps the raw JSON, compacted, along with whether it was accepted.
+func archiveJSONClaim(emailid uint32, from string, body string, jc *jsonClaim, err error) {
+
+	var raw bytes.Buffer
+	if json.Compact(&raw, []byte(strings.TrimSpace(body))) != nil {
+		raw.Reset()
+		raw.WriteString(body)
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	var lat, lon interface{}
+	if jc != nil && jc.GPS != nil {
+		lat, lon = *jc.GPS.Lat, *jc.GPS.Lon
+	}
+	_, xerr := dbExec("INSERT INTO ebcjsonclaims (LoggedAt,EmailID,FromAddr,JSON,Result,Latitude,Longitude) VALUES(?,?,?,?,?,?,?)",
+		storeTimeDB(time.Now()), emailid, from, raw.String(), result, lat, lon)
+	if xerr != nil {
+		fmt.Printf("%s can't archive JSON claim %v\n", logts(), xerr)
+	}
+
+}
@@ -0,0 +1,76 @@
+package main
+
+/*
+ * Finish-line projectors and ScoreMaster screens like to show who has
+ * claimed most, which bonuses are popular and how busy each hour has been.
+ * Counting ebclaims for every refresh is wasteful so I keep the totals in
+ * three small tables, updated whenever a claim is stored or cancelled:-
+ *
+ *		ebcboardentrants	EntrantID, Claims, Bonuses (distinct), LastClaim
+ *		ebcboardbonuses		BonusID, Claims, Entrants (distinct)
+ *		ebcboardhours		Hour (of the claim time, 2006-01-02T15), Claims
+ *
+ * Cancelled claims aren't counted. The tables are rebuilt from scratch at
+ * startup so they can't drift from ebclaims for long.
+ *
+ */
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const liveClaims = "IfNull(RiderCancelled,0)=0"
+
+// rebuildLeaderboard recalculates all the totals.
+func rebuildLeaderboard() {
+
+	for _, sqlx := range []string{
+		"DELETE FROM ebcboardentrants",
+		"INSERT INTO ebcboardentrants SELECT EntrantID,count(*),count(DISTINCT BonusID),max(ClaimTime) FROM ebclaims WHERE " + liveClaims + " GROUP BY EntrantID",
+		"DELETE FROM ebcboardbonuses",
+		"INSERT INTO ebcboardbonuses SELECT BonusID,count(*),count(DISTINCT EntrantID) FROM ebclaims WHERE " + liveClaims + " GROUP BY BonusID",
+		"DELETE FROM ebcboardhours",
+		"INSERT INTO ebcboardhours SELECT substr(ClaimTime,1,13),count(*) FROM ebclaims WHERE " + liveClaims + " GROUP BY 1",
+	} {
+		if _, err := dbExec(sqlx); err != nil {
+			fmt.Printf("%s can't rebuild leaderboard %v\n", logts(), err)
+			return
+		}
+	}
+
+}
+
+// refreshLeaderboard recalculates the totals affected by one claim.
+func refreshLeaderboard(rowid int64) {
+
+	var entrant int
+	var bonus, hour string
+	err := dbh.QueryRow("SELECT EntrantID,BonusID,substr(ClaimTime,1,13) FROM ebclaims WHERE rowid=?", rowid).Scan(&entrant, &bonus, &hour)
+	if err != nil {
+		return
+	}
+	for _, x := range []struct {
+		clear, fill string
+		key         interface{}
+	}{
+		{"DELETE FROM ebcboardentrants WHERE EntrantID=?",
+			"INSERT INTO ebcboardentrants SELECT EntrantID,count(*),count(DISTINCT BonusID),max(ClaimTime) FROM ebclaims WHERE EntrantID=? AND " + liveClaims + " GROUP BY EntrantID", entrant},
+		{"DELETE FROM ebcboardbonuses WHERE BonusID=?",
+			"INSERT INTO ebcboardbonuses SELECT BonusID,count(*),count(DISTINCT EntrantID) FROM ebclaims WHERE BonusID=? AND " + liveClaims + " GROUP BY BonusID", bonus},
+		{"DELETE FROM ebcboardhours WHERE Hour=?",
+			"INSERT INTO ebcboardhours SELECT substr(ClaimTime,1,13),count(*) FROM ebclaims WHERE substr(ClaimTime,1,13)=? AND " + liveClaims + " GROUP BY 1", hour},
+	} {
+		err = dbWriteTx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(x.clear, x.key); err != nil {
+				return err
+			}
+			_, err := tx.Exec(x.fill, x.key)
+			return err
+		})
+		if err != nil {
+			fmt.Printf("%s can't update leaderboard %v\n", logts(), err)
+		}
+	}
+
+}
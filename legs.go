@@ -0,0 +1,96 @@
+package main
+
+/*
+ * Multi-leg rallies have separate start and finish times for each leg and
+ * some bonuses are only available during particular legs. Legs are described
+ * in the legs table; if that's empty the rally is treated as a single leg
+ * and none of this applies.
+ *
+ */
+
+import (
+	"fmt"
+	"time"
+)
+
+type rallyLeg struct {
+	Leg    int
+	Start  time.Time
+	Finish time.Time
+}
+
+var rallyLegs []rallyLeg
+
+// loadLegs reads the leg definitions, if any, from the database.
+func loadLegs() {
+
+	rallyLegs = nil
+	rows, err := dbh.Query("SELECT Leg,StartTime,FinishTime FROM legs ORDER BY Leg")
+	if err != nil {
+		fmt.Printf("%s: can't load legs %v\n", apptitle, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var leg rallyLeg
+		var st, ft string
+		rows.Scan(&leg.Leg, &st, &ft)
+		leg.Start, err = time.ParseInLocation("2006-01-02T15:04", st, cfg.LocalTZ)
+		if err != nil {
+			fmt.Printf("%s: Leg %v start %v cannot be parsed\n", apptitle, leg.Leg, st)
+			continue
+		}
+		leg.Finish, err = time.ParseInLocation("2006-01-02T15:04", ft, cfg.LocalTZ)
+		if err != nil {
+			fmt.Printf("%s: Leg %v finish %v cannot be parsed\n", apptitle, leg.Leg, ft)
+			continue
+		}
+		rallyLegs = append(rallyLegs, leg)
+	}
+	if *verbose && len(rallyLegs) > 0 {
+		fmt.Printf("%s: Rally has %v legs\n", apptitle, len(rallyLegs))
+	}
+
+}
+
+// legOfClaim returns the leg whose window includes the claim time, or zero.
+func legOfClaim(ct time.Time) int {
+
+	for _, leg := range rallyLegs {
+		if !ct.Before(leg.Start) && !ct.After(leg.Finish) {
+			return leg.Leg
+		}
+	}
+	return 0
+
+}
+
+// fetchBonusLeg returns the leg a bonus is restricted to, zero meaning any.
+func fetchBonusLeg(b string) int {
+
+	if !hasColumn("bonuses", "Leg") {
+		return 0
+	}
+	var leg int
+	dbh.QueryRow("SELECT IfNull("+col("bonuses", "Leg")+",0) FROM bonuses WHERE "+col("bonuses", "BonusID")+"=?", b).Scan(&leg)
+	return leg
+
+}
+
+// validateLegWindow flags claims made outside any leg or outside the bonus's own leg.
+func validateLegWindow(f4 fourFields, flags *claimFlags) {
+
+	if len(rallyLegs) == 0 || f4.ClaimTime.IsZero() {
+		return
+	}
+	leg := legOfClaim(f4.ClaimTime)
+	if leg == 0 {
+		flags.add(flagOutsideLegs)
+		return
+	}
+	bl := fetchBonusLeg(f4.BonusID)
+	if bl != 0 && bl != leg {
+		flags.add(flagWrongLeg)
+	}
+
+}
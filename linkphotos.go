@@ -0,0 +1,304 @@
+package main
+
+/*
+ * Photos don't always arrive as attachments. iPhones quietly replace large
+ * attachments with Apple Mail Drop links, so the claim arrives with no
+ * photos at all. If cfg.FetchMailDrop is set I look for such links in the
+ * body and download the files they point to, treating any images found as
+ * if they'd been attached. The file must be, and stay, on Apple's servers,
+ * https://*.icloud-content.com, whatever the link says.
+ *
+ * Android users tend to paste Google Photos or Drive share links instead.
+ * If cfg.FetchGoogleLinks is set I resolve these into the images themselves,
+ * provided every host involved is in cfg.LinkDomains.
+ *
+ * Anything else must be allowed explicitly: any link in the body matching
+ * one of the regexes in cfg.LinkPatterns is downloaded as is.
+ *
+ * Every download is limited to cfg.MaxDownloadMB and cfg.DownloadTimeout,
+ * no more than cfg.MaxLinksPerEmail are tried for any one email and each
+ * attempt is recorded in ebcdownloads. The link is kept in ebcphotos.SourceURL.
+ *
+ */
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const defaultMaxDownloadMB = 20
+const defaultDownloadTimeout = 60 // seconds
+const defaultMaxLinksPerEmail = 10
+
+var mailDropRE = regexp.MustCompile(`https://www\.icloud\.com/attachment/\?[^\s"'<>]+`)
+var googleLinkRE = regexp.MustCompile(`https://(?:photos\.app\.goo\.gl|photos\.google\.com|drive\.google\.com)/[^\s"'<>]+`)
+var anyLinkRE = regexp.MustCompile(`https?://[^\s"'<>]+`)
+var driveFileRE = regexp.MustCompile(`/file/d/([\w-]+)|[?&]id=([\w-]+)`)
+var ogImageRE = regexp.MustCompile(`<meta[^>]+property="og:image"[^>]+content="([^"]+)"`)
+
+// defaultLinkDomains is used unless cfg.LinkDomains is set
+var defaultLinkDomains = []string{"photos.app.goo.gl", "photos.google.com", "drive.google.com", "drive.usercontent.google.com", "lh3.googleusercontent.com"}
+
+// mailDropDomain is where Mail Drop files are kept
+const mailDropDomain = "icloud-content.com"
+
+// linkedPhotos downloads the photos linked from the body of an email.
+func linkedPhotos(m Email, emailid uint32) []emailPhoto {
+
+	var res []emailPhoto
+	body := m.TextBody + "\n" + m.HTMLBody
+	seen := make(map[string]bool)
+	maxlinks := cfg.MaxLinksPerEmail
+	if maxlinks < 1 {
+		maxlinks = defaultMaxLinksPerEmail
+	}
+
+	// fetch tries one link, resolved by get, and records the outcome
+	fetch := func(link string, get func(string) (emailPhoto, error)) {
+		if seen[link] || len(seen) >= maxlinks {
+			return
+		}
+		seen[link] = true
+		p, err := get(link)
+		auditDownload(emailid, link, p, err)
+		if err != nil {
+			if !*silent {
+				fmt.Printf("%s can't fetch %v %v\n", logts(), link, err)
+			}
+			return
+		}
+		res = append(res, p)
+	}
+
+	for _, link := range anyLinkRE.FindAllString(body, -1) {
+		link = strings.ReplaceAll(link, "&amp;", "&")
+		switch {
+		case cfg.FetchMailDrop && mailDropRE.MatchString(link):
+			fetch(link, mailDropPhoto)
+		case cfg.FetchGoogleLinks && googleLinkRE.MatchString(link):
+			fetch(link, googlePhoto)
+		case linkPatternMatch(link):
+			fetch(link, directPhoto)
+		}
+	}
+	return res
+
+}
+
+// auditDownload records an attempt to fetch a linked photo.
+func auditDownload(emailid uint32, link string, p emailPhoto, err error) {
+
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	sqlx := "INSERT INTO ebcdownloads (FetchedAt,EmailID,URL,Bytes,ContentType,Result) VALUES(?,?,?,?,?,?)"
+	_, xerr := dbExec(sqlx, storeTimeDB(time.Now()), emailid, link, len(p.Data), p.ContentType, result)
+	if xerr != nil && !*silent {
+		fmt.Printf("%s can't record download [%v] %v\n", logts(), emailid, xerr)
+	}
+
+}
+
+// mailDropPhoto fetches the file offered by a Mail Drop link.
+func mailDropPhoto(link string) (emailPhoto, error) {
+
+	var res emailPhoto
+	u, err := url.Parse(link)
+	if err != nil {
+		return res, err
+	}
+	src := u.Query().Get("u") // The file itself, the link is to a page offering it
+	name := u.Query().Get("f")
+	if src == "" {
+		return res, fmt.Errorf("no file in link")
+	}
+	if !mailDropFile(src) {
+		return res, fmt.Errorf("%v isn't a Mail Drop file", src)
+	}
+	if name == "" {
+		name = path.Base(src)
+	}
+	pic, ct, err := downloadLink(src, true)
+	if err != nil {
+		return res, err
+	}
+	if sniffImageExt(pic) == "" {
+		return res, fmt.Errorf("%v isn't an image", name)
+	}
+	res = emailPhoto{Name: name, Filename: name, ContentType: ct, ContentDisposition: `attachment; filename="` + name + `"`, Data: pic, SourceURL: link}
+	return res, nil
+
+}
+
+// mailDropFile reports whether a link is to a file on Apple's Mail Drop servers.
+func mailDropFile(link string) bool {
+
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return strings.HasSuffix(host, "."+mailDropDomain)
+
+}
+
+// directPhoto fetches an image from a link matching cfg.LinkPatterns.
+func directPhoto(link string) (emailPhoto, error) {
+
+	var res emailPhoto
+	pic, ct, err := downloadLink(link, true)
+	if err != nil {
+		return res, err
+	}
+	ext := sniffImageExt(pic)
+	if ext == "" {
+		return res, fmt.Errorf("not an image")
+	}
+	name := path.Base(strings.Split(link, "?")[0])
+	if imageExt(name) == "" {
+		name = "linked" + ext
+	}
+	res = emailPhoto{Name: name, Filename: name, ContentType: ct, Data: pic, SourceURL: link}
+	return res, nil
+
+}
+
+// linkPatternMatch checks a link against the organisers' own patterns.
+func linkPatternMatch(link string) bool {
+
+	for _, p := range cfg.LinkPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			if *verbose {
+				fmt.Printf("%s LinkPattern %v %v\n", logts(), p, err)
+			}
+			continue
+		}
+		if re.MatchString(link) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// linkAllowed checks a link against the organisers' patterns and the domain allowlist.
+func linkAllowed(link string) bool {
+
+	if linkPatternMatch(link) || (cfg.FetchMailDrop && mailDropFile(link)) {
+		return true
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	domains := cfg.LinkDomains
+	if len(domains) == 0 {
+		domains = defaultLinkDomains
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, d := range domains {
+		if host == strings.ToLower(d) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// googlePhoto resolves a Google Photos or Drive share link into the image it shares.
+func googlePhoto(link string) (emailPhoto, error) {
+
+	var res emailPhoto
+	if !linkAllowed(link) {
+		return res, fmt.Errorf("domain not allowed")
+	}
+	src := ""
+	if strings.Contains(link, "drive.google.com") {
+		x := driveFileRE.FindStringSubmatch(link)
+		if x == nil {
+			return res, fmt.Errorf("no file id")
+		}
+		id := x[1] + x[2]
+		src = "https://drive.google.com/uc?export=download&id=" + id
+	} else {
+		// Photos share pages name the image in their og:image tag
+		page, _, err := downloadLink(link, true)
+		if err != nil {
+			return res, err
+		}
+		x := ogImageRE.FindSubmatch(page)
+		if x == nil {
+			return res, fmt.Errorf("no image found")
+		}
+		src = strings.ReplaceAll(string(x[1]), "&amp;", "&")
+		if i := strings.LastIndex(src, "="); i > 0 {
+			src = src[:i] // Drop the size parameters
+		}
+		src += "=d" // and ask for the original
+	}
+	pic, ct, err := downloadLink(src, true)
+	if err != nil {
+		return res, err
+	}
+	ext := sniffImageExt(pic)
+	if ext == "" {
+		return res, fmt.Errorf("not an image")
+	}
+	name := "linked" + ext
+	res = emailPhoto{Name: name, Filename: name, ContentType: ct, Data: pic, SourceURL: link}
+	return res, nil
+
+}
+
+// downloadLink fetches a file, giving up if it's too big or too slow. If
+// allowlisted, redirects are only followed to hosts in the allowlist.
+func downloadLink(link string, allowlisted bool) ([]byte, string, error) {
+
+	maxmb := cfg.MaxDownloadMB
+	if maxmb < 1 {
+		maxmb = defaultMaxDownloadMB
+	}
+	secs := cfg.DownloadTimeout
+	if secs < 1 {
+		secs = defaultDownloadTimeout
+	}
+	client := &http.Client{Timeout: time.Duration(secs) * time.Second}
+	if allowlisted {
+		// Google redirects all over the place, I only follow it to allowed hosts
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) > 10 || !linkAllowed(req.URL.String()) {
+				return fmt.Errorf("redirect to %v not allowed", req.URL.Hostname())
+			}
+			return nil
+		}
+	}
+	resp, err := client.Get(link)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%v", resp.Status)
+	}
+	limit := int64(maxmb) << 20
+	if resp.ContentLength > limit {
+		return nil, "", fmt.Errorf("%v bytes exceeds %vMB", resp.ContentLength, maxmb)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > limit {
+		return nil, "", fmt.Errorf("exceeds %vMB", maxmb)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+
+}
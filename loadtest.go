@@ -0,0 +1,311 @@
+package main
+
+/*
+ * Before an event it's worth knowing that the laptop can keep up when a
+ * few hundred riders reach a checkpoint at once:-
+ *
+ *		ebcfetch -db sm/ScoreMaster.db loadtest -n 300
+ *
+ * makes up n claims from registered entrants for real bonuses, each with a
+ * photo, and feeds them straight through the normal claim process against
+ * a temporary copy of the database, then reports how fast they went and
+ * which were slowest. Nothing is sent: mail, hooks and alerts are switched
+ * off for the run and the copy is thrown away afterwards.
+ *
+ * With -inject the claims are instead appended to the configured mailbox,
+ * which had better be a test one, for the next ordinary run to fetch.
+ *
+ */
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// syntheticRider is an entrant able to send claims.
+type syntheticRider struct {
+	EntrantID int
+	Email     string
+}
+
+// loadTestRiders returns the entrants with registered addresses.
+func loadTestRiders() []syntheticRider {
+
+	var res []syntheticRider
+	rows, err := dbh.Query("SELECT EntrantID,Email FROM entrant_emails ORDER BY EntrantID,Email")
+	if err != nil {
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r syntheticRider
+		rows.Scan(&r.EntrantID, &r.Email)
+		res = append(res, r)
+	}
+	return res
+
+}
+
+// loadTestBonuses returns the bonuses which may be claimed.
+func loadTestBonuses() []string {
+
+	var res []string
+	rows, err := dbh.Query("SELECT " + col("bonuses", "BonusID") + " FROM bonuses ORDER BY 1")
+	if err != nil {
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b string
+		rows.Scan(&b)
+		res = append(res, b)
+	}
+	return res
+
+}
+
+// syntheticPhoto makes a small JPEG, different each time, standing in for a claim photo.
+func syntheticPhoto(n int, size int) []byte {
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size*3/4))
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, color.RGBA{uint8(x + n), uint8(y * n), uint8(n), 255})
+		}
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80})
+	return buf.Bytes()
+
+}
+
+// syntheticClaim builds the raw text of claim email number n.
+func syntheticClaim(n int, r syntheticRider, bonus string, at time.Time, photo []byte) []byte {
+
+	var sb strings.Builder
+	boundary := fmt.Sprintf("loadtest-%d", n)
+	fmt.Fprintf(&sb, "From: %s\r\n", r.Email)
+	fmt.Fprintf(&sb, "To: %s\r\n", cfg.ImapLogin)
+	fmt.Fprintf(&sb, "Subject: %d %s %d %s\r\n", r.EntrantID, bonus, 10000+n, at.Format("1504"))
+	fmt.Fprintf(&sb, "Date: %s\r\n", at.Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "Message-ID: <loadtest-%d-%d@ebcfetch>\r\n", at.Unix(), n)
+	fmt.Fprintf(&sb, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&sb, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nLoad test claim %d\r\n", boundary, n)
+	fmt.Fprintf(&sb, "--%s\r\nContent-Type: image/jpeg\r\nContent-Disposition: attachment; filename=\"IMG_%04d.jpg\"\r\n", boundary, n)
+	sb.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	enc := base64.StdEncoding.EncodeToString(photo)
+	for len(enc) > 76 {
+		sb.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	fmt.Fprintf(&sb, "%s\r\n--%s--\r\n", enc, boundary)
+	return []byte(sb.String())
+
+}
+
+// syntheticClaims makes n claim emails spread across the riders and bonuses.
+func syntheticClaims(n int, photoSize int) ([][]byte, error) {
+
+	riders := loadTestRiders()
+	bonuses := loadTestBonuses()
+	if len(riders) == 0 || len(bonuses) == 0 {
+		return nil, fmt.Errorf("need entrants with email addresses and bonuses to claim")
+	}
+	now := time.Now()
+	var res [][]byte
+	for i := 1; i <= n; i++ {
+		res = append(res, syntheticClaim(i, riders[i%len(riders)], bonuses[i%len(bonuses)], now, syntheticPhoto(i, photoSize)))
+	}
+	return res, nil
+
+}
+
+// useScratchDatabase switches dbh to a copy of the database in dir.
+func useScratchDatabase(dir string) error {
+
+	var path string
+	dbh.QueryRow("SELECT file FROM pragma_database_list WHERE name='main'").Scan(&path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	copyPath := filepath.Join(dir, filepath.Base(path))
+	if abs, _ := filepath.Abs(copyPath); abs == path {
+		return fmt.Errorf("%v is the live database", path)
+	}
+	if err = os.WriteFile(copyPath, data, 0644); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", copyPath)
+	if err != nil {
+		return err
+	}
+	dbh.Close()
+	dbh = db
+	return nil
+
+}
+
+// useSandbox switches to a copy of the database in dir, with photos stored
+// alongside, and turns off everything which would reach the outside world.
+func useSandbox(dir string) error {
+
+	if err := useScratchDatabase(dir); err != nil {
+		return err
+	}
+	sandboxSettings(dir)
+	return nil
+
+}
+
+// sandboxSettings stores photos and quarantined emails in dir and turns off
+// everything which would reach the outside world.
+func sandboxSettings(dir string) {
+
+	cfg.Path2SM, cfg.ReceiptsFolder, cfg.QuarantineFolder = dir, "", filepath.Join(dir, "quarantine")
+	os.MkdirAll(filepath.Join(dir, cfg.ImageFolder), 0755)
+	cfg.TestMode, cfg.TrapMails = false, false
+	cfg.SmtpStuff, cfg.Hooks, cfg.AdminAddresses, cfg.ScorerAddress = EmailSettings{}, nil, nil, ""
+	cfg.AlertAddresses = nil
+	cfg.TeamDuplicateNotice = false
+
+}
+
+// loadTestResult summarises how the pipeline coped.
+type loadTestResult struct {
+	Claims   int
+	Elapsed  time.Duration
+	Each     []time.Duration
+	Stored   int
+	Rejected int
+	Ignored  int
+	Retry    int
+}
+
+func (lt loadTestResult) String() string {
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v claims in %v, %.1f/sec\n", lt.Claims, lt.Elapsed.Round(time.Millisecond), float64(lt.Claims)/lt.Elapsed.Seconds())
+	fmt.Fprintf(&sb, "stored %v, rejected %v, ignored %v, left for retry %v\n", lt.Stored, lt.Rejected, lt.Ignored, lt.Retry)
+	if len(lt.Each) > 0 {
+		each := append([]time.Duration(nil), lt.Each...)
+		sort.Slice(each, func(i, j int) bool { return each[i] < each[j] })
+		pc := func(p int) time.Duration { return each[(len(each)-1)*p/100].Round(time.Microsecond) }
+		fmt.Fprintf(&sb, "per claim: median %v, 95%% %v, slowest %v\n", pc(50), pc(95), pc(100))
+	}
+	return sb.String()
+
+}
+
+// pipelineLoadTest feeds raw emails through processMessages, timing each.
+// The channel is unbuffered so each send completes only when there's room
+// in the pipeline, see pipeline.go, for another message.
+func pipelineLoadTest(raws [][]byte) loadTestResult {
+
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message)
+	claimed, dealtwith, ignored, skipped := new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet)
+	done := make(chan bool)
+	prepared := prepareMessages(messages, section)
+	go func() {
+		for !processMessages(prepared, claimed, dealtwith, ignored, skipped) {
+			// One of them panicked, carry on with the rest
+		}
+		done <- true
+	}()
+
+	var lt loadTestResult
+	start := time.Now()
+	last := start
+	for i, raw := range raws {
+		body := map[*imap.BodySectionName]imap.Literal{{}: bytes.NewBuffer(raw)} // As the server would answer section
+		msg := &imap.Message{Uid: uint32(i + 1), InternalDate: time.Now(), Body: body}
+		messages <- msg
+		if i > 0 {
+			lt.Each = append(lt.Each, time.Since(last))
+		}
+		last = time.Now()
+	}
+	close(messages)
+	<-done
+	if len(raws) > 0 {
+		lt.Each = append(lt.Each, time.Since(last))
+	}
+	lt.Elapsed = time.Since(start)
+	lt.Claims = len(raws)
+	lt.Stored, lt.Rejected = seqSetLen(claimed), seqSetLen(dealtwith)
+	lt.Ignored, lt.Retry = seqSetLen(ignored), seqSetLen(skipped)
+	return lt
+
+}
+
+// injectLoadTest appends the emails to the INBOX.
+func injectLoadTest(raws [][]byte) error {
+
+	c, err := imapConnect()
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	start := time.Now()
+	for _, raw := range raws {
+		if err = c.Append("INBOX", nil, time.Now(), bytes.NewBuffer(raw)); err != nil {
+			return fmt.Errorf("Append: %v", err)
+		}
+	}
+	fmt.Printf("%s: appended %v claims to %v in %v\n", apptitle, len(raws), cfg.ImapLogin, time.Since(start).Round(time.Millisecond))
+	return nil
+
+}
+
+func runLoadTest(args []string) int {
+
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	n := fs.Int("n", 300, "Number of claims")
+	photoSize := fs.Int("photo", 1600, "Width of each photo in pixels")
+	inject := fs.Bool("inject", false, "Append the claims to the mailbox instead")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	raws, err := syntheticClaims(*n, *photoSize)
+	if err != nil {
+		fmt.Printf("%s: loadtest %v\n", apptitle, err)
+		return 1
+	}
+	if *inject {
+		if err = injectLoadTest(raws); err != nil {
+			fmt.Printf("%s: loadtest %v\n", apptitle, err)
+			return 1
+		}
+		return 0
+	}
+
+	dir, err := os.MkdirTemp("", "ebcloadtest")
+	if err != nil {
+		fmt.Printf("%s: loadtest %v\n", apptitle, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	if err = useSandbox(dir); err != nil {
+		fmt.Printf("%s: loadtest can't copy database %v\n", apptitle, err)
+		return 1
+	}
+	cfg.ClaimRateLimit = 0 // A burst is the whole point
+
+	fmt.Print(pipelineLoadTest(raws))
+	return 0
+
+}
@@ -0,0 +1,279 @@
+package main
+
+/*
+ * Everything I have to say goes to the console, which is fine while someone
+ * is watching but no use for finding out what happened overnight. With
+ * cfg.LogFile set, it's also written to that file, one entry per line, as
+ * text or, with cfg.LogFormat: json, as JSON objects. The file is rotated
+ * when it reaches cfg.LogMaxMB, keeping cfg.LogKeep old ones as LogFile.1,
+ * LogFile.2 and so on.
+ *
+ * Each entry has a level: debug, info, warn or error. Entries below
+ * cfg.LogLevel, default info, aren't written to the file. Messages written
+ * with logAt say what level they are; the rest of my output is read back
+ * from stdout and given a level by what it says, ERROR or FAILED being
+ * errors and WARNING or can't warnings.
+ *
+ * -s silences the console as usual but not the file.
+ *
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxMB = 10
+	defaultLogKeep  = 5
+)
+
+// Log levels
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// parseLevel turns a level name into a level, info if it isn't one.
+func parseLevel(s string) int {
+
+	for i, n := range levelNames {
+		if strings.EqualFold(strings.TrimSpace(s), n) {
+			return i
+		}
+	}
+	return levelInfo
+
+}
+
+// logtsRE matches the timestamps of logts and the log package, the entry has its own
+var logtsRE = regexp.MustCompile(`^\d{4}[-/]\d\d[-/]\d\d \d\d:\d\d:\d\d:? *`)
+
+// lineLevel guesses the level of a line of ordinary output.
+func lineLevel(line string) int {
+
+	switch {
+	case strings.Contains(line, "ERROR") || strings.Contains(line, "FAILED") || strings.Contains(line, "OMG"):
+		return levelError
+	case strings.Contains(line, "WARNING") || strings.Contains(line, "can't") || strings.Contains(line, "Can't"):
+		return levelWarn
+	}
+	return levelInfo
+
+}
+
+// rotatingFile is a log file which is rotated when it grows too big.
+type rotatingFile struct {
+	path string
+	max  int64
+	keep int
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxmb int, keep int) (*rotatingFile, error) {
+
+	if maxmb < 1 {
+		maxmb = defaultLogMaxMB
+	}
+	if keep < 1 {
+		keep = defaultLogKeep
+	}
+	rf := &rotatingFile{path: path, max: int64(maxmb) << 20, keep: keep}
+	return rf, rf.open()
+
+}
+
+func (rf *rotatingFile) open() error {
+
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, st.Size()
+	return nil
+
+}
+
+// rotate shuffles the old files along, dropping the oldest, and starts afresh.
+func (rf *rotatingFile) rotate() error {
+
+	rf.f.Close()
+	os.Remove(rf.path + "." + strconv.Itoa(rf.keep))
+	for i := rf.keep - 1; i >= 1; i-- {
+		os.Rename(rf.path+"."+strconv.Itoa(i), rf.path+"."+strconv.Itoa(i+1))
+	}
+	os.Rename(rf.path, rf.path+".1")
+	return rf.open()
+
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.max {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
+
+// logger writes entries to the log file.
+var logger struct {
+	sync.Mutex
+	out     io.WriteCloser
+	json    bool
+	level   int
+	console *os.File      // The real stdout
+	quiet   bool          // Nothing for the console, -s
+	pipe    *os.File      // Writing end of stdout's replacement
+	done    chan struct{} // Closed once stdout has been read to the end
+}
+
+// logEntry is one line of the log.
+type logEntry struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+// writeLog writes an entry to the log file, if it's wanted there.
+func writeLog(level int, msg string) {
+
+	logger.Lock()
+	defer logger.Unlock()
+	if logger.out == nil || level < logger.level {
+		return
+	}
+	e := logEntry{Time: time.Now().Format(time.RFC3339), Level: levelNames[level], Msg: logtsRE.ReplaceAllString(msg, "")}
+	if logger.json {
+		b, _ := json.Marshal(e)
+		logger.out.Write(append(b, '\n'))
+		return
+	}
+	fmt.Fprintf(logger.out, "%v %-5v %v\n", e.Time, strings.ToUpper(e.Level), e.Msg)
+
+}
+
+// logAt reports something at a particular level, to the console and the log file.
+func logAt(level int, format string, args ...interface{}) {
+
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	if logger.out == nil {
+		if !*silent {
+			fmt.Printf("%s %v\n", logts(), msg)
+		}
+		return
+	}
+	if !logger.quiet {
+		fmt.Fprintf(logger.console, "%s %v\n", logts(), msg)
+	}
+	writeLog(level, msg)
+
+}
+
+// levelWriter logs whatever's written to it at one level, for the log package.
+type levelWriter int
+
+func (lw levelWriter) Write(p []byte) (int, error) {
+
+	if !logger.quiet {
+		os.Stderr.Write(p)
+	}
+	writeLog(int(lw), strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+
+}
+
+// consoleOut is the real stdout, for the status display.
+func consoleOut() *os.File {
+
+	if logger.console != nil {
+		return logger.console
+	}
+	return os.Stdout
+
+}
+
+// startLogging starts writing to cfg.LogFile, if there is one.
+func startLogging() error {
+
+	if cfg.LogFile == "" {
+		return nil
+	}
+	rf, err := openRotatingFile(cfg.LogFile, cfg.LogMaxMB, cfg.LogKeep)
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		rf.Close()
+		return err
+	}
+	logger.out, logger.json = rf, strings.EqualFold(cfg.LogFormat, "json")
+	logger.level = parseLevel(cfg.LogLevel)
+	logger.console, logger.pipe, logger.done = os.Stdout, w, make(chan struct{})
+	logger.quiet = *silent
+	*silent = false // The log file wants everything
+	os.Stdout = w
+	log.SetOutput(levelWriter(levelError))
+
+	go func() {
+		defer close(logger.done)
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			line := sc.Text()
+			if !logger.quiet {
+				fmt.Fprintln(logger.console, line)
+			}
+			if strings.TrimSpace(line) != "" {
+				writeLog(lineLevel(line), line)
+			}
+		}
+	}()
+	return nil
+
+}
+
+// stopLogging finishes writing the log file.
+func stopLogging() {
+
+	if logger.pipe == nil {
+		return
+	}
+	os.Stdout = logger.console
+	logger.pipe.Close()
+	<-logger.done
+	log.SetOutput(os.Stderr)
+	logger.Lock()
+	logger.out.Close()
+	logger.out, logger.pipe = nil, nil
+	logger.Unlock()
+
+}
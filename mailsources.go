@@ -0,0 +1,132 @@
+package main
+
+/*
+ * Some rallies take claims at more than one address, a gmail box and the
+ * club's own domain say, and some organisers file claims into folders.
+ * Besides the INBOX of the account configured as usual, I can fetch from:-
+ *
+ *		Mailboxes: [INBOX, Claims/Day1]
+ *		ExtraAccounts:
+ *		  - {Server: "mail.club.org:993", Login: claims@club.org, Password: secret, Mailboxes: [INBOX]}
+ *
+ * Mailboxes, default just the INBOX, are those of the main account; an
+ * extra account without Mailboxes has its INBOX fetched. Every cycle goes
+ * through each mailbox in turn and each claim records in ebclaims.Source
+ * which login and mailbox it came from. Only the main account may use OAuth.
+ *
+ * UIDs only mean anything within their mailbox so retries, paging and the
+ * CONDSTORE sync point are kept for each. IDLE, expunging, reprocess and
+ * retry-flagged only deal with the main account's INBOX. Accounts reached
+ * by POP3 or Microsoft Graph are described in fetchsource.go.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mailAccount is another IMAP account to fetch claims from.
+type mailAccount struct {
+	Server    string   `yaml:"Server"`
+	Login     string   `yaml:"Login"`
+	Password  string   `yaml:"Password"`
+	Mailboxes []string `yaml:"Mailboxes"`
+	Protocol  string   `yaml:"Protocol"` // imap or pop3, see fetchsource.go
+}
+
+// mailSource is one mailbox I fetch claims from.
+type mailSource struct {
+	account *mailAccount // nil for the main account
+	Mailbox string
+}
+
+// source is the mailbox being fetched from now.
+var source = mailSource{Mailbox: "INBOX"}
+
+func (ms mailSource) login() string {
+
+	if ms.account == nil {
+		return cfg.ImapLogin
+	}
+	return ms.account.Login
+
+}
+
+// Name identifies the source in ebclaims and messages.
+func (ms mailSource) Name() string {
+	return ms.login() + "/" + ms.Mailbox
+}
+
+// key identifies the source in my state tables. The main INBOX is "" as it
+// was before there were others.
+func (ms mailSource) key() string {
+
+	if ms.account == nil && ms.Mailbox == "INBOX" {
+		return ""
+	}
+	return ms.Name()
+
+}
+
+// usable reports whether an extra account has enough configured to log in.
+func (a *mailAccount) usable() bool {
+	return a.Server != "" && a.Login != "" && a.Password != ""
+}
+
+// mailSources lists the mailboxes to fetch from, the main INBOX first.
+func mailSources() []mailSource {
+
+	var res []mailSource
+	add := func(a *mailAccount, boxes []string) {
+		if len(boxes) == 0 || (mailSource{account: a}).protocol() == protocolPOP3 {
+			boxes = []string{"INBOX"} // POP3 has only the one
+		}
+		for _, mb := range boxes {
+			if mb = strings.TrimSpace(mb); mb != "" {
+				res = append(res, mailSource{account: a, Mailbox: mb})
+			}
+		}
+	}
+	add(nil, cfg.Mailboxes)
+	for i := range cfg.ExtraAccounts {
+		if a := &cfg.ExtraAccounts[i]; a.usable() {
+			add(a, a.Mailboxes)
+		}
+	}
+	return res
+
+}
+
+// checkExtraAccounts reports any extra accounts I can't use.
+func checkExtraAccounts() {
+
+	for _, a := range cfg.ExtraAccounts {
+		if !a.usable() {
+			fmt.Printf("%s: extra account %v on %v needs Server, Login and Password, ignoring it\n", apptitle, a.Login, a.Server)
+		}
+	}
+
+}
+
+// fetchAllClaims fetches new claims from each mailbox in turn.
+func fetchAllClaims() {
+
+	srcs := mailSources()
+	for _, ms := range srcs {
+		if stopRequested() {
+			break
+		}
+		source = ms
+		if debugging(debugIMAP) && len(srcs) > 1 {
+			fmt.Printf("%s fetching from %v\n", logts(), ms.Name())
+		}
+		if f := ms.fetcher(); f != nil {
+			fetchFromSource(f)
+		} else {
+			fetchNewClaims()
+		}
+	}
+	source = mailSource{Mailbox: "INBOX"}
+
+}
@@ -0,0 +1,229 @@
+package main
+
+/*
+ * Once processed, each email is marked to show what became of it so
+ * that it isn't fetched again, or is, if it needs another go.
+ *
+ * Normally this uses the standard flags: claims are marked \Seen, non-claims
+ * are \Flagged for manual attention and those to be retried have their
+ * flags cleared. With cfg.GmailLabels each state instead gets its own IMAP
+ * keyword, which Gmail shows as a label, and \Seen/\Flagged are left for
+ * humans to use. Ignored emails, auto-replies, admin commands and the like,
+ * get one of their own so they're neither taken for rejects nor fetched again.
+ *
+ * cfg.StateKeywords does the same with private keywords, $EBCProcessed and
+ * $EBCRejected, for other servers so that people reading the shared mailbox
+ * can open messages without disturbing me. Not every server lets clients
+ * invent keywords so I only use them if the INBOX's PERMANENTFLAGS say I may,
+ * otherwise I carry on with the standard flags.
+ *
+ */
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Processing states of emails
+const (
+	mailClaimed  = iota // Stored as a claim
+	mailRejected        // Not a claim or not processable, needs human attention
+	mailIgnored         // Not a claim and of no interest
+	mailRetry           // Couldn't be stored just now, try again later
+)
+
+const (
+	defaultLabelClaimed  = "EBC/Claimed"
+	defaultLabelRejected = "EBC/Rejected"
+	defaultLabelIgnored  = "EBC/Ignored"
+	defaultLabelRetry    = "EBC/Retry"
+)
+
+const (
+	keywordProcessed = "$EBCProcessed"
+	keywordRejected  = "$EBCRejected"
+)
+
+// keywordsAllowed records whether the selected mailbox accepts new keywords.
+var keywordsAllowed bool
+
+// allowsKeywords reports whether a mailbox's permanent flags let me store
+// my own keywords, either because they're already known or because the
+// server will create them on demand.
+func allowsKeywords(permanent []string) bool {
+
+	for _, f := range permanent {
+		if f == imap.TryCreateFlag || f == keywordProcessed {
+			return true
+		}
+	}
+	return false
+
+}
+
+// labelMode reports whether states are recorded as keywords of my own
+// rather than with \Seen/\Flagged.
+func labelMode() bool {
+
+	return cfg.GmailLabels || (cfg.StateKeywords && keywordsAllowed)
+
+}
+
+func labelOrDefault(label string, def string) string {
+
+	if label == "" {
+		return def
+	}
+	return label
+
+}
+
+// stateLabel returns the keyword used for a state in label mode.
+func stateLabel(state int) string {
+
+	if !cfg.GmailLabels {
+		if state == mailRejected {
+			return keywordRejected
+		}
+		return keywordProcessed
+	}
+	switch state {
+	case mailClaimed:
+		return labelOrDefault(cfg.LabelClaimed, defaultLabelClaimed)
+	case mailIgnored:
+		return labelOrDefault(cfg.LabelIgnored, defaultLabelIgnored)
+	case mailRetry:
+		return labelOrDefault(cfg.LabelRetry, defaultLabelRetry)
+	}
+	return labelOrDefault(cfg.LabelRejected, defaultLabelRejected)
+
+}
+
+// selectionExcludes lists the flags which exclude an email from fetching.
+func selectionExcludes() []string {
+
+	if cfg.GmailLabels {
+		return []string{stateLabel(mailClaimed), stateLabel(mailRejected), stateLabel(mailIgnored)}
+	}
+	if labelMode() {
+		return []string{stateLabel(mailClaimed), stateLabel(mailRejected)} // Ignored are marked processed
+	}
+	return cfg.SelectFlags
+
+}
+
+// markEmails records the processing state of a set of emails.
+func markEmails(c *client.Client, uids *imap.SeqSet, state int) error {
+
+	if uids.Empty() {
+		return nil
+	}
+	var item imap.StoreItem
+	var flags []interface{}
+	var what string
+	if labelMode() {
+		if state == mailRetry && !cfg.GmailLabels {
+			return nil // Nothing was stored so there's nothing to undo
+		}
+		item = imap.FormatFlagsOp(imap.AddFlags, true)
+		flags = []interface{}{stateLabel(state)}
+		what = "labelling"
+		if state == mailRetry {
+			// The label is informative only, retries aren't excluded from selection
+			what = "releasing"
+		}
+	} else {
+		switch state {
+		case mailClaimed:
+			item = imap.FormatFlagsOp(imap.AddFlags, true)
+			flags = []interface{}{imap.SeenFlag}
+			what = "marking read"
+		case mailRejected:
+			item = imap.FormatFlagsOp(imap.SetFlags, true)
+			flags = []interface{}{imap.FlaggedFlag}
+			what = "leaving unread"
+		case mailIgnored:
+			item = imap.FormatFlagsOp(imap.AddFlags, true)
+			flags = []interface{}{imap.SeenFlag}
+			what = "filing"
+		case mailRetry:
+			item = imap.FormatFlagsOp(imap.SetFlags, true)
+			flags = []interface{}{}
+			what = "releasing"
+		}
+	}
+	if debugging(debugIMAP) {
+		fmt.Printf("%s %v %v %v %v\n", logts(), what, uids, item, flags)
+	}
+	return c.UidStore(uids, item, flags, nil)
+
+}
+
+// uidExpunge is UID EXPUNGE from UIDPLUS, which go-imap lacks.
+type uidExpunge struct {
+	uids *imap.SeqSet
+}
+
+func (cmd *uidExpunge) Command() *imap.Command {
+	return &imap.Command{Name: "UID", Arguments: []interface{}{imap.RawString("EXPUNGE"), cmd.uids}}
+}
+
+// moveEmails moves emails to another mailbox, creating it if need be. Without
+// MOVE they're copied and deleted, expunging only them if the server has
+// UIDPLUS; otherwise anything else marked \Deleted goes too.
+func moveEmails(c *client.Client, uids *imap.SeqSet, mbox string) error {
+
+	if mbox == "" || uids.Empty() {
+		return nil
+	}
+	c.Create(mbox) // Fails harmlessly if it already exists
+	if debugging(debugIMAP) {
+		fmt.Printf("%s moving %v to %v\n", logts(), uids, mbox)
+	}
+	if ok, _ := c.Support("MOVE"); ok {
+		return c.UidMove(uids, mbox)
+	}
+	if ok, _ := c.Support("UIDPLUS"); !ok {
+		return c.UidMove(uids, mbox) // go-imap's own fallback
+	}
+	if err := c.UidCopy(uids, mbox); err != nil {
+		return err
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(uids, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	status, err := c.Execute(&uidExpunge{uids}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+
+}
+
+// archiveEmails files processed emails in the mailboxes configured for
+// them: claims in ArchiveMailbox, those needing attention in
+// RejectedMailbox and, in test mode, everything in TestMailbox. This keeps
+// the INBOX small, searches fast over a long event and problems easy to find.
+func archiveEmails(c *client.Client, state int, uids *imap.SeqSet) error {
+	return moveEmails(c, uids, archiveMailboxFor(state))
+}
+
+// archiveMailboxFor returns where emails in a state are filed, "" to leave them be.
+func archiveMailboxFor(state int) string {
+
+	switch {
+	case state == mailRetry:
+		return ""
+	case cfg.TestMode:
+		return cfg.TestMailbox
+	case state == mailClaimed:
+		return cfg.ArchiveMailbox
+	case state == mailRejected:
+		return cfg.RejectedMailbox
+	}
+	return ""
+
+}
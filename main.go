@@ -30,11 +30,9 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/mail"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -69,13 +67,16 @@ If using Gmail, 2-factor authentication must be enabled and an 'app password'
 must be created. To do that, edit the Google Account settings, [Security].
 Check that all is ok before the rally.`
 
-var verbose = flag.Bool("v", false, "Verbose")
 var silent = flag.Bool("s", false, "Silent")
 var yml = flag.String("cfg", "", "Path of YAML config file")
 var showusage = flag.Bool("?", false, "Show this help text")
 var path2db = flag.String("db", "sm/ScoreMaster.db", "Path of ScoreMaster database")
 var debugwait = flag.Bool("dw", false, "Wait for [Enter] at exit (debug)")
 var trapmails = flag.String("trap", "", "Path used to record trapped emails (overrides config)")
+var checksubject = flag.String("checksubject", "", "Show how a Subject line would be parsed and exit")
+var replay = flag.String("replay", "", "Feed a saved .eml file, or a folder of them, through the claim process and exit")
+var tuimode = flag.Bool("tui", false, "Show a full-screen status display instead of log lines")
+var dashaddr = flag.String("http", "", "Address for the web dashboard, eg :8079 (overrides config)")
 
 const apptitle = "EBCFetch"
 const appversion = "1.8"
@@ -98,13 +99,35 @@ type EmailSettings struct {
 }
 
 var cfg struct {
-	ImapServer            string    `yaml:"imapserver"`
-	ImapLogin             string    `yaml:"login"`
-	ImapPassword          string    `yaml:"password"`
-	NotBefore             time.Time `yaml:"notbefore,omitempty"`
-	NotAfter              time.Time `yaml:"notafter,omitempty"`
-	Subject               string    `yaml:"subject"`
-	Strict                string    `yaml:"strict"`
+	ImapServer            string        `yaml:"imapserver"`
+	ImapLogin             string        `yaml:"login"`
+	ImapPassword          string        `yaml:"password"`
+	OAuthProvider         string        `yaml:"OAuthProvider"`
+	OAuthClientID         string        `yaml:"OAuthClientID"`
+	OAuthClientSecret     string        `yaml:"OAuthClientSecret"`
+	OAuthTenant           string        `yaml:"OAuthTenant"`
+	OAuthRefreshToken     string        `yaml:"OAuthRefreshToken"`
+	OAuthScope            string        `yaml:"OAuthScope"`
+	OAuthDeviceURL        string        `yaml:"OAuthDeviceURL"`
+	OAuthTokenURL         string        `yaml:"OAuthTokenURL"`
+	NotBefore             time.Time     `yaml:"notbefore,omitempty"`
+	NotAfter              time.Time     `yaml:"notafter,omitempty"`
+	LeadTime              time.Duration `yaml:"LeadTime"`
+	LagTime               time.Duration `yaml:"LagTime"`
+	SendSummaries         bool          `yaml:"SendSummaries"`
+	SummaryDelay          time.Duration `yaml:"SummaryDelay"`
+	ClaimRateWindow       time.Duration `yaml:"ClaimRateWindow"`
+	ExifTimeTolerance     time.Duration `yaml:"ExifTimeTolerance"`
+	AutoStopAfter         time.Duration `yaml:"AutoStopAfter"`
+	ImapTimeout           time.Duration `yaml:"ImapTimeout"`
+	SmtpTimeout           time.Duration `yaml:"SmtpTimeout"`
+	ClockSkewWarn         time.Duration `yaml:"ClockSkewWarn"`
+	MaintenanceEvery      time.Duration `yaml:"MaintenanceEvery"`
+	WriteRetryFor         time.Duration `yaml:"WriteRetryFor"`
+	IdlePollEvery         time.Duration `yaml:"IdlePollEvery"`
+	AckEvery              time.Duration `yaml:"AckEvery"`
+	Subject               string        `yaml:"subject"`
+	Strict                string        `yaml:"strict"`
 	SubjectRE             *regexp.Regexp
 	StrictRE              *regexp.Regexp
 	RallyTitle            string
@@ -113,33 +136,174 @@ var cfg struct {
 	LocalTimezone         string
 	LocalTZ               *time.Location
 	OffsetTZ              string
+	FieldOrder            []string `yaml:"FieldOrder"`
 	SelectFlags           []string `yaml:"selectflags"`
 	CheckStrict           bool     `yaml:"checkstrict"`
 	SleepSeconds          int      `yaml:"sleepseconds"`
 	Path2SM               string   `yaml:"path2sm"`
+	Workers               int      `yaml:"Workers"`
 	ImageFolder           string   `yaml:"imagefolder"`
+	PDFFolder             string   `yaml:"PDFFolder"`
+	VideoFolder           string   `yaml:"VideoFolder"`
 	MatchEmail            bool     `yaml:"matchemail"`
+	EmailMatching         []string `yaml:"EmailMatching"` // Rules in emailmatch.go, in order
+	CheckSenderAuth       bool     `yaml:"CheckSenderAuth"`
+	SenderAuthServers     []string `yaml:"SenderAuthServers"`
+	RejectUnauthenticated bool     `yaml:"RejectUnauthenticated"`
 	Heic2jpg              string   `yaml:"heic2jpg"`
+	OdoOCR                bool     `yaml:"OdoOCR"`
+	OCRCommand            string   `yaml:"OCRCommand"`
+	QRCommand             string   `yaml:"QRCommand"`
 	ConvertHeic           bool     `yaml:"convertheic2jpg"`
+	JpegQuality           int      `yaml:"JpegQuality"`
+	MaxAttachmentMB       int      `yaml:"MaxAttachmentMB"`
+	MaxPhotoEdge          int      `yaml:"MaxPhotoEdge"`
+	KeepOriginals         bool     `yaml:"KeepOriginals"`
 	DontRun               bool     `yaml:"dontrun"`
 	KeyWait               bool     `yaml:"debugwait"`
 	AllowBody             bool     `yaml:"allowbody"`
+	ClaimsInBody          bool     `yaml:"ClaimsInBody"`
 	TrapMails             bool     `yaml:"trapmails"`
 	TrapPath              string   `yaml:"trappath"`
 	TestMode              bool     `yaml:"testmode"`
 	SmtpStuff             EmailSettings
-	TestModeLiteral       string `yaml:"TestModeLiteral"`
-	TestResponseSubject   string `yaml:"TestResponseSubject"`
-	TestResponseGood      string `yaml:"TestResponseGood"`
-	TestResponseBad       string `yaml:"TestResponseBad"`
-	TestResponseAdvice    string `yaml:"TestResponseAdvice"`
-	TestResponseBCC       string `yaml:"TestResponseBCC"`
-	TestResponseBadEmail  string `yaml:"TestResponseBadEmail"`
-	TestResponseGoodEmail string `yaml:"TestResponseGoodEmail"`
-	MaxExtraPhotos        int    `yaml:"MaxExtraPhotos"`
-	DebugVerbose          bool   `yaml:"verbose"`
+	TestModeLiteral       string            `yaml:"TestModeLiteral"`
+	TestResponseSubject   string            `yaml:"TestResponseSubject"`
+	TestResponseGood      string            `yaml:"TestResponseGood"`
+	TestResponseBad       string            `yaml:"TestResponseBad"`
+	TestResponseAdvice    string            `yaml:"TestResponseAdvice"`
+	TestResponseBCC       string            `yaml:"TestResponseBCC"`
+	TestResponseBadEmail  string            `yaml:"TestResponseBadEmail"`
+	TestResponseGoodEmail string            `yaml:"TestResponseGoodEmail"`
+	ResponseTemplates     map[string]string `yaml:"ResponseTemplates"`   // Keyed by language, "" for everyone else
+	ResponseTemplateDir   string            `yaml:"ResponseTemplateDir"` // testresponse.html, testresponse.fr.html, ...
+	MaxExtraPhotos        int               `yaml:"MaxExtraPhotos"`
+	DashboardAddr         string            `yaml:"DashboardAddr"`
+	APIToken              string            `yaml:"APIToken"`
+	ControlAddr           string            `yaml:"ControlAddr"` // Control API alone, always on 127.0.0.1
+	DashboardUser         string            `yaml:"DashboardUser"`
+	DashboardPassword     string            `yaml:"DashboardPassword"`
+	DashboardToken        string            `yaml:"DashboardToken"`
+	DashboardLocalOnly    bool              `yaml:"DashboardLocalOnly"`
+	OverrideSecret        string            `yaml:"OverrideSecret"`
+	ScorerAddress         string            `yaml:"ScorerAddress"`
+	OdoStartCode          string            `yaml:"OdoStartCode"`
+	OdoEndCode            string            `yaml:"OdoEndCode"`
+	FuelCode              string            `yaml:"FuelCode"`
+	WatermarkCommand      string            `yaml:"WatermarkCommand"`
+	ReceiptsFolder        string            `yaml:"ReceiptsFolder"`
+	QuarantineFolder      string            `yaml:"QuarantineFolder"`
+	EmailsFolder          string            `yaml:"EmailsFolder"`
+	TeamDuplicateNotice   bool              `yaml:"TeamDuplicateNotice"`
+	ClaimRateLimit        int               `yaml:"ClaimRateLimit"`
+	RallyPointIsComma     bool              `yaml:"RallyPointIsComma"`
+	QuotaWarnPercent      int               `yaml:"QuotaWarnPercent"`
+	IgnoreOverKB          int               `yaml:"IgnoreOverKB"`
+	MapPinMetres          int               `yaml:"MapPinMetres"`
+	UseIdle               bool              `yaml:"UseIdle"`
+	LogFile               string            `yaml:"LogFile"`
+	LogFormat             string            `yaml:"LogFormat"`
+	LogLevel              string            `yaml:"LogLevel"`
+	LogMaxMB              int               `yaml:"LogMaxMB"`
+	LogKeep               int               `yaml:"LogKeep"`
+	FollowUpPhotoMinutes  int               `yaml:"FollowUpPhotoMinutes"`
+	HeadersFirst          bool              `yaml:"HeadersFirst"`
+	ThrottleResponses     bool              `yaml:"ThrottleResponses"`
+	RejectionNotices      bool              `yaml:"RejectionNotices"`
+	Acknowledge           bool              `yaml:"Acknowledge"`
+	GmailLabels           bool              `yaml:"GmailLabels"`
+	StateKeywords         bool              `yaml:"StateKeywords"`
+	LabelClaimed          string            `yaml:"LabelClaimed"`
+	LabelRejected         string            `yaml:"LabelRejected"`
+	LabelIgnored          string            `yaml:"LabelIgnored"`
+	LabelRetry            string            `yaml:"LabelRetry"`
+	ArchiveMailbox        string            `yaml:"ArchiveMailbox"`
+	RejectedMailbox       string            `yaml:"RejectedMailbox"`
+	TestMailbox           string            `yaml:"TestMailbox"`
+	ExpungeProcessed      bool              `yaml:"ExpungeProcessed"`
+	ExpungeAfterDays      int               `yaml:"ExpungeAfterDays"`
+	ExpungeDryRun         bool              `yaml:"ExpungeDryRun"`
+	MaxAvgSpeed           int               `yaml:"MaxAvgSpeed"`
+	MinPhotoBytes         int               `yaml:"MinPhotoBytes"`
+	MinPhotoPixels        int               `yaml:"MinPhotoPixels"`
+	FetchMailDrop         bool              `yaml:"FetchMailDrop"`
+	MaxDownloadMB         int               `yaml:"MaxDownloadMB"`
+	DownloadTimeout       int               `yaml:"DownloadTimeout"`
+	FetchGoogleLinks      bool              `yaml:"FetchGoogleLinks"`
+	MaxLinksPerEmail      int               `yaml:"MaxLinksPerEmail"`
+	FetchPageSize         int               `yaml:"FetchPageSize"`
+	ExifClaimTime         string            `yaml:"ExifClaimTime"`
+	AutoStopExit          bool              `yaml:"AutoStopExit"`
+	DebugVerbose          bool              `yaml:"verbose"`
+
+	// Converter templates for file extensions other than HEIC
+	Converters map[string]string `yaml:"Converters"`
+
+	// Content types never counted as photos
+	IgnoreImageTypes []string `yaml:"IgnoreImageTypes"`
+
+	// Areas for debug output: imap, parse, photos, db, smtp or all
+	Debug []string `yaml:"Debug"`
+
+	// Domains of carrier SMS-to-email gateways
+	SMSGateways []string `yaml:"SMSGateways"`
+
+	// ScoreMaster column names where they differ from the usual, see dbschema.go
+	Columns map[string]string `yaml:"Columns"`
+
+	// Organisers' own validation rules, see rules.go
+	Rules []claimRule `yaml:"Rules"`
+
+	// Commands run on claim-stored, claim-rejected, claim-cancelled and photo-stored events
+	Hooks map[string]string `yaml:"Hooks"`
+
+	// Addresses allowed to send admin commands
+	AdminAddresses []string `yaml:"AdminAddresses"`
+	AdminSecret    string   `yaml:"AdminSecret"` // Proves commands from senders who can't be authenticated
+
+	// Who's told when things go wrong and when, see alerts.go
+	AlertAddresses    []string      `yaml:"AlertAddresses"`
+	AlertImapFailures int           `yaml:"AlertImapFailures"`
+	AlertQuietFor     time.Duration `yaml:"AlertQuietFor"`
+	AlertDBFailures   int           `yaml:"AlertDBFailures"`
+	AlertEvery        time.Duration `yaml:"AlertEvery"`
+
+	// Where daylight-only bonuses are, see daylight.go
+	RallyLatitude  float64 `yaml:"RallyLatitude"`
+	RallyLongitude float64 `yaml:"RallyLongitude"`
+
+	// Hosts from which linked photos may be downloaded
+	LinkDomains []string `yaml:"LinkDomains"`
+
+	// Regexes matching links whose targets are downloaded as claim photos
+	LinkPatterns []string `yaml:"LinkPatterns"`
+
+	// Regexes matching Subjects and From addresses of mail which is never a claim, see ignorelist.go
+	IgnoreSubjects []string `yaml:"IgnoreSubjects"`
+	IgnoreSenders  []string `yaml:"IgnoreSenders"`
+
+	// Subject lines and what they should parse as, see subjectexamples.go
+	SubjectExamples    []subjectExample  `yaml:"SubjectExamples"`
+	RejectionTemplates map[string]string `yaml:"RejectionTemplates"`
+	Mailboxes          []string          `yaml:"Mailboxes"`
+	MailProtocol       string            `yaml:"MailProtocol"` // imap, pop3 or graph, see fetchsource.go
+	POP3Delete         bool              `yaml:"POP3Delete"`
+	GraphURL           string            `yaml:"GraphURL"`
+	ExtraAccounts      []mailAccount     `yaml:"ExtraAccounts"`
+
+	// Poll intervals for particular periods, see pollschedule.go
+	PollSchedule []pollPeriod `yaml:"PollSchedule"`
+
+	// Further subject REs tried in order if subject doesn't match, eg a legacy format
+	Subjects   []string `yaml:"subjects"`
+	SubjectREs []*regexp.Regexp
 }
 
+// ebclaimsInsertCols are the columns written for each claim, in the order of the INSERT's values
+var ebclaimsInsertCols = []string{"LoggedAt", "DateTime", "EntrantID", "BonusID", "OdoReading",
+	"FinalTime", "EmailID", "ClaimHH", "ClaimMM", "ClaimTime", "Subject", "ExtraField",
+	"StrictOk", "AttachmentTime", "FirstTime", "PhotoID", "EbcFlags", "PhotoIDs"}
+
 // fourFields: this contains the results of parsing the Subject line.
 // The "four fields" are entrant, bonus, odo & claimtime
 type fourFields struct {
@@ -148,12 +312,17 @@ type fourFields struct {
 	BonusID    string
 	OdoReading int
 	OdoOk      bool
+	OdoValue   float64 // OdoReading with any fraction
+	OdoText    string  // As typed by the rider
 	ClaimTime  time.Time
 	HHmm       string
+	TimeTyped  string // As typed by the rider if it needed interpreting
 	TimeOk     bool
 	TimeHH     int
 	TimeMM     int
 	Extra      string
+
+	NameMatched bool // EntrantID was found from the rider's name
 }
 
 // testResponse contains the response to be sent to the sender when
@@ -161,6 +330,7 @@ type fourFields struct {
 // email received.
 type testResponse struct {
 	AddressIsRegistered bool   // Sender's email is registered for rally
+	EmailMatched        string // Which of the entrant's addresses, and how
 	ClaimSubject        string // The claim string retrieved from Subject or body
 	SubjectFromBody     bool
 	PhotoPresent        int
@@ -169,11 +339,25 @@ type testResponse struct {
 	BonusID             string
 	BonusIsReal         bool
 	BonusDesc           string
+	IsCombo             bool        // BonusID is a combination, not a bonus
+	Combo               comboInfo   // What it's made of
+	Combos              []comboInfo // Those the bonus counts towards
+	Attachments         []string    // PDFs and videos, described
 	OdoReading          int
 	HHmm                string
+	TimeTyped           string
 	ClaimDateTime       time.Time
 	ExtraField          string
+	Flags               claimFlags
+	Rejection           string // Reason given by a rule
+	AnswerNeeded        bool   // Bonus has an ExpectedAnswer
+	AnswerOk            bool
+	Requirements        bonusRequirements
+	Window              bonusWindow
 	Commentary          string
+	ClockSkew           time.Duration // Estimated error of the sender's clock
+	ClockSamples        int
+	SentAt              time.Time // Date header, in the sender's own timezone
 	ClaimIsGood         bool
 	ClaimIsPerfect      bool
 }
@@ -192,6 +376,41 @@ func extractTime(s string) string {
 	return strings.Trim(x[len(x)-1], " ")
 }
 
+var timeWithSecondsRE = regexp.MustCompile(`^(\d?\d[:.]\d\d)[:.]\d\d$`)
+var time12hrRE = regexp.MustCompile(`(?i)^(\d?\d)(?:[:.h]?(\d\d))?\s*([ap])\.?m\.?$`)
+var time24hrRE = regexp.MustCompile(`(?i)^(\d?\d)(?:[:.h]?(\d\d))(?:\s*hrs?)?$`)
+
+// normaliseTime turns the informal spellings riders use, "5.15pm", "1715hrs",
+// "17h15", "17:13:42", into hhmm. Anything else is returned unchanged.
+func normaliseTime(s string) string {
+
+	s = strings.TrimSpace(s)
+	if x := timeWithSecondsRE.FindStringSubmatch(s); x != nil {
+		s = x[1] // Phones often autocomplete times with seconds, I only want the minute
+	}
+	if x := time12hrRE.FindStringSubmatch(s); x != nil {
+		hh, _ := strconv.Atoi(x[1])
+		if hh < 1 || hh > 12 {
+			return s
+		}
+		hh = hh % 12
+		if strings.EqualFold(x[3], "p") {
+			hh += 12
+		}
+		mm := x[2]
+		if mm == "" {
+			mm = "00"
+		}
+		return fmt.Sprintf("%02d%v", hh, mm)
+	}
+	if x := time24hrRE.FindStringSubmatch(s); x != nil {
+		hh, _ := strconv.Atoi(x[1])
+		return fmt.Sprintf("%02d%v", hh, x[2])
+	}
+	return s
+
+}
+
 func parseTime(s string) time.Time {
 	//fmt.Printf("Parsing time from [ %v ]\n", s)
 	if s == "" {
@@ -279,7 +498,7 @@ func calcClaimDate(hh, mm int, rfc822date time.Time) time.Time {
 	} else {
 		year, mth, day = rfc822date.In(cfg.LocalTZ).Date() // The datetime parsed from the Date: field of the email. Timezone is whatever it is.
 	}
-	if cfg.DebugVerbose {
+	if debugging(debugParse) {
 		fmt.Printf("calcClaimDate called with y=%v m=%v d=%v hh=%v mm=%v\n", year, mth, day, hh, mm)
 	}
 	cd := time.Date(year, mth, day, hh, mm, 0, 0, cfg.LocalTZ)
@@ -347,7 +566,7 @@ func extractDateOfResentClaim(EntrantID int, BonusID string, OdoReading int, Tim
 
 func fetchBonus(b string, t string) (string, int) {
 
-	rows, err := dbh.Query("SELECT BriefDesc,Points FROM "+t+" WHERE BonusID=?", b)
+	rows, err := dbh.Query("SELECT "+col(t, "BriefDesc")+","+col(t, "Points")+" FROM "+t+" WHERE "+col(t, "BonusID")+"=?", b)
 	if err != nil {
 		fmt.Printf("%s Bonus! %v %v\n", logts(), b, err)
 		return "", 0
@@ -378,323 +597,901 @@ func fetchConfigFromDB() (string, []byte) {
 	return yaml, json
 
 }
-func fetchNewClaims() {
 
-	// Connect to server
-	c, err := client.DialTLS(cfg.ImapServer, nil)
+const defaultImapTimeout = 5 * time.Minute // Long enough to fetch a batch of photos
+const defaultSmtpTimeout = 10 * time.Second
+
+func imapTimeout() time.Duration {
+
+	if cfg.ImapTimeout > 0 {
+		return cfg.ImapTimeout
+	}
+	return defaultImapTimeout
+
+}
+
+func smtpTimeout() time.Duration {
+
+	if cfg.SmtpTimeout > 0 {
+		return cfg.SmtpTimeout
+	}
+	return defaultSmtpTimeout
+
+}
+
+// imapConnect connects and logs in to the mail server and selects the
+// source's mailbox, normally the INBOX.
+// The caller must Logout.
+func imapConnect() (*client.Client, error) {
+
+	c, err := imapLogin(source)
 	if err != nil {
-		log.Printf("DialTLS: %v\n", err)
-		return
+		return nil, err
 	}
 
-	// Don't forget to logout
-	defer c.Logout()
+	// Select INBOX, or whichever mailbox is being fetched from
+	mbox, err := c.Select(source.Mailbox, false)
+	if err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("Select: %v", err)
+	}
+	keywordsAllowed = allowsKeywords(mbox.PermanentFlags)
+	inboxValidity = mbox.UidValidity
+	if cfg.StateKeywords && !keywordsAllowed && debugging(debugIMAP) {
+		fmt.Printf("%s server won't accept keywords, using standard flags\n", logts())
+	}
+	return c, nil
+
+}
+
+// imapLogin connects and logs in to the source's mail server. The caller must Logout.
+func imapLogin(ms mailSource) (*client.Client, error) {
+
+	server, login, password := cfg.ImapServer, cfg.ImapLogin, cfg.ImapPassword
+	if ms.account != nil {
+		server, login, password = ms.account.Server, ms.account.Login, ms.account.Password
+	}
+	// Connect to server
+	if debugging(debugIMAP) {
+		fmt.Printf("%s connecting to %v as %v\n", logts(), server, login)
+	}
+	// A stuck server mustn't hang the whole loop so every command, and the
+	// connection itself, gives up after ImapTimeout. Whatever was in hand
+	// is left unmarked and picked up again next cycle.
+	timeout := imapTimeout()
+	c, err := client.DialWithDialerTLS(&net.Dialer{Timeout: timeout}, server, nil)
+	if err != nil {
+		return nil, fmt.Errorf("DialTLS: %v", err)
+	}
+	c.Timeout = timeout
 
 	// Login
-	if err := c.Login(cfg.ImapLogin, cfg.ImapPassword); err != nil {
-		log.Printf("Login: %v\n", err)
-		return
+	if ms.account == nil && oauthConfigured() {
+		token, err := oauthAccessToken()
+		if err == nil {
+			err = c.Authenticate(xoauth2{login, token})
+		}
+		if err != nil {
+			c.Logout()
+			return nil, fmt.Errorf("XOAUTH2: %v", err)
+		}
+	} else if err := c.Login(login, password); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("Login: %v", err)
 	}
+	return c, nil
+
+}
 
-	// Select INBOX
-	_, err = c.Select("INBOX", false)
+func fetchNewClaims() {
+
+	c, err := imapConnect()
+	status.connected(err)
+	noteImapResult(err)
 	if err != nil {
-		log.Printf("Select: %v\n", err)
+		log.Println(err)
 		return
 	}
+
+	// Don't forget to logout
+	defer c.Logout()
+
+	checkQuota(c)
+	if !retriesReleased[source.key()] {
+		releaseRetries(c)
+	}
+
 	criteria := imap.NewSearchCriteria()
-	criteria.WithoutFlags = cfg.SelectFlags
+	criteria.WithoutFlags = selectionExcludes()
+	notBefore, notAfter := fetchWindow()
 	nulltime := time.Time{}
-	if cfg.NotBefore != nulltime {
-		criteria.SentSince = cfg.NotBefore
+	if notBefore != nulltime {
+		criteria.SentSince = notBefore
 	}
-	if cfg.NotAfter != nulltime {
-		criteria.SentBefore = cfg.NotAfter
+	if notAfter != nulltime {
+		criteria.SentBefore = notAfter
 	}
 
+	sp, spOK := currentSync(c, notBefore, notAfter)
+	if spOK && unchangedSince(sp) {
+		if debugging(debugIMAP) {
+			fmt.Printf("%s %v unchanged at modseq %v\n", logts(), source.Mailbox, sp.ModSeq)
+		}
+		return
+	}
+	settleSync(sp, false) // Until this cycle has finished cleanly
+
 	//	if *verbose {
 	//		fmt.Printf("%s searching ... ", logts())
 	//	}
-	uids, err := c.Search(criteria)
+	uids, err := c.UidSearch(criteria)
 	if err != nil {
 		log.Printf("Search: %v\n", err)
 	}
 	//	if *verbose {
 	//		fmt.Printf("%s ok\n", logts())
 	//	}
+	uids, paged := fetchPage(uids)
 
 	// Collect the unique IDs of messages found
 	seqset := new(imap.SeqSet)
 	seqset.AddNum(uids...)
 	if seqset.Empty() { // Didn't find any messages so we're done
+		settleSync(sp, spOK && err == nil)
 		return
 	}
 
+	if cfg.HeadersFirst || cfg.IgnoreOverKB > 0 {
+		wanted, unwanted, oversize, err := claimCandidates(c, seqset)
+		if err != nil {
+			log.Printf("Fetch envelopes: %v\n", err)
+			return
+		}
+		if err = markEmails(c, unwanted, mailRejected); err != nil {
+			log.Printf("Store: %v\n", err)
+		} else if err = archiveEmails(c, mailRejected, unwanted); err != nil {
+			log.Println(err)
+		}
+		if err = markEmails(c, oversize, mailIgnored); err != nil {
+			log.Printf("Store: %v\n", err)
+		}
+		seqset = wanted
+		if seqset.Empty() {
+			if paged {
+				pageDone(uids, seqset)
+			}
+			return
+		}
+	}
+
 	if *verbose {
-		fmt.Printf("%s fetching %v message(s)\n", logts(), len(uids))
+		fmt.Printf("%s fetching %v message(s)\n", logts(), seqSetLen(seqset))
 	}
 
-	// Get the whole message body, automatically sets //Seen
-	section := &imap.BodySectionName{}
+	// Get the whole message body without setting \Seen; that's done by markEmails
+	// once the claim is safely stored so that a crash meanwhile loses nothing
+	section := &imap.BodySectionName{Peek: true}
 	items := []imap.FetchItem{section.FetchItem(), imap.FetchUid, imap.FetchInternalDate}
 
 	messages := make(chan *imap.Message, 1)
 	done := make(chan error, 1)
 	go func() {
-		done <- c.Fetch(seqset, items, messages)
+		done <- c.UidFetch(seqset, items, messages)
 	}()
 
 	skipped := new(imap.SeqSet)   // Will contain UIDs of claims to be revisited. Possibly couldn't get DB lock
 	dealtwith := new(imap.SeqSet) // Will contain UIDs of non-claims
+	ignored := new(imap.SeqSet)   // Will contain UIDs of automatic replies, filed as read
+	claimed := new(imap.SeqSet)   // Will contain UIDs of claims successfully stored
+
+	prepared := prepareMessages(messages, section)
+	for !processMessages(prepared, claimed, dealtwith, ignored, skipped) {
+		// One of them panicked, carry on with the rest
+	}
+
+	if err := <-done; err != nil {
+		if !*silent {
+			fmt.Printf("%s OMG!! %v\n", logts(), err)
+		}
+		return
+	}
+	status.cycleDone(seqSetLen(claimed), seqSetLen(dealtwith), seqSetLen(ignored), seqSetLen(skipped))
+
+	// Those I didn't get to, because I'm stopping, are left for the next run
+	unfinished := new(imap.SeqSet)
+	for _, uid := range seqSetNums(seqset) {
+		if !claimed.Contains(uid) && !dealtwith.Contains(uid) && !ignored.Contains(uid) && (stopRequested() || !skipped.Contains(uid)) {
+			unfinished.AddNum(uid)
+		}
+	}
+
+	if !cfg.TestMode {
+		if err = markEmails(c, dealtwith, mailRejected); err != nil {
+			log.Println(err)
+			return
+		}
+	} else {
+		// Test emails are just filed, whatever became of them
+		dealtwith.AddSet(claimed)
+		if err = markEmails(c, dealtwith, mailIgnored); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if err = markEmails(c, ignored, mailIgnored); err != nil {
+		log.Println(err)
+		return
+	}
+	if err = markEmails(c, skipped, mailRetry); err != nil { // These are not yet dealt with
+		log.Println(err)
+		return
+	}
+	rememberRetries(skipped)
+	forgetRetries(dealtwith, ignored)
+	if !cfg.TestMode {
+		if err = markEmails(c, claimed, mailClaimed); err != nil {
+			log.Println(err)
+			return
+		}
+		forgetRetries(claimed)
+		if err = archiveEmails(c, mailClaimed, claimed); err != nil {
+			log.Println(err)
+			return
+		}
+		if err = archiveEmails(c, mailRejected, dealtwith); err != nil {
+			log.Println(err)
+			return
+		}
+	} else {
+		dealtwith.AddSet(claimed)
+		dealtwith.AddSet(ignored)
+		if err = archiveEmails(c, mailIgnored, dealtwith); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if paged {
+		pageDone(uids, unfinished)
+	}
+	settleSync(sp, spOK && skipped.Empty() && !paged)
 
-	for msg := range messages {
+}
 
-		var TR testResponse
+// processMessages handles the emails delivered by Fetch, once prepareMessages
+// has done with them, sorting their UIDs into the sets given. If handling one
+// of them panics it's quarantined and false is returned so that the caller
+// can call me again for the rest.
+func processMessages(prepared chan *preparedMessage, claimed, dealtwith, ignored, skipped *imap.SeqSet) bool {
+
+	var uid uint32
+	var body []byte
+	defer func() {
+		if p := recover(); p != nil {
+			if uid == 0 {
+				panic(p)
+			}
+			recoverMessage(uid, body, p)
+			dealtwith.AddNum(uid)
+		}
+	}()
+
+	for pm := range prepared {
 
-		r := msg.GetBody(section) // This automatically marks the message as 'read'
-		if r == nil {
-			log.Println("Server didn't return message body")
+		msg := pm.msg
+		if stopRequested() {
+			writeAudit(msg.Uid, pm.m.Header.Get("From"), pm.m.Subject, auditRetry, "stopping")
+			skipped.AddNum(msg.Uid) // Left for when I'm next run
+			continue
+		}
+		if pm.readErr != nil {
+			log.Println(pm.readErr)
+			writeAudit(msg.Uid, "", "", auditRetry, "can't read email: "+pm.readErr.Error())
+			skipped.AddNum(msg.Uid)
 			continue
 		}
-		m, err := Parse(r)
+		uid, body = msg.Uid, pm.raw
+		if pm.panicked != nil {
+			panic(pm.panicked)
+		}
+		raw, m, err := pm.raw, pm.m, pm.parseErr
 		if err != nil {
 			log.Println(err)
+			quarantineEmail(msg.Uid, raw, fmt.Sprintf("unparseable: %v", err))
+			dealtwith.AddNum(msg.Uid)
 			continue
 		}
 
 		if cfg.TrapMails && cfg.TrapPath != "" {
-			fmt.Printf("INCOMING: %v\n", m)
+			if fn, err := trapEmail(msg.Uid, raw); err != nil {
+				log.Printf("can't trap email [%v] %v\n", msg.Uid, err)
+			} else if debugging(debugParse) {
+				fmt.Printf("%s trapped [%v] as %v\n", logts(), msg.Uid, fn)
+			}
 		}
 
-		f4 := parseSubject(m.Subject, false)
-		if m.Subject == "" && cfg.AllowBody {
-			if cfg.DebugVerbose {
-				fmt.Println("Parsing body for Subject:")
+		if auto, why := isAutoReply(m); auto {
+			if !*silent {
+				fmt.Printf("%s ignoring automatic reply [ %v ] from %v (%v)\n", logts(), m.Subject, m.Header.Get("From"), why)
 			}
-			f4 = parseSubject(m.TextBody, false)
-			if f4.ok {
-				m.Subject = m.TextBody
-				TR.SubjectFromBody = true
+			writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditIgnored, "automatic reply: "+why)
+			ignored.AddNum(msg.Uid)
+			continue
+		}
+		if skip, why := isIgnorable(m); skip {
+			if !*silent {
+				fmt.Printf("%s ignoring [ %v ] from %v (%v)\n", logts(), m.Subject, m.Header.Get("From"), why)
 			}
+			writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditIgnored, "ignore list: "+why)
+			ignored.AddNum(msg.Uid)
+			continue
 		}
 
-		TR.ClaimSubject = m.Subject
-		TR.EntrantID = f4.EntrantID
-		TR.BonusID = f4.BonusID
-		TR.OdoReading = f4.OdoReading
-		TR.HHmm = f4.HHmm
-		if !f4.ClaimTime.IsZero() {
-			TR.ClaimDateTime = f4.ClaimTime
-		} else {
-			ok := false
-			TR.ClaimDateTime, ok = extractDateOfResentClaim(f4.EntrantID, f4.BonusID, f4.OdoReading, f4.TimeHH, f4.TimeMM)
-			if !ok {
-				TR.ClaimDateTime = calcClaimDate(f4.TimeHH, f4.TimeMM, m.Date)
+		if isAdminAddress(m.Header.Get("From")) {
+			subject, proven := adminProof(m, raw) // Without the secret, which isn't logged
+			if done, ok := adminCommand(subject, proven); ok {
+				if !*silent {
+					fmt.Printf("%s admin command [ %v ] from %v, %v\n", logts(), subject, m.Header.Get("From"), done)
+				}
+				writeAudit(msg.Uid, m.Header.Get("From"), subject, auditAdmin, done)
+				sendAdminReply(m.Header.Get("From"), done)
+				ignored.AddNum(msg.Uid)
+				continue
 			}
-			f4.ClaimTime = TR.ClaimDateTime
 		}
-		TR.ExtraField = f4.Extra
-
-		ve, vea := validateEntrant(*f4, m.Header.Get("From"))
-		TR.ValidEntrantID = ve && f4.EntrantID > 0
-		TR.AddressIsRegistered = vea
+		if isStatusQuery(m.Subject) {
+			if handleStatusQuery(msg.Uid, m.Header.Get("From"), m.Subject) {
+				ignored.AddNum(msg.Uid)
+			} else {
+				dealtwith.AddNum(msg.Uid)
+			}
+			continue
+		}
+		if isPaused() {
+			writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditRetry, "paused")
+			skipped.AddNum(msg.Uid) // Leave it for when I'm resumed
+			continue
+		}
 
-		// If ve is false then I don't know who the entrant is so I must not create a claim in ScoreMaster
-		// In TestMode we do want to process the email and respond even though ve is false
+		var photos, others []emailPhoto
+		photosRead := false
+		readPhotos := func() []emailPhoto {
+			if !photosRead {
+				all := pm.photos
+				if !pm.photosReady {
+					all = extractPhotos(m, msg.Uid)
+				}
+				photos, others = splitAttachments(all)
+				photosRead = true
+			}
+			return photos
+		}
 
-		vb := validateBonus(*f4)
-		TR.BonusIsReal = vb != ""
-		TR.BonusDesc = vb
+		// An email carrying several claims, see ClaimsInBody, has each handled in turn
+		parts, bonuses := claimParts(m)
+		for part, m := range parts {
+
+			var TR testResponse
+
+			claimText, isOverride, overrideOk := parseOverride(m.Subject)
+			if isOverride {
+				if !overrideOk {
+					if !*silent {
+						fmt.Printf("%s rejecting override [ %v ] from %v, wrong secret\n", logts(), claimText, m.Header.Get("From"))
+					}
+					writeAudit(msg.Uid, m.Header.Get("From"), claimText, auditRejected, "override with wrong secret")
+					dealtwith.AddNum(msg.Uid)
+					continue
+				}
+				m.Subject = claimText // Don't keep the secret
+			}
 
-		if !vea && !cfg.TestMode {
-			if !*silent {
-				okx := "ok"
-				if !f4.ok {
-					okx = "FALSE"
+			if entrant, bonus, ok := parseCancel(m.Subject); ok {
+				if handleCancel(msg.Uid, m.Header.Get("From"), m.Subject, entrant, bonus) {
+					ignored.AddNum(msg.Uid)
+				} else {
+					dealtwith.AddNum(msg.Uid)
 				}
-				vex := "ok"
-				if !ve {
-					vex = "FALSE"
+				continue
+			}
+
+			correction := false
+			if rest, ok := stripKeyword(m.Subject, "CORRECTION"); ok {
+				m.Subject = rest
+				correction = true
+			}
+
+			// Texts via SMS gateways have no subject, just the claim amongst the carrier's boilerplate
+			smsPhone := smsGatewayPhone(m.Header.Get("From"))
+			if smsPhone != "" && strings.TrimSpace(m.Subject) == "" {
+				if txt := smsClaimText(m.TextBody); txt != "" {
+					m.Subject = txt
+					TR.SubjectFromBody = true
 				}
-				vbx := "ok"
-				if vb == "" {
-					vbx = "FALSE"
+			}
+
+			var jc *jsonClaim
+			if strings.TrimSpace(m.Subject) == "" || strings.EqualFold(strings.TrimSpace(m.Subject), "JSON") {
+				if isJSONClaim(m.TextBody) {
+					var err error
+					jc, err = parseJSONClaim(m.TextBody)
+					archiveJSONClaim(msg.Uid, m.Header.Get("From"), m.TextBody, jc, err)
+					if err != nil {
+						if !*silent {
+							fmt.Printf("%s rejecting JSON claim [%v] %v\n", logts(), msg.Uid, err)
+						}
+						writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditRejected, "JSON claim: "+err.Error())
+						dealtwith.AddNum(msg.Uid)
+						continue
+					}
+					m.Subject = jc.subject()
+					TR.SubjectFromBody = true
 				}
-				fmt.Printf("%v skipping %v [%v] ok=%v,ve=%v,vb=%v\n", logts(), m.Subject, msg.Uid, okx, vex, vbx)
 			}
-			dealtwith.AddNum(msg.Uid) // Can't / won't process but don't want to see it again
-			if !cfg.TestMode {
-				continue
+
+			f4 := parseSubject(m.Subject, false)
+			if jc != nil {
+				f4 = jc.fourFields()
+			}
+			if f4.ok && f4.EntrantID == 0 && smsPhone != "" {
+				f4.EntrantID, _ = entrantByPhone(smsPhone)
+			}
+			if m.Subject == "" && cfg.AllowBody {
+				if debugging(debugParse) {
+					fmt.Println("Parsing body for Subject:")
+				}
+				f4 = parseSubject(m.TextBody, false)
+				if f4.ok {
+					m.Subject = m.TextBody
+					TR.SubjectFromBody = true
+				}
 			}
-		} else {
 
-			TR.ClaimIsGood = f4.ok && ve && (vea || !cfg.MatchEmail) && vb != "" && f4.TimeOk
+			// Photos sent on their own belong to a claim sent separately
+			if !f4.ok && jc == nil && !isOverride && !correction && !cfg.TestMode && len(entrantsByEmail(m.Header.Get("From"))) > 0 {
+				switch attachFollowUpPhotos(msg.Uid, m.Header.Get("From"), m.Subject, m.Date, readPhotos()) {
+				case followUpAttached:
+					claimed.AddNum(msg.Uid)
+					continue
+				case followUpWaiting:
+					writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditRetry, "photos waiting for their claim")
+					skipped.AddNum(msg.Uid)
+					continue
+				}
+			}
 
-		}
+			byPillion := false
+			if rider := pillionOf(f4.EntrantID); rider > 0 {
+				f4.EntrantID = rider
+				byPillion = true
+			}
 
-		/*
-			 *
-			 * No longer care about 'strict', only allowable
-			 *
-			var strictok bool = true
-			if cfg.CheckStrict || cfg.TestMode {
-				f5 := parseSubject(m.Subject, true)
-				strictok = f5.ok
+			TR.ClaimSubject = m.Subject
+			TR.SentAt = m.Date
+			TR.EntrantID = f4.EntrantID
+			TR.BonusID = f4.BonusID
+			TR.OdoReading = f4.OdoReading
+			TR.HHmm = f4.HHmm
+			TR.TimeTyped = f4.TimeTyped
+			thread := threadOf(m)
+			resendOf, resentTime := threadedClaim(f4.EntrantID, f4.BonusID, thread)
+			if !f4.ClaimTime.IsZero() {
+				TR.ClaimDateTime = f4.ClaimTime
+			} else {
+				ok := false
+				if lt := resentTime.In(cfg.LocalTZ); resendOf > 0 && lt.Hour() == f4.TimeHH && lt.Minute() == f4.TimeMM {
+					TR.ClaimDateTime, ok = resentTime, true
+				} else {
+					TR.ClaimDateTime, ok = extractDateOfResentClaim(f4.EntrantID, f4.BonusID, f4.OdoReading, f4.TimeHH, f4.TimeMM)
+				}
+				if !ok {
+					TR.ClaimDateTime = calcClaimDate(f4.TimeHH, f4.TimeMM, m.Date)
+				}
+				f4.ClaimTime = TR.ClaimDateTime
 			}
-			TR.ClaimIsPerfect = TR.ClaimIsGood && strictok
-			*
-		*/
+			TR.ExtraField = f4.Extra
 
-		var photoid int = 0
-		var photoTime time.Time
-		var numphotos int = 0
-		var photosok bool = true
-		for _, a := range m.Attachments {
-			if *verbose {
-				fmt.Printf("%s Att: CD = %v\n", logts(), a.ContentDisposition)
+			var flags claimFlags
+			if f4.NameMatched {
+				flags.add(flagNameMatched)
 			}
-			pt := timeFromPhoto(a.Filename, a.ContentDisposition)
-			numphotos++
-			if pt.After(photoTime) {
-				photoTime = pt
+			if byPillion {
+				flags.add(flagPillion)
 			}
-			pix, err := io.ReadAll(a.Data)
-			if err != nil {
-				if !*silent {
-					fmt.Printf("%s attachment error %v\n", logts(), err)
-					photosok = false
-					break
+			if isOverride {
+				flags.add(flagOrganiser)
+			}
+			var corrects int64
+			if correction {
+				corrects = previousClaim(f4.EntrantID, f4.BonusID)
+				if corrects > 0 {
+					flags.add(flagCorrection)
+				} else {
+					flags.add(flagCorrectionOrphan)
 				}
-			} else {
-				photoid = writeImage(f4.EntrantID, f4.BonusID, msg.Uid, pix, string(a.Filename))
-				if photoid == 0 && !cfg.TestMode {
-					photosok = false
-					break
+			}
+			ve, vea, matched := validateEntrant(*f4, m.Header.Get("From"))
+			if !vea && ve && smsPhone != "" {
+				id, ok := entrantByPhone(smsPhone)
+				vea = ok && id == f4.EntrantID
+			}
+			if isOverride {
+				vea = ve // Organisers may claim for any real entrant
+			}
+			var auth senderAuthResult
+			if cfg.CheckSenderAuth && !isOverride && smsPhone == "" {
+				auth = senderAuth(m.Header, raw)
+				if auth.Checked && !auth.Pass && vea {
+					if !*silent {
+						fmt.Printf("%s sender of [ %v ] not authenticated, %v\n", logts(), m.Subject, auth.Summary)
+					}
+					flags.add(flagSenderAuth)
+					if cfg.RejectUnauthenticated {
+						vea = false
+					}
+				}
+			}
+			TR.ValidEntrantID = ve && f4.EntrantID > 0
+			TR.AddressIsRegistered = vea
+			TR.EmailMatched = matched
+
+			// Photos are read early only if they're needed now, and only from entrants
+			if cfg.ExifClaimTime != "" && vea {
+				var theirs []emailPhoto
+				for _, px := range assignPhotos(bonuses, readPhotos())[part] {
+					theirs = append(theirs, photos[px])
 				}
-				if *verbose {
-					fmt.Printf("%s attachment of size %v bytes\n", logts(), len(pix))
+				if ct, changed := exifClaimTime(f4.ClaimTime, theirs); changed {
+					f4.ClaimTime, TR.ClaimDateTime = ct, ct
+					flags.add(flagExifTime)
 				}
 			}
-			//fmt.Printf("  Photo: %v\n", pt.Format(myTimeFormat))
-		}
-		for _, a := range m.EmbeddedFiles {
-			if *verbose {
-				fmt.Printf("%s Emb: CD = %v\n", logts(), a.ContentDisposition)
+
+			validateLegWindow(*f4, &flags)
+			TR.Window = fetchBonusWindow(f4.BonusID)
+			validateBonusWindow(TR.Window, *f4, &flags)
+			validateDaylight(*f4, &flags)
+			pin, pinned := checkMapPin(m, f4.BonusID, &flags)
+			TR.AnswerNeeded, TR.AnswerOk = checkAnswer(*f4, &flags)
+			validateAvgSpeed(*f4, &flags)
+			sanity := validateClaimSanity(*f4, &flags)
+			teamDupes := teamDuplicates(f4.EntrantID, f4.BonusID)
+			if len(teamDupes) > 0 {
+				flags.add(flagTeamDuplicate)
+			}
+
+			if column := odoCodeColumn(f4.BonusID); column != "" && f4.ok && vea {
+				if handleOdoCode(msg.Uid, m.Header.Get("From"), *f4, column) {
+					ignored.AddNum(msg.Uid)
+				} else {
+					dealtwith.AddNum(msg.Uid)
+				}
+				continue
 			}
-			pt := timeFromPhoto(nameFromContentType(a.ContentType), a.ContentDisposition)
-			numphotos++
-			if pt.After(photoTime) {
-				photoTime = pt
+			if isFuelCode(f4.BonusID) && f4.ok && vea {
+				if handleFuelClaim(msg.Uid, m.Header.Get("From"), m.Subject, *f4, readPhotos()) {
+					claimed.AddNum(msg.Uid)
+				} else {
+					dealtwith.AddNum(msg.Uid)
+				}
+				continue
 			}
-			pix, err := io.ReadAll(a.Data)
-			if err != nil {
+
+			rateAnomaly := false
+			if ve {
+				var alert bool
+				rateAnomaly, alert = noteClaimRate(f4.EntrantID, time.Now())
+				if rateAnomaly {
+					flags.add(flagClaimRate)
+				}
+				if alert {
+					alertClaimRate(f4.EntrantID, m.Header.Get("From"))
+				}
+			}
+
+			// If ve is false then I don't know who the entrant is so I must not create a claim in ScoreMaster
+			// In TestMode we do want to process the email and respond even though ve is false
+
+			vb := validateBonus(*f4)
+			TR.BonusIsReal = vb != ""
+			TR.BonusDesc = vb
+			if cfg.TestMode && vb == "" {
+				TR.Combo, TR.IsCombo = fetchCombo(f4.BonusID)
+			} else if cfg.TestMode {
+				TR.Combos = combosContaining(f4.BonusID)
+			}
+
+			if !vea && !cfg.TestMode {
+				okx := "ok"
+				if !f4.ok {
+					okx = "FALSE"
+				}
+				vex := "ok"
+				if !ve {
+					vex = "FALSE"
+				}
+				vbx := "ok"
+				if vb == "" {
+					vbx = "FALSE"
+				}
+				reason := fmt.Sprintf("ok=%v,ve=%v,vb=%v", okx, vex, vbx)
 				if !*silent {
-					fmt.Printf("%s embedding error %v\n", logts(), err)
-					photosok = false
-					break
+					fmt.Printf("%v skipping %v [%v] %v\n", logts(), m.Subject, msg.Uid, reason)
+				}
+				fireHook(hookEvent{Event: hookClaimRejected, EmailID: msg.Uid, From: m.Header.Get("From"), Subject: m.Subject,
+					EntrantID: f4.EntrantID, BonusID: f4.BonusID, Reason: reason})
+				if !(rateAnomaly && cfg.ThrottleResponses) {
+					sendRejection(m.Header.Get("From"), m.Subject, rejectionReason(*f4, ve, vea), f4, "")
+				}
+				writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditRejected, reason)
+				dealtwith.AddNum(msg.Uid) // Can't / won't process but don't want to see it again
+				if !cfg.TestMode {
+					continue
 				}
 			} else {
-				photoid = writeImage(f4.EntrantID, f4.BonusID, msg.Uid, pix, a.ContentDisposition)
-				if photoid == 0 && !cfg.TestMode {
-					photosok = false
-					break
+
+				TR.ClaimIsGood = f4.ok && ve && (vea || !cfg.MatchEmail) && vb != "" && f4.TimeOk
+
+			}
+
+			/*
+				 *
+				 * No longer care about 'strict', only allowable
+				 *
+				var strictok bool = true
+				if cfg.CheckStrict || cfg.TestMode {
+					f5 := parseSubject(m.Subject, true)
+					strictok = f5.ok
+				}
+				TR.ClaimIsPerfect = TR.ClaimIsGood && strictok
+				*
+			*/
+
+			var photoid int = 0
+			var photoTime time.Time
+			var numphotos int = 0
+			var photosok bool = true
+			var firstPhoto []byte
+			var firstPhotoName string
+			var photoids []string
+			var pending pendingPhotos
+			readPhotos()
+			mine := assignPhotos(bonuses, photos)[part]
+
+			reject := ""
+			if len(cfg.Rules) > 0 { // ruleVars costs several queries
+				reject = applyRules(ruleVars(*f4, m.Header.Get("From"), m.Subject, len(mine)), &flags)
+			}
+			if reject != "" {
+				TR.Rejection = reject
+				TR.ClaimIsGood = false
+				if !cfg.TestMode {
+					if !*silent {
+						fmt.Printf("%v rejecting %v [%v] %v\n", logts(), m.Subject, msg.Uid, reject)
+					}
+					writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditRejected, reject)
+					sendRejection(m.Header.Get("From"), m.Subject, rejectRule, f4, reject)
+					fireHook(hookEvent{Event: hookClaimRejected, EmailID: msg.Uid, From: m.Header.Get("From"), Subject: m.Subject,
+						EntrantID: f4.EntrantID, BonusID: f4.BonusID, Reason: reject})
+					dealtwith.AddNum(msg.Uid)
+					continue
 				}
-				if *verbose {
-					fmt.Printf("%s embedded image of size %v bytes\n", logts(), len(pix))
+			}
+
+			// A resent claim is linked to the one stored already, rather than storing it and its photos again
+			fingerprint := claimFingerprint(m.Subject, photos)
+			if !cfg.TestMode {
+				if dup, matched := duplicateClaim(f4.EntrantID, f4.BonusID, thread.MessageID, fingerprint); dup != 0 {
+					if !*silent {
+						fmt.Printf("%s ignoring %v [%v], duplicate of claim %v by %v\n", logts(), m.Subject, msg.Uid, dup, matched)
+					}
+					recordDuplicate(msg.Uid, m.Header.Get("From"), m.Subject, dup, matched)
+					ignored.AddNum(msg.Uid)
+					continue
 				}
 			}
-			if *verbose {
-				fmt.Printf("%s photo: %v\n", logts(), pt.Format(myTimeFormat))
+
+			for _, px := range mine {
+				p := photos[px]
+				if debugging(debugPhotos) {
+					if p.Embedded {
+						fmt.Printf("%s Emb: CD = %v\n", logts(), p.ContentDisposition)
+					} else {
+						fmt.Printf("%s Att: CD = %v\n", logts(), p.ContentDisposition)
+					}
+				}
+				pt := photoTakenAt(p)
+				numphotos++
+				if pt.After(photoTime) {
+					photoTime = pt
+				}
+				if p.Err != nil {
+					if !*silent {
+						fmt.Printf("%s attachment error %v\n", logts(), p.Err)
+						photosok = false
+						break
+					}
+				} else {
+					if firstPhoto == nil {
+						firstPhoto, firstPhotoName = p.Data, p.Name
+					}
+					pp := writePhoto(f4.EntrantID, f4.BonusID, msg.Uid, p)
+					if pp == nil && !cfg.TestMode {
+						photosok = false
+						break
+					}
+					if pp != nil && cfg.WatermarkCommand != "" {
+						if err := watermarkPhoto(pp, watermarkText(f4.EntrantID, f4.BonusID, f4.ClaimTime, msg.Uid)); err != nil {
+							fmt.Printf("%s can't watermark photo %v %v\n", logts(), p.Name, err)
+						}
+					}
+					if pp != nil {
+						pending = append(pending, pp)
+					}
+					if debugging(debugPhotos) {
+						fmt.Printf("%s photo of size %v bytes\n", logts(), len(p.Data))
+						fmt.Printf("%s photo: %v\n", logts(), pt.Format(myTimeFormat))
+					}
+				}
 			}
-		}
 
-		if photosok {
-			TR.PhotoPresent = numphotos
-		} else if numphotos > 0 {
-			TR.PhotoPresent = 0 - numphotos
-		}
+			TR.Attachments = storeAttachments(f4.EntrantID, f4.BonusID, msg.Uid, others, assignPhotos(bonuses, others)[part])
 
-		if numphotos != 1 {
-			photoid = 0 // Make ScoreMaster hunt for photos
-		}
+			if photosok {
+				TR.PhotoPresent = numphotos
+			} else if numphotos > 0 {
+				TR.PhotoPresent = 0 - numphotos
+			}
 
-		var sentatTime time.Time = msg.InternalDate
-		for _, xr := range m.Header["X-Received"] {
-			ts := timestamp{parseTime(extractTime(xr)).Local()}
-			if ts.date.Before(sentatTime) {
-				sentatTime = ts.date
+			TR.Requirements = fetchBonusRequirements(f4.BonusID)
+			checkRequirements(TR.Requirements, *f4, numphotos, &flags)
+
+			qrcode := ""
+			if cfg.QRCommand != "" {
+				var qrphotos []emailPhoto
+				for _, px := range mine {
+					qrphotos = append(qrphotos, photos[px])
+				}
+				qrcode = checkQRPhotos(qrphotos, f4.BonusID, &flags)
 			}
-		}
-		for _, xr := range m.Header["Received"] {
-			ts := timestamp{parseTime(extractTime(xr)).Local()}
-			if ts.date.Before(sentatTime) {
-				sentatTime = ts.date
+
+			if cfg.OdoOCR && cfg.OCRCommand != "" && f4.OdoOk && firstPhoto != nil {
+				checkOdoPhoto(firstPhoto, firstPhotoName, f4.OdoReading, &flags)
 			}
-		}
+			TR.Flags = flags
 
-		if cfg.TestMode {
-			sendTestResponse(TR, m.Header.Get("From"), f4)
-			continue
-		} else {
+			var sentatTime time.Time = msg.InternalDate
+			for _, xr := range m.Header["X-Received"] {
+				ts := timestamp{parseTime(extractTime(xr)).Local()}
+				if ts.date.Before(sentatTime) {
+					sentatTime = ts.date
+				}
+			}
+			for _, xr := range m.Header["Received"] {
+				ts := timestamp{parseTime(extractTime(xr)).Local()}
+				if ts.date.Before(sentatTime) {
+					sentatTime = ts.date
+				}
+			}
+			if ve {
+				recordClockSkew(f4.EntrantID, msg.Uid, m.Date, sentatTime)
+				TR.ClockSkew, TR.ClockSamples = entrantClockSkew(f4.EntrantID)
+			}
 
-			var sb strings.Builder
-			sb.WriteString("INSERT INTO ebclaims (LoggedAt,DateTime,EntrantID,BonusID,OdoReading,")
-			sb.WriteString("FinalTime,EmailID,ClaimHH,ClaimMM,ClaimTime,Subject,ExtraField,")
-			sb.WriteString("StrictOk,AttachmentTime,FirstTime,PhotoID) ")
-			sb.WriteString("VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)")
-			_, err = dbh.Exec(sb.String(), storeTimeDB(time.Now()), storeTimeDB(m.Date.Local()),
-				f4.EntrantID, f4.BonusID, f4.OdoReading,
-				storeTimeDB(msg.InternalDate), msg.Uid, f4.TimeHH, f4.TimeMM,
-				//storeTimeDB(calcClaimDate(f4.TimeHH, f4.TimeMM, m.Date)),
-				storeTimeDB(f4.ClaimTime),
-				m.Subject, f4.Extra,
-				false, photoTime, sentatTime, photoid)
-			if err != nil {
-				if !*silent {
-					fmt.Printf("%s can't store claim - %v\n", logts(), err)
+			if cfg.TestMode {
+				if !(rateAnomaly && cfg.ThrottleResponses) {
+					sendTestResponse(TR, m.Header.Get("From"), f4)
 				}
-				skipped.AddNum(msg.Uid) // Can't process now but I'll try again later
+				writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditTest, auditFlags("test response", flags))
+				claimed.AddNum(msg.Uid) // Answered, so it's filed with the rest below
 				continue
+			} else {
 
-			}
-		}
-		if !*silent {
-			fmt.Printf("%s claiming [ %v ]\n", logts(), m.Subject)
-		}
+				var sb strings.Builder
+				var cols []string
+				for _, c := range ebclaimsInsertCols {
+					cols = append(cols, col("ebclaims", c))
+				}
+				sb.WriteString("INSERT INTO ebclaims (" + strings.Join(cols, ",") + ") ")
+				sb.WriteString("VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)")
+				// The claim, its photos and everything recorded with it are written
+				// together, or not at all
+				var rowid int64
+				err := dbWriteTx(func(tx *sql.Tx) error {
+					ids, err := pending.store(tx)
+					if err != nil {
+						return err
+					}
+					photoids, photoid = ids, 0
+					if numphotos == 1 && len(pending) == 1 {
+						photoid = pending[0].id
+					} // Otherwise ScoreMaster hunts for photos
+					res, err := tx.Exec(sb.String(), storeTimeDB(time.Now()), storeTimeDB(m.Date.Local()),
+						f4.EntrantID, f4.BonusID, f4.OdoReading,
+						storeTimeDB(msg.InternalDate), msg.Uid, f4.TimeHH, f4.TimeMM,
+						//storeTimeDB(calcClaimDate(f4.TimeHH, f4.TimeMM, m.Date)),
+						storeTimeDB(f4.ClaimTime),
+						m.Subject, f4.Extra,
+						false, photoTime, sentatTime, photoid, flags.String(), strings.Join(photoids, ","))
+					if err != nil {
+						return err
+					}
+					rowid, _ = res.LastInsertId()
+					if qrcode != "" {
+						if _, err := tx.Exec("UPDATE ebclaims SET QRCode=? WHERE rowid=?", qrcode, rowid); err != nil {
+							return err
+						}
+					}
+					if _, err := tx.Exec("UPDATE ebclaims SET Fingerprint=?,Source=?,OdoValue=?,OdoText=?,AuthOk=?,SanityFlags=? WHERE rowid=?", fingerprint, source.Name(), f4.OdoValue, f4.OdoText, auth.authOk(), sanity.String(), rowid); err != nil {
+						return err
+					}
+					if err := storeThread(tx, rowid, thread, resendOf); err != nil {
+						return err
+					}
+					if pinned {
+						if err := storeMapPin(tx, rowid, pin); err != nil {
+							return err
+						}
+					}
+					if corrects > 0 {
+						if err := linkCorrection(tx, rowid, corrects); err != nil {
+							return err
+						}
+					}
+					return flagTeamDuplicates(tx, teamDupes)
+				})
+				if err != nil {
+					if !*silent {
+						fmt.Printf("%s can't store claim - %v\n", logts(), err)
+					}
+					if debugging(debugDB) {
+						fmt.Printf("%s %v\n", logts(), sb.String())
+					}
+					pending.discard()
+					if isTransient(err) {
+						writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditRetry, fmt.Sprintf("can't store claim: %v", err))
+						skipped.AddNum(msg.Uid) // Can't process now but I'll try again later
+					} else {
+						quarantineEmail(msg.Uid, raw, fmt.Sprintf("can't store claim: %v", err))
+						dealtwith.AddNum(msg.Uid)
+					}
+					continue
 
-	} // End msg loop
+				}
+				pending.keep()
+				if len(teamDupes) > 0 {
+					noticeTeamDuplicates(f4.EntrantID, f4.BonusID)
+				}
+				refreshLeaderboard(rowid)
+				saveRawEmail(msg.Uid, raw)
+				if cfg.ReceiptsFolder != "" {
+					if err := writeClaimReceipt(rowid); err != nil {
+						fmt.Printf("%s can't write receipt for claim %v %v\n", logts(), rowid, err)
+					}
+				}
+				noteClaimArrived(time.Now())
+				announceClaim()
+				writeAudit(msg.Uid, m.Header.Get("From"), m.Subject, auditClaimed, auditFlags(fmt.Sprintf("claim %v", rowid), flags))
+				acknowledgeClaim(m.Header.Get("From"), f4, numphotos, rateAnomaly)
+				if flags.has(flagPhotoMissing) && !(rateAnomaly && cfg.ThrottleResponses) {
+					sendRejection(m.Header.Get("From"), m.Subject, rejectPhoto, f4, "")
+				}
+			}
+			claimed.AddNum(msg.Uid)
+			status.addClaim(m.Subject)
+			fireHook(hookEvent{Event: hookClaimStored, EmailID: msg.Uid, From: m.Header.Get("From"), Subject: m.Subject,
+				EntrantID: f4.EntrantID, BonusID: f4.BonusID, OdoReading: f4.OdoReading, ClaimTime: storeTimeDB(f4.ClaimTime),
+				Flags: flags.String(), PhotoIDs: strings.Join(photoids, ",")})
+			if !*silent {
+				fmt.Printf("%s claiming [ %v ]\n", logts(), m.Subject)
+			}
 
-	if err := <-done; err != nil {
-		if !*silent {
-			fmt.Printf("%s OMG!! %v\n", logts(), err)
+		} // End claims loop
+		if len(parts) > 1 {
+			settleParts(msg.Uid, claimed, dealtwith, ignored, skipped)
 		}
-		return
-	}
 
-	if !dealtwith.Empty() && !cfg.TestMode {
-		item := imap.FormatFlagsOp(imap.SetFlags, true)
-		flags := []interface{}{imap.FlaggedFlag}
-		if *verbose {
-			fmt.Printf("%s leaving unread %v %v %v\n", logts(), dealtwith, item, flags)
-		}
-		err = c.UidStore(dealtwith, item, flags, nil)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-	}
-	if !skipped.Empty() && !cfg.TestMode { // These are not yet dealt with
-		item := imap.FormatFlagsOp(imap.SetFlags, true)
-		flags := []interface{}{}
-		if *verbose {
-			fmt.Printf("%s releasing %v %v %v\n", logts(), skipped, item, flags)
-		}
-		err = c.UidStore(skipped, item, flags, nil)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-	}
+	} // End msg loop
+	return true
 
 }
 
@@ -708,9 +1505,14 @@ func init() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "%v v%v\n", apptitle, appversion)
 		flag.PrintDefaults()
+		fmt.Fprintf(w, "%v\n", commandsHelp)
 		fmt.Fprintf(w, "%v\n", progdesc)
 	}
 	flag.Parse()
+	*verbose = *verbosity > 0
+	if *tuimode {
+		*silent = true // The status display replaces the log
+	}
 	if *showusage {
 		flag.Usage()
 		os.Exit(1)
@@ -726,6 +1528,17 @@ func init() {
 	}
 
 	openDB(*path2db)
+	dbtype := detectDBType()
+	if *verbose {
+		fmt.Printf("%s: %v is a %v database\n", apptitle, *path2db, dbtype)
+	}
+	if dbtype != dbSM3 {
+		// Chasm keeps its settings and claims differently and isn't supported yet
+		fmt.Printf("%s: %v is a %v database, only ScoreMaster 3 is supported. Run aborted\n", apptitle, *path2db, dbtype)
+		osExit(1)
+	}
+	ensureEbcTables()
+	rebuildLeaderboard()
 
 	configPath := *yml
 
@@ -749,6 +1562,10 @@ func init() {
 		}
 		cfg.Path2SM = filepath.Dir(*path2db)
 	}
+	applySettingOverrides()
+	if err := startLogging(); err != nil {
+		fmt.Printf("%s: can't log to %v %v\n", apptitle, cfg.LogFile, err)
+	}
 
 	/*
 	 * These are now live switcheable options. I'll continue to run but won't do anything unless
@@ -769,26 +1586,43 @@ func init() {
 	if cfg.ImapServer == "" || cfg.ImapLogin == "" {
 		fmt.Printf("%s: Email configuration has not been specified\n", apptitle)
 		fmt.Printf("%s: Email fetching will not be possible. Please fix %v and retry\n", apptitle, configPath)
-	} else if cfg.ImapPassword == "" {
+	} else if cfg.ImapPassword == "" && !oauthConfigured() {
 		fmt.Printf("%s: No password has been set for incoming IMAP account %v\n", apptitle, cfg.ImapServer)
 		fmt.Printf("%s: Email fetching will not be possible. Please fix %v and retry\n", apptitle, configPath)
 	}
+	checkExtraAccounts()
+	checkMailProtocols()
 
 	if *trapmails != "" {
 		cfg.TrapPath = *trapmails
 		cfg.TrapMails = true
 	}
+	if *dashaddr != "" {
+		cfg.DashboardAddr = *dashaddr
+	}
 
-	cfg.StrictRE = regexp.MustCompile(cfg.Strict)
-	cfg.SubjectRE = regexp.MustCompile(cfg.Subject)
+	if err := compileSubjects(); err != nil {
+		fmt.Printf("%s: %v. Please fix %v and retry\n", apptitle, err, configPath)
+		osExit(1)
+	}
 
 	if !loadRallyData() {
 		fmt.Printf("%s: Email fetching will not be possible. Please fix %v and retry\n", apptitle, configPath)
 		osExit(1)
 	}
+	if err := checkPollSchedule(); err != nil {
+		fmt.Printf("%s: %v. Please fix %v and retry\n", apptitle, err, configPath)
+		osExit(1)
+	}
 	if cfg.ConvertHeic {
 		validateHeicHandler()
 	}
+	if err := checkRules(); err != nil {
+		fmt.Printf("%s: %v. Please fix %v and retry\n", apptitle, err, configPath)
+		osExit(1)
+	}
+	checkResponseTemplates()
+	checkEmailMatching()
 }
 
 func loadRallyData() bool {
@@ -802,6 +1636,7 @@ func loadRallyData() bool {
 	rows.Next()
 	var RallyStart, RallyFinish, LocalTZ string
 	rows.Scan(&cfg.RallyTitle, &RallyStart, &RallyFinish, &LocalTZ)
+	rows.Close() // Release the read lock, entrant emails are written below
 
 	cfg.LocalTimezone = LocalTZ
 	cfg.LocalTZ, err = time.LoadLocation(LocalTZ)
@@ -827,6 +1662,8 @@ func loadRallyData() bool {
 		fmt.Printf("%s RallyFinish %s cannot be parsed\n", apptitle, RallyFinish)
 		return false
 	}
+	loadLegs()
+	syncEntrantEmails()
 	return true
 
 }
@@ -841,26 +1678,93 @@ func logts() string {
 // Checks configuration for possibility to monitor emails
 func monitoringOK() bool {
 
-	res := !cfg.DontRun && cfg.ImapPassword != "" && cfg.ImapServer != "" && cfg.ImapLogin != ""
+	res := !cfg.DontRun && (cfg.ImapPassword != "" || oauthConfigured()) && cfg.ImapServer != "" && cfg.ImapLogin != ""
 	return res
 
 }
 
 func main() {
 
+	if *checksubject != "" {
+		explainSubject(os.Stdout, *checksubject)
+		osExit(0)
+	}
+	if (flag.NArg() == 0 || flag.Arg(0) != "check") && !subjectExamplesOK(false) {
+		fmt.Printf("%s: subject doesn't parse the SubjectExamples as expected, see \"ebcfetch check\". Please fix and retry\n", apptitle)
+		osExit(1)
+	}
+	if flag.NArg() > 0 {
+		osExit(runCommand(flag.Args()))
+	}
+	if *replay != "" {
+		osExit(runReplay(*replay))
+	}
+	lockInstance()
+	handleSignals()
+
 	monitoring := monitoringOK()
 	testmode := cfg.TestMode
 
 	showMonitorStatus(monitoring)
 
+	if cfg.DashboardAddr != "" {
+		startDashboard(cfg.DashboardAddr)
+	}
+	if cfg.ControlAddr != "" {
+		startControlAPI(cfg.ControlAddr)
+	}
+	if cfg.UseIdle && mainIsIMAP() {
+		startIdleWatcher()
+	}
+
 	for {
+		if monitoring && autoStopDue(time.Now()) {
+			autoStop()
+			if cfg.AutoStopExit {
+				osExit(0)
+			}
+			monitoring = false
+			showMonitorStatus(monitoring)
+		}
 		if monitoring {
-			fetchNewClaims()
+			fetchAllClaims()
+			checkQuiet(time.Now())
+			if !cfg.TestMode {
+				expungeOldClaims()
+			}
+			if !cfg.TestMode && summariesDue() {
+				sendSummaries(false)
+				summariesDone = true
+			}
+		}
+		if maintenanceDue(time.Now()) {
+			runMaintenance()
+		}
+		startConversionRetries(time.Now())
+		if *tuimode {
+			drawStatus(consoleOut(), monitoring)
+		}
+		if stopRequested() {
+			shutdown()
+		}
+		waitForMail(pollInterval(time.Now()))
+		if stopRequested() {
+			shutdown()
+		}
+		switched := applyTestMode()
+		if applySettingChanges() {
+			switched = true
 		}
-		time.Sleep(time.Duration(cfg.SleepSeconds) * time.Second)
 		if ReloadConfigFromDB {
 			refreshConfig()
-			newmon := monitoringOK()
+			newmon := monitoringOK() && !autoStopDue(time.Now())
+			if newmon != monitoring || testmode != cfg.TestMode {
+				monitoring = newmon
+				testmode = cfg.TestMode
+				showMonitorStatus(monitoring)
+			}
+		} else if switched {
+			newmon := monitoringOK() && !autoStopDue(time.Now())
 			if newmon != monitoring || testmode != cfg.TestMode {
 				monitoring = newmon
 				testmode = cfg.TestMode
@@ -891,6 +1795,7 @@ func osExit(res int) {
 	if *debugwait || cfg.KeyWait {
 		waitforkey()
 	}
+	stopLogging()
 
 	defer os.Exit(res)
 	runtime.Goexit()
@@ -899,6 +1804,11 @@ func osExit(res int) {
 
 func extractEntrantID(x string) int {
 
+	// Organisers' aliases for habitually decorated/misspelt identifiers come first
+	if id, ok := entrantAlias(x); ok {
+		return id
+	}
+
 	// Strip any leading non-digits. Trailing non-digits ignored.
 	// This made necessary because some event organisers like to decorate rider numbers, no names, no pack drill.
 	re := regexp.MustCompile(`[^\d]*(\d+)`)
@@ -911,39 +1821,79 @@ func extractEntrantID(x string) int {
 
 }
 
+// defaultFieldOrder is the order of the fields in a Subject regex without named groups
+var defaultFieldOrder = []string{"entrant", "bonus", "odo", "time", "extra"}
+
+// subjectFields maps the submatches of a Subject regex onto the field names
+// entrant, bonus, odo, time and extra. Named groups, (?P<bonus>...), are used
+// if the regex has any, otherwise the groups are taken in the order given by
+// cfg.FieldOrder so organisers can reorder fields without rewriting the regex.
+func subjectFields(re *regexp.Regexp, ff []string) map[string]string {
+
+	res := make(map[string]string)
+	for i, n := range re.SubexpNames() {
+		if i > 0 && n != "" && i < len(ff) {
+			res[strings.ToLower(n)] = ff[i]
+		}
+	}
+	if len(res) > 0 {
+		return res
+	}
+	order := cfg.FieldOrder
+	if len(order) == 0 {
+		order = defaultFieldOrder
+	}
+	for i, n := range order {
+		if i+1 < len(ff) {
+			res[strings.ToLower(n)] = ff[i+1]
+		}
+	}
+	return res
+
+}
+
 func parseSubject(s string, formal bool) *fourFields {
 
 	var f4 fourFields
-	var ff []string
 
-	if formal {
-		ff = cfg.StrictRE.FindStringSubmatch(s)
-	} else {
-		ff = cfg.SubjectRE.FindStringSubmatch(s)
+	s = stripSubjectPrefixes(s)
+	_, re, fields := matchingSubject(s, formal) // First match wins
+	if re == nil && !formal {
+		fields = tokeniseSubject(s)
 	}
-	if ff == nil && cfg.DebugVerbose {
+	if fields == nil && debugging(debugParse) {
 		fmt.Printf("Matching %v %v returned nil\n", formal, s)
 	}
-	f4.ok = len(ff) > 0
-	if formal && len(ff) < 5 {
-		f4.ok = false
-	}
+	f4.ok = fields != nil
 	if !f4.ok {
 		return &f4
 	}
-	f4.EntrantID = extractEntrantID(ff[1])
-	f4.BonusID = strings.ToUpper(ff[2])
-	if len(ff) < 5 {
+	_, hasOdo := fields["odo"]
+	_, hasTime := fields["time"]
+	if formal && !(hasOdo && hasTime) {
+		f4.ok = false
+		return &f4
+	}
+	f4.EntrantID = extractEntrantID(fields["entrant"])
+	if f4.EntrantID == 0 && !strings.ContainsAny(fields["entrant"], "0123456789") {
+		f4.EntrantID, f4.NameMatched = entrantByName(fields["entrant"])
+	}
+	f4.BonusID = strings.ToUpper(fields["bonus"])
+	if !(hasOdo && hasTime) {
 		return &f4
 	}
-	f4.OdoReading, _ = strconv.Atoi(ff[3])
-	OdoRE := regexp.MustCompile(`^\d+$`)
-	f4.OdoOk = OdoRE.MatchString(ff[3])
+	f4.OdoText = fields["odo"]
+	f4.OdoValue, f4.OdoOk = odoValue(f4.OdoText)
+	f4.OdoReading = int(f4.OdoValue)
 
 	var err error
-	f4.ClaimTime, err = time.ParseInLocation(time.RFC3339, ff[4], cfg.LocalTZ)
+	f4.ClaimTime, err = time.ParseInLocation(time.RFC3339, fields["time"], cfg.LocalTZ)
 	if err != nil {
-		hmx := strings.ReplaceAll(strings.ReplaceAll(ff[4], ":", ""), ".", "")
+		tx := normaliseTime(fields["time"])
+		if tx != fields["time"] {
+			f4.TimeTyped = fields["time"]
+		}
+		hmx := strings.ReplaceAll(strings.ReplaceAll(tx, ":", ""), ".", "")
 		if len(hmx) < 4 {
 			hmx = "0" + hmx
 		}
@@ -955,7 +1905,7 @@ func parseSubject(s string, formal bool) *fourFields {
 		f4.TimeOk = TimeRE.MatchString(hmx) && f4.TimeHH < 24 && f4.TimeMM < 60
 		//fmt.Printf("TimeOk - %v == %v\n", hmx, f4.TimeOk)
 	} else {
-		f4.HHmm = ff[4]
+		f4.HHmm = fields["time"]
 		f4.TimeHH = f4.ClaimTime.Hour()
 		f4.TimeMM = f4.ClaimTime.Minute()
 		f4.TimeOk = f4.TimeHH < 24 && f4.TimeMM < 60
@@ -965,12 +1915,10 @@ func parseSubject(s string, formal bool) *fourFields {
 		f4.ok = false
 	}
 
-	if len(ff) > 5 {
-		f4.Extra = ff[5]
-	}
+	f4.Extra = fields["extra"]
 
-	if cfg.DebugVerbose {
-		fmt.Printf("%v [%v] (%v) '%v' == %v; %v == %v; Odo=%v; Time=%v; Extra='%v'\n", formal, s, len(ff), ff[1], f4.EntrantID, ff[2], f4.BonusID, f4.OdoReading, f4.HHmm, f4.Extra)
+	if debugging(debugParse) {
+		fmt.Printf("%v [%v] (%v) '%v' == %v; %v == %v; Odo=%v; Time=%v; Extra='%v'\n", formal, s, len(fields), fields["entrant"], f4.EntrantID, fields["bonus"], f4.BonusID, f4.OdoReading, f4.HHmm, f4.Extra)
 		/*
 			if formal {
 				fmt.Printf("RE is `%v`\n",cfg.StrictRE)
@@ -985,11 +1933,20 @@ func parseSubject(s string, formal bool) *fourFields {
 
 func refreshConfig() {
 
+	rules := cfg.Rules
 	ymltext, jsontext := fetchConfigFromDB()
 	file := strings.NewReader(ymltext)
 	D := yaml.NewDecoder(file)
 	D.Decode(&cfg)
+	if err := checkRules(); err != nil {
+		fmt.Printf("%s %v, keeping the rules I had\n", logts(), err)
+		cfg.Rules = rules
+	}
 	json.Unmarshal(jsontext, &cfg.SmtpStuff)
+	applySettingOverrides()
+	if adminTestMode != nil {
+		cfg.TestMode = *adminTestMode
+	}
 	if cfg.DebugVerbose {
 		*verbose = true
 	}
@@ -997,45 +1954,48 @@ func refreshConfig() {
 
 }
 
-func sendAlertToBob(whatsup string) {
-
-	var sendToAddress = []string{"stammers.bob@gmail.com", "webmaster@ironbutt.co.uk"}
-	const alertSubject = "EBCFetch alert"
+// newSMTPServer sets up the outgoing mail server from cfg.SmtpStuff.
+func newSMTPServer() *smtp.SMTPServer {
 
-	//fmt.Printf("WhatsUp: %v\n", whatsup)
 	client := smtp.NewSMTPClient()
 	client.Host = cfg.SmtpStuff.Host
 	client.Port = cfg.SmtpStuff.Port
 	client.Username = cfg.SmtpStuff.Username
 	client.Password = cfg.SmtpStuff.Password
 
-	//fmt.Printf("U:%v P:%v\n", client.Username, client.Password)
 	client.Encryption = smtp.EncryptionTLS // It's 2022, everybody needs TLS now, don't they.
 
-	client.ConnectTimeout = 10 * time.Second
-	client.SendTimeout = 10 * time.Second
+	client.ConnectTimeout = smtpTimeout()
+	client.SendTimeout = client.ConnectTimeout
 	client.KeepAlive = false
 
 	if cfg.SmtpStuff.CertName != "" {
 		client.TLSConfig = &tls.Config{ServerName: cfg.SmtpStuff.CertName}
 	}
+	return client
 
-	conn, err := client.Connect()
+}
+
+// sendPlainMail sends a simple text email, replies to riders and the like.
+func sendPlainMail(to string, subject string, body string) error {
+
+	if mailFolder != "" {
+		return fileMail(to, subject, "text/plain", body)
+	}
+	conn, err := newSMTPServer().Connect()
 	if err != nil {
-		fmt.Printf("Can't connect to %v because %v\n", client.Host, err)
-		return
+		fmt.Printf("%v can't send to %v because %v\n", logts(), to, err)
+		return err
 	}
 	msg := smtp.NewMSG()
-	for _, k := range sendToAddress {
-		msg.AddTo(k)
-	}
+	msg.AddTo(to)
 	msg.SetFrom(cfg.ImapLogin)
-	msg.SetSubject(alertSubject)
-
-	msg.SetBody(smtp.TextPlain, whatsup)
-
-	msg.Send(conn)
-	fmt.Printf("%v sending alert to %v\n", logts(), sendToAddress)
+	msg.SetSubject(subject)
+	msg.SetBody(smtp.TextPlain, body)
+	if err = msg.Send(conn); err != nil {
+		fmt.Printf("%v can't send to %v because %v\n", logts(), to, err)
+	}
+	return err
 
 }
 
@@ -1043,96 +2003,20 @@ func sendAlertToBob(whatsup string) {
 // of any emails received while cfg.TestMode is true.
 func sendTestResponse(tr testResponse, from string, f4 *fourFields) {
 
-	var sb strings.Builder
-
-	maxphoto := 1 + cfg.MaxExtraPhotos
-
-	if tr.ClaimIsGood && tr.PhotoPresent > 0 && tr.PhotoPresent <= maxphoto {
-		sb.WriteString("<p>" + cfg.TestResponseGood)
-	} else {
-		sb.WriteString("<p>" + cfg.TestResponseBad)
-	}
-	sb.WriteString(" [ " + cfg.RallyTitle + " ")
-	sb.WriteString("(TZ=" + cfg.LocalTimezone + " " + cfg.OffsetTZ + ") ")
-	sb.WriteString(cfg.TestModeLiteral + " ]</p>")
-
-	sb.WriteString("<table>")
-	sb.WriteString(`<tr><td style="` + ResponseStyleLbl + `">Subject</td><td>`)
-	sb.WriteString(tr.ClaimSubject)
-	if tr.SubjectFromBody {
-		sb.WriteString(" &#x2611;")
-	}
-	sb.WriteString((" " + yesno(cfg.SubjectRE.MatchString(tr.ClaimSubject) && f4.TimeOk)))
-	sb.WriteString(`</td></tr><tr><td style="` + ResponseStyleLbl + `">Entrant#</td><td>` + strconv.Itoa(f4.EntrantID))
-	sb.WriteString(yesno(tr.ValidEntrantID))
-	if tr.ValidEntrantID {
-		sb.WriteString(`</td></tr><tr><td style="` + ResponseStyleLbl + `">Email = Entrant Email</td><td>`)
-		sb.WriteString(yesno(tr.AddressIsRegistered))
-		if !tr.AddressIsRegistered {
-			sb.WriteString(" " + cfg.TestResponseBadEmail)
-		} else {
-			sb.WriteString(" " + cfg.TestResponseGoodEmail)
-		}
-	}
-
-	sb.WriteString(`</td></tr><tr><td style="` + ResponseStyleLbl + `">Bonus</td><td>`)
-	sb.WriteString(tr.BonusID)
-	if tr.BonusIsReal {
-		sb.WriteString(" - ")
-		sb.WriteString(tr.BonusDesc)
-		sb.WriteString(yesno(true))
-	} else {
-		sb.WriteString(yesno(false))
-	}
-	sb.WriteString(`</td></tr><tr><td style="` + ResponseStyleLbl + `">Odo</td><td>`)
-	sb.WriteString(strconv.Itoa(tr.OdoReading) + yesno(f4.OdoOk))
-	sb.WriteString(`</td></tr><tr><td style="` + ResponseStyleLbl + `">hhmm '` + tr.HHmm + `'</td><td>`)
-	sb.WriteString(yesno(f4.TimeOk))
-	sb.WriteString(" " + tr.ClaimDateTime.Format(time.UnixDate))
-	sb.WriteString(" / " + tr.ClaimDateTime.Format(time.RFC3339))
-	if tr.ExtraField != "" {
-		sb.WriteString(`</td></tr><tr><td style="` + ResponseStyleLbl + `">&#x270D;</td><td>`)
-		sb.WriteString(tr.ExtraField)
-	}
-	sb.WriteString(`</td></tr><tr><td style="` + ResponseStyleLbl + `">Photo</td><td>`)
-
-	if tr.PhotoPresent > 1 {
-		sb.WriteString(` x ` + strconv.Itoa(tr.PhotoPresent) + " ")
-	}
-
-	sb.WriteString(yesno(tr.PhotoPresent > 0 && tr.PhotoPresent <= maxphoto))
-
-	if tr.PhotoPresent > maxphoto {
-		sb.WriteString("  (max = " + strconv.Itoa(maxphoto) + ")")
-	}
-	sb.WriteString("</td></tr></table>")
-
-	if cfg.TestResponseAdvice != "" {
-		sb.WriteString("<p>" + cfg.TestResponseAdvice + "</p>")
+	subject, body := testResponseHTML(tr, f4)
+	if mailFolder != "" {
+		fileMail(from, subject, "text/html", body)
+		return
 	}
-
-	sb.WriteString("<p>ScoreMaster [" + apptitle + " v" + appversion + " :]</p>")
-
 	if cfg.SmtpStuff.Password == "" {
 		fmt.Println("ERROR: Can't send test response, password is empty")
 		return
 	}
-	client := smtp.NewSMTPClient()
-	client.Host = cfg.SmtpStuff.Host
-	client.Port = cfg.SmtpStuff.Port
-	client.Username = cfg.SmtpStuff.Username
-	client.Password = cfg.SmtpStuff.Password
+	client := newSMTPServer()
 
-	client.Encryption = smtp.EncryptionTLS // It's 2022, everybody needs TLS now, don't they.
-
-	client.ConnectTimeout = 10 * time.Second
-	client.SendTimeout = 10 * time.Second
-	client.KeepAlive = false
-
-	if cfg.SmtpStuff.CertName != "" {
-		client.TLSConfig = &tls.Config{ServerName: cfg.SmtpStuff.CertName}
+	if debugging(debugSMTP) {
+		fmt.Printf("%v connecting to %v:%v as %v\n", logts(), client.Host, client.Port, client.Username)
 	}
-
 	conn, err := client.Connect()
 	if err != nil {
 		fmt.Printf("Can't connect to %v because %v\n", client.Host, err)
@@ -1144,15 +2028,9 @@ func sendTestResponse(tr testResponse, from string, f4 *fourFields) {
 		msg.AddBcc(cfg.TestResponseBCC)
 	}
 	msg.SetFrom(cfg.ImapLogin)
-	if cfg.TestResponseSubject != "" {
-		msg.SetSubject(cfg.TestResponseSubject)
-	} else if tr.ClaimIsGood && tr.PhotoPresent > 0 && tr.PhotoPresent <= maxphoto {
-		msg.SetSubject("EBC test: " + cfg.TestResponseGood)
-	} else {
-		msg.SetSubject("EBC test: " + cfg.TestResponseBad)
-	}
+	msg.SetSubject(subject)
 
-	msg.SetBody(smtp.TextHTML, sb.String())
+	msg.SetBody(smtp.TextHTML, body)
 
 	msg.Send(conn)
 	fmt.Printf("%v sending test response to %v\n", logts(), from)
@@ -1189,7 +2067,7 @@ func validateBonus(f4 fourFields) string {
 
 func fetchTeamID(eid int) int {
 
-	rows, err := dbh.Query("SELECT TeamID FROM entrants WHERE EntrantID=?", eid)
+	rows, err := dbh.Query("SELECT "+col("entrants", "TeamID")+" FROM entrants WHERE "+col("entrants", "EntrantID")+"=?", eid)
 	if err != nil {
 		fmt.Printf("%v can't fetch TeamID\n", logts())
 		return 0
@@ -1203,43 +2081,48 @@ func fetchTeamID(eid int) int {
 	return res
 }
 
-func validateEntrant(f4 fourFields, from string) (bool, bool) {
+func validateEntrant(f4 fourFields, from string) (bool, bool, string) {
 
 	var allE []string
 	if cfg.TestMode && !cfg.MatchEmail {
 		allE = listValidTestAddresses()
 	}
 
-	sqlx := "SELECT RiderName,Email,TeamID FROM entrants WHERE EntrantID=" + strconv.Itoa(f4.EntrantID)
+	sqlx := "SELECT " + col("entrants", "RiderName") + "," + col("entrants", "EntrantID") + "," + col("entrants", "TeamID")
+	sqlx += " FROM entrants WHERE " + col("entrants", "EntrantID") + "=" + strconv.Itoa(f4.EntrantID)
 	team := fetchTeamID(f4.EntrantID)
 	if team > 0 {
-		sqlx += " OR TeamID=" + strconv.Itoa(team)
+		sqlx += " OR " + col("entrants", "TeamID") + "=" + strconv.Itoa(team)
 	}
 	rows, err := dbh.Query(sqlx)
 	if err != nil {
 		fmt.Printf("%v Entrant! %v %v\n", logts(), f4.EntrantID, err)
-		return false, false
+		return false, false, ""
 	}
 	defer rows.Close()
 	if !rows.Next() {
 		if *verbose {
 			fmt.Printf("%v No such entrant %v\n", logts(), f4.EntrantID)
 		}
-		return false, false
+		return false, false, ""
 	}
 
-	var RiderName, Email string
-	var TeamID int
-	rows.Scan(&RiderName, &Email, &TeamID)
+	var RiderName string
+	var EntrantID, TeamID int
+	rows.Scan(&RiderName, &EntrantID, &TeamID)
+	ids := []int{EntrantID}
 	for rows.Next() {
-		var rn, em string
-		var tn int
-		rows.Scan(&rn, &em, &tn)
-		Email += "," + em
-	}
-	v, _ := mail.ParseAddress(from)      // where the email is sent from
-	e, _ := mail.ParseAddressList(Email) // addresses known for this entrant
+		var rn string
+		var en, tn int
+		rows.Scan(&rn, &en, &tn)
+		ids = append(ids, en)
+	}
+	ids = append(ids, pillionsOf(ids)...)
+	sender := senderAddress(from) // where the email is sent from
+	e := entrantEmails(ids)       // addresses known for this entrant
+	Email := strings.Join(e, ",")
 	ok := !cfg.MatchEmail
+	matched := ""
 
 	// Email matching options
 	//
@@ -1248,132 +2131,159 @@ func validateEntrant(f4 fourFields, from string) (bool, bool) {
 	//
 	// In Test mode, MatchEmail=true means return ok if from must match entrant's address,
 	//               MatchEmail=false means return ok if from matches any address in database
+	//
+	// Addresses are matched by the rules in emailmatch.go
 
 	if !ok || cfg.TestMode {
-		if cfg.TestMode {
-			ok = false
-		}
 		var myE []string
 		if cfg.TestMode && !cfg.MatchEmail {
 			myE = allE
 		} else {
-			for _, em := range e {
-				myE = append(myE, em.Address)
-			}
+			myE = e
 		}
-		for _, em := range myE {
-			if *verbose {
-				fmt.Printf("%v comparing %v with %v\n", logts(), v.Address, em)
-			}
-			ok = ok || strings.EqualFold(v.Address, cfg.ImapLogin) // Anything sent from my email address is ok by definition
-			ok = ok || strings.EqualFold(em, v.Address)
-			if !ok {
-				f := func(c rune) bool {
-					return c == '@'
-				}
-				a1 := strings.FieldsFunc(em, f)
-				a2 := strings.FieldsFunc(v.Address, f)
-				ok = strings.EqualFold(a1[0], a2[0]) // Compare only the 'account' port of the address
-				if ok && !*silent {
-					fmt.Printf("%v matched email from %v for rider %v <%v> [%v]\n", logts(), v.Address, RiderName, Email, ok)
-				}
-			}
+		em, rule := matchEmail(sender, myE, emailMatching())
+		if strings.EqualFold(sender, cfg.ImapLogin) { // Anything sent from my email address is ok by definition
+			em, rule = sender, "mine"
+		}
+		ok = em != ""
+		matched = describeEmailMatch(em, rule)
+		if ok && rule != matchExact && !*silent {
+			fmt.Printf("%v matched email from %v for rider %v <%v> by %v\n", logts(), sender, RiderName, Email, matched)
 		}
 		if !ok && !*silent {
-			fmt.Printf("%v received from %v for rider %v <%v> [%v]\n", logts(), v.Address, RiderName, Email, ok)
+			fmt.Printf("%v received from %v for rider %v <%v> [%v]\n", logts(), sender, RiderName, Email, ok)
 		}
 	}
-	return true, ok && !strings.EqualFold(RiderName, "")
+	return true, ok && !strings.EqualFold(RiderName, ""), matched
 }
 
 // returns an array of email addresses for all entrants
 func listValidTestAddresses() []string {
 
-	sqlx := "SELECT Email FROM entrants"
-	rows, err := dbh.Query(sqlx)
-	if err != nil {
-		panic(err)
-	}
-	defer rows.Close()
-	var res []string
-	var email string
-	for rows.Next() {
-		rows.Scan(&email)
-		if email != "" {
-			res = append(res, email)
-		}
-	}
-	return res
+	return entrantEmails(nil)
 
 }
 
-func imageFilename(imgid int, entrant int, bonus string, isHeic bool) string {
+func imageFilename(imgid int, entrant int, bonus string, ext string) string {
 
-	var ext string = ".jpg"
-	if isHeic {
-		ext = ".HEIC"
-	}
 	return "img" + "-" + strconv.Itoa(entrant) + "-" + bonus + "-" + strconv.Itoa(imgid) + ext
 
 }
-func writeImage(entrant int, bonus string, emailid uint32, pic []byte, filename string) int {
 
-	var photoid int = 0
+// writeImage stores a photo on its own, returning its rowid.
+func writeImage(entrant int, bonus string, emailid uint32, pic []byte, filename string) int {
 
-	if cfg.TestMode {
+	pp := writePhoto(entrant, bonus, emailid, emailPhoto{Data: pic, Filename: filename})
+	if pp == nil {
 		return 0
 	}
-
-	isHeic, _ := regexp.MatchString("(?i)\\.heic", filename)
-	_, err := dbh.Exec("BEGIN TRANSACTION")
-	if err != nil {
-		if *verbose {
+	if err := dbWriteTx(pp.store); err != nil {
+		if debugging(debugDB) {
 			fmt.Printf("%v can't store photo %v\n", logts(), err)
 		}
-		dbh.Exec("ROLLBACK")
+		pp.discard()
 		return 0
 	}
+	pp.keep()
+	return pp.id
 
-	sqlx := "INSERT INTO ebcphotos(EntrantID,BonusID,EmailID) VALUES(?,?,?)"
-	dbh.Exec(sqlx, entrant, bonus, emailid)
-	row := dbh.QueryRow("SELECT last_insert_rowid()")
-	row.Scan(&photoid)
-
-	x := filepath.Join(cfg.Path2SM, cfg.ImageFolder, imageFilename(photoid, entrant, bonus, isHeic))
-	err = os.WriteFile(x, pic, 0644)
-	if err != nil {
-		fmt.Printf("%v can't write image %v - error:%v\n", logts(), x, err)
-		dbh.Exec("ROLLBACK")
-		return 0
-	}
-	y := filepath.Join(cfg.ImageFolder, imageFilename(photoid, entrant, bonus, isHeic))
-	if cfg.ConvertHeic && isHeic {
-		y = filepath.Join(cfg.Path2SM, cfg.ImageFolder, imageFilename(photoid, entrant, bonus, false))
-		cmd := exec.Command(cfg.Heic2jpg, x, y)
-		err := cmd.Run()
-		if err != nil {
-			fmt.Printf("%v HEIC x %v FAILED %v\n", logts(), cfg.Heic2jpg, err)
-			dbh.Exec("ROLLBACK")
-			return 0
-		}
-		y = filepath.Join(cfg.ImageFolder, imageFilename(photoid, entrant, bonus, false))
+}
 
-	}
-	sqlx = "UPDATE ebcphotos SET image=? WHERE rowid=?"
-	dbh.Exec(sqlx, y, photoid)
-	dbh.Exec("COMMIT TRANSACTION")
-	return photoid
+// writePhoto writes a photo's files under a temporary name, using the JPG
+// prepared for it in advance if there is one. The photo is numbered and
+// recorded in ebcphotos by store, as part of its claim, and only then are
+// the files given their proper names.
+func writePhoto(entrant int, bonus string, emailid uint32, p emailPhoto) *pendingPhoto {
 
-}
+	pic, filename := p.Data, p.Filename
 
-func validateHeicHandler() {
+	if cfg.TestMode {
+		return nil
+	}
+
+	// Originals are stored as .HEIC or with their own extension if I know how to
+	// convert them, everything else is assumed to be a JPG.
+	ext := contentImageExt(pic, filename)
+	converter := converterFor(ext)
+	storedExt := ".jpg"
+	if isHeicExt(ext) {
+		storedExt = ".HEIC"
+	} else if converter != "" {
+		storedExt = ext
+	}
+	pp := &pendingPhoto{entrant: entrant, bonus: bonus, emailid: emailid, sourceURL: p.SourceURL, temp: pendingPhotoName(emailid)}
+
+	// Photos too big to be worth storing are shrunk, keeping the original if asked
+	stored := pic
+	if storedExt == ".jpg" {
+		small, ok := p.Prepared, p.Prepared != nil
+		if !ok {
+			small, ok = downscalePhoto(pic)
+		}
+		if ok {
+			stored = small
+			if cfg.KeepOriginals {
+				origExt := ext
+				if origExt == "" {
+					origExt = ".jpg"
+				}
+				if _, err := keepOriginal(pp.temp+origExt, pic); err != nil {
+					fmt.Printf("%v can't keep original image - error:%v\n", logts(), err)
+				} else {
+					pp.original = origExt
+				}
+			}
+		}
+	}
 
-	cmd := exec.Command(cfg.Heic2jpg)
-	err := cmd.Run()
-	if err != nil {
-		fmt.Printf("%s: HEIC handler %v may not be available (%v)\n", apptitle, cfg.Heic2jpg, err)
-		cfg.ConvertHeic = true // On Linux, "convert" returns 1 if run with no params
+	x := filepath.Join(cfg.Path2SM, cfg.ImageFolder, pp.temp+storedExt)
+	if err := os.WriteFile(x, stored, 0644); err != nil {
+		fmt.Printf("%v can't write image %v - error:%v\n", logts(), x, err)
+		os.Remove(x)
+		pp.discard()
+		return nil
+	}
+	pp.exts, pp.image = append(pp.exts, storedExt), storedExt
+	y := filepath.Join(cfg.ImageFolder, pp.temp+storedExt)
+	jpg := filepath.Join(cfg.ImageFolder, pp.temp+".jpg")
+	if storedExt != ".jpg" && p.Prepared != nil {
+		// Converted already, see preparePhoto
+		if err := os.WriteFile(filepath.Join(cfg.Path2SM, jpg), p.Prepared, 0644); err != nil {
+			fmt.Printf("%v can't write image %v - error:%v\n", logts(), jpg, err)
+			os.Remove(filepath.Join(cfg.Path2SM, jpg))
+			conversionFailed(pp)
+		} else {
+			pp.exts, pp.image, stored = append(pp.exts, ".jpg"), ".jpg", p.Prepared
+		}
+	} else if storedExt != ".jpg" && (converter != "" || nativeHeic(ext)) {
+		if err := convertStored(ext, converter, y, jpg); err != nil {
+			// The original is kept and conversion retried later
+			name := "in-process"
+			if converter != "" {
+				name = converterName(converter)
+			}
+			fmt.Printf("%v %v x %v FAILED %v\n", logts(), ext, name, err)
+			os.Remove(filepath.Join(cfg.Path2SM, jpg))
+			conversionFailed(pp)
+		} else {
+			pp.exts, pp.image = append(pp.exts, ".jpg"), ".jpg"
+			if small := downscaleStored(jpg); small != nil {
+				stored = small
+			}
+		}
+	}
+	w, h, camera, taken := photoDetails(pic)
+	if len(stored) != len(pic) {
+		w, h, _, _ = photoDetails(stored)
+	}
+	pp.width, pp.height, pp.camera = w, h, camera
+	if !taken.IsZero() {
+		pp.captured = storeTimeDB(taken)
+	}
+	if la, lo, ok := photoPosition(pic); ok {
+		pp.lat, pp.lon = la, lo
 	}
+	return pp
 
 }
 
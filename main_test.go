@@ -1,9 +1,56 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/mattn/go-sqlite3"
+	"github.com/toorop/go-dkim"
 )
 
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files in testdata/corpus")
+
 type SUBJECT struct {
 	x  string
 	ok bool
@@ -26,11 +73,86 @@ var subjects = []SUBJECT{
 	{"Fwd: 1 23b 27 2023-02-01T07:15:00+03:00 some old bollox", true},
 }
 
+// fixtureSQL builds the databases the tests use, see useMemoryDB.
+const fixtureSQL = "testdata/fixture.sql"
+
+// fixtureDir holds the database opened by init in place of sm/ScoreMaster.db.
+var fixtureDir string
+
 var _ = func() bool {
 	testing.Init()
+	dir, err := os.MkdirTemp("", "ebcfetch-test")
+	if err != nil {
+		panic(err)
+	}
+	fixtureDir = dir
+	*path2db = filepath.Join(dir, "ScoreMaster.db")
+	db, err := sql.Open("sqlite3", *path2db)
+	if err == nil {
+		err = loadFixture(db)
+		db.Close()
+	}
+	if err != nil {
+		panic(err)
+	}
 	return true
 }()
 
+func TestMain(m *testing.M) {
+
+	res := m.Run()
+	os.RemoveAll(fixtureDir)
+	os.Exit(res)
+
+}
+
+// loadFixture creates the tables ScoreMaster would and a small rally.
+func loadFixture(db *sql.DB) error {
+
+	fixture, err := os.ReadFile(fixtureSQL)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(string(fixture))
+	return err
+
+}
+
+// memoryDBs numbers the in-memory databases so each starts afresh.
+var memoryDBs int
+
+// useMemoryDB gives the test a database of its own, in memory, built from
+// the fixture with my tables added, and sandboxes the settings. Both are
+// put back when the test is done.
+func useMemoryDB(t *testing.T) {
+
+	t.Helper()
+	memoryDBs++
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:ebctest%d?mode=memory&cache=shared", memoryDBs))
+	if err != nil {
+		t.Fatalf("Can't open database %v\n", err)
+	}
+	// This connection keeps the database alive until the test is done
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		t.Fatalf("Can't open database %v\n", err)
+	}
+	savedDB, savedCfg := dbh, cfg
+	t.Cleanup(func() {
+		dbh, cfg = savedDB, savedCfg
+		conn.Close()
+		db.Close()
+	})
+	if err := loadFixture(db); err != nil {
+		t.Fatalf("Can't load %v %v\n", fixtureSQL, err)
+	}
+	dbh = db
+	ensureEbcTables()
+	sandboxSettings(t.TempDir())
+
+}
+
 /*
  *
  * No longer care about 'strict', only allowable
@@ -53,3 +175,4181 @@ func TestAllowableSubject(t *testing.T) {
 		}
 	}
 }
+
+func TestSubjectFieldOrder(t *testing.T) {
+
+	saveRE, saveOrder := cfg.SubjectRE, cfg.FieldOrder
+	defer func() { cfg.SubjectRE, cfg.FieldOrder = saveRE, saveOrder }()
+
+	cfg.SubjectRE = regexp.MustCompile(`^\s*(?P<bonus>[a-zA-Z0-9\-]+)\s+(?P<entrant>\d+)\s+(?P<odo>\d+)\s+(?P<time>\d\d\d\d)\s*(?P<extra>.*)`)
+	ff := *parseSubject("A4 12 10423 1713 lovely", false)
+	if !ff.ok || ff.EntrantID != 12 || ff.BonusID != "A4" || ff.OdoReading != 10423 || ff.HHmm != "1713" || ff.Extra != "lovely" {
+		t.Fatalf("Named groups returned %+v\n", ff)
+	}
+
+	cfg.SubjectRE = regexp.MustCompile(`^\s*([a-zA-Z0-9\-]+)\s+(\d+)\s+(\d+)\s+(\d\d\d\d)\s*(.*)`)
+	cfg.FieldOrder = []string{"bonus", "entrant", "odo", "time", "extra"}
+	ff = *parseSubject("A4 12 10423 1713", false)
+	if !ff.ok || ff.EntrantID != 12 || ff.BonusID != "A4" || ff.OdoReading != 10423 {
+		t.Fatalf("FieldOrder returned %+v\n", ff)
+	}
+}
+
+func TestSubjectAlternatives(t *testing.T) {
+
+	saveRE, saveREs := cfg.SubjectRE, cfg.SubjectREs
+	defer func() { cfg.SubjectRE, cfg.SubjectREs = saveRE, saveREs }()
+
+	cfg.SubjectRE = regexp.MustCompile(`^\s*(?P<entrant>\d+)\s+(?P<bonus>[a-zA-Z0-9\-]+)\s+(?P<odo>\d+)\s+(?P<time>\d\d\d\d)`)
+	cfg.SubjectREs = []*regexp.Regexp{
+		regexp.MustCompile(`^\s*(?P<bonus>[a-zA-Z]+\d*)/(?P<entrant>\d+)/(?P<odo>\d+)/(?P<time>\d\d\d\d)`),
+		regexp.MustCompile(`^\s*(?P<bonus>\S+)`),
+	}
+	if ff := parseSubject("12 A4 10423 1713", false); !ff.ok || ff.EntrantID != 12 || ff.BonusID != "A4" {
+		t.Errorf("Preferred format returned %+v\n", ff)
+	}
+	if ff := parseSubject("A4/12/10423/1713", false); !ff.ok || ff.EntrantID != 12 || ff.OdoReading != 10423 {
+		t.Errorf("Legacy format returned %+v\n", ff)
+	}
+	if ff := parseSubject("A4/12/10423/1713", true); ff.ok {
+		t.Errorf("Strict parse used alternatives\n")
+	}
+}
+
+func TestNormaliseTime(t *testing.T) {
+
+	var times = []struct{ in, out string }{
+		{"5.15pm", "1715"}, {"5:15 PM", "1715"}, {"12.05am", "0005"}, {"12pm", "1200"},
+		{"1715hrs", "1715"}, {"17h15", "1715"}, {"9h05", "0905"}, {"17:13:42", "1713"}, {"1713", "1713"},
+		{"13pm", "13pm"}, {"banana", "banana"},
+	}
+	for _, x := range times {
+		if got := normaliseTime(x.in); got != x.out {
+			t.Errorf("normaliseTime(%v) returned %v, expected %v\n", x.in, got, x.out)
+		}
+	}
+}
+
+func TestEntrantByName(t *testing.T) {
+
+	ff := *parseSubject("bob A4 10423 1713", false)
+	if ff.EntrantID != 1 || !ff.NameMatched {
+		t.Errorf("Entrant name returned %+v\n", ff)
+	}
+	ff = *parseSubject("nobody A4 10423 1713", false)
+	if ff.EntrantID != 0 || ff.NameMatched {
+		t.Errorf("Unknown name returned %+v\n", ff)
+	}
+	ff = *parseSubject("#1 A4 10423 1713", false)
+	if ff.EntrantID != 1 || ff.NameMatched {
+		t.Errorf("Decorated number returned %+v\n", ff)
+	}
+}
+
+func TestEntrantAlias(t *testing.T) {
+
+	dbh.Exec("INSERT OR REPLACE INTO entrantaliases (Alias,EntrantID) VALUES('Bobster',1),('X42',1)")
+	defer dbh.Exec("DELETE FROM entrantaliases WHERE Alias IN ('Bobster','X42')")
+
+	for _, x := range []string{"bobster", "X42", "x42"} {
+		ff := *parseSubject(x+" A4 10423 1713", false)
+		if ff.EntrantID != 1 || ff.NameMatched {
+			t.Errorf("Alias %v returned %+v\n", x, ff)
+		}
+	}
+}
+
+func TestSplitEmails(t *testing.T) {
+
+	for _, x := range []struct {
+		s string
+		n int
+	}{
+		{"bob@example.com", 1},
+		{"Bob <bob@example.com>, spot@findmespot.com", 2},
+		{"bob@example.com; wife@example.com", 2},
+		{"", 0},
+	} {
+		if got := splitEmails(x.s); len(got) != x.n {
+			t.Errorf("splitEmails(%v) returned %v\n", x.s, got)
+		}
+	}
+	if e := entrantEmails([]int{1}); len(e) != 1 || e[0] != "bob@example.com" {
+		t.Errorf("entrantEmails returned %v\n", e)
+	}
+}
+
+func TestSMSGateway(t *testing.T) {
+
+	if ph := smsGatewayPhone("+1 (555) 123-4567 <15551234567@txt.att.net>"); ph != "5551234567" {
+		t.Errorf("Gateway phone returned %v\n", ph)
+	}
+	if ph := smsGatewayPhone("bob@example.com"); ph != "" {
+		t.Errorf("Non-gateway phone returned %v\n", ph)
+	}
+	body := "This message was sent via AT&T\n\n1 A4 10423 1713\n\n--\nReply to this message to respond"
+	if txt := smsClaimText(body); txt != "1 A4 10423 1713" {
+		t.Errorf("SMS claim text returned %v\n", txt)
+	}
+}
+
+func TestDownloadLink(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 3<<20))
+	}))
+	defer srv.Close()
+	save := cfg.MaxDownloadMB
+	defer func() { cfg.MaxDownloadMB = save }()
+
+	cfg.MaxDownloadMB = 4
+	if pic, _, err := downloadLink(srv.URL, false); err != nil || len(pic) != 3<<20 {
+		t.Errorf("Download returned %v bytes, %v\n", len(pic), err)
+	}
+	cfg.MaxDownloadMB = 2
+	if _, _, err := downloadLink(srv.URL, false); err == nil {
+		t.Errorf("Download exceeding limit succeeded\n")
+	}
+}
+
+func TestLinkAllowed(t *testing.T) {
+
+	for link, ok := range map[string]bool{
+		"https://photos.app.goo.gl/AbCdEf":                  true,
+		"https://drive.google.com/file/d/1aB-c/view":        true,
+		"http://drive.google.com/file/d/1aB-c/view":         false,
+		"https://drive.google.com.evil.example/file/d/1aB-": false,
+		"https://example.com/photo.jpg":                     false,
+	} {
+		if linkAllowed(link) != ok {
+			t.Errorf("linkAllowed(%v) != %v\n", link, ok)
+		}
+	}
+
+	save := cfg.LinkPatterns
+	defer func() { cfg.LinkPatterns = save }()
+	cfg.LinkPatterns = []string{`^http://photos\.example\.org/.+\.jpg$`}
+	if !linkAllowed("http://photos.example.org/a/b.jpg") || linkAllowed("http://photos.example.org/a/b.exe") {
+		t.Errorf("LinkPatterns not applied\n")
+	}
+
+	for link, ok := range map[string]bool{
+		"https://cvws.icloud-content.com/B/AbCd/IMG_0001.JPG": true,
+		"http://cvws.icloud-content.com/B/AbCd/IMG_0001.JPG":  false,
+		"https://icloud-content.com.evil.example/IMG.JPG":     false,
+		"https://evilicloud-content.com/IMG.JPG":              false,
+		"http://169.254.169.254/latest/meta-data/":            false,
+	} {
+		if mailDropFile(link) != ok {
+			t.Errorf("mailDropFile(%v) != %v\n", link, ok)
+		}
+	}
+	if _, err := mailDropPhoto("https://www.icloud.com/attachment/?u=http%3A%2F%2F127.0.0.1%2Fsecret&f=IMG.JPG"); err == nil || !strings.Contains(err.Error(), "Mail Drop") {
+		t.Errorf("Mail Drop link to elsewhere fetched, %v\n", err)
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+
+	rec := httptest.NewRecorder()
+	dashStatsAPI(rec, httptest.NewRequest("GET", "/api/stats", nil))
+	var st claimStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatalf("Stats returned %v %v\n", rec.Body.String(), err)
+	}
+	if st.ClaimsToday > st.ClaimsTotal || st.ClaimsLastHr > st.ClaimsToday {
+		t.Errorf("Stats inconsistent %+v\n", st)
+	}
+}
+
+func TestVerbosityFlag(t *testing.T) {
+
+	for args, n := range map[string]int{"-v": 1, "-v -v": 2, "-v=3": 3, "": 0} {
+		var v verbosityFlag
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Var(&v, "v", "")
+		if err := fs.Parse(strings.Fields(args)); err != nil || int(v) != n {
+			t.Errorf("%q gave verbosity %v %v\n", args, v, err)
+		}
+	}
+}
+
+func TestSeqSetLen(t *testing.T) {
+
+	s := new(imap.SeqSet)
+	s.AddNum(3, 4, 5, 9)
+	if n := seqSetLen(s); n != 4 {
+		t.Errorf("seqSetLen returned %v\n", n)
+	}
+}
+
+func TestAPIPause(t *testing.T) {
+
+	save := cfg.APIToken
+	defer func() { cfg.APIToken = save; paused = 0 }()
+	cfg.APIToken = "sesame"
+
+	rec := httptest.NewRecorder()
+	apiPauser(1)(rec, httptest.NewRequest("POST", "/api/pause", nil))
+	if rec.Code != http.StatusUnauthorized || isPaused() {
+		t.Fatalf("Pause without token returned %v\n", rec.Code)
+	}
+	for _, auth := range []string{"Bearer sesam", "Bearer sesame2", "sesame", "Basic sesame"} {
+		req := httptest.NewRequest("POST", "/api/pause", nil)
+		req.Header.Set("Authorization", auth)
+		rec = httptest.NewRecorder()
+		apiPauser(1)(rec, req)
+		if rec.Code != http.StatusUnauthorized || isPaused() {
+			t.Errorf("Pause with %q returned %v\n", auth, rec.Code)
+		}
+	}
+	req := httptest.NewRequest("POST", "/api/pause", nil)
+	req.Header.Set("Authorization", "Bearer sesame")
+	rec = httptest.NewRecorder()
+	apiPauser(1)(rec, req)
+	var st apiState
+	json.Unmarshal(rec.Body.Bytes(), &st)
+	if !isPaused() || !st.Paused {
+		t.Errorf("Pause returned %v %v\n", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIClaimsStream(t *testing.T) {
+
+	useMemoryDB(t)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		apiClaims(rec, httptest.NewRequest("GET", "/api/claims?after=1&wait=30", nil))
+		done <- rec
+	}()
+	select {
+	case rec := <-done:
+		t.Fatalf("Answered with nothing stored %v\n", rec.Body.String())
+	case <-time.After(200 * time.Millisecond):
+	}
+	dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,OdoReading) VALUES(1,'A1',10001)")
+	started := time.Now()
+	announceClaim()
+	select {
+	case rec := <-done:
+		var claims []apiClaim
+		json.Unmarshal(rec.Body.Bytes(), &claims)
+		if len(claims) != 1 || claims[0].OdoReading != 10001 {
+			t.Errorf("Stream returned %v\n", rec.Body.String())
+		}
+		if time.Since(started) > time.Second {
+			t.Errorf("Claim took %v to arrive\n", time.Since(started))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stored claim not announced\n")
+	}
+}
+
+func TestFireHook(t *testing.T) {
+
+	out := filepath.Join(t.TempDir(), "hook.json")
+	save := cfg.Hooks
+	defer func() { cfg.Hooks = save }()
+	cfg.Hooks = map[string]string{hookClaimStored: "tee " + out}
+
+	fireHook(hookEvent{Event: hookClaimStored, EmailID: 42, EntrantID: 1, BonusID: "A4"})
+	var ev hookEvent
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if b, err := os.ReadFile(out); err == nil && json.Unmarshal(b, &ev) == nil {
+			break
+		}
+	}
+	if ev.EmailID != 42 || ev.BonusID != "A4" {
+		t.Errorf("Hook received %+v\n", ev)
+	}
+}
+
+func TestEvalRule(t *testing.T) {
+
+	vars := map[string]interface{}{"BonusID": "CAFE1", "ClaimHH": float64(6), "OdoReading": float64(10423), "Extra": ""}
+	for expr, want := range map[string]bool{
+		`BonusID in ("cafe1", "CAFE2") && ClaimHH < 7`: true,
+		`BonusID == "CAFE2" or ClaimHH >= 7`:           false,
+		`not (OdoReading - 10000 > 500)`:               true,
+		`BonusID =~ "^caf" and !Extra`:                 true,
+		`-ClaimHH < -5`:                                true,
+	} {
+		got, err := evalRule(expr, vars)
+		if err != nil || got != want {
+			t.Errorf("%v returned %v %v\n", expr, got, err)
+		}
+	}
+	for _, expr := range []string{`Nonsense == 1`, `ClaimHH <`, `(ClaimHH`, `BonusID + 1`, `ClaimHH`} {
+		if _, err := evalRule(expr, vars); err == nil {
+			t.Errorf("%v didn't fail\n", expr)
+		}
+	}
+
+	// Mistakes are found when the configuration is loaded
+	useMemoryDB(t)
+	cfg.Rules = nil
+	if err := checkRules(); err != nil {
+		t.Errorf("No rules gave %v\n", err)
+	}
+	cfg.Rules = []claimRule{{When: `BonusID in ("CAFE1") && ClaimHH < 7 && RiderName != "" && TeamID == 0`, Flag: "CAF"}}
+	if err := checkRules(); err != nil {
+		t.Errorf("Good rule gave %v\n", err)
+	}
+	for _, r := range []claimRule{
+		{When: `Bonus == "A1"`, Flag: "X"},
+		{When: `ClaimHH < 7 &&`, Reject: "Too early"},
+		{When: `BonusID =~ "("`, Flag: "X"},
+		{When: `ClaimHH < 7`},
+		{Flag: "X"},
+	} {
+		cfg.Rules = []claimRule{{When: "Photos == 0", Flag: "NP"}, r}
+		if err := checkRules(); err == nil || !strings.Contains(err.Error(), "rule 2") {
+			t.Errorf("%+v gave %v\n", r, err)
+		}
+	}
+}
+
+func TestColumnMapping(t *testing.T) {
+
+	save := cfg.Columns
+	defer func() { cfg.Columns = save }()
+
+	if c := col("entrants", "RiderName"); c != "RiderName" {
+		t.Errorf("Unmapped column returned %v\n", c)
+	}
+	cfg.Columns = map[string]string{"entrants.RiderName": "upper(RiderName)"}
+	id, ok := entrantByName("BOB")
+	if c := col("entrants", "RiderName"); c != "upper(RiderName)" || !ok || id != 1 {
+		t.Errorf("Mapped column returned %v, %v %v\n", c, id, ok)
+	}
+	if hasColumn("entrants", "Phone") {
+		t.Errorf("Fixture has no Phone column\n")
+	}
+}
+
+func TestDetectDBType(t *testing.T) {
+
+	if x := detectDBType(); x != dbSM3 {
+		t.Errorf("Fixture detected as %v\n", x)
+	}
+}
+
+func TestParseOverride(t *testing.T) {
+
+	save := cfg.OverrideSecret
+	defer func() { cfg.OverrideSecret = save }()
+	cfg.OverrideSecret = "xyz"
+
+	var subjects = []struct {
+		s, claim    string
+		isOv, secOk bool
+	}{
+		{"OVERRIDE 12 A4 10423 1713 secret=xyz", "12 A4 10423 1713", true, true},
+		{"override secret=xyz 12 A4 10423 1713", "12 A4 10423 1713", true, true},
+		{"OVERRIDE 12 A4 10423 1713 secret=abc", "12 A4 10423 1713", true, false},
+		{"OVERRIDE 12 A4 10423 1713", "12 A4 10423 1713", true, false},
+		{"12 A4 10423 1713", "12 A4 10423 1713", false, false},
+	}
+	for _, x := range subjects {
+		claim, isOv, secOk := parseOverride(x.s)
+		if claim != x.claim || isOv != x.isOv || secOk != x.secOk {
+			t.Errorf("%v returned %q %v %v\n", x.s, claim, isOv, secOk)
+		}
+	}
+	cfg.OverrideSecret = ""
+	if _, _, ok := parseOverride("OVERRIDE 12 A4 10423 1713 secret="); ok {
+		t.Errorf("Override accepted with no secret configured\n")
+	}
+}
+
+func TestAdminCommand(t *testing.T) {
+
+	saveTM, saveAdmins := cfg.TestMode, cfg.AdminAddresses
+	defer func() { cfg.TestMode, cfg.AdminAddresses, adminTestMode, paused = saveTM, saveAdmins, nil, 0 }()
+	cfg.AdminAddresses = []string{"HQ@example.com"}
+
+	if !isAdminAddress("Rally HQ <hq@example.com>") || isAdminAddress("bob@example.com") {
+		t.Errorf("isAdminAddress failed\n")
+	}
+	if _, ok := adminCommand("12 A4 10423 1713", true); ok {
+		t.Errorf("Claim taken as a command\n")
+	}
+	if _, ok := adminCommand("pause", true); !ok || !isPaused() {
+		t.Errorf("PAUSE failed\n")
+	}
+	if _, ok := adminCommand("RESUME", true); !ok || isPaused() {
+		t.Errorf("RESUME failed\n")
+	}
+	if _, ok := adminCommand("TESTMODE ON", true); !ok || cfg.TestMode != saveTM || !applyTestMode() || !cfg.TestMode || adminTestMode == nil {
+		t.Errorf("TESTMODE ON failed\n")
+	}
+	if _, ok := adminCommand("TESTMODE MAYBE", true); ok {
+		t.Errorf("TESTMODE MAYBE accepted\n")
+	}
+
+	// Forged commands
+	saveSecret, saveServers := cfg.AdminSecret, cfg.SenderAuthServers
+	defer func() { cfg.AdminSecret, cfg.SenderAuthServers = saveSecret, saveServers }()
+	cfg.AdminSecret, cfg.SenderAuthServers = "xyz", nil
+	if done, ok := adminCommand("PAUSE", false); !ok || isPaused() || !strings.Contains(done, "not obeyed") {
+		t.Errorf("Unproven PAUSE gave %v\n", done)
+	}
+	if done, ok := adminCommand("STATUS", false); !ok || done != "Status" {
+		t.Errorf("Unproven STATUS gave %v\n", done)
+	}
+	forged := Email{Subject: "TESTMODE ON", Header: mail.Header{"From": {"hq@example.com"}, "Authentication-Results": {"mx.google.com; dmarc=pass"}}}
+	if subject, proven := adminProof(forged, nil); proven || subject != "TESTMODE ON" {
+		t.Errorf("Forged header proved %v\n", subject)
+	}
+	for subject, want := range map[string]bool{"PAUSE secret=xyz": true, "PAUSE secret=abc": false, "PAUSE SECRET=xyz": true} {
+		if s, proven := adminProof(Email{Subject: subject, Header: forged.Header}, nil); proven != want || s != "PAUSE" {
+			t.Errorf("adminProof(%v) = %v %v\n", subject, s, proven)
+		}
+	}
+}
+
+func TestCorrection(t *testing.T) {
+
+	if rest, ok := stripKeyword("correction: 1 A4 10423 1715", "CORRECTION"); !ok || rest != "1 A4 10423 1715" {
+		t.Errorf("stripKeyword returned %q %v\n", rest, ok)
+	}
+	if _, ok := stripKeyword("CORRECTIONS 1 A4 10423 1715", "CORRECTION"); ok {
+		t.Errorf("stripKeyword matched a longer word\n")
+	}
+
+	res, err := dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,EbcFlags) VALUES(1,'ZZ9','SPD')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, _ := res.LastInsertId()
+	res, _ = dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID) VALUES(1,'ZZ9')")
+	corr, _ := res.LastInsertId()
+	defer dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZ9'")
+
+	if prev := previousClaim(1, "ZZ9"); prev != corr {
+		t.Errorf("previousClaim returned %v, expected %v\n", prev, corr)
+	}
+	if err := dbWriteTx(func(tx *sql.Tx) error { return linkCorrection(tx, corr, orig) }); err != nil {
+		t.Fatal(err)
+	}
+	var flags string
+	var link int64
+	dbh.QueryRow("SELECT EbcFlags FROM ebclaims WHERE rowid=?", orig).Scan(&flags)
+	dbh.QueryRow("SELECT CorrectsRowID FROM ebclaims WHERE rowid=?", corr).Scan(&link)
+	if flags != "SPD,CRD" || link != orig {
+		t.Errorf("Correction left flags %q link %v\n", flags, link)
+	}
+}
+
+func TestCancel(t *testing.T) {
+
+	if e, b, ok := parseCancel("cancel 1 a4"); !ok || e != 1 || b != "A4" {
+		t.Errorf("parseCancel returned %v %v %v\n", e, b, ok)
+	}
+	if _, _, ok := parseCancel("CANCEL 1 A4 10423 1715"); ok {
+		t.Errorf("parseCancel matched a claim\n")
+	}
+
+	res, err := dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID) VALUES(1,'ZZ8')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, _ := res.LastInsertId()
+	defer dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZ8'")
+
+	if rowid, ok := cancelClaim(1, "ZZ8"); !ok || rowid != orig {
+		t.Errorf("cancelClaim returned %v %v\n", rowid, ok)
+	}
+	var n int
+	var flags string
+	dbh.QueryRow("SELECT RiderCancelled,EbcFlags FROM ebclaims WHERE rowid=?", orig).Scan(&n, &flags)
+	if n != 1 || flags != flagCancelled {
+		t.Errorf("Cancelled claim has %v %q\n", n, flags)
+	}
+	if _, ok := cancelClaim(1, "ZZ8"); ok {
+		t.Errorf("cancelClaim cancelled the same claim twice\n")
+	}
+}
+
+func TestRiderStatus(t *testing.T) {
+
+	if !isStatusQuery(" status ") || isStatusQuery("STATUS 1") {
+		t.Errorf("isStatusQuery wrong\n")
+	}
+	if e := entrantsByEmail("Bob <BOB@example.com>"); len(e) != 1 || e[0] != 1 {
+		t.Errorf("entrantsByEmail returned %v\n", e)
+	}
+	dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,ClaimTime,PhotoIDs,Decision) VALUES(1,'ZZ7','2026-06-01T10:00','3,4',0)")
+	defer dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZ7'")
+	txt := riderStatusText(1)
+	if !strings.Contains(txt, "ZZ7") || !strings.Contains(txt, "photos: 2  awaiting judging") {
+		t.Errorf("riderStatusText returned %q\n", txt)
+	}
+}
+
+func TestOdoCodes(t *testing.T) {
+
+	if odoCodeColumn("odostart") != odoStartColumn || odoCodeColumn("ODOEND") != odoFinishColumn || odoCodeColumn("A4") != "" {
+		t.Errorf("odoCodeColumn wrong\n")
+	}
+	if err := recordOdo(1, odoStartColumn, 10423); err == nil {
+		t.Errorf("recordOdo succeeded without the column\n")
+	}
+	save := cfg.Columns
+	defer func() { cfg.Columns = save }()
+	cfg.Columns = map[string]string{"entrants.OdoRallyStart": "TeamID"}
+	defer dbh.Exec("UPDATE entrants SET TeamID=0 WHERE EntrantID=1")
+	if err := recordOdo(1, odoStartColumn, 10423); err != nil {
+		t.Errorf("recordOdo returned %v\n", err)
+	}
+	if err := recordOdo(99, odoStartColumn, 10423); err == nil {
+		t.Errorf("recordOdo succeeded for a missing entrant\n")
+	}
+}
+
+func TestFuelReceipt(t *testing.T) {
+
+	pdf := []byte("%PDF-1.4\n<< /CreationDate (D:20260601143205+01'00') >>")
+	if receiptExt(pdf, "x.jpg") != ".pdf" {
+		t.Errorf("PDF receipt not recognised\n")
+	}
+	if rt, ok := receiptTime(pdf); !ok || rt.Hour() != 14 || rt.Minute() != 32 {
+		t.Errorf("receiptTime returned %v %v\n", rt, ok)
+	}
+	if _, ok := receiptTime([]byte("nothing")); ok {
+		t.Errorf("receiptTime found a time in nothing\n")
+	}
+
+	save := cfg.FuelCode
+	defer func() { cfg.FuelCode = save }()
+	cfg.FuelCode = ""
+	if isFuelCode("FUEL") {
+		t.Errorf("isFuelCode true while not configured\n")
+	}
+	cfg.FuelCode = "FUEL"
+	if !isFuelCode("fuel") {
+		t.Errorf("isFuelCode false\n")
+	}
+
+	dir := t.TempDir()
+	savePath, saveFolder := cfg.Path2SM, cfg.ImageFolder
+	defer func() { cfg.Path2SM, cfg.ImageFolder = savePath, saveFolder }()
+	cfg.Path2SM, cfg.ImageFolder = dir, "img"
+	os.Mkdir(filepath.Join(dir, "img"), 0755)
+	rowid, err := storeFuelReceipt(1, "1 FUEL 10423 1432", fourFields{EntrantID: 1, OdoReading: 10423}, emailPhoto{Data: pdf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Exec("DELETE FROM ebcfuellog WHERE rowid=?", rowid)
+	var receipt, receipted string
+	dbh.QueryRow("SELECT Receipt,ReceiptTime FROM ebcfuellog WHERE rowid=?", rowid).Scan(&receipt, &receipted)
+	if _, err := os.Stat(filepath.Join(dir, receipt)); err != nil || receipted == "" {
+		t.Errorf("Fuel receipt %q %q %v\n", receipt, receipted, err)
+	}
+}
+
+func TestExpectedAnswer(t *testing.T) {
+
+	if !answerMatches("plaque says 1,234!", "1234") || !answerMatches("Red Lion", "white hart|RED LION") || answerMatches("", "1234") {
+		t.Errorf("answerMatches wrong\n")
+	}
+	dbh.Exec("INSERT INTO bonuses (BonusID,BriefDesc,ExpectedAnswer) VALUES('ZZ6','Plaque','1862')")
+	defer dbh.Exec("DELETE FROM bonuses WHERE BonusID='ZZ6'")
+
+	var flags claimFlags
+	if needed, ok := checkAnswer(fourFields{BonusID: "ZZ6", Extra: "1862"}, &flags); !needed || !ok || flags.String() != flagAnswerOk {
+		t.Errorf("checkAnswer returned %v %v %v\n", needed, ok, flags)
+	}
+	flags = nil
+	if needed, ok := checkAnswer(fourFields{BonusID: "ZZ6", Extra: "1866"}, &flags); !needed || ok || flags.String() != flagAnswerMismatch {
+		t.Errorf("checkAnswer returned %v %v %v\n", needed, ok, flags)
+	}
+	flags = nil
+	if needed, _ := checkAnswer(fourFields{BonusID: "A4"}, &flags); needed || len(flags) > 0 {
+		t.Errorf("checkAnswer needed an answer for A4\n")
+	}
+}
+
+func TestBonusRequirements(t *testing.T) {
+
+	dbh.Exec("INSERT INTO bonuses (BonusID,BriefDesc,PhotoRequired,OdoRequired,AnswerRequired,RestMinutes) VALUES('ZZ5','Rest',0,0,1,60)")
+	defer dbh.Exec("DELETE FROM bonuses WHERE BonusID='ZZ5'")
+	req := fetchBonusRequirements("ZZ5")
+	if req.Photo || req.Odo || !req.Answer || req.RestMinutes != 60 {
+		t.Errorf("fetchBonusRequirements returned %+v\n", req)
+	}
+	if req := fetchBonusRequirements("NOSUCH"); req != defaultRequirements {
+		t.Errorf("Missing bonus has requirements %+v\n", req)
+	}
+
+	ct := time.Date(2026, 6, 1, 12, 0, 0, 0, cfg.LocalTZ)
+	dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,OdoReading,ClaimTime) VALUES(1,'ZZ5',10400,?)", storeTimeDB(ct.Add(-30*time.Minute)))
+	defer dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZ5'")
+	var flags claimFlags
+	checkRequirements(req, fourFields{EntrantID: 1, BonusID: "ZZ5", ClaimTime: ct}, 0, &flags)
+	if flags.String() != flagAnswerMismatch+","+flagRestShort {
+		t.Errorf("checkRequirements flagged %v\n", flags)
+	}
+	flags = nil
+	checkRequirements(defaultRequirements, fourFields{EntrantID: 1, BonusID: "A4", ClaimTime: ct}, 0, &flags)
+	if flags.String() != flagPhotoMissing+","+flagOdoMissing {
+		t.Errorf("checkRequirements flagged %v\n", flags)
+	}
+}
+
+func TestBonusWindow(t *testing.T) {
+
+	dbh.Exec("INSERT INTO bonuses (BonusID,BriefDesc,AvailableFrom,AvailableUntil,OpensAt,ClosesAt) VALUES('ZZ3','Cafe','2026-06-01T00:00','2026-06-03T23:59','9:00','17:30')")
+	dbh.Exec("INSERT INTO bonuses (BonusID,BriefDesc,OpensAt,ClosesAt) VALUES('ZZ2','Club','22:00','02:00')")
+	defer dbh.Exec("DELETE FROM bonuses WHERE BonusID IN ('ZZ3','ZZ2')")
+
+	w := fetchBonusWindow("ZZ3")
+	if !w.isSet() || w.Opens != "0900" || !strings.Contains(w.String(), "09:00-17:30 daily") {
+		t.Errorf("fetchBonusWindow returned %+v %v\n", w, w)
+	}
+	at := func(d, hh, mm int) time.Time { return time.Date(2026, 6, d, hh, mm, 0, 0, cfg.LocalTZ) }
+	if !w.contains(at(2, 12, 0)) || w.contains(at(2, 8, 59)) || w.contains(at(4, 12, 0)) {
+		t.Errorf("ZZ3 window wrong\n")
+	}
+	w = fetchBonusWindow("ZZ2")
+	if !w.contains(at(2, 23, 0)) || !w.contains(at(2, 1, 0)) || w.contains(at(2, 12, 0)) {
+		t.Errorf("ZZ2 window wrong\n")
+	}
+	var flags claimFlags
+	validateBonusWindow(w, fourFields{ClaimTime: at(2, 12, 0)}, &flags)
+	validateBonusWindow(fetchBonusWindow("A4"), fourFields{ClaimTime: at(2, 12, 0)}, &flags)
+	if flags.String() != flagOutsideWindow {
+		t.Errorf("validateBonusWindow flagged %v\n", flags)
+	}
+}
+
+func TestDaylight(t *testing.T) {
+
+	// Greenwich at midsummer, sunrise 03:43 and sunset 20:21 UTC
+	rise, set, ok, _ := sunTimes(time.Date(2026, 6, 21, 12, 0, 0, 0, time.UTC), 51.48, 0)
+	near := func(t1 time.Time, hh, mm int) bool {
+		want := time.Date(2026, 6, 21, hh, mm, 0, 0, time.UTC)
+		return math.Abs(t1.Sub(want).Minutes()) < 5
+	}
+	if !ok || !near(rise, 3, 43) || !near(set, 20, 21) {
+		t.Errorf("sunTimes returned %v %v %v\n", rise.UTC(), set.UTC(), ok)
+	}
+	if _, _, ok, dark := sunTimes(time.Date(2026, 12, 21, 12, 0, 0, 0, time.UTC), 78, 15); ok || !dark {
+		t.Errorf("Svalbard isn't dark at midwinter\n")
+	}
+
+	dbh.Exec("INSERT INTO bonuses (BonusID,BriefDesc,DaylightOnly,Latitude,Longitude) VALUES('ZZ1','Castle',1,51.48,0)")
+	defer dbh.Exec("DELETE FROM bonuses WHERE BonusID='ZZ1'")
+	var flags claimFlags
+	validateDaylight(fourFields{BonusID: "ZZ1", ClaimTime: time.Date(2026, 6, 21, 12, 0, 0, 0, time.UTC)}, &flags)
+	if len(flags) > 0 {
+		t.Errorf("Noon claim flagged %v\n", flags)
+	}
+	validateDaylight(fourFields{BonusID: "ZZ1", ClaimTime: time.Date(2026, 6, 21, 23, 0, 0, 0, time.UTC)}, &flags)
+	if flags.String() != flagDarkness {
+		t.Errorf("Night claim flagged %v\n", flags)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+
+	ct := time.Date(2026, 6, 1, 14, 32, 0, 0, cfg.LocalTZ)
+	if txt := watermarkText(12, "A4", ct, 345); txt != "#12 A4 2026-06-01 14:32 [345]" {
+		t.Errorf("watermarkText returned %q\n", txt)
+	}
+
+	dir := t.TempDir()
+	savePath, saveCmd := cfg.Path2SM, cfg.WatermarkCommand
+	defer func() { cfg.Path2SM, cfg.WatermarkCommand = savePath, saveCmd }()
+	cfg.Path2SM = dir
+	cfg.WatermarkCommand = "cp {in} {out}"
+	pp := &pendingPhoto{temp: "pending-1", image: ".jpg"}
+	os.MkdirAll(filepath.Join(dir, cfg.ImageFolder), 0755)
+	os.WriteFile(filepath.Join(dir, cfg.ImageFolder, "pending-1.jpg"), []byte("jpg"), 0644)
+	if err := watermarkPhoto(pp, "x"); err != nil {
+		t.Errorf("watermarkPhoto returned %v\n", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, cfg.ImageFolder, "pending-1.jpg.wm.jpg")); err == nil {
+		t.Errorf("watermarkPhoto left its temporary file\n")
+	}
+	cfg.WatermarkCommand = "false"
+	if err := watermarkPhoto(pp, "x"); err == nil {
+		t.Errorf("watermarkPhoto ignored a failing command\n")
+	}
+}
+
+func TestClaimReceipt(t *testing.T) {
+
+	dir := t.TempDir()
+	savePath, saveFolder := cfg.Path2SM, cfg.ReceiptsFolder
+	defer func() { cfg.Path2SM, cfg.ReceiptsFolder = savePath, saveFolder }()
+	cfg.Path2SM, cfg.ReceiptsFolder = dir, "receipts"
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 48)), nil)
+	os.WriteFile(filepath.Join(dir, "img-1-ZZR-1.jpg"), buf.Bytes(), 0644)
+	res, _ := dbh.Exec("INSERT INTO ebcphotos (EntrantID,BonusID,image) VALUES(1,'ZZR','img-1-ZZR-1.jpg')")
+	photo, _ := res.LastInsertId()
+	defer dbh.Exec("DELETE FROM ebcphotos WHERE BonusID='ZZR'")
+	res, _ = dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,OdoReading,Subject,EbcFlags,PhotoIDs) VALUES(1,'ZZR',10423,'1 ZZR (10423)','SPD',?)", strconv.FormatInt(photo, 10))
+	rowid, _ := res.LastInsertId()
+	defer dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZR'")
+
+	if err := writeClaimReceipt(rowid); err != nil {
+		t.Fatal(err)
+	}
+	pdf, err := os.ReadFile(filepath.Join(dir, "receipts", "1", fmt.Sprintf("claim-1-ZZR-%v.pdf", rowid)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) || !bytes.Contains(pdf, []byte("/DCTDecode")) || !bytes.Contains(pdf, []byte(`1 ZZR \(10423\)`)) {
+		t.Errorf("Receipt content wrong\n")
+	}
+	x := regexp.MustCompile(`startxref\n(\d+)`).FindSubmatch(pdf)
+	if x == nil {
+		t.Fatalf("Receipt has no startxref\n")
+	}
+	if off, _ := strconv.Atoi(string(x[1])); !bytes.HasPrefix(pdf[off:], []byte("xref")) {
+		t.Errorf("startxref %v doesn't point at the xref\n", off)
+	}
+}
+
+func TestSummaries(t *testing.T) {
+
+	defer dbh.Exec("DELETE FROM ebcsummaries")
+	if p := pendingSummaries(false); len(p) != 1 || p[0] != 1 {
+		t.Errorf("pendingSummaries returned %v\n", p)
+	}
+	dbh.Exec("INSERT INTO ebcsummaries (EntrantID,SentAt) VALUES(1,'')")
+	if p := pendingSummaries(false); len(p) != 0 {
+		t.Errorf("pendingSummaries returned %v after sending\n", p)
+	}
+	if p := pendingSummaries(true); len(p) != 1 {
+		t.Errorf("pendingSummaries(resend) returned %v\n", p)
+	}
+
+	save := cfg.SendSummaries
+	defer func() { cfg.SendSummaries = save }()
+	cfg.SendSummaries = true
+	if summariesDue() != time.Now().After(cfg.RallyFinish.Add(cfg.SummaryDelay)) {
+		t.Errorf("summariesDue wrong\n")
+	}
+}
+
+func TestPillion(t *testing.T) {
+
+	dbh.Exec("INSERT INTO entrants (EntrantID,RiderName,Email,PillionOf) VALUES(91,'Alice','alice@example.com',1)")
+	dbh.Exec("INSERT INTO entrant_emails (EntrantID,Email) VALUES(91,'alice@example.com')")
+	defer dbh.Exec("DELETE FROM entrants WHERE EntrantID=91")
+	defer dbh.Exec("DELETE FROM entrant_emails WHERE EntrantID=91")
+
+	if pillionOf(91) != 1 || pillionOf(1) != 0 {
+		t.Errorf("pillionOf wrong\n")
+	}
+	if p := pillionsOf([]int{1}); len(p) != 1 || p[0] != 91 {
+		t.Errorf("pillionsOf returned %v\n", p)
+	}
+	save := cfg.MatchEmail
+	defer func() { cfg.MatchEmail = save }()
+	cfg.MatchEmail = true
+	if _, vea, _ := validateEntrant(fourFields{EntrantID: 1}, "alice@example.com"); !vea {
+		t.Errorf("Pillion's address not accepted for the rider\n")
+	}
+}
+
+func TestTeamDuplicates(t *testing.T) {
+
+	dbh.Exec("INSERT INTO entrants (EntrantID,RiderName,TeamID) VALUES(92,'Carol',7),(93,'Dave',7)")
+	defer dbh.Exec("DELETE FROM entrants WHERE EntrantID IN (92,93)")
+	res, _ := dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID) VALUES(92,'ZZT')")
+	first, _ := res.LastInsertId()
+	defer dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZT'")
+
+	if d := teamDuplicates(92, "ZZT"); len(d) != 0 {
+		t.Errorf("Own claim counted as a duplicate %v\n", d)
+	}
+	if d := teamDuplicates(1, "ZZT"); len(d) != 0 {
+		t.Errorf("Non-team entrant has duplicates %v\n", d)
+	}
+	d := teamDuplicates(93, "ZZT")
+	if len(d) != 1 || d[0] != first {
+		t.Fatalf("teamDuplicates returned %v\n", d)
+	}
+	if err := dbWriteTx(func(tx *sql.Tx) error { return flagTeamDuplicates(tx, d) }); err != nil {
+		t.Fatal(err)
+	}
+	var flags string
+	dbh.QueryRow("SELECT EbcFlags FROM ebclaims WHERE rowid=?", first).Scan(&flags)
+	if flags != flagTeamDuplicate {
+		t.Errorf("Earlier claim flagged %q\n", flags)
+	}
+}
+
+func TestJSONClaim(t *testing.T) {
+
+	body := `
+	{"entrant": 12, "bonus": "a4", "odo": 10423, "time": "2026-06-01T14:32:00+01:00", "extra": "1862",
+	 "gps": {"lat": 52.95, "lon": -1.15, "accuracy": 8}}`
+	if !isJSONClaim(body) || isJSONClaim("12 A4 10423 1432") {
+		t.Errorf("isJSONClaim wrong\n")
+	}
+	jc, err := parseJSONClaim(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f4 := jc.fourFields()
+	if !f4.ok || f4.EntrantID != 12 || f4.BonusID != "A4" || !f4.OdoOk || f4.OdoReading != 10423 || !f4.TimeOk || f4.Extra != "1862" {
+		t.Errorf("fourFields returned %+v\n", f4)
+	}
+	if !f4.ClaimTime.Equal(time.Date(2026, 6, 1, 13, 32, 0, 0, time.UTC)) {
+		t.Errorf("ClaimTime is %v\n", f4.ClaimTime)
+	}
+
+	for _, bad := range []string{
+		`{"entrant": 12, "bonus": "A4"}`,
+		`{"entrant": 12, "bonus": "A4", "time": "14:32"}`,
+		`{"bonus": "A4", "time": "2026-06-01T14:32:00Z"}`,
+		`{"entrant": 12, "bonus": "A4", "time": "2026-06-01T14:32:00Z", "colour": "red"}`,
+		`{"entrant": 12, "bonus": "A4", "time": "2026-06-01T14:32:00Z", "gps": {"lat": 95, "lon": 0}}`,
+	} {
+		if _, err := parseJSONClaim(bad); err == nil {
+			t.Errorf("%v accepted\n", bad)
+		}
+	}
+
+	archiveJSONClaim(99, "bob@example.com", body, jc, nil)
+	defer dbh.Exec("DELETE FROM ebcjsonclaims WHERE EmailID=99")
+	var raw string
+	var lat float64
+	dbh.QueryRow("SELECT JSON,Latitude FROM ebcjsonclaims WHERE EmailID=99").Scan(&raw, &lat)
+	if !strings.HasPrefix(raw, `{"entrant":12,`) || lat != 52.95 {
+		t.Errorf("Archived %q %v\n", raw, lat)
+	}
+}
+
+func TestQRCodes(t *testing.T) {
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "qr.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\necho\necho MUSEUM-1862\n"), 0755)
+	save := cfg.QRCommand
+	defer func() { cfg.QRCommand = save }()
+	cfg.QRCommand = script
+
+	dbh.Exec("INSERT INTO bonuses (BonusID,BriefDesc,QRCode) VALUES('ZZQ','Museum','museum-1862')")
+	defer dbh.Exec("DELETE FROM bonuses WHERE BonusID='ZZQ'")
+	if expectedQRCode("ZZQ") != "museum-1862" || expectedQRCode("A4") != "A4" {
+		t.Errorf("expectedQRCode wrong\n")
+	}
+
+	photos := []emailPhoto{{Name: "x.jpg", Data: []byte("jpg")}}
+	var flags claimFlags
+	if qr := checkQRPhotos(photos, "ZZQ", &flags); qr != "MUSEUM-1862" || flags.String() != flagQRCodeOk {
+		t.Errorf("checkQRPhotos returned %q %v\n", qr, flags)
+	}
+	flags = nil
+	if qr := checkQRPhotos(photos, "A4", &flags); qr != "MUSEUM-1862" || flags.String() != flagQRCodeMismatch {
+		t.Errorf("checkQRPhotos returned %q %v\n", qr, flags)
+	}
+	cfg.QRCommand = "false"
+	flags = nil
+	if qr := checkQRPhotos(photos, "A4", &flags); qr != "" || len(flags) > 0 {
+		t.Errorf("checkQRPhotos found %q %v in nothing\n", qr, flags)
+	}
+}
+
+func TestClaimRate(t *testing.T) {
+
+	saveLimit, saveWindow := cfg.ClaimRateLimit, cfg.ClaimRateWindow
+	defer func() { cfg.ClaimRateLimit, cfg.ClaimRateWindow = saveLimit, saveWindow }()
+	cfg.ClaimRateLimit, cfg.ClaimRateWindow = 3, 10*time.Minute
+
+	start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	want := [][2]bool{{false, false}, {false, false}, {false, false}, {true, true}, {true, false}}
+	for i, w := range want {
+		bad, alert := noteClaimRate(94, start.Add(time.Duration(i)*time.Minute))
+		if bad != w[0] || alert != w[1] {
+			t.Errorf("Claim %v returned %v %v\n", i+1, bad, alert)
+		}
+	}
+	if bad, _ := noteClaimRate(94, start.Add(30*time.Minute)); bad {
+		t.Errorf("Rate still anomalous after the window\n")
+	}
+}
+
+func TestQuotaResponse(t *testing.T) {
+
+	h := &quotaHandler{}
+	for _, ln := range []string{"* QUOTAROOT INBOX \"\"\r\n", "* QUOTA \"\" (MESSAGE 7 1000 STORAGE 870 1024)\r\n"} {
+		resp, err := imap.ReadResp(imap.NewReader(bufio.NewReader(strings.NewReader(ln))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Handle(resp); err != nil {
+			t.Errorf("%q not handled %v\n", ln, err)
+		}
+	}
+	if !h.Found || h.Used != 870 || h.Limit != 1024 {
+		t.Errorf("quotaHandler read %+v\n", h)
+	}
+}
+
+func TestLooksLikeClaim(t *testing.T) {
+
+	saveMatch, saveTest := cfg.MatchEmail, cfg.TestMode
+	defer func() { cfg.MatchEmail, cfg.TestMode = saveMatch, saveTest }()
+	cfg.MatchEmail, cfg.TestMode = true, false
+
+	if !looksLikeClaim("bob@example.com", "Weekly newsletter") {
+		t.Errorf("Email from an entrant not downloaded\n")
+	}
+	if looksLikeClaim("news@example.org", "1 A4 10423 1432") {
+		t.Errorf("Claim from a stranger downloaded while matching emails\n")
+	}
+	if !looksLikeClaim("organiser@example.org", "OVERRIDE secret 1 A4 10423 1432") {
+		t.Errorf("Override not downloaded\n")
+	}
+	cfg.MatchEmail = false
+	if !looksLikeClaim("news@example.org", "1 A4 10423 1432") || looksLikeClaim("news@example.org", "Big savings this weekend") {
+		t.Errorf("Subject check wrong\n")
+	}
+}
+
+func TestOversizeNonClaim(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.MatchEmail, cfg.AllowBody = true, false
+
+	cfg.IgnoreOverKB = 0
+	if oversizeNonClaim(50<<20, "news@example.org", "Big savings this weekend") {
+		t.Errorf("Ignored by size without IgnoreOverKB\n")
+	}
+	cfg.IgnoreOverKB = 2048
+	for _, x := range []struct {
+		size          uint32
+		from, subject string
+		want          bool
+	}{
+		{5 << 20, "news@example.org", "Big savings this weekend", true},
+		{1 << 20, "news@example.org", "Big savings this weekend", false},
+		{5 << 20, "news@example.org", "1 A4 10423 1432", false},
+		{5 << 20, "bob@example.com", "Photos from today", false},
+		{5 << 20, "news@example.org", "CANCEL 1 A4", false},
+	} {
+		if got := oversizeNonClaim(x.size, x.from, x.subject); got != x.want {
+			t.Errorf("oversizeNonClaim(%v, %v, %q) = %v\n", x.size, x.from, x.subject, got)
+		}
+	}
+}
+
+func TestStateKeywords(t *testing.T) {
+
+	saveKeywords, saveLabels, saveAllowed := cfg.StateKeywords, cfg.GmailLabels, keywordsAllowed
+	defer func() { cfg.StateKeywords, cfg.GmailLabels, keywordsAllowed = saveKeywords, saveLabels, saveAllowed }()
+	cfg.StateKeywords, cfg.GmailLabels = true, false
+
+	keywordsAllowed = allowsKeywords([]string{imap.SeenFlag, imap.FlaggedFlag})
+	if labelMode() {
+		t.Errorf("Keywords used when the server doesn't allow them\n")
+	}
+	keywordsAllowed = allowsKeywords([]string{imap.SeenFlag, imap.TryCreateFlag})
+	if !labelMode() {
+		t.Errorf("Keywords not used when the server allows them\n")
+	}
+	x := selectionExcludes()
+	if len(x) != 2 || x[0] != keywordProcessed || x[1] != keywordRejected {
+		t.Errorf("Selection excludes %v\n", x)
+	}
+	if stateLabel(mailIgnored) != keywordProcessed {
+		t.Errorf("Ignored emails marked %v\n", stateLabel(mailIgnored))
+	}
+
+	saveIgnored := cfg.LabelIgnored
+	defer func() { cfg.LabelIgnored = saveIgnored }()
+	cfg.StateKeywords, cfg.GmailLabels, cfg.LabelIgnored = false, true, ""
+	if l := stateLabel(mailIgnored); l != defaultLabelIgnored || l == stateLabel(mailRejected) {
+		t.Errorf("Ignored emails labelled %v\n", l)
+	}
+	if x := selectionExcludes(); len(x) != 3 || x[2] != defaultLabelIgnored {
+		t.Errorf("Selection with labels excludes %v\n", x)
+	}
+}
+
+func TestModSeqSync(t *testing.T) {
+
+	mbox := new(imap.MailboxStatus)
+	if err := mbox.Parse([]interface{}{"UIDVALIDITY", "1234", "HIGHESTMODSEQ", "90060115205545359"}); err != nil {
+		t.Fatal(err)
+	}
+	modseq, ok := highestModSeq(mbox)
+	if !ok || modseq != 90060115205545359 || mbox.UidValidity != 1234 {
+		t.Errorf("STATUS read as %v %v %v\n", mbox.UidValidity, modseq, ok)
+	}
+
+	defer settleSync(syncPoint{}, false)
+	sp := syncPoint{Validity: 1234, ModSeq: modseq}
+	settleSync(sp, false)
+	if unchangedSince(sp) {
+		t.Errorf("Search skipped after a cycle with work outstanding\n")
+	}
+	settleSync(sp, true)
+	if !unchangedSince(sp) {
+		t.Errorf("Search not skipped when nothing changed\n")
+	}
+	sp.ModSeq++
+	if unchangedSince(sp) {
+		t.Errorf("Search skipped after the mailbox changed\n")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+
+	saveFolder := cfg.QuarantineFolder
+	defer func() { cfg.QuarantineFolder = saveFolder }()
+	cfg.QuarantineFolder = t.TempDir()
+
+	raw := []byte("From: bob@example.com\r\nSubject: 1 A4 10423 1432\r\nContent-Type: multipart/mixed; boundary=\r\n\r\n--\r\n")
+	recoverMessage(99123, raw, "index out of range")
+	defer dbh.Exec("DELETE FROM ebcaudit WHERE EmailID=99123")
+
+	files, _ := filepath.Glob(filepath.Join(cfg.QuarantineFolder, "*-99123.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Quarantined as %v\n", files)
+	}
+	if saved, _ := os.ReadFile(files[0]); !bytes.Equal(saved, raw) {
+		t.Errorf("Quarantined copy differs\n")
+	}
+	var subject, decision string
+	dbh.QueryRow("SELECT Subject,Decision FROM ebcaudit WHERE EmailID=99123").Scan(&subject, &decision)
+	if subject != "1 A4 10423 1432" || decision != auditQuarantined {
+		t.Errorf("Audited as %q %q\n", subject, decision)
+	}
+}
+
+func TestTransientErrors(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("malformed MIME header"), false},
+		{retryLater(errors.New("server said try later")), true},
+		{fmt.Errorf("store: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, true},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v\n", tt.err, got)
+		}
+	}
+}
+
+func TestPendingRetries(t *testing.T) {
+
+	saveValidity := inboxValidity
+	defer func() { inboxValidity = saveValidity }()
+	defer dbh.Exec("DELETE FROM ebcretries")
+
+	inboxValidity = 7
+	rememberRetries(new(imap.SeqSet)) // Nothing to remember
+	rememberRetries(&imap.SeqSet{Set: []imap.Seq{{Start: 41, Stop: 43}}})
+	done := new(imap.SeqSet)
+	done.AddNum(42)
+	forgetRetries(done)
+	if got := pendingRetries().String(); got != "41,43" {
+		t.Errorf("Pending retries %v\n", got)
+	}
+	inboxValidity = 8
+	if !pendingRetries().Empty() {
+		t.Errorf("Retries kept after UIDVALIDITY changed\n")
+	}
+
+	// Other mailboxes keep their own
+	inboxValidity = 7
+	rememberRetries(&imap.SeqSet{Set: []imap.Seq{{Start: 41, Stop: 41}}})
+	source = mailSource{Mailbox: "Claims"}
+	defer func() { source = mailSource{Mailbox: "INBOX"} }()
+	inboxValidity = 9
+	rememberRetries(&imap.SeqSet{Set: []imap.Seq{{Start: 50, Stop: 50}}})
+	if got := pendingRetries().String(); got != "50" {
+		t.Errorf("Pending retries in Claims %v\n", got)
+	}
+	source, inboxValidity = mailSource{Mailbox: "INBOX"}, 7
+	if got := pendingRetries().String(); got != "41" {
+		t.Errorf("Pending retries in INBOX %v\n", got)
+	}
+}
+
+func TestArchiveMailboxFor(t *testing.T) {
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	cfg.ArchiveMailbox, cfg.RejectedMailbox, cfg.TestMailbox = "Claims", "Rejected", "Test"
+	for _, x := range []struct {
+		test  bool
+		state int
+		want  string
+	}{{false, mailClaimed, "Claims"}, {false, mailRejected, "Rejected"}, {false, mailIgnored, ""}, {false, mailRetry, ""},
+		{true, mailClaimed, "Test"}, {true, mailIgnored, "Test"}} {
+		cfg.TestMode = x.test
+		if got := archiveMailboxFor(x.state); got != x.want {
+			t.Errorf("Test=%v state %v filed in %q\n", x.test, x.state, got)
+		}
+	}
+	cfg.TestMode = false
+	if cmd := (&uidExpunge{&imap.SeqSet{Set: []imap.Seq{{Start: 4, Stop: 6}}}}).Command(); cmd.Name != "UID" || fmt.Sprint(cmd.Arguments) != "[EXPUNGE 4:6]" {
+		t.Errorf("UID EXPUNGE is %v %v\n", cmd.Name, cmd.Arguments)
+	}
+}
+
+// fakeIMAP returns a client, with INBOX selected, of a server offering the
+// capabilities given which agrees to everything and records the commands
+// it's sent, unquoted.
+func fakeIMAP(t *testing.T, caps string) (*client.Client, func() []string) {
+
+	conn, server := net.Pipe()
+	var mu sync.Mutex
+	var cmds []string
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		fmt.Fprintf(server, "* PREAUTH [CAPABILITY %s] ready\r\n", caps)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			f := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			if len(f) < 2 {
+				return
+			}
+			mu.Lock()
+			cmds = append(cmds, strings.Replace(f[1], `"`, "", -1))
+			mu.Unlock()
+			switch strings.ToUpper(strings.Fields(f[1])[0]) {
+			case "SELECT":
+				fmt.Fprintf(server, "* 12 EXISTS\r\n%s OK [READ-WRITE] done\r\n", f[0])
+			case "LOGOUT":
+				fmt.Fprintf(server, "* BYE\r\n%s OK done\r\n", f[0])
+				return
+			default:
+				fmt.Fprintf(server, "%s OK done\r\n", f[0])
+			}
+		}
+	}()
+	c, err := client.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if _, err = c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	return c, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), cmds[1:]...)
+	}
+
+}
+
+func TestArchiveEmails(t *testing.T) {
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	cfg.ArchiveMailbox, cfg.RejectedMailbox, cfg.TestMailbox = "Claims", "Rejected", "Test"
+
+	// UID 7 carries a claim and an ignored part, 8 a stored claim and a
+	// rejected one and 9 a stored claim and one still to retry.
+	c, sent := fakeIMAP(t, "IMAP4rev1 MOVE")
+	claimed, dealtwith, ignored, skipped := new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet)
+	claimed.AddNum(7, 8, 9)
+	dealtwith.AddNum(8, 10)
+	ignored.AddNum(7, 11)
+	skipped.AddNum(9, 12)
+	for _, uid := range []uint32{7, 8, 9, 10, 11, 12} {
+		settleParts(uid, claimed, dealtwith, ignored, skipped)
+	}
+	for _, x := range []struct {
+		state int
+		uids  *imap.SeqSet
+	}{{mailClaimed, claimed}, {mailRejected, dealtwith}, {mailIgnored, ignored}, {mailRetry, skipped}} {
+		if err := archiveEmails(c, x.state, x.uids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "[CREATE Claims UID MOVE 7 Claims CREATE Rejected UID MOVE 8,10 Rejected]"
+	if got := fmt.Sprint(sent()); got != want {
+		t.Errorf("Archiving sent %v not %v\n", got, want)
+	}
+
+	// In test mode everything dealt with goes to TestMailbox, as
+	// processMessages files it, here on a server without MOVE.
+	cfg.TestMode = true
+	c, sent = fakeIMAP(t, "IMAP4rev1 UIDPLUS")
+	dealtwith.AddSet(claimed)
+	dealtwith.AddSet(ignored)
+	if err := archiveEmails(c, mailIgnored, dealtwith); err != nil {
+		t.Fatal(err)
+	}
+	want = "[CREATE Test UID COPY 7:8,10:11 Test UID STORE 7:8,10:11 +FLAGS.SILENT (\\Deleted) UID EXPUNGE 7:8,10:11]"
+	if got := fmt.Sprint(sent()); got != want {
+		t.Errorf("Test mode archiving sent %v not %v\n", got, want)
+	}
+
+}
+
+func TestFetchWindow(t *testing.T) {
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	finish := start.Add(10 * time.Hour)
+	nb, na := start.Add(-24*time.Hour), finish.Add(time.Hour)
+	var zero time.Time
+	for _, x := range []struct {
+		name          string
+		notBefore     time.Time
+		notAfter      time.Time
+		lead, lag     time.Duration
+		start, finish time.Time
+		wantNB        time.Time
+		wantNA        time.Time
+	}{
+		{"nothing set", zero, zero, 0, 0, zero, zero, zero, zero},
+		{"no rally times", zero, zero, 48 * time.Hour, 2 * time.Hour, zero, zero, zero, zero},
+		{"rally times only", zero, zero, 0, 0, start, finish, zero, zero},
+		{"derived", zero, zero, 48 * time.Hour, 2 * time.Hour, start, finish, start.Add(-48 * time.Hour), finish.Add(2 * time.Hour)},
+		{"lead only", zero, zero, 48 * time.Hour, 0, start, finish, start.Add(-48 * time.Hour), zero},
+		{"lag only", zero, zero, 0, 2 * time.Hour, start, finish, zero, finish.Add(2 * time.Hour)},
+		{"explicit", nb, na, 48 * time.Hour, 2 * time.Hour, start, finish, nb, na},
+		{"explicit NotBefore", nb, zero, 48 * time.Hour, 2 * time.Hour, start, finish, nb, finish.Add(2 * time.Hour)},
+		{"explicit NotAfter", zero, na, 48 * time.Hour, 2 * time.Hour, start, finish, start.Add(-48 * time.Hour), na},
+		{"explicit, no rally times", nb, na, 0, 0, zero, zero, nb, na},
+	} {
+		cfg.NotBefore, cfg.NotAfter, cfg.LeadTime, cfg.LagTime = x.notBefore, x.notAfter, x.lead, x.lag
+		cfg.RallyStart, cfg.RallyFinish = x.start, x.finish
+		if gotNB, gotNA := fetchWindow(); !gotNB.Equal(x.wantNB) || !gotNA.Equal(x.wantNA) {
+			t.Errorf("%v: window %v - %v not %v - %v\n", x.name, gotNB, gotNA, x.wantNB, x.wantNA)
+		}
+	}
+
+}
+
+func TestMailSources(t *testing.T) {
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	cfg.ImapLogin = "rally@gmail.com"
+	cfg.Mailboxes = nil
+	cfg.ExtraAccounts = []mailAccount{
+		{Server: "mail.club.org:993", Login: "claims@club.org", Password: "x", Mailboxes: []string{"INBOX", "Late"}},
+		{Server: "mail.club.org:993", Login: "nopassword@club.org"},
+	}
+	var names, keys []string
+	for _, ms := range mailSources() {
+		names, keys = append(names, ms.Name()), append(keys, ms.key())
+	}
+	if strings.Join(names, ",") != "rally@gmail.com/INBOX,claims@club.org/INBOX,claims@club.org/Late" {
+		t.Errorf("Sources %v\n", names)
+	}
+	if keys[0] != "" || keys[1] != "claims@club.org/INBOX" {
+		t.Errorf("Keys %q\n", keys)
+	}
+	cfg.Mailboxes, cfg.ExtraAccounts = []string{"Claims", " "}, nil
+	if srcs := mailSources(); len(srcs) != 1 || srcs[0].key() != "rally@gmail.com/Claims" {
+		t.Errorf("Sources %+v\n", srcs)
+	}
+}
+
+func TestClaimFingerprint(t *testing.T) {
+
+	useMemoryDB(t)
+	a, b := emailPhoto{Data: []byte("photo one")}, emailPhoto{Data: []byte("photo two")}
+	fp := claimFingerprint("1 A4 10423 1432", []emailPhoto{a, b})
+	if claimFingerprint("Fwd: RE:  1 a4 10423   1432 ", []emailPhoto{b, a}) != fp {
+		t.Errorf("Forwarded copy has a different fingerprint\n")
+	}
+	if claimFingerprint("1 A4 10423 1432", []emailPhoto{a}) == fp {
+		t.Errorf("Different photos have the same fingerprint\n")
+	}
+
+	res, _ := dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,Fingerprint) VALUES(1,'ZZ5',?)", fp)
+	rowid, _ := res.LastInsertId()
+	if got := fingerprintedClaim(fp); got != rowid {
+		t.Errorf("Duplicate found as %v, not %v\n", got, rowid)
+	}
+	dbh.Exec("UPDATE ebclaims SET MessageID='claim-5@phone.example' WHERE rowid=?", rowid)
+	if got, by := duplicateClaim(1, "ZZ5", "<claim-5@phone.example>", "other"); got != rowid || by != dupByMessageID {
+		t.Errorf("Same Message-ID found as %v by %v\n", got, by)
+	}
+	if got, by := duplicateClaim(1, "ZZ6", "<claim-5@phone.example>", fp); got != rowid || by != dupByFingerprint {
+		t.Errorf("Same content found as %v by %v\n", got, by)
+	}
+	if got, _ := duplicateClaim(2, "ZZ5", "claim-5@phone.example", "other"); got != 0 {
+		t.Errorf("Another entrant's claim %v counted as a duplicate\n", got)
+	}
+	dbh.Exec("UPDATE ebclaims SET RiderCancelled=1 WHERE rowid=?", rowid)
+	if got := fingerprintedClaim(fp); got != 0 {
+		t.Errorf("Cancelled claim %v counted as a duplicate\n", got)
+	}
+	if got, _ := duplicateClaim(1, "ZZ5", "claim-5@phone.example", fp); got != 0 {
+		t.Errorf("Cancelled claim %v counted as a duplicate\n", got)
+	}
+
+	recordDuplicate(77, "bob@example.com", "1 A4 10423 1432", rowid, dupByMessageID)
+	var by string
+	if dbh.QueryRow("SELECT MatchedBy FROM ebcduplicates WHERE ClaimID=? AND EmailID=77", rowid).Scan(&by); by != dupByMessageID {
+		t.Errorf("Duplicate recorded by %q\n", by)
+	}
+}
+
+func TestLocalisedSubjects(t *testing.T) {
+
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"=?UTF-8?Q?1_A4_10423_1432?=", "1 A4 10423 1432"},
+		{"=?utf-8?B?MSBBNA==?= =?utf-8?B?IDEwNDIzIDE0MzI=?=", "1 A4 10423 1432"},
+		{"12 =?windows-1252?Q?Caf=E9?=", "12 Café"},
+		{"=?gb2312?B?u9i4tDogMSBBNCAxMDQyMyAxNDMy?=", "回复: 1 A4 10423 1432"},
+	}
+	for _, tt := range tests {
+		if got := decodeMimeSentence(tt.raw); got != tt.want {
+			t.Errorf("decodeMimeSentence(%q) = %q\n", tt.raw, got)
+		}
+	}
+	for _, s := range []string{"Fwd: 1 A4 10423 1432", "WG: TR: 1 A4 10423 1432", "VS:1 A4 10423 1432", "回复：1 A4 10423 1432", "Re[2]: Fw: 1 A4 10423 1432"} {
+		if got := stripSubjectPrefixes(s); got != "1 A4 10423 1432" {
+			t.Errorf("%q stripped to %q\n", s, got)
+		}
+		if ff := parseSubject(s, false); !ff.ok || ff.EntrantID != 1 || ff.BonusID != "A4" {
+			t.Errorf("%q parsed as %+v\n", s, ff)
+		}
+	}
+}
+
+func TestIsAutoReply(t *testing.T) {
+
+	for _, x := range []struct {
+		header  mail.Header
+		subject string
+		auto    bool
+		why     string
+	}{
+		{mail.Header{}, "1 A4 10423 1432", false, ""},
+		{mail.Header{"Auto-Submitted": {"auto-replied"}}, "1 A4 10423 1432", true, "Auto-Submitted: auto-replied"},
+		{mail.Header{"Auto-Submitted": {" Auto-Generated "}}, "Re: 1 A4", true, "Auto-Submitted: auto-generated"},
+		{mail.Header{"Auto-Submitted": {"no"}}, "1 A4 10423 1432", false, ""},
+		{mail.Header{"Auto-Submitted": {"No"}}, "1 A4 10423 1432", false, ""},
+		{mail.Header{"X-Autoreply": {"yes"}}, "Re: 1 A4", true, "X-Autoreply"},
+		{mail.Header{"X-Autorespond": {"1"}}, "Re: 1 A4", true, "X-Autorespond"},
+		{mail.Header{"X-Auto-Response": {"vacation"}}, "Re: 1 A4", true, "X-Auto-Response"},
+		{mail.Header{"X-Autoreply": {""}}, "1 A4 10423 1432", false, ""},
+		{mail.Header{"Precedence": {"auto_reply"}}, "Re: 1 A4", true, "Precedence: auto_reply"},
+		{mail.Header{"Precedence": {"Auto_Reply"}}, "Re: 1 A4", true, "Precedence: auto_reply"},
+		{mail.Header{"Precedence": {"bulk"}}, "1 A4 10423 1432", false, ""},
+		{mail.Header{"Precedence": {"list"}}, "1 A4 10423 1432", false, ""},
+		{mail.Header{}, "Out of office: Bob", true, "Subject"},
+		{mail.Header{}, "Automatic reply: 1 A4", true, "Subject"},
+		{mail.Header{}, "1 A4 out of office 1432", false, ""},
+		{mail.Header{"Auto-Submitted": {"auto-replied"}, "Precedence": {"auto_reply"}}, "Out of office", true, "Auto-Submitted: auto-replied"},
+	} {
+		if auto, why := isAutoReply(Email{Subject: x.subject, Header: x.header}); auto != x.auto || why != x.why {
+			t.Errorf("%v %q is %v (%q) not %v (%q)\n", x.header, x.subject, auto, why, x.auto, x.why)
+		}
+	}
+
+}
+
+func TestIgnoreList(t *testing.T) {
+
+	save := cfg.IgnoreSenders
+	defer func() { cfg.IgnoreSenders = save }()
+
+	mk := func(from, subject string) Email {
+		m := Email{Subject: subject, Header: mail.Header{"From": {from}}}
+		m.From, _ = mail.ParseAddressList(from)
+		return m
+	}
+	if skip, _ := isIgnorable(mk("bob@example.com", "1 A4 10423 1432")); skip {
+		t.Errorf("Claim ignored\n")
+	}
+	if skip, why := isIgnorable(mk("Mail Delivery Subsystem <MAILER-DAEMON@example.com>", "Returned mail")); !skip {
+		t.Errorf("Bounce not ignored\n")
+	} else if !strings.HasPrefix(why, "Subject") {
+		t.Errorf("Bounce ignored because %v\n", why)
+	}
+	if skip, _ := isIgnorable(mk("postmaster@example.com", "Your message")); !skip {
+		t.Errorf("Postmaster not ignored\n")
+	}
+	cfg.IgnoreSenders = []string{`@newsletter\.example\.org$`}
+	if skip, _ := isIgnorable(mk("postmaster@example.com", "Your message")); skip {
+		t.Errorf("Defaults applied despite IgnoreSenders\n")
+	}
+	if skip, _ := isIgnorable(mk("offers@NEWSLETTER.example.org", "Big savings")); !skip {
+		t.Errorf("IgnoreSenders not applied\n")
+	}
+}
+
+func TestSubjectExamples(t *testing.T) {
+
+	save := cfg.SubjectExamples
+	defer func() { cfg.SubjectExamples = save }()
+
+	cfg.SubjectExamples = []subjectExample{
+		{Subject: "12 A4 10423 1432", Valid: true, Entrant: 12, Bonus: "a4", Odo: 10423, Time: "1432"},
+		{Subject: "Hello from the road", Valid: false},
+	}
+	if !subjectExamplesOK(false) {
+		t.Errorf("Good examples failed\n")
+	}
+	x := subjectExample{Subject: "12 A4 10423 1432", Valid: true, Entrant: 21, Time: "1423"}
+	if got := x.check(); got != "entrant=12, time=1432" {
+		t.Errorf("Bad example reported as %q\n", got)
+	}
+	cfg.SubjectExamples = append(cfg.SubjectExamples, x)
+	if runCheck(nil) != 1 {
+		t.Errorf("check didn't fail\n")
+	}
+}
+
+func TestSyntheticClaims(t *testing.T) {
+
+	raws, err := syntheticClaims(3, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Parse(bytes.NewReader(raws[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ff := parseSubject(m.Subject, false); !ff.ok || ff.OdoReading != 10003 {
+		t.Errorf("Synthetic claim %q parsed as %+v\n", m.Subject, ff)
+	}
+	if photos := extractPhotos(m, 3); len(photos) != 1 {
+		t.Errorf("Synthetic claim has %v photos\n", len(photos))
+	}
+}
+
+func TestRehearsalOrder(t *testing.T) {
+
+	dir := t.TempDir()
+	for name, date := range map[string]string{"b.eml": "10:30:00", "a.eml": "10:00:00", "c.eml": "12:00:00"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("Subject: x\r\nDate: Sat, 01 Jun 2024 "+date+" +0100\r\n\r\n"), 0644)
+	}
+	emails, err := loadRehearsal(dir)
+	if err != nil || len(emails) != 3 || emails[0].Name != "a.eml" || emails[2].Name != "c.eml" {
+		t.Fatalf("Loaded %+v %v\n", emails, err)
+	}
+	delays := rehearsalDelays(emails, 60, 1*time.Minute)
+	if delays[0] != 0 || delays[1] != 30*time.Second || delays[2] != time.Minute {
+		t.Errorf("Delays %v\n", delays)
+	}
+}
+
+func TestTimeWithSeconds(t *testing.T) {
+
+	for _, s := range []string{"12 A4 10423 17:13:42", "12 A4 10423 17.13.42", "12 A4 10423 1713"} {
+		ff := *parseSubject(s, false)
+		if !ff.TimeOk || ff.TimeHH != 17 || ff.TimeMM != 13 {
+			t.Errorf("%v returned %+v\n", s, ff)
+		}
+	}
+	ff := *parseSubject("12 A4 10423 171342", false)
+	if ff.TimeOk {
+		t.Errorf("171342 accepted as a time\n")
+	}
+}
+
+func TestSniffImageExt(t *testing.T) {
+
+	var pics = []struct {
+		pic []byte
+		ext string
+	}{
+		{[]byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0x10, 'J', 'F', 'I', 'F'}, ".jpg"},
+		{[]byte{0, 0, 0, 0x18, 'f', 't', 'y', 'p', 'h', 'e', 'i', 'c', 0, 0}, ".heic"},
+		{[]byte{0, 0, 0, 0x18, 'f', 't', 'y', 'p', 'm', 'p', '4', '2', 0, 0}, ""},
+		{[]byte{0x89, 'P', 'N', 'G', '\r', '\n'}, ".png"},
+		{[]byte("hello world"), ""},
+	}
+	for _, x := range pics {
+		if ext := sniffImageExt(x.pic); ext != x.ext {
+			t.Fatalf("Sniffing %v returned [%v] not [%v]\n", x.pic, ext, x.ext)
+		}
+	}
+}
+
+func TestIsTrivialImage(t *testing.T) {
+
+	saved, savedBytes, savedPixels := cfg.IgnoreImageTypes, cfg.MinPhotoBytes, cfg.MinPhotoPixels
+	defer func() { cfg.IgnoreImageTypes, cfg.MinPhotoBytes, cfg.MinPhotoPixels = saved, savedBytes, savedPixels }()
+	cfg.IgnoreImageTypes, cfg.MinPhotoBytes, cfg.MinPhotoPixels = nil, 10000, 200
+
+	var logo, emoji, photo bytes.Buffer
+	png.Encode(&logo, image.NewRGBA(image.Rect(0, 0, 180, 60)))
+	gif.Encode(&emoji, image.NewPaletted(image.Rect(0, 0, 24, 24), palette.Plan9), nil)
+	pic := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	rand.Read(pic.Pix) // Noise doesn't compress, so this is photo sized
+	jpeg.Encode(&photo, pic, nil)
+
+	for _, x := range []struct {
+		name    string
+		pic     []byte
+		ct      string
+		trivial bool
+		why     string
+	}{
+		{"signature logo", logo.Bytes(), "image/png", true, fmt.Sprintf("%v bytes", logo.Len())},
+		{"emoji", emoji.Bytes(), "image/gif; name=\"smile.gif\"", true, "image/gif"},
+		{"emoji, type in capitals", emoji.Bytes(), " Image/GIF", true, "image/gif"},
+		{"photo", photo.Bytes(), "image/jpeg", false, ""},
+		{"photo, no type", photo.Bytes(), "application/octet-stream", false, ""},
+	} {
+		if trivial, why := isTrivialImage(x.pic, x.ct); trivial != x.trivial || why != x.why {
+			t.Errorf("%v is trivial %v (%q) not %v (%q)\n", x.name, trivial, why, x.trivial, x.why)
+		}
+	}
+
+	// Without a size limit it's the logo's dimensions which count, and the
+	// emoji needs its pixels checking once GIFs are allowed.
+	cfg.MinPhotoBytes = 0
+	if trivial, why := isTrivialImage(logo.Bytes(), "image/png"); !trivial || why != "180x60" {
+		t.Errorf("Logo is trivial %v (%q)\n", trivial, why)
+	}
+	cfg.IgnoreImageTypes = []string{}
+	if trivial, why := isTrivialImage(emoji.Bytes(), "image/gif"); !trivial || why != "24x24" {
+		t.Errorf("Allowed emoji is trivial %v (%q)\n", trivial, why)
+	}
+	cfg.MinPhotoPixels = 0
+	if trivial, _ := isTrivialImage(emoji.Bytes(), "image/gif"); trivial {
+		t.Errorf("Emoji trivial with no limits\n")
+	}
+	if trivial, _ := isTrivialImage(photo.Bytes(), "image/jpeg"); trivial {
+		t.Errorf("Photo trivial with no limits\n")
+	}
+
+}
+
+func TestAssignPhotos(t *testing.T) {
+
+	photos := []emailPhoto{{Name: "IMG_0002.jpg"}, {Name: "b7-sign.jpg"}, {Name: "IMG_0001.jpg"}}
+
+	res := assignPhotos([]string{"A4"}, photos)
+	if len(res[0]) != 3 {
+		t.Fatalf("Single claim got %v\n", res)
+	}
+	res = assignPhotos([]string{"A4", "B7", "C1"}, photos)
+	if fmt.Sprint(res) != "[[2] [1] [0]]" {
+		t.Fatalf("Three claims got %v\n", res)
+	}
+	res = assignPhotos([]string{"A4", "B7"}, photos)
+	if fmt.Sprint(res) != "[[0 2] [1 0 2]]" {
+		t.Fatalf("Two claims got %v\n", res)
+	}
+}
+
+// exifJPEG builds a small JPG carrying an EXIF segment with the given IFD0 and Exif IFD ASCII/SHORT tags.
+func exifJPEG(t *testing.T, ifd0 map[uint16]interface{}, sub map[uint16]interface{}, gps ...map[uint16]interface{}) []byte {
+
+	var tiff []byte
+	le := binary.LittleEndian
+	put16 := func(b []byte, v uint16) []byte {
+		var x [2]byte
+		le.PutUint16(x[:], v)
+		return append(b, x[:]...)
+	}
+	put32 := func(b []byte, v uint32) []byte {
+		var x [4]byte
+		le.PutUint32(x[:], v)
+		return append(b, x[:]...)
+	}
+	tiff = append(tiff, 'I', 'I', 42, 0, 8, 0, 0, 0)
+	ifdSize := func(m map[uint16]interface{}) int { return 2 + 12*len(m) + 4 }
+	writeIFD := func(m map[uint16]interface{}, dataAt int) (ifd []byte, data []byte) {
+		ifd = put16(ifd, uint16(len(m)))
+		tags := make([]int, 0, len(m))
+		for k := range m {
+			tags = append(tags, int(k))
+		}
+		sort.Ints(tags)
+		for _, k := range tags {
+			ifd = put16(ifd, uint16(k))
+			switch v := m[uint16(k)].(type) {
+			case string:
+				s := append([]byte(v), 0)
+				ifd = put16(ifd, 2)
+				ifd = put32(ifd, uint32(len(s)))
+				if len(s) <= 4 {
+					ifd = append(ifd, append(s, make([]byte, 4-len(s))...)...)
+					break
+				}
+				ifd = put32(ifd, uint32(dataAt+len(data)))
+				data = append(data, s...)
+			case []uint32: // RATIONAL numerator/denominator pairs
+				ifd = put16(ifd, 5)
+				ifd = put32(ifd, uint32(len(v)/2))
+				ifd = put32(ifd, uint32(dataAt+len(data)))
+				for _, n := range v {
+					data = put32(data, n)
+				}
+			case uint16:
+				ifd = put16(ifd, 3)
+				ifd = put32(ifd, 1)
+				ifd = put16(ifd, v)
+				ifd = put16(ifd, 0)
+			case uint32:
+				ifd = put16(ifd, 4)
+				ifd = put32(ifd, 1)
+				ifd = put32(ifd, v)
+			}
+		}
+		ifd = put32(ifd, 0)
+		return
+	}
+	subAt := 8 + ifdSize(ifd0) + 64
+	ifd0[exifTagExifIFD] = uint32(subAt)
+	gpsAt := subAt + ifdSize(sub) + 128
+	if len(gps) > 0 {
+		ifd0[exifTagGPSIFD] = uint32(gpsAt)
+	}
+	i0, d0 := writeIFD(ifd0, 8+ifdSize(ifd0))
+	tiff = append(tiff, i0...)
+	tiff = append(tiff, d0...)
+	if len(tiff) > subAt {
+		t.Fatalf("IFD0 too big for test builder")
+	}
+	tiff = append(tiff, make([]byte, subAt-len(tiff))...)
+	i1, d1 := writeIFD(sub, subAt+ifdSize(sub))
+	tiff = append(tiff, i1...)
+	tiff = append(tiff, d1...)
+	if len(gps) > 0 {
+		if len(tiff) > gpsAt {
+			t.Fatalf("Exif IFD too big for test builder")
+		}
+		tiff = append(tiff, make([]byte, gpsAt-len(tiff))...)
+		i2, d2 := writeIFD(gps[0], gpsAt+ifdSize(gps[0]))
+		tiff = append(tiff, i2...)
+		tiff = append(tiff, d2...)
+	}
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 32, 24)), nil)
+	jpg := buf.Bytes()
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	app1 = append(app1, []byte("Exif\x00\x00")...)
+	app1 = append(app1, tiff...)
+	binary.BigEndian.PutUint16(app1[2:4], uint16(len(app1)-2))
+	return append(append(append([]byte{}, jpg[:2]...), app1...), jpg[2:]...)
+}
+
+func TestReadExif(t *testing.T) {
+
+	pic := exifJPEG(t, map[uint16]interface{}{exifTagMake: "Apple", exifTagModel: "iPhone 13"},
+		map[uint16]interface{}{exifTagDateTimeOriginal: "2024:06:01 10:11:12", exifTagPixelXDimension: uint16(4032), exifTagPixelYDimension: uint16(3024)})
+	w, h, camera, taken := photoDetails(pic)
+	if w != 32 || h != 24 || camera != "Apple iPhone 13" || taken.Format(exifTimeFormat) != "2024:06:01 10:11:12" {
+		t.Fatalf("photoDetails returned %v x %v [%v] %v\n", w, h, camera, taken)
+	}
+	ex, ok := readExif(pic)
+	if !ok || ex.Width != 4032 || ex.Height != 3024 {
+		t.Fatalf("readExif returned %+v\n", ex)
+	}
+}
+
+func TestExifGPS(t *testing.T) {
+
+	pic := exifJPEG(t, map[uint16]interface{}{exifTagModel: "Pixel 7"},
+		map[uint16]interface{}{exifTagDateTimeOriginal: "2024:06:01 10:11:12"},
+		map[uint16]interface{}{exifTagGPSLatitudeRef: "N", exifTagGPSLatitude: []uint32{53, 1, 30, 1, 1800, 100},
+			exifTagGPSLongitudeRef: "W", exifTagGPSLongitude: []uint32{2, 1, 15, 1, 0, 1}})
+	lat, lon, ok := photoPosition(pic)
+	if !ok || math.Abs(lat-53.505) > 1e-6 || math.Abs(lon+2.25) > 1e-6 {
+		t.Fatalf("photoPosition returned %v,%v %v\n", lat, lon, ok)
+	}
+	if _, _, ok := photoPosition(exifJPEG(t, map[uint16]interface{}{}, map[uint16]interface{}{})); ok {
+		t.Errorf("Position found without GPS\n")
+	}
+
+	// The same EXIF inside a HEIC
+	heic := append([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), "\x00\x00\x00\x06Exif\x00\x00"...)
+	heic = append(heic, exifSegment(pic)...)
+	ex, ok := readExif(heic)
+	if !ok || ex.Model != "Pixel 7" || !ex.HasGPS || ex.CaptureTime.Format(exifTimeFormat) != "2024:06:01 10:11:12" {
+		t.Fatalf("readExif of HEIC returned %+v\n", ex)
+	}
+
+	// The EXIF time beats the filename
+	if pt := photoTakenAt(emailPhoto{Name: "20240601_090000.jpg", Data: pic}); pt.Format(exifTimeFormat) != "2024:06:01 10:11:12" {
+		t.Errorf("Photo taken at %v\n", pt)
+	}
+	if pt := photoTakenAt(emailPhoto{Name: "20240601_090000.jpg"}); pt.IsZero() || pt.Hour() != 9 {
+		t.Errorf("Photo without EXIF taken at %v\n", pt)
+	}
+}
+
+func TestAnonymise(t *testing.T) {
+
+	pic := exifJPEG(t, map[uint16]interface{}{exifTagMake: "Apple"}, map[uint16]interface{}{exifTagDateTimeOriginal: "2024:06:01 10:11:12"})
+	raw := "From: \"Fred Bloggs\" <fred.bloggs@gmail.com>\r\nTo: claims@rally.org\r\nSubject: 12 A4 10423 1713\r\n" +
+		"Received: from mx.gmail.com by rally.org; Sat, 01 Jun 2024 10:12:00 +0100\r\nDKIM-Signature: v=1; secret\r\n" +
+		"Message-ID: <abc@gmail.com>\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"XX\"\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nRegards, Fred. Call me on 07700 123456 or fred.bloggs@gmail.com\r\n" +
+		"--XX\r\nContent-Type: image/jpeg\r\nContent-Transfer-Encoding: base64\r\n\r\n" + base64.StdEncoding.EncodeToString(pic) + "\r\n--XX--\r\n"
+
+	out := string(newAnonymiser().message([]byte(raw)))
+	for _, s := range []string{"Fred", "Bloggs", "gmail", "123456", "secret", "abc@"} {
+		if strings.Contains(out, s) {
+			t.Errorf("Anonymised email still contains %v\n%v\n", s, out)
+		}
+	}
+	m, err := mail.ReadMessage(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Can't read anonymised email %v\n", err)
+	}
+	if m.Header.Get("Subject") != "12 A4 10423 1713" || m.Header.Get("From") != "\"Rider 1\" <rider1@example.com>" {
+		t.Errorf("Headers now %v\n", m.Header)
+	}
+	_, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	mr.NextPart()
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("Photo part missing %v\n", err)
+	}
+	data, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	if bytes.Equal(data, pic) {
+		t.Errorf("Photo unchanged\n")
+	}
+	if ex, ok := readExif(data); !ok || ex.CaptureTime.Format(exifTimeFormat) != "2024:06:01 10:11:12" || ex.Make != "" {
+		t.Errorf("Placeholder EXIF %+v\n", ex)
+	}
+}
+
+// goldenClaim is what the golden files record of each stored claim.
+type goldenClaim struct {
+	EntrantID  int
+	BonusID    string
+	OdoReading int
+	ClaimTime  string
+	Extra      string
+	Flags      string
+	Decision   int
+	Photos     int
+}
+
+// goldenResult is what happened to one fixture email.
+type goldenResult struct {
+	Outcome string
+	Claims  []goldenClaim `json:",omitempty"`
+}
+
+// TestGoldenCorpus runs the emails in testdata/corpus through the whole
+// claim process, in the order they were sent, against an in-memory copy of
+// the database and compares the results with the .json file alongside each.
+// After a deliberate change run go test -run GoldenCorpus -args -update and
+// check the differences before committing them.
+func TestGoldenCorpus(t *testing.T) {
+
+	const corpus = "testdata/corpus"
+	emails, err := loadRehearsal(corpus)
+	if err != nil || len(emails) == 0 {
+		t.Fatalf("No corpus %v\n", err)
+	}
+
+	useMemoryDB(t)
+	dbh.Exec("DELETE FROM ebclaims")
+	sandboxSettings(t.TempDir())
+	cfg.ClaimRateLimit = 0
+
+	claimed, dealtwith, ignored, skipped := replayEmails(emails, make([]time.Duration, len(emails)))
+	outcomes := map[string]*imap.SeqSet{"stored": claimed, "rejected": dealtwith, "ignored": ignored, "retry": skipped}
+
+	for i, e := range emails {
+		uid := uint32(i + 1)
+		res := goldenResult{Outcome: "none"}
+		for k, s := range outcomes {
+			if s.Contains(uid) {
+				res.Outcome = k
+			}
+		}
+		rows, err := dbh.Query("SELECT EntrantID,BonusID,OdoReading,ClaimTime,ExtraField,EbcFlags,Decision,PhotoIDs FROM ebclaims WHERE EmailID=? ORDER BY rowid", uid)
+		if err != nil {
+			t.Fatalf("Can't load claims %v\n", err)
+		}
+		for rows.Next() {
+			var gc goldenClaim
+			var photos string
+			rows.Scan(&gc.EntrantID, &gc.BonusID, &gc.OdoReading, &gc.ClaimTime, &gc.Extra, &gc.Flags, &gc.Decision, &photos)
+			if ct, err := time.Parse(timefmt, gc.ClaimTime); err == nil {
+				gc.ClaimTime = ct.In(cfg.LocalTZ).Format(timefmt) // Not wherever the tests happen to run
+			}
+			if photos != "" {
+				gc.Photos = len(strings.Split(photos, ","))
+			}
+			res.Claims = append(res.Claims, gc)
+		}
+		rows.Close()
+
+		got, _ := json.MarshalIndent(res, "", "  ")
+		got = append(got, '\n')
+		fn := filepath.Join(corpus, strings.TrimSuffix(e.Name, ".eml")+".json")
+		if *updateGolden {
+			os.WriteFile(fn, got, 0644)
+			continue
+		}
+		want, err := os.ReadFile(fn)
+		if err != nil {
+			t.Errorf("%v has no golden file, run with -update to create it\n", e.Name)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v now gives\n%s\nnot\n%s\n", e.Name, got, want)
+		}
+	}
+}
+
+func TestTokenisedSubjects(t *testing.T) {
+
+	var tokenised = []struct {
+		subject string
+		odo     int
+		hhmm    string
+		extra   string
+	}{
+		{"1, A1, 10423, 17:13", 10423, "1713", ""},
+		{"#1/a1/10423mi/5:13 pm", 10423, "1713", ""},
+		{"1 bonus A1 odo 10423 time 1713 fuel receipt", 10423, "1713", "fuel receipt"},
+		{"Re: 1;A1;10423 miles;0713", 10423, "0713", ""},
+	}
+	for _, x := range tokenised {
+		ff := *parseSubject(x.subject, false)
+		if !ff.ok || ff.EntrantID != 1 || ff.BonusID != "A1" || ff.OdoReading != x.odo || ff.HHmm != x.hhmm || ff.Extra != x.extra {
+			t.Errorf("%v returned %+v\n", x.subject, ff)
+		}
+	}
+	for _, s := range []string{"1, ZZ9, 10423, 17:13", "1, 10423, A1, 17:13", "1, A1, 17:13", "1, A1, 10423, 25:13", "1, A1, 10.4.23, 1713"} {
+		if ff := *parseSubject(s, false); ff.ok {
+			t.Errorf("%v accepted as %+v\n", s, ff)
+		}
+	}
+}
+
+// Whatever separators and case are used, a subject built from valid
+// fields in the right order gives back those fields.
+func TestTokenisedSubjectProperty(t *testing.T) {
+
+	seps := []string{" ", ", ", ",", ";", " / ", "/", "  ", "\t", " | "}
+	prop := func(entrant uint16, odo uint32, hh, mm uint8, sep uint8, lower bool) bool {
+		e, o, h, m := int(entrant%9999)+1, int(odo%1000000), int(hh%24), int(mm%60)
+		bonus := "A1"
+		if lower {
+			bonus = "a1"
+		}
+		sp := seps[int(sep)%len(seps)]
+		s := fmt.Sprintf("%d%s%s%s%d%s%02d:%02d", e, sp, bonus, sp, o, sp, h, m)
+		ff := *parseSubject(s, false)
+		return ff.ok && ff.EntrantID == e && ff.BonusID == "A1" && ff.OdoReading == o && ff.TimeHH == h && ff.TimeMM == m
+	}
+	if err := quick.Check(prop, nil); err != nil {
+		t.Error(err)
+	}
+
+	// Putting the odo where the time should be is never accepted, unless it
+	// could itself be a time
+	swapped := func(odo uint32, hh, mm uint8) bool {
+		o := int(odo%900000) + 2400
+		s := fmt.Sprintf("1,A1,%02d%02d,%d", hh%24, mm%60, o)
+		return !parseSubject(s, false).ok
+	}
+	if err := quick.Check(swapped, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOdoReadingPointIsComma(t *testing.T) {
+
+	saved := cfg.RallyPointIsComma
+	defer func() { cfg.RallyPointIsComma = saved }()
+
+	var readings = []struct {
+		s       string
+		isComma bool
+		odo     int
+		ok      bool
+	}{
+		{"10423", false, 10423, true},
+		{"10,423", false, 10423, true},
+		{"10.4", false, 10, true},
+		{"1,0423", false, 0, false},
+		{"10.423", true, 10423, true},
+		{"10,4", true, 10, true},
+		{"1.234.567", true, 1234567, true},
+		{"10.42", true, 0, false},
+		{"odo", false, 0, false},
+		{"12345km", false, 12345, true},
+		{"12,345 Miles", false, 12345, true},
+		{"12.345,6 km", true, 12345, true},
+		{"12345kmh", false, 0, false},
+	}
+	for _, x := range readings {
+		cfg.RallyPointIsComma = x.isComma
+		if odo, ok := odoReading(x.s); odo != x.odo || ok != x.ok {
+			t.Errorf("%v (comma=%v) gave %v %v\n", x.s, x.isComma, odo, ok)
+		}
+	}
+	if v, ok := odoValue("12,345.6mi"); !ok || v != 12345.6 {
+		t.Errorf("12,345.6mi gave %v %v\n", v, ok)
+	}
+	cfg.RallyPointIsComma = true
+	if ff := *parseSubject("1 A1 10.423 1713", false); !ff.ok || ff.OdoReading != 10423 {
+		t.Errorf("Continental subject gave %+v\n", ff)
+	}
+	cfg.RallyPointIsComma = false
+	if ff := *parseSubject("1 A1 10423.7km 1713", false); !ff.ok || ff.OdoReading != 10423 || ff.OdoValue != 10423.7 || ff.OdoText != "10423.7km" {
+		t.Errorf("Subject with a unit gave %+v\n", ff)
+	}
+}
+
+func TestOdoShown(t *testing.T) {
+
+	for _, c := range []struct {
+		n, claimed string
+		ok         bool
+	}{
+		{"12345", "12345", true},
+		{"012345", "12345", true},
+		{"123456", "12345", true},   // Tenths
+		{"712345", "12345", true},   // Something beside it
+		{"1234567", "12345", false}, // Too much beside it
+		{"91234", "123", false},
+		{"1230", "123", false},
+		{"123", "123", true},
+		{"9123", "123", false},
+	} {
+		if odoShown(c.n, c.claimed) != c.ok {
+			t.Errorf("odoShown(%v, %v) != %v\n", c.n, c.claimed, c.ok)
+		}
+	}
+
+}
+
+func TestHeicConverterDetection(t *testing.T) {
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "heif-convert"), []byte("#!/bin/sh\nexit 0\n"), 0755)
+	savedPath, saved := os.Getenv("PATH"), cfg.Heic2jpg
+	os.Setenv("PATH", dir)
+	defer func() {
+		os.Setenv("PATH", savedPath)
+		cfg.Heic2jpg = saved
+		heicChoice.checked = false
+	}()
+
+	cfg.Heic2jpg, heicChoice.checked = "magick", false
+	if tmpl := heicTemplate(); converterName(tmpl) != "heif-convert" {
+		t.Errorf("Missing magick replaced by [%v]\n", tmpl)
+	}
+	cfg.Heic2jpg = "heif-convert {in} {out}"
+	if tmpl := heicTemplate(); tmpl != cfg.Heic2jpg {
+		t.Errorf("Available converter replaced by [%v]\n", tmpl)
+	}
+	os.Setenv("PATH", t.TempDir())
+	cfg.Heic2jpg = "auto"
+	if tmpl := heicTemplate(); tmpl != "" {
+		t.Errorf("Found [%v] with nothing installed\n", tmpl)
+	}
+}
+
+func TestConverterCommand(t *testing.T) {
+
+	saved := cfg.JpegQuality
+	defer func() { cfg.JpegQuality = saved }()
+	cfg.JpegQuality = 0
+	for _, x := range []struct {
+		tmpl string
+		want string
+	}{
+		{"magick {in} -quality {quality} {out}", "[magick in.png -quality 85 out.jpg]"},
+		{"heif-convert -q {quality} {in} {out}", "[heif-convert -q 85 in.png out.jpg]"},
+		{"  sips   -s format jpeg  ", "[sips -s format jpeg in.png out.jpg]"},
+		{"convert {in}[0] jpg:{out}", "[convert in.png[0] jpg:out.jpg]"},
+	} {
+		if got := fmt.Sprint(converterCommand(x.tmpl, "in.png", "out.jpg").Args); got != x.want {
+			t.Errorf("%q runs %v not %v\n", x.tmpl, got, x.want)
+		}
+	}
+	cfg.JpegQuality = 60
+	if got := fmt.Sprint(converterCommand("magick {in} -quality {quality} {out}", "a", "b").Args); got != "[magick a -quality 60 b]" {
+		t.Errorf("Quality 60 runs %v\n", got)
+	}
+	for _, tmpl := range []string{"", "   "} {
+		cmd := converterCommand(tmpl, "in.png", "out.jpg")
+		if strings.Contains(fmt.Sprint(cmd.Args), "in.png") || cmd.Run() == nil {
+			t.Errorf("Empty template %q runs %v\n", tmpl, cmd.Args)
+		}
+	}
+
+}
+
+func TestConverterFor(t *testing.T) {
+
+	saved, savedHeic := cfg.Converters, cfg.ConvertHeic
+	savedChoice := heicChoice
+	defer func() { cfg.Converters, cfg.ConvertHeic, heicChoice = saved, savedHeic, savedChoice }()
+	cfg.Converters = map[string]string{".png": "magick {in} {out}", ".gif": "  ", ".heic": "sips"}
+	heicChoice.checked, heicChoice.configured, heicChoice.template = true, cfg.Heic2jpg, "heif-convert {in} {out}"
+	for _, x := range []struct {
+		ext  string
+		heic bool
+		want string
+	}{
+		{".png", false, "magick {in} {out}"},
+		{".gif", false, ""},
+		{".webp", false, ""},
+		{".jpg", true, ""},
+		{".heif", true, "heif-convert {in} {out}"},
+		{".heif", false, ""},
+		{".heic", false, "sips"},
+	} {
+		cfg.ConvertHeic = x.heic
+		if got := converterFor(x.ext); got != x.want {
+			t.Errorf("%v (ConvertHeic=%v) converted by %q not %q\n", x.ext, x.heic, got, x.want)
+		}
+	}
+
+}
+
+func TestFetchPage(t *testing.T) {
+
+	saved := cfg.FetchPageSize
+	defer func() {
+		cfg.FetchPageSize = saved
+		dbh.Exec("DELETE FROM ebcpaging")
+	}()
+	dbh.Exec("DELETE FROM ebcpaging")
+
+	uids := []uint32{9, 3, 7, 1, 5}
+	cfg.FetchPageSize = 10
+	if page, paged := fetchPage(uids); paged || len(page) != 5 {
+		t.Fatalf("Short list paged as %v %v\n", page, paged)
+	}
+	cfg.FetchPageSize = 2
+	for _, want := range []string{"[1 3]", "[5 7]", "[9 1]", "[3 5]"} {
+		page, paged := fetchPage(uids)
+		if !paged || fmt.Sprint(page) != want {
+			t.Fatalf("Page %v %v, expected %v\n", page, paged, want)
+		}
+		pageDone(page, new(imap.SeqSet))
+	}
+	// Stopped after the first of the page, or before any, I carry on from there
+	page, _ := fetchPage(uids)
+	unfinished := new(imap.SeqSet)
+	unfinished.AddNum(page[1])
+	pageDone(page, unfinished)
+	if next, _ := fetchPage(uids); fmt.Sprint(next) != "[9 1]" {
+		t.Errorf("After stopping at %v the next page is %v\n", page, next)
+	}
+	unfinished.AddNum(9)
+	pageDone([]uint32{9, 1}, unfinished)
+	if next, _ := fetchPage(uids); fmt.Sprint(next) != "[9 1]" {
+		t.Errorf("After finishing none the next page is %v\n", next)
+	}
+	cfg.FetchPageSize = -1
+	if _, paged := fetchPage(uids); paged {
+		t.Errorf("Paged with no limit\n")
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+
+	const entrant = 9901
+	defer dbh.Exec("DELETE FROM ebcclockskew WHERE EntrantID=?", entrant)
+	received := time.Date(2024, 6, 1, 23, 58, 0, 0, time.UTC)
+
+	recordClockSkew(entrant, 1, received.Add(-40*time.Minute), received) // Sat in an outbox
+	skew, n := entrantClockSkew(entrant)
+	if skew != -40*time.Minute || n != 1 || clockSkewAdvice(skew, n) != "" {
+		t.Fatalf("One delayed claim gave %v %v [%v]\n", skew, n, clockSkewAdvice(skew, n))
+	}
+	recordClockSkew(entrant, 2, received.Add(-7*time.Minute), received)
+	recordClockSkew(entrant, 3, received.Add(-9*time.Minute), received)
+	skew, n = entrantClockSkew(entrant)
+	if skew != -7*time.Minute || !strings.Contains(clockSkewAdvice(skew, n), "7 minutes slow") {
+		t.Errorf("Slow clock gave %v %v [%v]\n", skew, n, clockSkewAdvice(skew, n))
+	}
+	recordClockSkew(entrant, 4, received.Add(5*time.Minute), received)
+	skew, n = entrantClockSkew(entrant)
+	if !strings.Contains(clockSkewAdvice(skew, n), "5 minutes fast") {
+		t.Errorf("Fast clock gave %v %v [%v]\n", skew, n, clockSkewAdvice(skew, n))
+	}
+	if clockSkewAdvice(30*time.Second, 5) != "" {
+		t.Errorf("Advised about 30 seconds\n")
+	}
+}
+
+func TestExifClaimTime(t *testing.T) {
+
+	saved := cfg.ExifClaimTime
+	defer func() { cfg.ExifClaimTime = saved }()
+
+	photo := func(taken string) []emailPhoto {
+		return []emailPhoto{{Data: exifJPEG(t, map[uint16]interface{}{}, map[uint16]interface{}{exifTagDateTimeOriginal: taken})}}
+	}
+	at := func(s string) time.Time {
+		x, _ := time.ParseInLocation(myTimeFormat, s, cfg.LocalTZ)
+		return x
+	}
+	var times = []struct {
+		mode    string
+		claimed string
+		taken   string
+		want    string
+	}{
+		{"", "2024-06-02 23:58:00", "2024:06:01 23:57:10", "2024-06-02 23:58:00"},
+		{"date", "2024-06-02 23:58:00", "2024:06:01 23:57:10", "2024-06-01 23:58:00"},
+		{"date", "2024-06-01 00:02:00", "2024:06:01 23:59:30", "2024-06-02 00:02:00"},
+		{"date", "2024-06-01 14:00:00", "2024:06:01 09:00:00", "2024-06-01 14:00:00"},
+		{"time", "2024-06-01 14:00:00", "2024:06:01 09:00:40", "2024-06-01 09:00:00"},
+		{"time", "2024-06-01 09:20:00", "2024:06:01 09:00:40", "2024-06-01 09:20:00"},
+	}
+	for _, x := range times {
+		cfg.ExifClaimTime = x.mode
+		got, changed := exifClaimTime(at(x.claimed), photo(x.taken))
+		if got.Format(myTimeFormat) != x.want || changed != (x.want != x.claimed) {
+			t.Errorf("%v %v with photo at %v gave %v %v\n", x.mode, x.claimed, x.taken, got, changed)
+		}
+	}
+	cfg.ExifClaimTime = "time"
+	if _, changed := exifClaimTime(at("2024-06-01 14:00:00"), nil); changed {
+		t.Errorf("Changed without a photo\n")
+	}
+}
+
+func TestAutoStop(t *testing.T) {
+
+	savedCfg := cfg
+	defer func() {
+		cfg = savedCfg
+		dbh.Exec("DELETE FROM ebcautostop")
+	}()
+	cfg.AdminAddresses, cfg.SendSummaries = nil, false
+	dbh.Exec("DELETE FROM ebcautostop")
+
+	finish := cfg.RallyFinish
+	cfg.AutoStopAfter = 0
+	if autoStopDue(finish.Add(1000 * time.Hour)) {
+		t.Errorf("Stopping without AutoStopAfter\n")
+	}
+	cfg.AutoStopAfter = 48 * time.Hour
+	if autoStopDue(finish.Add(47*time.Hour)) || !autoStopDue(finish.Add(49*time.Hour)) {
+		t.Errorf("AutoStopAfter not respected\n")
+	}
+	if !strings.Contains(finalReport(time.Now()), "Claims stored:") {
+		t.Errorf("Final report %v\n", finalReport(time.Now()))
+	}
+	autoStop()
+	autoStop()
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM ebcautostop").Scan(&n)
+	if n != 1 || !autoStopped() {
+		t.Errorf("Stopped %v times\n", n)
+	}
+}
+
+func TestPollSchedule(t *testing.T) {
+
+	saved := cfg.PollSchedule
+	defer func() { cfg.PollSchedule = saved }()
+	cfg.PollSchedule = []pollPeriod{
+		{Every: 15 * time.Second, From: "finish-3h", Until: "finish+1h"},
+		{Every: 5 * time.Minute, From: "23:00", Until: "06:00"},
+		{Every: time.Hour, From: "start-168h", Until: "start-24h"},
+	}
+	if err := checkPollSchedule(); err != nil {
+		t.Fatal(err)
+	}
+	at := func(base time.Time, d time.Duration) time.Time { return base.Add(d) }
+	night := time.Date(cfg.RallyStart.Year(), cfg.RallyStart.Month(), cfg.RallyStart.Day(), 2, 30, 0, 0, cfg.LocalTZ)
+	var intervals = []struct {
+		now  time.Time
+		want time.Duration
+	}{
+		{at(cfg.RallyFinish, -2*time.Hour), 15 * time.Second},
+		{at(cfg.RallyFinish, 2*time.Hour), time.Duration(cfg.SleepSeconds) * time.Second},
+		{night, 5 * time.Minute},
+		{at(night, 10*time.Hour), time.Duration(cfg.SleepSeconds) * time.Second},
+		{at(cfg.RallyStart, -72*time.Hour+10*time.Hour), time.Hour},
+	}
+	for _, x := range intervals {
+		if got := pollInterval(x.now); got != x.want {
+			t.Errorf("At %v polled every %v not %v\n", x.now, got, x.want)
+		}
+	}
+	cfg.PollSchedule = []pollPeriod{{Every: time.Minute, From: "22:00", Until: "finish"}}
+	if checkPollSchedule() == nil {
+		t.Errorf("Mixed period accepted\n")
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+
+	defer func() {
+		dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZL'")
+		rebuildLeaderboard()
+	}()
+	for _, e := range []int{1, 1, 2} {
+		res, err := dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,ClaimTime) VALUES(?,'ZZL','2024-06-01T09:15:00+01:00')", e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowid, _ := res.LastInsertId()
+		refreshLeaderboard(rowid)
+	}
+	board := func() (claims, entrants int) {
+		dbh.QueryRow("SELECT Claims,Entrants FROM ebcboardbonuses WHERE BonusID='ZZL'").Scan(&claims, &entrants)
+		return
+	}
+	if c, e := board(); c != 3 || e != 2 {
+		t.Errorf("Bonus board has %v claims by %v entrants\n", c, e)
+	}
+	var hour int
+	dbh.QueryRow("SELECT Claims FROM ebcboardhours WHERE Hour='2024-06-01T09'").Scan(&hour)
+	if hour < 3 {
+		t.Errorf("Hour board has %v claims\n", hour)
+	}
+
+	if _, ok := cancelClaim(2, "ZZL"); !ok {
+		t.Fatal("cancelClaim failed")
+	}
+	if c, e := board(); c != 2 || e != 1 {
+		t.Errorf("After cancelling, bonus board has %v claims by %v entrants\n", c, e)
+	}
+	var entrant2 int
+	dbh.QueryRow("SELECT count(*) FROM ebcboardentrants WHERE EntrantID=2").Scan(&entrant2)
+	if entrant2 != 0 {
+		t.Errorf("Entrant with only a cancelled claim is on the board\n")
+	}
+
+	dbh.Exec("DELETE FROM ebcboardbonuses")
+	rebuildLeaderboard()
+	if c, e := board(); c != 2 || e != 1 {
+		t.Errorf("After rebuilding, bonus board has %v claims by %v entrants\n", c, e)
+	}
+}
+
+func TestArchive(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	dir := t.TempDir()
+	cfg.Path2SM, cfg.ImageFolder, cfg.EmailsFolder, cfg.ReceiptsFolder = dir, "img", "emails", ""
+	cfg.QuarantineFolder = filepath.Join(dir, "quarantine")
+	os.MkdirAll(filepath.Join(dir, "img"), 0755)
+	img := filepath.Join(dir, "img", "img-1-A1-7.jpg")
+	os.WriteFile(img, []byte("jpeg"), 0644)
+	saveRawEmail(99001, []byte("Subject: 1 A1 10423 1015\r\n\r\n"))
+
+	for _, format := range []string{"zip", "tar"} {
+		out := filepath.Join(dir, format)
+		args := []string{"-to", out, "-format", format}
+		if format == "tar" {
+			args = append(args, "-prune")
+		}
+		if rc := runArchive(args); rc != 0 {
+			t.Fatalf("archive %v returned %v\n", format, rc)
+		}
+		files, _ := filepath.Glob(filepath.Join(out, "ebcfetch-archive-*"))
+		if len(files) != 1 {
+			t.Fatalf("archive %v wrote %v\n", format, files)
+		}
+		names, err := archiveContents(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"claims.csv", "images/img-1-A1-7.jpg", "emails/99001.eml"}
+		for _, w := range want {
+			if !containsFold(names, w) {
+				t.Errorf("%v archive has %v, missing %v\n", format, names, w)
+			}
+		}
+	}
+	if _, err := os.Stat(img); !os.IsNotExist(err) {
+		t.Errorf("Archived image wasn't pruned\n")
+	}
+	if rc := runArchive([]string{"-to", dir, "-format", "rar"}); rc == 0 {
+		t.Errorf("Unknown archive format accepted\n")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.AdminAddresses = nil
+
+	cfg.MaintenanceEvery = 0
+	if maintenanceDue(time.Now()) {
+		t.Errorf("Maintenance due without MaintenanceEvery\n")
+	}
+	cfg.MaintenanceEvery = time.Hour
+	if !maintenanceDue(time.Now()) {
+		t.Errorf("Maintenance not due when never run\n")
+	}
+	report, ok := runMaintenance()
+	if !ok || !strings.Contains(report, "integrity_check: ok") {
+		t.Errorf("Maintenance reported %v %q\n", ok, report)
+	}
+	if maintenanceDue(time.Now()) || !maintenanceDue(time.Now().Add(61*time.Minute)) {
+		t.Errorf("MaintenanceEvery not respected\n")
+	}
+	var result string
+	dbh.QueryRow("SELECT Result FROM ebcmaintenance").Scan(&result)
+	if result != maintenanceOK {
+		t.Errorf("Maintenance recorded as %q\n", result)
+	}
+}
+
+func TestThreadedResends(t *testing.T) {
+
+	ct := time.Date(2024, 6, 1, 23, 50, 0, 0, cfg.LocalTZ)
+	res, err := dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,ClaimTime) VALUES(1,'ZZM',?)", storeTimeDB(ct))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, _ := res.LastInsertId()
+	defer dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZM'")
+	dbWriteTx(func(tx *sql.Tx) error {
+		return storeThread(tx, orig, messageThread{MessageID: "<claim-1@phone.example>"}, 0)
+	})
+
+	reply := messageThread{MessageID: "claim-2@phone.example", InReplyTo: []string{"claim-1@phone.example"}}
+	if rowid, when := threadedClaim(1, "ZZM", reply); rowid != orig || !when.Equal(ct) {
+		t.Errorf("Reply matched %v at %v\n", rowid, when)
+	}
+	resent := messageThread{MessageID: "claim-1@phone.example"}
+	if rowid, _ := threadedClaim(1, "ZZM", resent); rowid != orig {
+		t.Errorf("Identical Message-ID matched %v\n", rowid)
+	}
+	forwarded := messageThread{MessageID: "fwd@mail.example", References: []string{"other@x", "<claim-1@phone.example>"}}
+	if rowid, _ := threadedClaim(1, "ZZM", forwarded); rowid != orig {
+		t.Errorf("References matched %v\n", rowid)
+	}
+	if rowid, _ := threadedClaim(1, "ZZN", reply); rowid != 0 {
+		t.Errorf("Reply claiming another bonus matched %v\n", rowid)
+	}
+	if rowid, _ := threadedClaim(1, "ZZM", messageThread{}); rowid != 0 {
+		t.Errorf("Unthreaded email matched %v\n", rowid)
+	}
+
+	res, _ = dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID) VALUES(1,'ZZM')")
+	resend, _ := res.LastInsertId()
+	dbWriteTx(func(tx *sql.Tx) error { return storeThread(tx, resend, reply, orig) })
+	var linked int64
+	var inReplyTo string
+	dbh.QueryRow("SELECT ResendOf,InReplyTo FROM ebclaims WHERE rowid=?", resend).Scan(&linked, &inReplyTo)
+	if linked != orig || inReplyTo != "claim-1@phone.example" {
+		t.Errorf("Resend stored as %v %q\n", linked, inReplyTo)
+	}
+}
+
+func TestMapPins(t *testing.T) {
+
+	for _, x := range []struct {
+		text     string
+		lat, lon float64
+	}{
+		{"I'm here https://www.google.com/maps?q=52.9536,-1.1505 thanks", 52.9536, -1.1505},
+		{"https://maps.google.co.uk/?q=loc:52.9536%2C-1.1505", 52.9536, -1.1505},
+		{"https://www.google.com/maps/place/Trent+Bridge/@52.94,-1.13,17z/data=!3m1!4b1!4m6!3m5!1s0x0:0x0!8m2!3d52.9371!4d-1.1322", 52.9371, -1.1322},
+		{"https://www.google.com/maps/search/?api=1&amp;query=52.9536,-1.1505", 52.9536, -1.1505},
+		{"https://waze.com/ul?ll=52.9536,-1.1505&navigate=yes", 52.9536, -1.1505},
+		{"https://www.waze.com/live-map/directions?to=ll.52.9536%2C-1.1505", 52.9536, -1.1505},
+		{"https://maps.apple.com/?ll=52.9536,-1.1505&q=Dropped%20Pin", 52.9536, -1.1505},
+		{"geo:52.9536,-1.1505?z=17", 52.9536, -1.1505},
+	} {
+		lat, lon, ok := mapPin(x.text)
+		if !ok || lat != x.lat || lon != x.lon {
+			t.Errorf("mapPin(%q) = %v %v %v\n", x.text, lat, lon, ok)
+		}
+	}
+	for _, s := range []string{"https://maps.app.goo.gl/AbCdEf", "https://example.com/?q=52.9,-1.1", "https://www.google.com/maps?q=152.9,-1.1"} {
+		if _, _, ok := mapPin(s); ok {
+			t.Errorf("mapPin(%q) found a pin\n", s)
+		}
+	}
+	if d := distanceMetres(52.9536, -1.1505, 52.9536, -1.1505); d != 0 {
+		t.Errorf("Distance to self %v\n", d)
+	}
+	if d := distanceMetres(52.9536, -1.1505, 52.9626, -1.1505); d < 990 || d > 1010 {
+		t.Errorf("Distance over 0.009 degrees of latitude %v\n", d)
+	}
+
+	var lat, lon sql.NullFloat64
+	dbh.QueryRow("SELECT Latitude,Longitude FROM bonuses WHERE BonusID='A1'").Scan(&lat, &lon)
+	defer dbh.Exec("UPDATE bonuses SET Latitude=?,Longitude=? WHERE BonusID='A1'", lat, lon)
+	dbh.Exec("UPDATE bonuses SET Latitude=52.9536,Longitude=-1.1505 WHERE BonusID='A1'")
+	saved := cfg.MapPinMetres
+	defer func() { cfg.MapPinMetres = saved }()
+	cfg.MapPinMetres = 500
+
+	for _, x := range []struct {
+		body string
+		flag string
+	}{
+		{"https://www.google.com/maps?q=52.9550,-1.1510", flagMapPinOk},
+		{"https://www.google.com/maps?q=53.0536,-1.1505", flagMapPinFar},
+	} {
+		var flags claimFlags
+		if _, ok := checkMapPin(Email{TextBody: x.body}, "A1", &flags); !ok || flags.String() != x.flag {
+			t.Errorf("checkMapPin(%v) flagged %q\n", x.body, flags.String())
+		}
+	}
+}
+
+func TestDeviceZoneAdvice(t *testing.T) {
+
+	for secs, want := range map[int]string{0: "UTC", 3600: "UTC+1", -4 * 3600: "UTC-4", 19800: "UTC+5:30", -12600: "UTC-3:30"} {
+		if got := utcOffset(secs); got != want {
+			t.Errorf("utcOffset(%v) = %v, want %v\n", secs, got, want)
+		}
+	}
+
+	summer := time.Date(2024, 6, 1, 10, 15, 0, 0, cfg.LocalTZ)
+	if advice := deviceZoneAdvice(summer); advice != "" {
+		t.Errorf("Rally timezone advised %q\n", advice)
+	}
+	if advice := deviceZoneAdvice(time.Time{}); advice != "" {
+		t.Errorf("Missing Date advised %q\n", advice)
+	}
+	away := summer.In(time.FixedZone("", 3*3600))
+	if advice := deviceZoneAdvice(away); !strings.Contains(advice, "set to UTC+3, the rally runs on UTC+1") {
+		t.Errorf("Wrong timezone advised %q\n", advice)
+	}
+	if advice := deviceZoneAdvice(summer.UTC()); !strings.Contains(advice, "webmail") {
+		t.Errorf("UTC advised %q\n", advice)
+	}
+	winter := time.Date(2024, 1, 10, 10, 15, 0, 0, time.UTC)
+	if advice := deviceZoneAdvice(winter); advice != "" {
+		t.Errorf("UTC in a UK winter advised %q\n", advice)
+	}
+}
+
+func TestDashboardAuth(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := requireAuth(ok)
+	try := func(setup func(*http.Request)) int {
+		req := httptest.NewRequest("GET", "/api/stats", nil)
+		if setup != nil {
+			setup(req)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	cfg.DashboardUser, cfg.DashboardPassword, cfg.DashboardToken, cfg.APIToken = "", "", "", "sesame"
+	if code := try(nil); code != http.StatusOK {
+		t.Errorf("Open dashboard refused with %v\n", code)
+	}
+
+	cfg.DashboardUser, cfg.DashboardPassword, cfg.DashboardToken = "hq", "letmein", "tok"
+	for _, x := range []struct {
+		setup func(*http.Request)
+		want  int
+	}{
+		{nil, http.StatusUnauthorized},
+		{func(r *http.Request) { r.SetBasicAuth("hq", "letmein") }, http.StatusOK},
+		{func(r *http.Request) { r.SetBasicAuth("hq", "wrong") }, http.StatusUnauthorized},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok") }, http.StatusOK},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer sesame") }, http.StatusOK},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+	} {
+		if code := try(x.setup); code != x.want {
+			t.Errorf("Got %v, want %v\n", code, x.want)
+		}
+	}
+
+	cfg.DashboardLocalOnly = true
+	for addr, want := range map[string]string{":8079": "127.0.0.1:8079", "0.0.0.0:80": "127.0.0.1:80", "localhost:8079": "localhost:8079", "[::1]:8079": "[::1]:8079"} {
+		if got := dashboardListenAddr(addr); got != want {
+			t.Errorf("dashboardListenAddr(%v) = %v, want %v\n", addr, got, want)
+		}
+	}
+	cfg.DashboardLocalOnly = false
+	if got := dashboardListenAddr(":8079"); got != ":8079" {
+		t.Errorf("dashboardListenAddr moved to %v\n", got)
+	}
+}
+
+func TestStateExportImport(t *testing.T) {
+
+	useMemoryDB(t)
+	dbh.Exec("DELETE FROM ebcretries")
+	dbh.Exec("DELETE FROM ebcpaging")
+	dbh.Exec("INSERT INTO ebcpaging (UidValidity,LastUid) VALUES(7,4321)")
+	dbh.Exec("INSERT INTO ebcretries (EmailID,UidValidity,SkippedAt) VALUES(4322,7,'2024-06-01T10:00:00+01:00')")
+	dbh.Exec("INSERT INTO ebclaims (EmailID,EntrantID,BonusID,Fingerprint,MessageID) VALUES(4300,1,'ZZS','fp-zzs','zzs@phone')")
+	dbh.Exec("INSERT INTO ebclaims (EmailID,EntrantID,BonusID,Fingerprint) VALUES(4301,1,'ZZT','fp-zzt')")
+
+	sf, err := exportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(sf)
+	var back stateFile
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backup's database is older: no paging, no retries and no ZZT claim
+	dbh.Exec("DELETE FROM ebcpaging")
+	dbh.Exec("DELETE FROM ebcretries")
+	dbh.Exec("DELETE FROM ebclaims WHERE BonusID='ZZT'")
+	dbh.Exec("UPDATE ebclaims SET Fingerprint='',MessageID='' WHERE BonusID='ZZS'")
+
+	missing, err := importState(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing != 1 {
+		t.Errorf("%v claims reported missing\n", missing)
+	}
+	var validity, last uint32
+	dbh.QueryRow("SELECT UidValidity,LastUid FROM ebcpaging").Scan(&validity, &last)
+	var retries int
+	dbh.QueryRow("SELECT count(*) FROM ebcretries WHERE EmailID=4322").Scan(&retries)
+	if validity != 7 || last != 4321 || retries != 1 {
+		t.Errorf("Imported paging %v/%v and %v retries\n", validity, last, retries)
+	}
+	if fingerprintedClaim("fp-zzs") == 0 {
+		t.Errorf("Fingerprint not imported\n")
+	}
+
+	back.Version = 99
+	if _, err := importState(back); err == nil {
+		t.Errorf("Wrong version imported\n")
+	}
+	back.Version = stateVersion
+	back.Tables["ebcpaging"][0]["Nonsense"] = 1
+	if _, err := importState(back); err == nil {
+		t.Errorf("Unknown column imported\n")
+	}
+}
+
+func TestDBWriter(t *testing.T) {
+
+	fn := filepath.Join(t.TempDir(), "writer.db")
+	db, err := sql.Open("sqlite3", "file:"+fn+"?_busy_timeout=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDB, savedCfg := dbh, cfg
+	defer func() {
+		dbh, cfg = savedDB, savedCfg
+		db.Close()
+	}()
+	dbh = db
+	cfg.WriteRetryFor = 5 * time.Second
+	if _, err := dbExec("CREATE TABLE w (x INTEGER PRIMARY KEY, y TEXT NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes arriving together are batched, a bad one spoiling nothing else
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var y interface{} = fmt.Sprint(i)
+			if i == 5 {
+				y = nil
+			}
+			_, errs[i] = dbExec("INSERT INTO w (x,y) VALUES(?,?)", i, y)
+		}(i)
+	}
+	wg.Wait()
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM w").Scan(&n)
+	if n != 9 || errs[5] == nil || errs[4] != nil {
+		t.Errorf("Batched writes stored %v rows, errors %v\n", n, errs)
+	}
+
+	// Someone else holding the write lock only delays things
+	other, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		conn.ExecContext(context.Background(), "COMMIT")
+	}()
+	retries := dbRetries
+	res, err := dbExec("INSERT INTO w (x,y) VALUES(99,'late')")
+	if err != nil {
+		t.Fatalf("Write while locked failed %v\n", err)
+	}
+	if id, _ := res.LastInsertId(); id != 99 || dbRetries == retries {
+		t.Errorf("Write while locked gave rowid %v after %v retries\n", id, dbRetries-retries)
+	}
+
+	err = dbWriteTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT INTO w (x,y) VALUES(100,'a')"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO w (x,y) VALUES(101,NULL)")
+		return err
+	})
+	dbh.QueryRow("SELECT count(*) FROM w WHERE x=100").Scan(&n)
+	if err == nil || n != 0 {
+		t.Errorf("Failed transaction left %v rows, error %v\n", n, err)
+	}
+}
+
+func TestDashboardSettings(t *testing.T) {
+
+	saved := cfg
+	defer func() {
+		cfg = saved
+		dbh.Exec("DELETE FROM ebcoverrides")
+		dbh.Exec("DELETE FROM ebcsettingslog")
+	}()
+	cfg.TestMode, cfg.SleepSeconds, cfg.FetchPageSize = false, 10, 500
+
+	form := url.Values{"TestMode": {"true"}, "SleepSeconds": {"30"}, "MaxFetch": {"0"}}
+	req := httptest.NewRequest("POST", "/settings", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("hq", "x")
+	rec := httptest.NewRecorder()
+	dashSettingsPage(rec, req)
+	if cfg.TestMode || cfg.SleepSeconds != 10 {
+		t.Errorf("Settings changed outside the main loop\n")
+	}
+	if !strings.Contains(rec.Body.String(), `<input name="SleepSeconds" value="30"`) {
+		t.Errorf("Queued change not shown\n%v\n", rec.Body.String())
+	}
+	if !applySettingChanges() || applySettingChanges() {
+		t.Errorf("Queued changes not made once\n")
+	}
+	if !cfg.TestMode || cfg.SleepSeconds != 30 || cfg.FetchPageSize != 500 {
+		t.Errorf("Settings now %v %v %v\n", cfg.TestMode, cfg.SleepSeconds, cfg.FetchPageSize)
+	}
+	if !strings.Contains(rec.Body.String(), "MaxFetch: &#34;0&#34; isn&#39;t allowed") {
+		t.Errorf("Invalid MaxFetch not reported\n%v\n", rec.Body.String())
+	}
+	var who, old, now string
+	dbh.QueryRow("SELECT ChangedBy,OldValue,NewValue FROM ebcsettingslog WHERE Setting='SleepSeconds'").Scan(&who, &old, &now)
+	if who != "hq" || old != "10" || now != "30" {
+		t.Errorf("Change logged as %v %v %v\n", who, old, now)
+	}
+
+	// The changes outlive a reload of the configuration
+	cfg.TestMode, cfg.SleepSeconds = false, 10
+	applySettingOverrides()
+	if !cfg.TestMode || cfg.SleepSeconds != 30 {
+		t.Errorf("Overrides not reapplied %v %v\n", cfg.TestMode, cfg.SleepSeconds)
+	}
+
+	req = httptest.NewRequest("POST", "/settings", strings.NewReader("DontRun=true"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	dashSettingsPage(rec, req)
+	applySettingChanges()
+	if rec.Code != http.StatusForbidden || cfg.DontRun {
+		t.Errorf("Cross-site change allowed %v\n", rec.Code)
+	}
+	req.Header.Del("Origin")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rec = httptest.NewRecorder()
+	dashSettingsPage(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Cross-site change by Sec-Fetch-Site allowed %v\n", rec.Code)
+	}
+	if err := changeSetting("ImapPassword", "x", "hq"); err == nil {
+		t.Errorf("Changed a setting which isn't switchable\n")
+	}
+}
+
+func TestPreviewResponse(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.TestResponseGood, cfg.TestResponseBad, cfg.TestResponseSubject = "Looks good", "Needs work", ""
+	cfg.TestResponseAdvice = "Check the rally book"
+
+	subject, page := previewResponses(true, false)
+	if subject != "EBC test: Looks good" || strings.Contains(page, "Needs work") {
+		t.Errorf("Good preview %v\n%v\n", subject, page)
+	}
+	subject, page = previewResponses(false, true)
+	if subject != "EBC test: Needs work" || !strings.Contains(page, "Photo bonus without a photo") || !strings.Contains(page, "Check the rally book") {
+		t.Errorf("Bad preview %v\n%v\n", subject, page)
+	}
+
+	out := filepath.Join(t.TempDir(), "preview.html")
+	if rc := runPreviewResponse([]string{"--good", "--bad", "-out", out}); rc != 0 {
+		t.Fatalf("preview-response returned %v\n", rc)
+	}
+	data, _ := os.ReadFile(out)
+	if !strings.Contains(string(data), "Looks good") || !strings.Contains(string(data), "Needs work") {
+		t.Errorf("Preview file lacks a response\n%s\n", data)
+	}
+}
+
+func TestUnconvertedPhotos(t *testing.T) {
+
+	useMemoryDB(t)
+	savedFailures := conversionFailures
+	defer func() {
+		conversionFailures = savedFailures
+	}()
+	cfg.Converters = map[string]string{".png": "false"}
+
+	pic := []byte("\x89PNG\r\n\x1a\nnot really")
+	photoid := writeImage(1, "A1", 77, pic, "pic.png")
+	if photoid == 0 {
+		t.Fatalf("Photo not stored when conversion failed\n")
+	}
+	var img string
+	var unconverted int
+	dbh.QueryRow("SELECT image,Unconverted FROM ebcphotos WHERE rowid=?", photoid).Scan(&img, &unconverted)
+	if !strings.HasSuffix(img, ".png") || unconverted != 1 || conversionFailures != savedFailures+1 {
+		t.Errorf("Failed conversion stored as %v unconverted=%v failures=%v\n", img, unconverted, conversionFailures)
+	}
+	if st := fetchClaimStats(time.Now()); st.Unconverted != 1 {
+		t.Errorf("Stats show %v unconverted\n", st.Unconverted)
+	}
+
+	if n := retryConversions(); n != 0 {
+		t.Errorf("Retry converted %v with a broken converter\n", n)
+	}
+	cfg.Converters[".png"] = "cp"
+	if n := retryConversions(); n != 1 {
+		t.Errorf("Retry converted %v\n", n)
+	}
+	dbh.QueryRow("SELECT image,Unconverted FROM ebcphotos WHERE rowid=?", photoid).Scan(&img, &unconverted)
+	if !strings.HasSuffix(img, ".jpg") || unconverted != 0 {
+		t.Errorf("After retry %v unconverted=%v\n", img, unconverted)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Path2SM, img)); err != nil {
+		t.Errorf("Converted image missing %v\n", err)
+	}
+}
+
+func TestPendingPhotos(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.Converters = map[string]string{".png": "cp"}
+	images := filepath.Join(cfg.Path2SM, cfg.ImageFolder)
+	var before int
+	dbh.QueryRow("SELECT count(*) FROM ebcphotos").Scan(&before)
+
+	write := func() pendingPhotos {
+		return pendingPhotos{
+			writePhoto(1, "A1", 80, emailPhoto{Data: exifJPEG(t, map[uint16]interface{}{}, map[uint16]interface{}{}), Filename: "keep.jpg"}),
+			writePhoto(1, "A1", 80, emailPhoto{Data: []byte("\x89PNG\r\n\x1a\nnot really"), Filename: "conv.png"}),
+		}
+	}
+	pending := write()
+	if files, _ := filepath.Glob(filepath.Join(images, "pending-*")); len(files) != 3 {
+		t.Fatalf("Photos written as %v\n", files)
+	}
+
+	// A claim which can't be stored takes its photos with it
+	err := dbWriteTx(func(tx *sql.Tx) error {
+		if _, err := pending.store(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO nosuchtable VALUES(1)")
+		return err
+	})
+	if err == nil {
+		t.Fatalf("Failing transaction committed\n")
+	}
+	pending.discard()
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM ebcphotos").Scan(&n)
+	if n != before {
+		t.Errorf("%v photo rows left\n", n-before)
+	}
+	if files, _ := filepath.Glob(filepath.Join(images, "*")); len(files) != 0 {
+		t.Errorf("Files left %v\n", files)
+	}
+
+	pending = write()
+	var ids []string
+	if err := dbWriteTx(func(tx *sql.Tx) (err error) { ids, err = pending.store(tx); return }); err != nil {
+		t.Fatal(err)
+	}
+	pending.keep()
+	if len(ids) != 2 {
+		t.Fatalf("Stored as %v\n", ids)
+	}
+	for _, id := range ids {
+		var img string
+		dbh.QueryRow("SELECT image FROM ebcphotos WHERE rowid=?", id).Scan(&img)
+		if _, err := os.Stat(filepath.Join(cfg.Path2SM, img)); err != nil || !strings.HasSuffix(img, "-"+id+".jpg") {
+			t.Errorf("Photo %v stored as %v %v\n", id, img, err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(images, "pending-*")); len(files) != 0 {
+		t.Errorf("Files not renamed %v\n", files)
+	}
+}
+
+func TestNativeHeic(t *testing.T) {
+
+	useMemoryDB(t)
+	savedDecoder := heicDecoder
+	defer func() {
+		heicDecoder = savedDecoder
+	}()
+	cfg.ConvertHeic = true
+	cfg.Converters = map[string]string{".heic": ""} // No external converter
+	heicDecoder = func(pic []byte) (image.Image, error) {
+		return image.NewNRGBA(image.Rect(0, 0, 4, 4)), nil
+	}
+
+	pic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00")
+	photoid := writeImage(1, "A1", 78, pic, "pic.heic")
+	var img string
+	var unconverted int
+	dbh.QueryRow("SELECT image,Unconverted FROM ebcphotos WHERE rowid=?", photoid).Scan(&img, &unconverted)
+	if !strings.HasSuffix(img, ".jpg") || unconverted != 0 {
+		t.Errorf("HEIC stored as %v unconverted=%v\n", img, unconverted)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Path2SM, img)); err != nil {
+		t.Errorf("Converted image missing %v\n", err)
+	}
+
+	heicDecoder = func(pic []byte) (image.Image, error) {
+		return nil, fmt.Errorf("can't decode")
+	}
+	photoid = writeImage(1, "A1", 79, pic, "pic.heic")
+	dbh.QueryRow("SELECT image,Unconverted FROM ebcphotos WHERE rowid=?", photoid).Scan(&img, &unconverted)
+	if !strings.HasSuffix(strings.ToLower(img), ".heic") || unconverted != 1 {
+		t.Errorf("Undecodable HEIC stored as %v unconverted=%v\n", img, unconverted)
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+
+	saveEvery, saveTitle := cfg.AckEvery, cfg.RallyTitle
+	defer func() { cfg.AckEvery, cfg.RallyTitle = saveEvery, saveTitle }()
+	cfg.AckEvery, cfg.RallyTitle = 5*time.Minute, "Test Rally"
+
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	for i, want := range []struct {
+		after time.Duration
+		due   bool
+		held  int
+	}{{0, true, 0}, {time.Minute, false, 0}, {2 * time.Minute, false, 0}, {6 * time.Minute, true, 2}, {7 * time.Minute, false, 0}} {
+		due, held := ackDue(9901, now.Add(want.after))
+		if due != want.due || held != want.held {
+			t.Errorf("Ack %v due=%v held=%v\n", i, due, held)
+		}
+	}
+	if due, _ := ackDue(9902, now.Add(time.Minute)); !due {
+		t.Errorf("Another entrant's ack held back\n")
+	}
+
+	f4 := &fourFields{EntrantID: 12, BonusID: "A4", OdoReading: 10423, ClaimTime: time.Date(2024, 6, 1, 17, 13, 0, 0, time.UTC)}
+	subject, body := ackText(f4, 2, 1)
+	if subject != "Test Rally: Claim received" || !strings.Contains(body, "entrant 12, bonus A4, odo 10423, time 17:13, 2 photos") ||
+		!strings.Contains(body, "Also 1 other claim") {
+		t.Errorf("Acknowledgement %v\n%v\n", subject, body)
+	}
+}
+
+func TestRejectionNotices(t *testing.T) {
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	cfg.RejectionTemplates = map[string]string{rejectEntrant: "No entrant {entrant} for {bonus}"}
+	cfg.SubjectExamples = []subjectExample{{Subject: "bad", Valid: false}, {Subject: "7 B2 1234 0915", Valid: true}}
+	cfg.FollowUpPhotoMinutes = -1
+
+	f4 := &fourFields{ok: true, EntrantID: 99, BonusID: "A4"}
+	for _, x := range []struct {
+		ok, ve, vea bool
+		want        string
+	}{{false, false, false, rejectFormat}, {true, false, false, rejectEntrant}, {true, true, false, rejectAddress}, {true, true, true, ""}} {
+		f4.ok = x.ok
+		if got := rejectionReason(*f4, x.ve, x.vea); got != x.want {
+			t.Errorf("Reason for ok=%v ve=%v vea=%v is %v\n", x.ok, x.ve, x.vea, got)
+		}
+	}
+	if s := rejectionText(rejectEntrant, "99 A4", f4, ""); s != "No entrant 99 for A4" {
+		t.Errorf("Template gave %v\n", s)
+	}
+	if s := rejectionText(rejectFormat, "hello", f4, ""); !strings.Contains(s, "\"hello\"") || !strings.Contains(s, "7 B2 1234 0915") {
+		t.Errorf("Format notice %v\n", s)
+	}
+	if s := rejectionText(rejectRule, "99 A4", f4, "too late"); !strings.HasSuffix(s, "can't be accepted: too late") {
+		t.Errorf("Rule notice %v\n", s)
+	}
+	cfg.FollowUpPhotoMinutes = 10
+	if s := rejectionText(rejectPhoto, "99 A4", f4, ""); !strings.Contains(s, "within 10 minutes") {
+		t.Errorf("Photo notice %v\n", s)
+	}
+}
+
+func TestFollowUpPhotos(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.FollowUpPhotoMinutes = 0
+	dbh.Exec("DELETE FROM ebclaims")
+
+	jpg := emailPhoto{Filename: "pic.jpg", Data: []byte("\xff\xd8\xff\xe0not really")}
+	now := time.Now()
+	if got := attachFollowUpPhotos(51, "bob@example.com", "", now, []emailPhoto{jpg}); got != followUpWaiting {
+		t.Errorf("Photos before the claim gave %v\n", got)
+	}
+	if got := attachFollowUpPhotos(51, "bob@example.com", "", now.Add(-time.Hour), []emailPhoto{jpg}); got != followUpNone {
+		t.Errorf("Photos with no claim gave %v\n", got)
+	}
+
+	res, _ := dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,EmailID,DateTime,EbcFlags,PhotoIDs) VALUES(1,'A1',50,?,'PHX','')", storeTimeDB(now))
+	rowid, _ := res.LastInsertId()
+	if got := attachFollowUpPhotos(51, "stranger@example.com", "", now, []emailPhoto{jpg}); got != followUpNone {
+		t.Errorf("Photos from a stranger gave %v\n", got)
+	}
+	if got := attachFollowUpPhotos(51, "Bob <bob@example.com>", "", now.Add(2*time.Minute), []emailPhoto{jpg, jpg}); got != followUpAttached {
+		t.Fatalf("Follow-up photos gave %v\n", got)
+	}
+	var flags, photoids string
+	dbh.QueryRow("SELECT EbcFlags,PhotoIDs FROM ebclaims WHERE rowid=?", rowid).Scan(&flags, &photoids)
+	if flags != flagFollowUpPhotos || len(strings.Split(photoids, ",")) != 2 {
+		t.Errorf("Claim now flagged %q with photos %q\n", flags, photoids)
+	}
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM ebcphotos WHERE EmailID=50 AND EntrantID=1 AND BonusID='A1'").Scan(&n)
+	if n != 2 {
+		t.Errorf("%v photos stored against the claim\n", n)
+	}
+	if got := attachFollowUpPhotos(52, "bob@example.com", "", now, []emailPhoto{jpg}); got != followUpWaiting {
+		t.Errorf("Claim with photos matched again, %v\n", got)
+	}
+}
+
+func TestOAuthRefresh(t *testing.T) {
+
+	useMemoryDB(t)
+
+	calls := 0
+	var gotRefresh string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		r.ParseForm()
+		gotRefresh = r.PostForm.Get("refresh_token")
+		fmt.Fprintf(w, `{"access_token":"a%v","expires_in":3600}`, calls)
+	}))
+	defer ts.Close()
+	cfg.ImapLogin, cfg.OAuthProvider, cfg.OAuthClientID = "hq@example.com", "google", "id"
+	cfg.OAuthTokenURL, cfg.OAuthRefreshToken = ts.URL, "r1"
+
+	if !oauthConfigured() {
+		t.Fatalf("OAuth not configured\n")
+	}
+	tok, err := oauthAccessToken()
+	if tok != "a1" || err != nil || gotRefresh != "r1" {
+		t.Fatalf("First token %v %v refreshed with %v\n", tok, err, gotRefresh)
+	}
+	if tok, _ = oauthAccessToken(); tok != "a1" || calls != 1 {
+		t.Errorf("Current token not reused, %v after %v calls\n", tok, calls)
+	}
+
+	// The stored refresh token is kept when a new one isn't issued
+	cfg.OAuthRefreshToken = ""
+	dbh.Exec("UPDATE ebcoauth SET Expiry=?", storeTimeDB(time.Now().Add(30*time.Second)))
+	if tok, _ = oauthAccessToken(); tok != "a2" || gotRefresh != "r1" {
+		t.Errorf("Expiring token refreshed as %v using %v\n", tok, gotRefresh)
+	}
+
+	mech, ir, _ := xoauth2{"hq@example.com", "a2"}.Start()
+	if mech != "XOAUTH2" || string(ir) != "user=hq@example.com\x01auth=Bearer a2\x01\x01" {
+		t.Errorf("XOAUTH2 starts %v %q\n", mech, ir)
+	}
+}
+
+func TestIdleWait(t *testing.T) {
+
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.IdlePollEvery = 0
+
+	if d := idleWait(10 * time.Second); d != 10*time.Second {
+		t.Errorf("Waiting %v when not idling\n", d)
+	}
+	atomic.StoreInt32(&idling, 1)
+	defer atomic.StoreInt32(&idling, 0)
+	if d := idleWait(10 * time.Second); d != defaultIdlePollEvery {
+		t.Errorf("Waiting %v while idling\n", d)
+	}
+	if d := idleWait(time.Hour); d != time.Hour {
+		t.Errorf("Waiting %v while idling with a long interval\n", d)
+	}
+
+	signalMail()
+	signalMail() // Only wakes once
+	start := time.Now()
+	waitForMail(time.Hour)
+	if time.Since(start) > time.Second {
+		t.Errorf("New mail didn't wake the loop\n")
+	}
+	atomic.StoreInt32(&idling, 0)
+	start = time.Now()
+	waitForMail(50 * time.Millisecond)
+	if time.Since(start) > time.Second {
+		t.Errorf("Stale signal or long wait\n")
+	}
+}
+
+func TestLogFile(t *testing.T) {
+
+	saved, savedSilent := cfg, *silent
+	defer func() { cfg, *silent = saved, savedSilent }()
+	dir := t.TempDir()
+	cfg.LogFile, cfg.LogFormat, cfg.LogLevel = filepath.Join(dir, "ebcfetch.log"), "json", "warn"
+	*silent = true
+
+	if err := startLogging(); err != nil {
+		t.Fatalf("Can't start logging %v\n", err)
+	}
+	fmt.Printf("%s claiming [ 1 A1 ]\n", logts())
+	fmt.Printf("%s can't store claim - locked\n", logts())
+	log.Println("Search: ERROR connection reset")
+	logAt(levelError, "can't write to database %v", "disk full")
+	stopLogging()
+	if *silent {
+		t.Errorf("Silent not restored to the console\n")
+	}
+
+	data, _ := os.ReadFile(cfg.LogFile)
+	var levels, msgs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e logEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Log line isn't JSON %v %q\n", err, line)
+		}
+		levels, msgs = append(levels, e.Level), append(msgs, e.Msg)
+	}
+	// What came by way of stdout may be logged after what didn't
+	sort.Strings(levels)
+	sort.Strings(msgs)
+	want := []string{"error", "error", "warn"}
+	if strings.Join(levels, ",") != strings.Join(want, ",") || msgs[1] != "can't store claim - locked" {
+		t.Errorf("Logged %v %q\n", levels, msgs)
+	}
+
+	rf, err := openRotatingFile(filepath.Join(dir, "r.log"), 1, 2)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	chunk := []byte(strings.Repeat("x", 700<<10))
+	for i := 0; i < 4; i++ {
+		rf.Write(chunk)
+	}
+	rf.Close()
+	for _, f := range []string{"r.log", "r.log.1", "r.log.2"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("No %v after rotation\n", f)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "r.log.3")); err == nil {
+		t.Errorf("Kept too many old logs\n")
+	}
+}
+
+func TestReprocessCriteria(t *testing.T) {
+
+	if _, err := reprocessCriteria("", ""); err == nil {
+		t.Errorf("No emails chosen but no error\n")
+	}
+	c, err := reprocessCriteria("1234-1300,17", "2025-07-01")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !c.Uid.Contains(1250) || !c.Uid.Contains(17) || c.Uid.Contains(1301) {
+		t.Errorf("UIDs chosen %v\n", c.Uid)
+	}
+	if c.Since.Format("2006-01-02") != "2025-07-01" {
+		t.Errorf("Since %v\n", c.Since)
+	}
+	if _, err := reprocessCriteria("x", ""); err == nil {
+		t.Errorf("Bad UIDs accepted\n")
+	}
+}
+
+func TestTrapEmail(t *testing.T) {
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+	cfg.TrapPath = t.TempDir()
+	raw := []byte("From: bob@example.com\r\nSubject: 1 A1 123 1200\r\n\r\nHello\r\n")
+
+	fn1, err := trapEmail(42, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn2, err := trapEmail(42, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fn1 == fn2 || !strings.Contains(filepath.Base(fn1), "-INBOX-42") {
+		t.Errorf("trapped as %v and %v\n", fn1, fn2)
+	}
+	if got, _ := os.ReadFile(fn2); !bytes.Equal(got, raw) {
+		t.Errorf("trapped %q\n", got)
+	}
+
+	emails, err := loadReplay(fn1)
+	if err != nil || len(emails) != 1 || !bytes.Equal(emails[0].Raw, raw) {
+		t.Errorf("replaying a file got %v %v\n", len(emails), err)
+	}
+	if emails, err = loadReplay(cfg.TrapPath); err != nil || len(emails) != 2 {
+		t.Errorf("replaying a folder got %v %v\n", len(emails), err)
+	}
+	if _, err = loadReplay(filepath.Join(cfg.TrapPath, "missing")); err == nil {
+		t.Error("replaying nothing succeeded")
+	}
+}
+
+func TestAlerts(t *testing.T) {
+
+	savedCfg, savedSend := cfg, alertSend
+	defer func() { cfg, alertSend = savedCfg, savedSend }()
+	var sent []string
+	alertSend = func(to, subject, body string) error {
+		sent = append(sent, to+" "+subject)
+		return nil
+	}
+	reset := func() {
+		alerts.mu.Lock()
+		alerts.last, alerts.imapFailures, alerts.dbFailures, alerts.lastClaim = make(map[string]time.Time), 0, 0, time.Time{}
+		alerts.mu.Unlock()
+		sent = nil
+	}
+	defer reset()
+	reset()
+
+	cfg.AdminAddresses, cfg.AlertAddresses = []string{"admin@example.com"}, nil
+	cfg.AlertImapFailures, cfg.AlertEvery = 0, 0
+	for i := 0; i < 5; i++ {
+		noteImapResult(fmt.Errorf("refused"))
+	}
+	if len(sent) != 1 || sent[0] != "admin@example.com "+apptitle+" alert: imap" {
+		t.Errorf("5 IMAP failures sent %v\n", sent)
+	}
+
+	reset()
+	cfg.AlertAddresses = []string{"a@example.com", "b@example.com"}
+	noteImapResult(fmt.Errorf("refused"))
+	noteImapResult(fmt.Errorf("refused"))
+	noteImapResult(nil)
+	noteImapResult(fmt.Errorf("refused"))
+	if len(sent) != 0 {
+		t.Errorf("intermittent IMAP failures sent %v\n", sent)
+	}
+	cfg.AlertImapFailures = -1
+	for i := 0; i < 5; i++ {
+		noteImapResult(fmt.Errorf("refused"))
+	}
+	if len(sent) != 0 {
+		t.Errorf("IMAP alerts turned off sent %v\n", sent)
+	}
+
+	now := time.Date(2025, 7, 5, 12, 0, 0, 0, time.UTC)
+	if !alertDue(alertDB, now) || alertDue(alertDB, now.Add(59*time.Minute)) || !alertDue(alertDB, now.Add(61*time.Minute)) {
+		t.Error("alerts aren't throttled to one an hour")
+	}
+
+	reset()
+	cfg.RallyStart, cfg.RallyFinish, cfg.TestMode = now.Add(-2*time.Hour), now.Add(6*time.Hour), false
+	cfg.AlertQuietFor = 45 * time.Minute
+	savedStarted := runStarted
+	defer func() { runStarted = savedStarted }()
+	runStarted = now.Add(-3 * time.Hour)
+	noteClaimArrived(now.Add(-30 * time.Minute))
+	if _, quiet := quietSince(now); quiet {
+		t.Error("quiet 30 minutes after a claim")
+	}
+	if since, quiet := quietSince(now.Add(20 * time.Minute)); !quiet || !since.Equal(now.Add(-30*time.Minute)) {
+		t.Errorf("not quiet 50 minutes after a claim, since %v\n", since)
+	}
+	if _, quiet := quietSince(now.Add(7 * time.Hour)); quiet {
+		t.Error("quiet after the rally finished")
+	}
+	runStarted = now.Add(-10 * time.Minute)
+	if _, quiet := quietSince(now.Add(20 * time.Minute)); quiet {
+		t.Error("quiet before I'd been running for AlertQuietFor")
+	}
+}
+
+func TestCheckSubject(t *testing.T) {
+
+	savedCfg := cfg
+	defer func() { cfg = savedCfg }()
+
+	for _, x := range []struct {
+		subject  string
+		subjects []string
+		bad      string
+	}{
+		{`^(\d+)\s+(\w+)`, nil, ""},
+		{`^(\d+`, nil, "subject"},
+		{`^(?P<entrant>\d+)\s+(?P<odometer>\d+)`, nil, "odometer"},
+		{`^(?P<entrant>\d+)\s+(?P<odo>\d+)`, nil, "no entrant or bonus"},
+		{`^(\d+)`, []string{`^(?P<bonus>\w+)\s+(?P<entrant>\d+)`, `[`}, "subjects[2]"},
+	} {
+		cfg.Subject, cfg.Subjects = x.subject, x.subjects
+		err := compileSubjects()
+		if (err == nil) != (x.bad == "") || (err != nil && !strings.Contains(err.Error(), x.bad)) {
+			t.Errorf("%v %v gave %v\n", x.subject, x.subjects, err)
+		}
+	}
+
+	cfg = savedCfg
+	cfg.SubjectRE = regexp.MustCompile(`^(\d+)\s+(\S+)\s+(\d+)\s+(\d{4})$`)
+	cfg.SubjectREs = []*regexp.Regexp{regexp.MustCompile(`^(?P<bonus>[A-Z]\d+)\s+(?P<entrant>\d+)\s+(?P<odo>\d+)\s+(?P<time>\d\d\d\d)`)}
+	var sb strings.Builder
+	explainSubject(&sb, "A1 1 10423 1713")
+	for _, want := range []string{"Matched  subjects[1]", `odo      "10423"`, "Valid    true", "Entrant  1\n", "Bonus    A1\n", "Time     17:13\n"} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("explanation lacks %q\n%v", want, sb.String())
+		}
+	}
+	sb.Reset()
+	explainSubject(&sb, "Hello from the road")
+	if !strings.Contains(sb.String(), "Valid    false") {
+		t.Errorf("explanation of a non-claim\n%v", sb.String())
+	}
+}
+
+func TestClaimsInBody(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.ClaimRateLimit, cfg.ClaimsInBody = 0, true
+	dbh.Exec("DELETE FROM ebclaims")
+	dbh.Exec("INSERT INTO bonuses (BonusID,BriefDesc,Points) VALUES('B2','Second bonus',10)")
+
+	email := func(id string, subject string, body string, photos ...string) rehearsalEmail {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "From: Bob Rider <bob@example.com>\r\nTo: claims@example.org\r\nSubject: %s\r\n", subject)
+		fmt.Fprintf(&sb, "Date: Sat, 01 Jun 2024 12:15:00 +0100\r\nMessage-ID: <%s@test>\r\n", id)
+		sb.WriteString("MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n")
+		fmt.Fprintf(&sb, "--b\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", body)
+		for i, fn := range photos {
+			fmt.Fprintf(&sb, "--b\r\nContent-Type: image/jpeg\r\nContent-Disposition: attachment; filename=%q\r\n", fn)
+			fmt.Fprintf(&sb, "Content-Transfer-Encoding: base64\r\n\r\n%s\r\n", base64.StdEncoding.EncodeToString(syntheticPhoto(i+1, 32)))
+		}
+		sb.WriteString("--b--\r\n")
+		return rehearsalEmail{Name: id, Raw: []byte(sb.String())}
+	}
+	emails := []rehearsalEmail{
+		email("batch", "Claims", "Sorry, no signal\r\n1 A1 10001 1013\r\n1 B2 10050 1100\r\n> 1 A1 9000 0900\r\nBob", "B2.jpg", "A1.jpg"),
+		email("single", "1 A1 10100 1130", "Tel 01234 567890", "IMG_1.jpg"),
+	}
+	claimed, dealtwith, ignored, skipped := replayEmails(emails, make([]time.Duration, len(emails)))
+	if !claimed.Contains(1) || dealtwith.Contains(1) || ignored.Contains(1) || skipped.Contains(1) || !claimed.Contains(2) {
+		t.Errorf("claimed %v rejected %v ignored %v retry %v\n", claimed, dealtwith, ignored, skipped)
+	}
+
+	rows, err := dbh.Query("SELECT EmailID,BonusID,OdoReading,PhotoIDs FROM ebclaims ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var uid, odo int
+		var bonus, photoids string
+		rows.Scan(&uid, &bonus, &odo, &photoids)
+		var names []string
+		for _, id := range strings.Split(photoids, ",") {
+			var img string
+			dbh.QueryRow("SELECT image FROM ebcphotos WHERE rowid=?", id).Scan(&img)
+			pic, _ := os.ReadFile(filepath.Join(cfg.Path2SM, img))
+			switch { // Which was attached is told by its pixels
+			case bytes.Equal(pic, syntheticPhoto(1, 32)):
+				names = append(names, "first")
+			case bytes.Equal(pic, syntheticPhoto(2, 32)):
+				names = append(names, "second")
+			default:
+				names = append(names, "?")
+			}
+		}
+		got = append(got, fmt.Sprintf("%v %v %v %v", uid, bonus, odo, strings.Join(names, ",")))
+	}
+	rows.Close()
+	want := []string{"1 A1 10001 second", "1 B2 10050 first", "2 A1 10100 first"}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("stored %v\n", got)
+	}
+
+	s1, s2, s3, s4 := new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet)
+	s1.AddNum(4, 5, 6)
+	s2.AddNum(5)
+	s3.AddNum(5, 7)
+	settleParts(5, s1, s2, s3, s4)
+	if s1.String() != "4,6" || s2.String() != "5" || s3.String() != "7" {
+		t.Errorf("settled as claimed %v rejected %v ignored %v\n", s1, s2, s3)
+	}
+}
+
+func TestCombos(t *testing.T) {
+
+	useMemoryDB(t)
+	if combos := combosContaining("A1"); combos != nil {
+		t.Errorf("Combos without a combinations table %v\n", combos)
+	}
+	dbh.Exec("CREATE TABLE combinations (ComboID TEXT, BriefDesc TEXT, ScoreMethod INTEGER, MinimumTicks INTEGER, ScorePoints TEXT, Bonuses TEXT)")
+	dbh.Exec("INSERT INTO combinations VALUES('C1','Coast to coast',0,0,'100','A1,b2, C3'),('C2','Any two',0,2,'50','A1,D4,E5')")
+
+	ci, ok := fetchCombo("c1")
+	if !ok || ci.String() != "C1 - Coast to coast" || ci.needs() != "A1, B2 and C3" {
+		t.Errorf("C1 is %+v %v needing %v\n", ci, ok, ci.needs())
+	}
+	if combos := combosContaining("a1"); len(combos) != 2 || combos[1].needs() != "any 2 of A1, D4 and E5" {
+		t.Errorf("A1 counts towards %+v\n", combos)
+	}
+
+	f4 := fourFields{ok: true, EntrantID: 1, BonusID: "C1", TimeOk: true}
+	_, body := testResponseHTML(testResponse{BonusID: "C1", IsCombo: true, Combo: ci}, &f4)
+	if !strings.Contains(body, "C1 - Coast to coast is a combination, scored once you've claimed A1, B2 and C3") {
+		t.Errorf("Combo claimed directly gave\n%v\n", body)
+	}
+	f4.BonusID = "A1"
+	_, body = testResponseHTML(testResponse{BonusID: "A1", BonusIsReal: true, BonusDesc: "Somewhere", Combos: combosContaining("A1")}, &f4)
+	if !strings.Contains(body, "Counts towards C2 - Any two, with any 2 of A1, D4 and E5") {
+		t.Errorf("Bonus in combos gave\n%v\n", body)
+	}
+}
+
+func TestInstanceLock(t *testing.T) {
+
+	useMemoryDB(t)
+
+	now := time.Now()
+	host, _ := os.Hostname()
+	if held, err := claimInstance(now); err != nil || held.PID != 0 {
+		t.Fatalf("First claim found %v %v\n", held, err)
+	}
+	if held, _ := claimInstance(now.Add(time.Minute)); held.PID != 0 {
+		t.Errorf("My own claim held by %v\n", held)
+	}
+
+	fresh := now.UTC().Format(time.RFC3339)
+	dbh.Exec("UPDATE ebcinstance SET PID=?,Host='laptop'", os.Getpid()+1)
+	if held, _ := claimInstance(now.Add(time.Minute)); held.PID != os.Getpid()+1 || held.Host != "laptop" {
+		t.Errorf("Another host's fresh claim not held, %v\n", held)
+	}
+	if held, _ := claimInstance(now.Add(time.Minute + instanceStale)); held.PID != 0 {
+		t.Errorf("Another host's stale claim held by %v\n", held)
+	}
+	var pid int
+	dbh.QueryRow("SELECT PID FROM ebcinstance").Scan(&pid)
+	if pid != os.Getpid() {
+		t.Errorf("Stale claim not taken over, PID %v\n", pid)
+	}
+
+	// A process which has gone doesn't hold it, one still running does
+	cmd := exec.Command("true")
+	cmd.Run()
+	dbh.Exec("UPDATE ebcinstance SET PID=?,Host=?,Heartbeat=?", cmd.Process.Pid, host, fresh)
+	if held, _ := claimInstance(now); held.PID != 0 {
+		t.Errorf("Claim of a finished process held by %v\n", held)
+	}
+	dbh.Exec("UPDATE ebcinstance SET PID=?,Host=?,Heartbeat=?", os.Getppid(), host, fresh)
+	if held, _ := claimInstance(now); held.PID != os.Getppid() {
+		t.Errorf("Claim of a running process not held, %v\n", held)
+	}
+
+	dbh.Exec("UPDATE ebcinstance SET PID=?,Host=?", os.Getpid(), host)
+	releaseInstance()
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM ebcinstance").Scan(&n)
+	if n != 0 {
+		t.Errorf("%v claims left after release\n", n)
+	}
+
+	// A lapsed claim is renewed by the heartbeat, unless someone else has taken it
+	if held := heartbeat(now); held.PID != 0 {
+		t.Errorf("Lapsed claim held by %v\n", held)
+	}
+	if held := heartbeat(now.Add(time.Minute)); held.PID != 0 {
+		t.Errorf("Heartbeat found my claim held by %v\n", held)
+	}
+	dbh.QueryRow("SELECT PID FROM ebcinstance").Scan(&pid)
+	if pid != os.Getpid() {
+		t.Errorf("Lapsed claim not renewed, PID %v\n", pid)
+	}
+	dbh.Exec("UPDATE ebcinstance SET PID=?,Host='laptop',Heartbeat=?", os.Getpid()+1, fresh)
+	if held := heartbeat(now.Add(time.Minute)); held.PID != os.Getpid()+1 {
+		t.Errorf("Heartbeat didn't notice the takeover, %v\n", held)
+	}
+}
+
+func TestStopRequested(t *testing.T) {
+
+	useMemoryDB(t)
+	savedStopping := stopping
+	defer func() { stopping = savedStopping }()
+	stopping = make(chan struct{})
+	if stopRequested() {
+		t.Error("Stopping before being asked")
+	}
+	close(stopping)
+	if !stopRequested() {
+		t.Error("Not stopping when asked")
+	}
+
+	// Emails fetched after I've been asked to stop are left for next time
+	claimed, dealtwith, ignored, skipped := replayEmails([]rehearsalEmail{{Name: "a", Raw: []byte("Subject: 1 A1 10001 1013\r\n\r\nHi\r\n")}}, make([]time.Duration, 1))
+	if !skipped.Contains(1) || !claimed.Empty() || !dealtwith.Empty() || !ignored.Empty() {
+		t.Errorf("After stopping claimed %v rejected %v ignored %v retry %v\n", claimed, dealtwith, ignored, skipped)
+	}
+}
+
+func TestSenderAuth(t *testing.T) {
+
+	savedCfg, savedLookup := cfg, dkimLookupTXT
+	defer func() { cfg, dkimLookupTXT = savedCfg, savedLookup }()
+	cfg.SenderAuthServers = []string{"mx.google.com", "mx.example.net"}
+
+	header := func(from string, ars ...string) mail.Header {
+		h := mail.Header{"From": {from}}
+		if len(ars) > 0 {
+			h["Authentication-Results"] = ars
+		}
+		return h
+	}
+	for i, x := range []struct {
+		h       mail.Header
+		checked bool
+		pass    bool
+		summary string
+	}{
+		{header("bob@example.com"), false, false, ""},
+		{header("Bob <bob@example.com>", "mx.google.com; dkim=pass header.i=@example.com header.s=x; spf=pass (google.com: domain of bob@example.com designates 1.2.3.4) smtp.mailfrom=bob@example.com"), true, true, "dkim=pass spf=pass"},
+		{header("bob@example.com", "mx.google.com; dkim=pass header.d=mail.example.com; spf=softfail smtp.mailfrom=x@elsewhere.net"), true, true, "dkim=pass spf=softfail"},
+		{header("bob@example.com", "mx.google.com; dkim=pass header.d=elsewhere.net; spf=pass smtp.mailfrom=x@elsewhere.net"), true, false, "dkim=pass spf=pass"},
+		{header("bob@example.com", "mx.google.com; dkim=none; spf=fail smtp.mailfrom=bob@example.com; dmarc=fail header.from=example.com"), true, false, "dkim=none spf=fail dmarc=fail"},
+		{header("bob@example.com", "mx.example.net; dmarc=pass header.from=example.com"), true, true, "dmarc=pass"},
+		// A forged header below the server's own isn't believed
+		{header("bob@example.com", "mx.google.com; spf=fail smtp.mailfrom=bob@example.com", "mx.google.com; dmarc=pass"), true, false, "spf=fail"},
+	} {
+		res := senderAuth(x.h, nil)
+		if res.Checked != x.checked || res.Pass != x.pass || res.Summary != x.summary {
+			t.Errorf("%v: got %+v\n", i, res)
+		}
+	}
+
+	cfg.SenderAuthServers = []string{"mx.rally.org"}
+	h := header("bob@example.com", "mx.evil.net; dmarc=pass", "mx.rally.org; dkim=fail header.d=example.com")
+	if res := senderAuth(h, nil); !res.Checked || res.Pass || res.authOk() != 0 {
+		t.Errorf("Trusted server's results gave %+v\n", res)
+	}
+	cfg.SenderAuthServers = []string{"mx.other.org"}
+	if res := senderAuth(h, nil); res.Checked || res.authOk() != nil {
+		t.Errorf("No trusted server gave %+v\n", res)
+	}
+	cfg.SenderAuthServers = nil
+	if res := senderAuth(header("bob@example.com", "mx.google.com; dmarc=pass"), nil); res.Checked || res.Pass {
+		t.Errorf("Untrusted header believed %+v\n", res)
+	}
+
+	// Signatures verified myself
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	dkimLookupTXT = func(name string) ([]string, error) {
+		if name != "sel._domainkey.example.com" {
+			return nil, fmt.Errorf("no such record %v", name)
+		}
+		return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	}
+	signed := func(from string, domain string) []byte {
+		email := []byte("From: " + from + "\r\nSubject: 1 A1 10001 1015\r\nDate: Sat, 01 Jun 2024 10:15:00 +0100\r\n\r\nHello\r\n")
+		opts := dkim.NewSigOptions()
+		opts.PrivateKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		opts.Domain, opts.Selector = domain, "sel"
+		opts.Headers = []string{"from", "subject", "date"}
+		if err := dkim.Sign(&email, opts); err != nil {
+			t.Fatal(err)
+		}
+		return email
+	}
+	good := signed("bob@example.com", "example.com")
+	if res := senderAuth(header("bob@example.com"), good); !res.Checked || !res.Pass || res.Summary != "verified-dkim=pass" {
+		t.Errorf("Good signature gave %+v\n", res)
+	}
+	forged := bytes.Replace(good, []byte("1 A1 10001 1015"), []byte("TESTMODE ON"), 1)
+	if res := senderAuth(header("bob@example.com"), forged); !res.Checked || res.Pass {
+		t.Errorf("Altered email gave %+v\n", res)
+	}
+	if res := senderAuth(header("eve@elsewhere.net"), signed("eve@elsewhere.net", "example.com")); !res.Checked || res.Pass {
+		t.Errorf("Signature by another domain gave %+v\n", res)
+	}
+}
+
+func TestPhotoSize(t *testing.T) {
+
+	useMemoryDB(t)
+
+	cfg.MaxAttachmentMB = 1
+	if _, err := readAttachment(bytes.NewReader(make([]byte, 1<<20+1))); err == nil {
+		t.Errorf("Oversize attachment read\n")
+	}
+	if data, err := readAttachment(bytes.NewReader(make([]byte, 1<<20))); err != nil || len(data) != 1<<20 {
+		t.Errorf("Attachment at the limit read as %v bytes %v\n", len(data), err)
+	}
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 400, 300)), nil)
+	tagged := exifJPEG(t, map[uint16]interface{}{exifTagModel: "Pixel 7"}, map[uint16]interface{}{})
+	pic := withExif(buf.Bytes(), exifSegment(tagged))
+
+	if _, ok := downscalePhoto(pic); ok {
+		t.Errorf("Photo shrunk with no MaxPhotoEdge\n")
+	}
+	cfg.MaxPhotoEdge, cfg.KeepOriginals = 100, true
+	photoid := writeImage(1, "A1", 90, pic, "big.jpg")
+	var img, camera, original string
+	var w, h int
+	dbh.QueryRow("SELECT image,Width,Height,CameraModel,Original FROM ebcphotos WHERE rowid=?", photoid).Scan(&img, &w, &h, &camera, &original)
+	if w != 100 || h != 75 || camera != "Pixel 7" {
+		t.Errorf("Shrunk photo recorded as %vx%v by %v\n", w, h, camera)
+	}
+	stored, _ := os.ReadFile(filepath.Join(cfg.Path2SM, img))
+	if ic, err := jpeg.DecodeConfig(bytes.NewReader(stored)); err != nil || ic.Width != 100 {
+		t.Errorf("Stored photo is %v wide %v\n", ic.Width, err)
+	}
+	if kept, _ := os.ReadFile(filepath.Join(cfg.Path2SM, original)); !bytes.Equal(kept, pic) {
+		t.Errorf("Original not kept as %v\n", original)
+	}
+	if !strings.HasPrefix(filepath.Base(original), "img-1-A1-") {
+		t.Errorf("Original kept under temporary name %v\n", original)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.ClaimRateLimit = 0
+
+	kinds := []struct {
+		p    emailPhoto
+		kind string
+	}{
+		{emailPhoto{Name: "receipt.pdf", ContentType: "application/octet-stream"}, attachmentPDF},
+		{emailPhoto{Name: "scan", Data: []byte("%PDF-1.4 ...")}, attachmentPDF},
+		{emailPhoto{Name: "rest.MOV", ContentType: "application/octet-stream"}, attachmentVideo},
+		{emailPhoto{Name: "clip", Data: []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00")}, attachmentVideo},
+		{emailPhoto{Name: "IMG_1.HEIC", Data: []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00")}, ""},
+		{emailPhoto{Name: "IMG_2.jpg", ContentType: "image/jpeg"}, ""},
+	}
+	for _, k := range kinds {
+		if kind := attachmentKind(k.p); kind != k.kind {
+			t.Errorf("%v is a %q, not a %q\n", k.p.Name, kind, k.kind)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("From: Bob Rider <bob@example.com>\r\nTo: claims@example.org\r\nSubject: 1 A1 10001 1013\r\n")
+	sb.WriteString("Date: Sat, 01 Jun 2024 12:15:00 +0100\r\nMessage-ID: <pdf@test>\r\n")
+	sb.WriteString("MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n")
+	sb.WriteString("--b\r\nContent-Type: text/plain\r\n\r\nReceipt attached\r\n")
+	fmt.Fprintf(&sb, "--b\r\nContent-Type: image/jpeg\r\nContent-Disposition: attachment; filename=\"IMG_1.jpg\"\r\nContent-Transfer-Encoding: base64\r\n\r\n%s\r\n",
+		base64.StdEncoding.EncodeToString(syntheticPhoto(1, 32)))
+	sb.WriteString("--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"receipt.pdf\"\r\n\r\n%PDF-1.4 receipt\r\n--b--\r\n")
+	claimed, _, _, _ := replayEmails([]rehearsalEmail{{Name: "pdf", Raw: []byte(sb.String())}}, []time.Duration{0})
+	if !claimed.Contains(1) {
+		t.Fatalf("Claim with a PDF not stored\n")
+	}
+	var photos, kind, path string
+	dbh.QueryRow("SELECT PhotoIDs FROM ebclaims WHERE EmailID=1").Scan(&photos)
+	dbh.QueryRow("SELECT Kind,Path FROM ebcattachments WHERE EmailID=1 AND BonusID='A1'").Scan(&kind, &path)
+	if strings.Contains(photos, ",") || kind != attachmentPDF || !strings.HasSuffix(path, ".pdf") {
+		t.Errorf("Stored photos %v and %v at %v\n", photos, kind, path)
+	}
+	if data, err := os.ReadFile(filepath.Join(cfg.Path2SM, path)); !strings.HasPrefix(string(data), "%PDF-") {
+		t.Errorf("PDF stored as %q %v\n", data, err)
+	}
+
+	tr := testResponse{Attachments: []string{describeAttachment(emailPhoto{Name: "receipt.pdf", Kind: attachmentPDF, Data: make([]byte, 2000)})}}
+	if _, html := testResponseHTML(tr, &fourFields{}); !strings.Contains(html, "PDF receipt.pdf (2KB)") {
+		t.Errorf("Test response doesn't list the PDF\n%v\n", html)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.ClaimRateLimit, cfg.Workers, cfg.MaxPhotoEdge = 0, 4, 16
+	dbh.Exec("DELETE FROM ebclaims")
+
+	rider := syntheticRider{EntrantID: 1, Email: "bob@example.com"}
+	at := time.Date(2024, 6, 1, 10, 0, 0, 0, time.Local)
+	var emails []rehearsalEmail
+	for i := 0; i < 12; i++ {
+		emails = append(emails, rehearsalEmail{Raw: syntheticClaim(i, rider, "A1", at.Add(time.Duration(i)*time.Minute), syntheticPhoto(i, 64))})
+	}
+	claimed, _, _, _ := replayEmails(emails, make([]time.Duration, len(emails)))
+	if seqSetLen(claimed) != len(emails) {
+		t.Fatalf("Only %v stored\n", claimed)
+	}
+	rows, err := dbh.Query("SELECT ebclaims.EmailID,ebcphotos.Width FROM ebclaims JOIN ebcphotos ON ebcphotos.rowid=ebclaims.PhotoIDs ORDER BY ebclaims.rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := 1
+	for rows.Next() {
+		var uid, width int
+		rows.Scan(&uid, &width)
+		if uid != want || width != 16 {
+			t.Errorf("Claim %v from email %v with a photo %v wide\n", want, uid, width)
+		}
+		want++
+	}
+}
+
+func TestDryRun(t *testing.T) {
+
+	useMemoryDB(t)
+	defer func() {
+		mailFolder = ""
+	}()
+
+	maildir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		os.MkdirAll(filepath.Join(maildir, sub), 0755)
+	}
+	os.WriteFile(filepath.Join(maildir, "new", "1717236900.M1P1.host"), syntheticClaim(1, syntheticRider{EntrantID: 1, Email: "bob@example.com"}, "A1", time.Now(), syntheticPhoto(1, 32)), 0644)
+	if !isMaildir(maildir) || isMaildir(filepath.Join(maildir, "new")) {
+		t.Errorf("Maildir not recognised\n")
+	}
+
+	out := filepath.Join(t.TempDir(), "responses")
+	if rc := runDryRun([]string{"-from", maildir, "-responses", out}); rc != 0 || !cfg.TestMode {
+		t.Fatalf("dryrun returned %v, test mode %v\n", rc, cfg.TestMode)
+	}
+	files, _ := filepath.Glob(filepath.Join(out, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Responses written %v\n", files)
+	}
+	if data, _ := os.ReadFile(files[0]); !strings.Contains(string(data), "To: bob@example.com") || !strings.Contains(string(data), "text/html") {
+		t.Errorf("Response written as\n%s\n", data)
+	}
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM ebclaims WHERE EntrantID=1 AND BonusID='A1' AND OdoReading=10001").Scan(&n)
+	if n != 0 {
+		t.Errorf("Claim stored in test mode\n")
+	}
+	if rc := runDryRun([]string{"-from", maildir, "-live"}); rc == 0 {
+		t.Errorf("-live allowed without -scratch\n")
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.ClaimRateLimit = 0
+	dbh.Exec("DELETE FROM ebcaudit")
+
+	at := time.Date(2024, 6, 1, 10, 13, 0, 0, time.Local)
+	emails := []rehearsalEmail{
+		{Raw: syntheticClaim(1, syntheticRider{EntrantID: 1, Email: "bob@example.com"}, "A1", at, syntheticPhoto(1, 32))},
+		{Raw: syntheticClaim(2, syntheticRider{EntrantID: 1, Email: "eve@example.net"}, "A1", at, syntheticPhoto(2, 32))},
+	}
+	replayEmails(emails, make([]time.Duration, len(emails)))
+
+	var got []string
+	for uid := uint32(1); uid <= 2; uid++ {
+		for _, a := range fetchAudit(uid, 0) {
+			got = append(got, fmt.Sprintf("%v %v", a.EmailID, a.Decision))
+		}
+	}
+	if strings.Join(got, ", ") != "1 claimed, 2 rejected" {
+		t.Errorf("Audit trail %v\n", got)
+	}
+	if all := fetchAudit(0, 0); len(all) != 2 || len(fetchAudit(0, all[0].RowID)) != 1 {
+		t.Errorf("Audit after rowid gave %v\n", all)
+	}
+	if st := fetchClaimStats(time.Now()); st.NotClaims[auditClaimed] != 0 || st.NotClaims[auditRejected] != 1 {
+		t.Errorf("Stats count %v as not claims\n", st.NotClaims)
+	}
+}
+
+func TestResponseTemplates(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.TestResponseGood, cfg.TestResponseSubject = "Looks good", ""
+
+	tr := testResponse{BonusID: "A1", BonusIsReal: true, BonusDesc: "Fish & chips", ValidEntrantID: true, ClaimIsGood: true}
+	f4 := fourFields{EntrantID: 1, ok: true, TimeOk: true, OdoOk: true}
+
+	subject, body := testResponseHTML(tr, &f4)
+	if subject != "EBC test: Looks good" || !strings.Contains(body, "Looks good") || !strings.Contains(body, "Fish &amp; chips") {
+		t.Errorf("Default response wrong %q %v\n", subject, body)
+	}
+
+	if _, err := dbh.Exec("ALTER TABLE entrants ADD COLUMN Language TEXT"); err != nil {
+		t.Fatalf("Can't add Language %v\n", err)
+	}
+	dbh.Exec("UPDATE entrants SET Language='DE' WHERE EntrantID=1")
+	dir := t.TempDir()
+	cfg.ResponseTemplateDir = dir
+	os.WriteFile(filepath.Join(dir, "testresponse.html"), []byte(`Hello {{.BonusDesc}}`), 0644)
+	cfg.ResponseTemplates = map[string]string{"de": `{{define "subject"}}Test: {{.BonusID}} & mehr{{end}}Hallo {{.BonusDesc}}{{yesno .Good}}`}
+
+	subject, body = testResponseHTML(tr, &f4)
+	if subject != "Test: A1 & mehr" || !strings.HasPrefix(body, "Hallo Fish &amp; chips") || !strings.Contains(body, ResponseStyleYes) {
+		t.Errorf("German response wrong %q %v\n", subject, body)
+	}
+
+	f4.EntrantID = 2
+	if _, body = testResponseHTML(tr, &f4); body != "Hello Fish &amp; chips" {
+		t.Errorf("Response from directory wrong %v\n", body)
+	}
+
+	cfg.ResponseTemplates[""] = `{{.NoSuchField}}`
+	if _, body = testResponseHTML(tr, &f4); !strings.Contains(body, "Looks good") {
+		t.Errorf("Broken template not replaced by mine %v\n", body)
+	}
+
+}
+
+func TestEmailMatching(t *testing.T) {
+
+	rules := []struct {
+		rule, from, registered string
+		match                  bool
+	}{
+		{matchExact, "Bob@Example.com", "bob@example.com", true},
+		{matchExact, "bob+ebc@example.com", "bob@example.com", false},
+		{matchAlias, "bob+ebc@example.com", "bob@example.com", true},
+		{matchAlias, "b.o.b@googlemail.com", "bob@gmail.com", true},
+		{matchAlias, "b.o.b@example.com", "bob@example.com", false},
+		{matchDomain, "anyone@inreach.example.com", "@inreach.example.com", true},
+		{matchDomain, "anyone@example.com", "@inreach.example.com", false},
+		{matchAccount, "bob@elsewhere.com", "bob@example.com", true},
+		{matchAccount, "bob@elsewhere.com", "@example.com", false},
+	}
+	for _, r := range rules {
+		if emailRuleMatches(r.rule, r.from, r.registered) != r.match {
+			t.Errorf("%v %v %v should be %v\n", r.rule, r.from, r.registered, r.match)
+		}
+	}
+
+	dbh.Exec("INSERT INTO entrant_emails (EntrantID,Email) VALUES(1,'@tracker.example.org')")
+	defer dbh.Exec("DELETE FROM entrant_emails WHERE Email='@tracker.example.org'")
+	save, saveRules := cfg.MatchEmail, cfg.EmailMatching
+	defer func() { cfg.MatchEmail, cfg.EmailMatching = save, saveRules }()
+	cfg.MatchEmail = true
+
+	if e := entrantsByEmail("bob+rally@example.com"); len(e) != 1 || e[0] != 1 {
+		t.Errorf("Alias not recognised %v\n", e)
+	}
+	if e := entrantsByEmail("bob@elsewhere.com"); len(e) != 0 {
+		t.Errorf("Stranger recognised by account %v\n", e)
+	}
+	if _, vea, matched := validateEntrant(fourFields{EntrantID: 1}, "Bob <unit7@tracker.example.org>"); !vea || matched != "@tracker.example.org (domain)" {
+		t.Errorf("Tracker domain not matched %v %v\n", vea, matched)
+	}
+	if _, vea, matched := validateEntrant(fourFields{EntrantID: 1}, "bob@example.com"); !vea || matched != "bob@example.com (exact)" {
+		t.Errorf("Exact address not matched %v %v\n", vea, matched)
+	}
+	cfg.EmailMatching = []string{matchExact}
+	if _, vea, _ := validateEntrant(fourFields{EntrantID: 1}, "bob+rally@example.com"); vea {
+		t.Errorf("Alias accepted with only exact matching\n")
+	}
+	if e := entrantsByEmail("bob+rally@example.com"); len(e) != 0 {
+		t.Errorf("Alias recognised with only exact matching %v\n", e)
+	}
+
+}
+
+func TestClaimSanity(t *testing.T) {
+
+	useMemoryDB(t)
+	cfg.ClaimRateLimit, cfg.MaxAvgSpeed = 0, 0
+	dbh.Exec("DELETE FROM ebclaims")
+
+	day := func(hh int) time.Time { return time.Date(2024, 6, 1, hh, 0, 0, 0, cfg.LocalTZ) }
+	cfg.RallyStart, cfg.RallyFinish = day(8), day(18)
+	dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,OdoReading,ClaimTime) VALUES(1,'ZZ1',20000,?)", storeTimeDB(day(9)))
+
+	checks := []struct {
+		at   time.Time
+		odo  int
+		want string
+	}{
+		{day(7), 100, flagBeforeStart},
+		{day(19), 30000, flagAfterFinish},
+		{day(10), 19999, flagOdoBackwards},
+		{day(10), 20001, ""},
+	}
+	for _, c := range checks {
+		var flags claimFlags
+		sanity := validateClaimSanity(fourFields{EntrantID: 1, ClaimTime: c.at, OdoReading: c.odo, OdoOk: true}, &flags)
+		if sanity.String() != c.want || flags.String() != c.want {
+			t.Errorf("%v odo %v flagged %v, not %v\n", c.at.Format(myTimeFormat), c.odo, sanity, c.want)
+		}
+	}
+
+	rider := syntheticRider{EntrantID: 1, Email: "bob@example.com"}
+	emails := []rehearsalEmail{{Name: "backwards", Raw: syntheticClaim(1, rider, "A1", day(10).Local(), syntheticPhoto(1, 16))}}
+	claimed, _, _, _ := replayEmails(emails, []time.Duration{0})
+	if !claimed.Contains(1) {
+		t.Fatalf("Impossible claim not stored\n")
+	}
+	var ebcflags, sanity string
+	dbh.QueryRow("SELECT EbcFlags,SanityFlags FROM ebclaims WHERE BonusID='A1'").Scan(&ebcflags, &sanity)
+	if sanity != flagOdoBackwards || !strings.Contains(ebcflags, flagOdoBackwards) {
+		t.Errorf("Stored flags %q, sanity %q\n", ebcflags, sanity)
+	}
+
+}
+
+func TestControlAPI(t *testing.T) {
+
+	saveToken, saveTM, saveAdmin := cfg.APIToken, cfg.TestMode, adminTestMode
+	defer func() { cfg.APIToken, cfg.TestMode, adminTestMode = saveToken, saveTM, saveAdmin }()
+
+	cfg.APIToken = "sesame"
+	mux := http.NewServeMux()
+	apiRoutes(mux)
+	call := func(method string, url string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var h apiHealth
+	rec := call("GET", "/api/health", "")
+	json.Unmarshal(rec.Body.Bytes(), &h)
+	if h.Version != appversion || h.Healthy != (rec.Code == http.StatusOK) {
+		t.Errorf("Health returned %v %v\n", rec.Code, rec.Body.String())
+	}
+
+	if rec = call("POST", "/api/testmode?on=true", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Test mode switched without token %v\n", rec.Code)
+	}
+	if rec = call("POST", "/api/testmode?on=maybe", "sesame"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Test mode accepted nonsense %v\n", rec.Code)
+	}
+	cfg.TestMode = false
+	var st apiState
+	rec = call("POST", "/api/testmode?on=true", "sesame")
+	json.Unmarshal(rec.Body.Bytes(), &st)
+	if cfg.TestMode || !st.TestMode {
+		t.Errorf("Test mode switched by the API's goroutine %v\n", rec.Body.String())
+	}
+	if !applyTestMode() || !cfg.TestMode || adminTestMode == nil || !*adminTestMode || applyTestMode() {
+		t.Errorf("Test mode not switched on by the main loop\n")
+	}
+
+	// Forms posted from other sites, and requests with neither token nor header
+	req := httptest.NewRequest("POST", "/api/pause", nil)
+	req.Header.Set("Authorization", "Bearer sesame")
+	req.Header.Set("Origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || isPaused() {
+		t.Errorf("Cross-site pause returned %v\n", rec.Code)
+	}
+	cfg.APIToken = ""
+	if rec = call("POST", "/api/pause", ""); rec.Code != http.StatusUnauthorized || isPaused() {
+		t.Errorf("Pause without %v returned %v\n", controlHeader, rec.Code)
+	}
+	req = httptest.NewRequest("POST", "/api/pause", nil)
+	req.Header.Set(controlHeader, "1")
+	req.Header.Set("Origin", "http://"+req.Host)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !isPaused() {
+		t.Errorf("Pause with %v returned %v\n", controlHeader, rec.Code)
+	}
+	paused = 0
+	cfg.APIToken = "sesame"
+
+	select {
+	case <-mailArrived:
+	default:
+	}
+	if rec = call("GET", "/api/fetch", "sesame"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Fetch by GET returned %v\n", rec.Code)
+	}
+	call("POST", "/api/fetch", "sesame")
+	select {
+	case <-mailArrived:
+	default:
+		t.Errorf("Fetch didn't wake the main loop\n")
+	}
+
+	for addr, want := range map[string]string{"8078": "127.0.0.1:8078", ":8078": "127.0.0.1:8078", "0.0.0.0:8078": "127.0.0.1:8078", "localhost:9": "localhost:9"} {
+		if got := controlListenAddr(addr); got != want {
+			t.Errorf("controlListenAddr(%v) = %v\n", addr, got)
+		}
+	}
+
+}
+
+// fakePOP3 serves the emails given over POP3, recording the commands it's sent.
+func fakePOP3(emails [][]byte, deleted map[int]bool) func(string, time.Duration) (net.Conn, error) {
+
+	return func(string, time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			r := bufio.NewReader(server)
+			fmt.Fprintf(server, "+OK ready\r\n")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				f := strings.Fields(line)
+				n := 0
+				if len(f) > 1 {
+					n, _ = strconv.Atoi(f[1])
+				}
+				switch strings.ToUpper(f[0]) {
+				case "UIDL":
+					fmt.Fprintf(server, "+OK\r\n")
+					for i := range emails {
+						if !deleted[i+1] {
+							fmt.Fprintf(server, "%d uid-%d\r\n", i+1, i+1)
+						}
+					}
+					fmt.Fprintf(server, ".\r\n")
+				case "RETR":
+					fmt.Fprintf(server, "+OK\r\n")
+					for _, l := range strings.SplitAfter(string(emails[n-1]), "\n") {
+						if strings.HasPrefix(l, ".") {
+							l = "." + l
+						}
+						server.Write([]byte(l))
+					}
+					fmt.Fprintf(server, "\r\n.\r\n")
+				case "DELE":
+					deleted[n] = true
+					fmt.Fprintf(server, "+OK\r\n")
+				case "QUIT":
+					fmt.Fprintf(server, "+OK bye\r\n")
+					return
+				default:
+					fmt.Fprintf(server, "+OK\r\n")
+				}
+			}
+		}()
+		return client, nil
+	}
+
+}
+
+func TestPOP3AndGraph(t *testing.T) {
+
+	useMemoryDB(t)
+	savedDial, savedToken := pop3Dial, graphToken
+	defer func() {
+		pop3Dial, graphToken = savedDial, savedToken
+		source = mailSource{Mailbox: "INBOX"}
+	}()
+	cfg.ClaimRateLimit = 0
+	dbh.Exec("DELETE FROM ebclaims")
+
+	rider := syntheticRider{EntrantID: 1, Email: "bob@example.com"}
+	at := time.Date(2024, 6, 1, 10, 0, 0, 0, time.Local)
+	junk := []byte("From: someone@example.net\r\nSubject: Cheap watches\r\nDate: Sat, 01 Jun 2024 10:00:00 +0100\r\n\r\nBuy now\r\n")
+	emails := [][]byte{syntheticClaim(1, rider, "A1", at, syntheticPhoto(1, 16)), junk}
+
+	// POP3, deleting the claim but leaving the junk for a human. The claim
+	// arrived when the topmost Received header says.
+	received := "Received: from mx.example.com by pop.example.com;\r\n\tSat, 01 Jun 2024 09:02:03 +0000 (UTC)\r\n" +
+		"Received: from phone by mx.example.com; Sat, 01 Jun 2024 09:01:00 +0000\r\n"
+	deleted := make(map[int]bool)
+	pop3Dial = fakePOP3([][]byte{append([]byte(received), emails[0]...), junk}, deleted)
+	cfg.MailProtocol, cfg.POP3Delete, cfg.Mailboxes = protocolPOP3, true, []string{"INBOX", "Other"}
+	if srcs := mailSources(); len(srcs) != 1 {
+		t.Errorf("POP3 account has %v mailboxes\n", len(srcs))
+	}
+	fetchAllClaims()
+	fetchAllClaims()
+	var n int
+	var final string
+	dbh.QueryRow("SELECT count(*),max(FinalTime) FROM ebclaims WHERE BonusID='A1' AND Source=?", cfg.ImapLogin+"/INBOX").Scan(&n, &final)
+	if n != 1 || !deleted[1] || deleted[2] {
+		t.Errorf("POP3 stored %v claims, deleted %v\n", n, deleted)
+	}
+	if want := storeTimeDB(time.Date(2024, 6, 1, 9, 2, 3, 0, time.UTC)); final != want {
+		t.Errorf("POP3 claim received at %v not %v\n", final, want)
+	}
+	if rcvd := receivedAt(junk); time.Since(rcvd) > time.Minute {
+		t.Errorf("Email without Received header received at %v\n", rcvd)
+	}
+
+	// Graph, marking the claim read and flagging the junk
+	cfg.MailProtocol, cfg.Mailboxes = protocolGraph, nil
+	dbh.Exec("DELETE FROM ebclaims")
+	graphToken = func() (string, error) { return "tok", nil }
+	patched := make(map[string]string)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "no", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/mailFolders/inbox/messages"):
+			fmt.Fprint(w, `{"value":[{"id":"m2","receivedDateTime":"2024-06-01T09:05:00Z"},{"id":"m1","receivedDateTime":"2024-06-01T09:01:00Z"}]}`)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/$value"):
+			if strings.Contains(r.URL.Path, "/m1/") {
+				w.Write(emails[0])
+			} else {
+				w.Write(emails[1])
+			}
+		case r.Method == http.MethodPatch:
+			b, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			patched[r.URL.Path] = string(b)
+			mu.Unlock()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	cfg.GraphURL = srv.URL
+	fetchAllClaims()
+	dbh.QueryRow("SELECT count(*) FROM ebclaims WHERE BonusID='A1'").Scan(&n)
+	if n != 1 || !strings.Contains(patched["/me/messages/m1"], `"isRead":true`) || !strings.Contains(patched["/me/messages/m2"], "flagged") {
+		t.Errorf("Graph stored %v claims, patched %v\n", n, patched)
+	}
+
+}
+
+func TestTestModeAnsweredOnce(t *testing.T) {
+
+	useMemoryDB(t)
+	savedDial := pop3Dial
+	defer func() {
+		pop3Dial, mailFolder = savedDial, ""
+		source = mailSource{Mailbox: "INBOX"}
+	}()
+	cfg.ClaimRateLimit, cfg.TestMode = 0, true
+	mailFolder = t.TempDir()
+
+	rider := syntheticRider{EntrantID: 1, Email: "bob@example.com"}
+	emails := [][]byte{syntheticClaim(1, rider, "A1", time.Date(2024, 6, 1, 10, 0, 0, 0, time.Local), syntheticPhoto(1, 16))}
+	pop3Dial = fakePOP3(emails, make(map[int]bool))
+	cfg.MailProtocol = protocolPOP3
+	fetchAllClaims()
+	fetchAllClaims()
+	files, _ := filepath.Glob(filepath.Join(mailFolder, "*.eml"))
+	if len(files) != 1 {
+		t.Errorf("%v test responses sent to one email\n", len(files))
+	}
+	var state int
+	dbh.QueryRow("SELECT State FROM ebcremotemail WHERE RemoteID='uid-1'").Scan(&state)
+	if state != mailIgnored {
+		t.Errorf("Test email left in state %v\n", state)
+	}
+
+}
+
+func TestClaimedUIDSource(t *testing.T) {
+
+	useMemoryDB(t)
+	dbh.Exec("DELETE FROM ebclaims")
+
+	inbox := mailSource{Mailbox: "INBOX"}.Name()
+	for uid, src := range map[int]interface{}{7: inbox, 8: nil, 9: cfg.ImapLogin + "/Other", 10: "extra@example.com/INBOX"} {
+		if _, err := dbh.Exec("INSERT INTO ebclaims (EmailID,EntrantID,BonusID,Source) VALUES(?,1,'A1',?)", uid, src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for uid, want := range map[uint32]bool{7: true, 8: true, 9: false, 10: false, 11: false} {
+		if got := claimedUID(uid); got != want {
+			t.Errorf("claimedUID(%v) = %v\n", uid, got)
+		}
+	}
+
+}
+
+func TestReparseKeeps(t *testing.T) {
+
+	useMemoryDB(t)
+	dbh.Exec("INSERT INTO entrants (EntrantID,RiderName,Email,PillionOf) VALUES(91,'Alice','alice@example.com',1)")
+
+	sent := time.Date(2024, 6, 1, 10, 20, 0, 0, time.Local)
+	exif := storeTimeDB(time.Date(2024, 6, 1, 9, 58, 0, 0, time.Local))
+	f4, ok := reparseClaim(storedClaim{EntrantID: 1, Subject: "91 A1 10001 1015", DateTime: sent.Format(time.RFC3339)})
+	if !ok || f4.EntrantID != 1 {
+		t.Errorf("Pillion's claim reparsed as entrant %v\n", f4.EntrantID)
+	}
+	f4, ok = reparseClaim(storedClaim{EntrantID: 1, Subject: "91 A1 10001 1015", DateTime: sent.Format(time.RFC3339), ClaimTime: exif, Flags: flagPillion + "," + flagExifTime})
+	if !ok || storeTimeDB(f4.ClaimTime) != exif {
+		t.Errorf("EXIF claim time replaced by %v\n", f4.ClaimTime)
+	}
+	if f4, ok = reparseClaim(storedClaim{EntrantID: 1, Subject: "Zebedee A1 10001 1015", DateTime: sent.Format(time.RFC3339)}); !ok || f4.EntrantID != 1 {
+		t.Errorf("Entrant from the sender lost, now %v\n", f4.EntrantID)
+	}
+
+}
+
+func TestImpliedSpeed(t *testing.T) {
+
+	at := time.Date(2024, 6, 1, 10, 0, 0, 0, time.Local)
+	if spd := impliedSpeed(10000, at, 10030, at); spd != 1800 {
+		t.Errorf("30 miles in no time is %v mph\n", spd)
+	}
+	if spd := impliedSpeed(10000, at, 10000, at.Add(20*time.Second)); spd != 0 {
+		t.Errorf("Standing still is %v mph\n", spd)
+	}
+	if spd := impliedSpeed(10000, at, 10060, at.Add(time.Hour)); spd != 60 {
+		t.Errorf("60 miles in an hour is %v mph\n", spd)
+	}
+
+	useMemoryDB(t)
+	cfg.MaxAvgSpeed = 100
+	dbh.Exec("DELETE FROM ebclaims")
+	dbh.Exec("INSERT INTO ebclaims (EntrantID,BonusID,OdoReading,ClaimTime) VALUES(1,'A1',10000,?)", storeTimeDB(at))
+
+	var flags claimFlags
+	validateAvgSpeed(fourFields{EntrantID: 1, BonusID: "A2", OdoReading: 10000, OdoOk: true, ClaimTime: at}, &flags)
+	if flags.has(flagSpeed) {
+		t.Errorf("Two bonuses claimed together flagged\n")
+	}
+	validateAvgSpeed(fourFields{EntrantID: 1, BonusID: "A2", OdoReading: 10300, OdoOk: true, ClaimTime: at}, &flags)
+	if !flags.has(flagSpeed) {
+		t.Errorf("300 miles in no time not flagged\n")
+	}
+
+}
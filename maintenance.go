@@ -0,0 +1,116 @@
+package main
+
+/*
+ * Housekeeping routines, run as subcommands, eg:- ebcfetch -db x.db gc -dryrun
+ *
+ */
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Images younger than this are left alone as their claim may still be being stored
+const gcMinAge = time.Hour
+
+var imageFileRE = regexp.MustCompile(`^img-\d+-.+-(\d+)\.\w+$`)
+
+// referencedPhotoIDs returns the ids of photos belonging to a stored claim
+// together with the image paths recorded for them.
+func referencedPhotoIDs() (map[int]bool, map[string]bool, error) {
+
+	ids := make(map[int]bool)
+	images := make(map[string]bool)
+	sqlx := "SELECT ebcphotos.rowid,IfNull(ebcphotos.image,'') FROM ebcphotos"
+	sqlx += " WHERE EXISTS (SELECT 1 FROM ebclaims WHERE ebclaims.EmailID=ebcphotos.EmailID"
+	sqlx += " AND ebclaims.EntrantID=ebcphotos.EntrantID AND ebclaims.BonusID=ebcphotos.BonusID)"
+	rows, err := dbh.Query(sqlx)
+	if err != nil {
+		return ids, images, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var img string
+		rows.Scan(&id, &img)
+		ids[id] = true
+		images[filepath.Base(img)] = true
+	}
+	return ids, images, nil
+
+}
+
+// orphanImages lists image files not belonging to any stored claim.
+func orphanImages() ([]string, error) {
+
+	var res []string
+	ids, images, err := referencedPhotoIDs()
+	if err != nil {
+		return res, err
+	}
+	dir := filepath.Join(cfg.Path2SM, cfg.ImageFolder)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return res, err
+	}
+	for _, f := range files {
+		if f.IsDir() || images[f.Name()] {
+			continue
+		}
+		m := imageFileRE.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue // Not one of mine
+		}
+		id, _ := strconv.Atoi(m[1])
+		if ids[id] {
+			continue // HEIC original of a converted image
+		}
+		info, err := f.Info()
+		if err != nil || time.Since(info.ModTime()) < gcMinAge {
+			continue
+		}
+		res = append(res, filepath.Join(dir, f.Name()))
+	}
+	return res, nil
+
+}
+
+// runGC removes orphaned images, or just lists them.
+func runGC(args []string) int {
+
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryrun := fs.Bool("dryrun", false, "List orphaned images without deleting them")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	orphans, err := orphanImages()
+	if err != nil {
+		fmt.Printf("%s: gc failed %v\n", apptitle, err)
+		return 1
+	}
+	for _, f := range orphans {
+		if *dryrun {
+			fmt.Println(f)
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			fmt.Printf("%s: can't remove %v %v\n", apptitle, f, err)
+		} else if *verbose {
+			fmt.Printf("%s: removed %v\n", apptitle, f)
+		}
+	}
+	if !*silent {
+		verb := "removed"
+		if *dryrun {
+			verb = "found"
+		}
+		fmt.Printf("%s: %v %v orphaned images\n", apptitle, verb, len(orphans))
+	}
+	return 0
+
+}
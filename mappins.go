@@ -0,0 +1,113 @@
+package main
+
+/*
+ * Riders sometimes paste a map pin into the claim, a Google Maps, Waze or
+ * Apple Maps link or a geo: URI, to show where they were. I take the
+ * coordinates from the first such link in the body, store them with the
+ * claim as PinLatitude and PinLongitude and, if the bonus has its own
+ * Latitude and Longitude, flag whether the pin is within cfg.MapPinMetres
+ * of it. Shortened links, maps.app.goo.gl and the like, don't contain the
+ * coordinates and are ignored.
+ *
+ */
+
+import (
+	"database/sql"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultMapPinMetres = 500
+
+var mapLinkRE = regexp.MustCompile(`(?i)(?:https?://(?:www\.)?(?:google\.[a-z.]+/maps|maps\.google\.[a-z.]+|(?:[a-z]+\.)?waze\.com|maps\.apple\.com)[^\s"'<>]*|geo:-?\d[^\s"'<>]*)`)
+
+// mapCoordREs find the coordinates in a map link, most precise first.
+var mapCoordREs = []*regexp.Regexp{
+	regexp.MustCompile(`!3d(-?\d+\.\d+)!4d(-?\d+\.\d+)`),
+	regexp.MustCompile(`[?&](?:q|query|ll|daddr|destination)=(?:loc:)?(-?\d+\.\d+)(?:,|%2C)\s*(-?\d+\.\d+)`),
+	regexp.MustCompile(`to=ll\.(-?\d+\.\d+)(?:,|%2C)(-?\d+\.\d+)`),
+	regexp.MustCompile(`/@(-?\d+\.\d+),(-?\d+\.\d+)`),
+	regexp.MustCompile(`^geo:(-?\d+\.\d+),(-?\d+\.\d+)`),
+}
+
+// mapPin finds the coordinates of the first map link in text.
+func mapPin(text string) (float64, float64, bool) {
+
+	for _, link := range mapLinkRE.FindAllString(text, -1) {
+		link = strings.ReplaceAll(link, "&amp;", "&")
+		for _, re := range mapCoordREs {
+			m := re.FindStringSubmatch(link)
+			if m == nil {
+				continue
+			}
+			lat, _ := strconv.ParseFloat(m[1], 64)
+			lon, _ := strconv.ParseFloat(m[2], 64)
+			if math.Abs(lat) <= 90 && math.Abs(lon) <= 180 {
+				return lat, lon, true
+			}
+		}
+	}
+	return 0, 0, false
+
+}
+
+// distanceMetres is the great circle distance between two points.
+func distanceMetres(lat1, lon1, lat2, lon2 float64) float64 {
+
+	const earthRadius = 6371000
+	rad := math.Pi / 180
+	dlat, dlon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+
+}
+
+// bonusCoordinates returns the bonus's own location, if it has one.
+func bonusCoordinates(bonus string) (float64, float64, bool) {
+
+	if !hasColumn("bonuses", "Latitude") || !hasColumn("bonuses", "Longitude") {
+		return 0, 0, false
+	}
+	var lat, lon float64
+	sqlx := "SELECT IfNull(" + col("bonuses", "Latitude") + ",0),IfNull(" + col("bonuses", "Longitude") + ",0)"
+	sqlx += " FROM bonuses WHERE " + col("bonuses", "BonusID") + "=?"
+	if dbh.QueryRow(sqlx, bonus).Scan(&lat, &lon) != nil {
+		return 0, 0, false
+	}
+	return lat, lon, lat != 0 || lon != 0
+
+}
+
+// checkMapPin looks for a map pin in the email and compares it with the
+// bonus's location, returning the pin's coordinates if there is one.
+func checkMapPin(m Email, bonus string, flags *claimFlags) ([2]float64, bool) {
+
+	lat, lon, ok := mapPin(m.TextBody + "\n" + m.HTMLBody)
+	if !ok {
+		return [2]float64{}, false
+	}
+	blat, blon, ok := bonusCoordinates(bonus)
+	if ok {
+		tolerance := cfg.MapPinMetres
+		if tolerance < 1 {
+			tolerance = defaultMapPinMetres
+		}
+		if distanceMetres(lat, lon, blat, blon) <= float64(tolerance) {
+			flags.add(flagMapPinOk)
+		} else {
+			flags.add(flagMapPinFar)
+		}
+	}
+	return [2]float64{lat, lon}, true
+
+}
+
+// storeMapPin records the map pin sent with a claim.
+func storeMapPin(tx *sql.Tx, rowid int64, pin [2]float64) error {
+
+	_, err := tx.Exec("UPDATE ebclaims SET PinLatitude=?,PinLongitude=? WHERE rowid=?", pin[0], pin[1], rowid)
+	return err
+
+}
@@ -0,0 +1,99 @@
+package main
+
+/*
+ * Searching the INBOX every cycle is wasteful when nothing has happened
+ * since the last look. If the server supports CONDSTORE (QRESYNC implies it)
+ * every change to the mailbox, new messages and flag changes alike, bumps
+ * its HIGHESTMODSEQ, so I ask for that first and skip the SEARCH when it,
+ * the UIDVALIDITY and the fetch window are all as they were after the last
+ * cycle which left nothing outstanding.
+ *
+ * The sync point is only kept in memory and is forgotten whenever anything
+ * goes wrong, so after a restart or a failed cycle the next one always does
+ * a full SEARCH and picks up whatever state the flags are really in.
+ *
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+// syncPoint identifies the state of the INBOX as seen at the start of a cycle.
+type syncPoint struct {
+	Validity  uint32
+	ModSeq    uint64
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// lastSync is the sync point of the last cycle which left nothing to do,
+// for each source.
+var lastSync = make(map[string]syncPoint)
+
+// highestModSeq extracts HIGHESTMODSEQ from a STATUS response.
+func highestModSeq(mbox *imap.MailboxStatus) (uint64, bool) {
+
+	f, ok := mbox.Items[statusHighestModSeq]
+	if !ok || f == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(fmt.Sprint(f), 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return n, true
+
+}
+
+// currentSync returns the INBOX's present sync point or false if the
+// server can't tell me.
+func currentSync(c *client.Client, notBefore, notAfter time.Time) (syncPoint, bool) {
+
+	var sp syncPoint
+	if ok, _ := c.Support("CONDSTORE"); !ok {
+		if ok, _ = c.Support("QRESYNC"); !ok {
+			return sp, false
+		}
+	}
+	mbox, err := c.Status(source.Mailbox, []imap.StatusItem{imap.StatusUidValidity, statusHighestModSeq})
+	if err != nil {
+		if debugging(debugIMAP) {
+			fmt.Printf("%s STATUS HIGHESTMODSEQ: %v\n", logts(), err)
+		}
+		return sp, false
+	}
+	modseq, ok := highestModSeq(mbox)
+	if !ok {
+		return sp, false
+	}
+	sp = syncPoint{Validity: mbox.UidValidity, ModSeq: modseq, NotBefore: notBefore, NotAfter: notAfter}
+	return sp, true
+
+}
+
+// unchangedSince reports whether the INBOX is known not to have changed
+// since a cycle which left nothing outstanding.
+func unchangedSince(sp syncPoint) bool {
+
+	last := lastSync[source.key()]
+	return last.ModSeq != 0 && sp == last
+
+}
+
+// settleSync records the sync point of a cycle, forgetting it if the cycle
+// left anything to be retried.
+func settleSync(sp syncPoint, clean bool) {
+
+	if !clean {
+		sp = syncPoint{}
+	}
+	lastSync[source.key()] = sp
+
+}
@@ -0,0 +1,106 @@
+package main
+
+/*
+ * Riders out of signal save their claims up and send them together, one
+ * per line of the body:-
+ *
+ *		Subject: Claims
+ *
+ *		12 A4 10423 1432
+ *		12 B7 10488 1519
+ *
+ * With ClaimsInBody set, each line of the body which parses as a claim for
+ * a real bonus, and the Subject too if it is one, becomes a claim of its
+ * own going through everything a claim sent alone would. Quoted lines,
+ * starting with ">", are left alone. Photos are shared out by assignPhotos:
+ * those named for a bonus go with its claim and any others are paired off
+ * in order or, failing that, shared by all of them.
+ *
+ * The email as a whole is left for retry if any of its claims were, flagged
+ * for attention if any were rejected, and otherwise marked as claimed.
+ *
+ */
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// isClaimLine reports whether a line of the body is a claim in its own right.
+func isClaimLine(f4 *fourFields) bool {
+	return f4.ok && f4.TimeOk && knownBonus(f4.BonusID)
+}
+
+// claimParts splits an email into one per claim it carries, each with the
+// claim as its Subject, returning the bonus each is for. An email which
+// isn't carrying claims in its body comes back as it was.
+func claimParts(m Email) ([]Email, []string) {
+
+	whole := func() ([]Email, []string) { return []Email{m}, []string{""} }
+	if !cfg.ClaimsInBody {
+		return whole()
+	}
+	var lines, bonuses []string
+	add := func(line string) bool {
+		f4 := parseSubject(line, false)
+		if !isClaimLine(f4) || containsFold(lines, line) {
+			return false
+		}
+		lines, bonuses = append(lines, line), append(bonuses, f4.BonusID)
+		return true
+	}
+	add(strings.TrimSpace(m.Subject))
+	inBody := 0
+	for _, line := range strings.Split(m.TextBody, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ">") {
+			continue
+		}
+		if add(line) {
+			inBody++
+		}
+	}
+	if inBody == 0 {
+		return whole()
+	}
+	res := make([]Email, len(lines))
+	for i, line := range lines {
+		res[i] = m
+		res[i].Subject = line
+	}
+	return res, bonuses
+
+}
+
+// removeNum takes a UID out of a set.
+func removeNum(s *imap.SeqSet, uid uint32) {
+
+	if !s.Contains(uid) {
+		return
+	}
+	nums := seqSetNums(s)
+	s.Clear()
+	for _, n := range nums {
+		if n != uid {
+			s.AddNum(n)
+		}
+	}
+
+}
+
+// settleParts leaves an email carrying several claims in just one of the
+// sets, whichever matters most of those its claims ended up in.
+func settleParts(uid uint32, claimed, dealtwith, ignored, skipped *imap.SeqSet) {
+
+	sets := []*imap.SeqSet{skipped, dealtwith, claimed, ignored} // Most important first
+	found := false
+	for _, s := range sets {
+		if found {
+			removeNum(s, uid)
+		} else {
+			found = s.Contains(uid)
+		}
+	}
+
+}
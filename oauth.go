@@ -0,0 +1,255 @@
+package main
+
+/*
+ * Google Workspace and Microsoft 365 increasingly refuse plain logins, even
+ * with app passwords, so the IMAP account may instead be reached using
+ * OAuth2 and the XOAUTH2 mechanism. With cfg.OAuthProvider set to google or
+ * microsoft, and cfg.OAuthClientID (and cfg.OAuthClientSecret if the app
+ * registration has one), run once:-
+ *
+ *		ebcfetch oauth
+ *
+ * which shows a code to be entered at the provider's web page by whoever
+ * owns the mailbox. The tokens granted are kept in ebcoauth and the access
+ * token is refreshed as it expires. A refresh token obtained some other way
+ * can be given as cfg.OAuthRefreshToken instead. For other providers the
+ * endpoints and scope are given by cfg.OAuthDeviceURL, cfg.OAuthTokenURL and
+ * cfg.OAuthScope.
+ *
+ * This is for IMAP, or Graph, see graph.go, only, responses are still sent
+ * using SmtpStuff.
+ *
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Refresh tokens this long before they expire
+const oauthExpiryMargin = time.Minute
+
+type oauthEndpoints struct {
+	DeviceURL string
+	TokenURL  string
+	Scope     string
+}
+
+var oauthProviders = map[string]oauthEndpoints{
+	"google": {
+		DeviceURL: "https://oauth2.googleapis.com/device/code",
+		TokenURL:  "https://oauth2.googleapis.com/token",
+		Scope:     "https://mail.google.com/",
+	},
+	"microsoft": {
+		DeviceURL: "https://login.microsoftonline.com/{tenant}/oauth2/v2.0/devicecode",
+		TokenURL:  "https://login.microsoftonline.com/{tenant}/oauth2/v2.0/token",
+		Scope:     "https://outlook.office.com/IMAP.AccessAsUser.All offline_access",
+	},
+}
+
+var oauthMutex sync.Mutex
+
+// oauthConfigured reports whether IMAP logins use OAuth2.
+func oauthConfigured() bool {
+	return cfg.OAuthProvider != "" && cfg.OAuthClientID != ""
+}
+
+// oauthEndpointsFor returns the provider's endpoints, with any overrides.
+func oauthEndpointsFor() oauthEndpoints {
+
+	ep := oauthProviders[strings.ToLower(cfg.OAuthProvider)]
+	if cfg.OAuthDeviceURL != "" {
+		ep.DeviceURL = cfg.OAuthDeviceURL
+	}
+	if cfg.OAuthTokenURL != "" {
+		ep.TokenURL = cfg.OAuthTokenURL
+	}
+	if cfg.OAuthScope != "" {
+		ep.Scope = cfg.OAuthScope
+	} else if !mainIsIMAP() {
+		ep.Scope = graphScope
+	}
+	tenant := cfg.OAuthTenant
+	if tenant == "" {
+		tenant = "common"
+	}
+	ep.DeviceURL = strings.ReplaceAll(ep.DeviceURL, "{tenant}", tenant)
+	ep.TokenURL = strings.ReplaceAll(ep.TokenURL, "{tenant}", tenant)
+	return ep
+
+}
+
+// oauthToken is what a token endpoint returns.
+type oauthToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+// oauthPost posts a form to an endpoint and decodes the JSON reply.
+func oauthPost(endpoint string, form url.Values, res interface{}) error {
+
+	if endpoint == "" {
+		return fmt.Errorf("no endpoint for OAuthProvider %v", cfg.OAuthProvider)
+	}
+	client := &http.Client{Timeout: imapTimeout()}
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("%v %v", resp.Status, err)
+	}
+	return nil
+
+}
+
+// storeOAuthToken keeps the tokens granted, holding onto the refresh token
+// if a new one wasn't issued.
+func storeOAuthToken(tok oauthToken, refresh string) error {
+
+	if tok.RefreshToken != "" {
+		refresh = tok.RefreshToken
+	}
+	expiry := time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	_, err := dbExec("INSERT OR REPLACE INTO ebcoauth (Login,AccessToken,RefreshToken,Expiry) VALUES(?,?,?,?)",
+		cfg.ImapLogin, tok.AccessToken, refresh, storeTimeDB(expiry))
+	return err
+
+}
+
+// oauthAccessToken returns a current access token, refreshing it if need be.
+func oauthAccessToken() (string, error) {
+
+	oauthMutex.Lock()
+	defer oauthMutex.Unlock()
+
+	var access, refresh, expiry string
+	dbh.QueryRow("SELECT IfNull(AccessToken,''),IfNull(RefreshToken,''),IfNull(Expiry,'') FROM ebcoauth WHERE Login=?", cfg.ImapLogin).Scan(&access, &refresh, &expiry)
+	if t, err := time.Parse(timefmt, expiry); err == nil && access != "" && time.Until(t) > oauthExpiryMargin {
+		return access, nil
+	}
+	if refresh == "" {
+		refresh = cfg.OAuthRefreshToken
+	}
+	if refresh == "" {
+		return "", fmt.Errorf("no OAuth2 token for %v, run ebcfetch oauth", cfg.ImapLogin)
+	}
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}, "client_id": {cfg.OAuthClientID}}
+	if cfg.OAuthClientSecret != "" {
+		form.Set("client_secret", cfg.OAuthClientSecret)
+	}
+	var tok oauthToken
+	if err := oauthPost(oauthEndpointsFor().TokenURL, form, &tok); err != nil {
+		return "", err
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("can't refresh token %v %v", tok.Error, tok.ErrorDesc)
+	}
+	if err := storeOAuthToken(tok, refresh); err != nil {
+		return "", err
+	}
+	if debugging(debugIMAP) {
+		fmt.Printf("%s OAuth2 token refreshed, expires in %vs\n", logts(), tok.ExpiresIn)
+	}
+	return tok.AccessToken, nil
+
+}
+
+// xoauth2 is the SASL XOAUTH2 mechanism used by Gmail and Office 365.
+type xoauth2 struct {
+	user  string
+	token string
+}
+
+func (x xoauth2) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + x.user + "\x01auth=Bearer " + x.token + "\x01\x01"), nil
+}
+
+// Next answers the server's error challenge, which is JSON describing the
+// failure, with an empty response so that it goes on to say NO.
+func (x xoauth2) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// deviceCode is what a device authorization endpoint returns.
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	VerificationURL string `json:"verification_url"` // Google's name for it
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+	Error           string `json:"error"`
+	ErrorDesc       string `json:"error_description"`
+}
+
+// runOAuth is the oauth subcommand, the device code flow.
+func runOAuth(args []string) int {
+
+	if !oauthConfigured() {
+		fmt.Printf("%s: set OAuthProvider and OAuthClientID first\n", apptitle)
+		return 1
+	}
+	ep := oauthEndpointsFor()
+	var dc deviceCode
+	err := oauthPost(ep.DeviceURL, url.Values{"client_id": {cfg.OAuthClientID}, "scope": {ep.Scope}}, &dc)
+	if err == nil && dc.DeviceCode == "" {
+		err = fmt.Errorf("%v %v", dc.Error, dc.ErrorDesc)
+	}
+	if err != nil {
+		fmt.Printf("%s: can't start authorization %v\n", apptitle, err)
+		return 1
+	}
+	if dc.VerificationURI == "" {
+		dc.VerificationURI = dc.VerificationURL
+	}
+	fmt.Printf("%s: signed in as %v, visit %v and enter the code %v\n", apptitle, cfg.ImapLogin, dc.VerificationURI, dc.UserCode)
+
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval < time.Second {
+		interval = 5 * time.Second
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:device_code"}, "device_code": {dc.DeviceCode}, "client_id": {cfg.OAuthClientID}}
+	if cfg.OAuthClientSecret != "" {
+		form.Set("client_secret", cfg.OAuthClientSecret)
+	}
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		var tok oauthToken
+		if err := oauthPost(ep.TokenURL, form, &tok); err != nil {
+			fmt.Printf("%s: %v\n", apptitle, err)
+			return 1
+		}
+		switch tok.Error {
+		case "":
+			if err := storeOAuthToken(tok, ""); err != nil {
+				fmt.Printf("%s: can't store token %v\n", apptitle, err)
+				return 1
+			}
+			fmt.Printf("%s: authorized, IMAP logins for %v will use OAuth2\n", apptitle, cfg.ImapLogin)
+			return 0
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			fmt.Printf("%s: not authorized %v %v\n", apptitle, tok.Error, tok.ErrorDesc)
+			return 1
+		}
+	}
+	fmt.Printf("%s: the code has expired, run oauth again\n", apptitle)
+	return 1
+
+}
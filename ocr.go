@@ -0,0 +1,112 @@
+package main
+
+/*
+ * Where a rally requires a photo of the odometer with each claim, I can ask
+ * an external OCR utility, tesseract for example, to read the first image
+ * and see whether the claimed odo reading appears in it. The result is only
+ * a hint for the scorer, OCR of dashboards is far from perfect.
+ *
+ * The command is called as:- OCRCommand imagefile stdout
+ * and is expected to write whatever text it recognises to stdout.
+ *
+ */
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ocrNumberRE = regexp.MustCompile(`\d[\d\s.,]*\d|\d`)
+
+// ocrMinOdoDigits is the shortest reading I'll look for amongst other digits
+const ocrMinOdoDigits = 4
+
+// runImageCommand writes an image to a temporary file and returns what the
+// command writes to stdout when given the filename, followed by any extra args.
+func runImageCommand(command string, pic []byte, filename string, args ...string) ([]byte, error) {
+
+	ext := contentImageExt(pic, filename)
+	if ext == "" {
+		ext = ".jpg"
+	}
+	tmp, err := os.CreateTemp("", "ebcocr-*"+ext)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Write(pic)
+	tmp.Close()
+
+	cmd := strings.Fields(command)
+	if len(cmd) < 1 {
+		return nil, fmt.Errorf("no command")
+	}
+	cmd = append(append(cmd, tmp.Name()), args...)
+	return exec.Command(cmd[0], cmd[1:]...).Output()
+
+}
+
+// ocrNumbers runs the configured OCR utility over an image and returns
+// any numbers it recognised, with embedded spaces and separators removed.
+func ocrNumbers(pic []byte, filename string) ([]string, error) {
+
+	out, err := runImageCommand(cfg.OCRCommand, pic, filename, "stdout")
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, n := range ocrNumberRE.FindAllString(string(out), -1) {
+		n = strings.NewReplacer(" ", "", "\n", "", "\t", "", ".", "", ",", "").Replace(n)
+		res = append(res, n)
+	}
+	return res, nil
+
+}
+
+// odoShown reports whether a number read from a photo is the claimed odo
+// reading. OCR runs the odometer into whatever's beside it and the tenths
+// into the reading, so a reading long enough not to turn up by chance may
+// also end the number or be followed by a single digit.
+func odoShown(n string, claimed string) bool {
+
+	n = strings.TrimLeft(n, "0")
+	if n == claimed {
+		return true
+	}
+	if len(claimed) < ocrMinOdoDigits {
+		return false
+	}
+	return strings.HasSuffix(n, claimed) || (len(n) == len(claimed)+1 && strings.HasPrefix(n, claimed))
+
+}
+
+// checkOdoPhoto compares the claimed odo reading with what OCR finds in the photo.
+func checkOdoPhoto(pic []byte, filename string, odo int, flags *claimFlags) {
+
+	nums, err := ocrNumbers(pic, filename)
+	if err != nil {
+		if !*silent {
+			fmt.Printf("%s OCR %v failed %v\n", logts(), cfg.OCRCommand, err)
+		}
+		return
+	}
+	if len(nums) == 0 {
+		return
+	}
+	claimed := strconv.Itoa(odo)
+	for _, n := range nums {
+		if odoShown(n, claimed) {
+			flags.add(flagOdoPhotoOk)
+			return
+		}
+	}
+	if *verbose {
+		fmt.Printf("%s OCR found %v, claimed odo %v\n", logts(), nums, claimed)
+	}
+	flags.add(flagOdoPhotoMismatch)
+
+}
@@ -0,0 +1,84 @@
+package main
+
+/*
+ * Riders send their start and finish odometer readings using the claim
+ * format they already know, with a reserved code in place of the bonus:
+ *
+ *		12 ODOSTART 10423 0800
+ *
+ * These are written to the entrant's record rather than becoming claims.
+ * The codes can be changed with cfg.OdoStartCode and cfg.OdoEndCode.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScoreMaster's entrant columns for the odo readings
+const (
+	odoStartColumn  = "OdoRallyStart"
+	odoFinishColumn = "OdoRallyFinish"
+)
+
+// odoCodeColumn returns the entrants column set by a reserved bonus code, or "".
+func odoCodeColumn(bonus string) string {
+
+	start, end := cfg.OdoStartCode, cfg.OdoEndCode
+	if start == "" {
+		start = "ODOSTART"
+	}
+	if end == "" {
+		end = "ODOEND"
+	}
+	switch {
+	case strings.EqualFold(bonus, start):
+		return odoStartColumn
+	case strings.EqualFold(bonus, end):
+		return odoFinishColumn
+	}
+	return ""
+
+}
+
+// recordOdo stores an odo reading in the entrant's record.
+func recordOdo(entrant int, column string, odo int) error {
+
+	if !hasColumn("entrants", column) {
+		return fmt.Errorf("entrants has no %v column", column)
+	}
+	res, err := dbExec("UPDATE entrants SET "+col("entrants", column)+"=? WHERE "+col("entrants", "EntrantID")+"=?", odo, entrant)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n < 1 {
+		return fmt.Errorf("no entrant %v", entrant)
+	}
+	return nil
+
+}
+
+// handleOdoCode deals with an odo reading, reporting whether it was stored.
+func handleOdoCode(emailid uint32, from string, f4 fourFields, column string) bool {
+
+	if !f4.OdoOk {
+		writeAudit(emailid, from, f4.BonusID, auditRejected, "odo code without a reading")
+		return false
+	}
+	if cfg.TestMode {
+		sendPlainMail(from, "EBC test: "+f4.BonusID, fmt.Sprintf("In a live rally %v would now be recorded as %v for entrant %v.", f4.OdoReading, column, f4.EntrantID))
+		return true
+	}
+	if err := recordOdo(f4.EntrantID, column, f4.OdoReading); err != nil {
+		fmt.Printf("%s can't record %v for entrant %v %v\n", logts(), column, f4.EntrantID, err)
+		writeAudit(emailid, from, f4.BonusID, auditRejected, err.Error())
+		return false
+	}
+	if !*silent {
+		fmt.Printf("%s entrant %v %v=%v\n", logts(), f4.EntrantID, column, f4.OdoReading)
+	}
+	writeAudit(emailid, from, f4.BonusID, auditOdo, fmt.Sprintf("%v=%v", column, f4.OdoReading))
+	return true
+
+}
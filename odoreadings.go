@@ -0,0 +1,48 @@
+package main
+
+/*
+ * Riders on continental rallies write 10.423 for ten thousand four hundred
+ * and twenty three and 10,4 for ten point four; everyone else the other way
+ * round. cfg.RallyPointIsComma, named as in Chasm's configuration, says
+ * which. Thousands must be grouped properly or the reading is marked as
+ * not ok. A unit, "12345km", "12345 mi" and the like, may follow.
+ *
+ * ScoreMaster keeps odo readings as whole numbers so any fraction is
+ * dropped from OdoReading. The reading with its fraction is stored in
+ * ebclaims.OdoValue and the text as typed in OdoText.
+ *
+ */
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// odoUnitRE matches a unit following the reading.
+var odoUnitRE = regexp.MustCompile(`(?i)\s*(?:mi|miles|km|kms)\.?$`)
+
+// odoValue interprets an odo reading as typed by the rider, keeping any fraction.
+func odoValue(s string) (float64, bool) {
+
+	point, thousands := ".", ","
+	if cfg.RallyPointIsComma {
+		point, thousands = ",", "."
+	}
+	re := regexp.MustCompile(`^(\d+|\d{1,3}(?:` + regexp.QuoteMeta(thousands) + `\d{3})+)(?:` + regexp.QuoteMeta(point) + `(\d*))?$`)
+	x := re.FindStringSubmatch(odoUnitRE.ReplaceAllString(strings.TrimSpace(s), ""))
+	if x == nil {
+		return 0, false
+	}
+	res, err := strconv.ParseFloat(strings.ReplaceAll(x[1], thousands, "")+"."+x[2]+"0", 64)
+	return res, err == nil
+
+}
+
+// odoReading interprets an odo reading as typed by the rider, as a whole number.
+func odoReading(s string) (int, bool) {
+
+	v, ok := odoValue(s)
+	return int(v), ok
+
+}
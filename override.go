@@ -0,0 +1,41 @@
+package main
+
+/*
+ * The rallymaster sometimes needs to enter a claim on a rider's behalf, one
+ * phoned in to HQ for instance. Sending
+ *
+ *		OVERRIDE 12 A4 10423 1713 secret=xyz
+ *
+ * from any address, with cfg.OverrideSecret as the secret, puts the claim
+ * through the normal pipeline as if it came from the entrant but flags it
+ * as an organiser entry. Overrides are disabled unless a secret is set.
+ *
+ */
+
+import (
+	"crypto/subtle"
+	"regexp"
+	"strings"
+)
+
+var overrideRE = regexp.MustCompile(`(?i)^\s*OVERRIDE\s+(.*)$`)
+var overrideSecretRE = regexp.MustCompile(`(?i)\s*\bsecret=(\S+)`)
+
+// parseOverride recognises an override claim, returning the claim itself
+// with the keyword and secret removed and whether the secret was correct.
+func parseOverride(subject string) (claim string, isOverride bool, secretOk bool) {
+
+	x := overrideRE.FindStringSubmatch(subject)
+	if x == nil {
+		return subject, false, false
+	}
+	claim = x[1]
+	s := overrideSecretRE.FindStringSubmatch(claim)
+	if s == nil {
+		return strings.TrimSpace(claim), true, false
+	}
+	claim = strings.TrimSpace(overrideSecretRE.ReplaceAllString(claim, ""))
+	secretOk = cfg.OverrideSecret != "" && subtle.ConstantTimeCompare([]byte(s[1]), []byte(cfg.OverrideSecret)) == 1
+	return claim, true, secretOk
+
+}
@@ -0,0 +1,98 @@
+package main
+
+/*
+ * Pointed at an old mailbox with thousands of unprocessed emails the first
+ * cycle would try to fetch the lot at once. Instead I take them a page of
+ * cfg.FetchPageSize at a time, oldest first, and note in ebcpaging the UID
+ * I got up to so that the next cycle, even after a restart, carries on from
+ * there. When I reach the end I start again from the beginning so emails
+ * left unflagged, because they're to be retried, still get another go.
+ *
+ * The cursor is only moved once the page's emails have been dealt with and
+ * flagged, and then only past those I finished with. If I'm stopped, or
+ * crash, part way through a page the next run starts with the first email
+ * I didn't get to rather than relying on it still being unread. The cursor
+ * belongs to the mailbox's UIDVALIDITY, if that changes I start afresh.
+ *
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/emersion/go-imap"
+)
+
+const defaultFetchPageSize = 500
+
+// fetchPageSize is the most emails to fetch in one cycle, 0 for no limit.
+func fetchPageSize() int {
+
+	switch {
+	case cfg.FetchPageSize < 0:
+		return 0
+	case cfg.FetchPageSize == 0:
+		return defaultFetchPageSize
+	}
+	return cfg.FetchPageSize
+
+}
+
+// pageCursor returns the UID the last page finished at, 0 if none.
+func pageCursor() uint32 {
+
+	var uid uint32
+	dbh.QueryRow("SELECT LastUid FROM ebcpaging WHERE UidValidity=? AND IfNull(Source,'')=?", inboxValidity, source.key()).Scan(&uid)
+	return uid
+
+}
+
+func savePageCursor(uid uint32) {
+
+	dbWriteTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM ebcpaging WHERE IfNull(Source,'')=?", source.key()); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO ebcpaging (UidValidity,LastUid,Source) VALUES(?,?,?)", inboxValidity, uid, source.key())
+		return err
+	})
+
+}
+
+// fetchPage picks the UIDs to fetch this cycle from those found, returning
+// true if some have been left for later.
+func fetchPage(uids []uint32) ([]uint32, bool) {
+
+	size := fetchPageSize()
+	if size == 0 || len(uids) <= size {
+		return uids, false
+	}
+	sorted := append([]uint32(nil), uids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	last := pageCursor()
+	i := sort.Search(len(sorted), func(i int) bool { return sorted[i] > last })
+	page := append(sorted[i:], sorted[:i]...)[:size]
+	if !*silent {
+		fmt.Printf("%s %v emails waiting, taking %v from UID %v\n", logts(), len(uids), size, page[0])
+	}
+	return page, true
+
+}
+
+// pageDone moves the cursor past the emails at the start of the page which
+// were finished with, stopping at the first which wasn't.
+func pageDone(page []uint32, unfinished *imap.SeqSet) {
+
+	var last uint32
+	for _, uid := range page {
+		if unfinished.Contains(uid) {
+			break
+		}
+		last = uid
+	}
+	if last != 0 {
+		savePageCursor(last)
+	}
+
+}
@@ -22,6 +22,8 @@ import (
 	"net/mail"
 	"strings"
 	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 const contentTypeMultipartMixed = "multipart/mixed"
@@ -74,7 +76,7 @@ func Parse(r io.Reader) (email Email, err error) {
 	default:
 		email.Content, err = decodeContent(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
 
-		sendAlertToBob(fmt.Sprintf("EBCFetch: ParseMail defaulting - ContentType is %v  \r\n\r\n  From: %v  \r\n\r\n  Subject: %v\n\n", contentType, email.From, email.Subject))
+		raiseAlert(alertParse, fmt.Sprintf("ParseMail defaulting - ContentType is %v\n\nFrom: %v\n\nSubject: %v\n", contentType, email.From, email.Subject))
 
 	}
 
@@ -418,25 +420,24 @@ func parseMultipartMixed(msg io.Reader, boundary string) (textBody, htmlBody str
 	return textBody, htmlBody, attachments, embeddedFiles, err
 }
 
+// decodeMimeSentence decodes RFC 2047 encoded-words in a header. Riders'
+// phones use all sorts of charsets so anything the WHATWG knows is accepted;
+// if it still can't be decoded the header is returned as it came.
 func decodeMimeSentence(s string) string {
-	result := []string{}
-	ss := strings.Split(s, " ")
-
-	for _, word := range ss {
-		dec := new(mime.WordDecoder)
-		w, err := dec.Decode(word)
-		if err != nil {
-			if len(result) == 0 {
-				w = word
-			} else {
-				w = " " + word
-			}
-		}
-
-		result = append(result, w)
+	dec := mime.WordDecoder{CharsetReader: charsetReader}
+	res, err := dec.DecodeHeader(s)
+	if err != nil {
+		return s
 	}
+	return res
+}
 
-	return strings.Join(result, "")
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
 }
 
 func decodeHeaderMime(header mail.Header) (mail.Header, error) {
@@ -503,15 +504,14 @@ func decodeContent(content io.Reader, encoding string) (io.Reader, error) {
 		}
 
 		return bytes.NewReader(b), nil
-	case "7bit":
+	case "7bit", "":
+		// Read now, the part can't be read once the next one is reached
 		dd, err := io.ReadAll(content)
 		if err != nil {
 			return nil, err
 		}
 
 		return bytes.NewReader(dd), nil
-	case "":
-		return content, nil
 	default:
 		return nil, fmt.Errorf("unknown encoding: %s", encoding)
 	}
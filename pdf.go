@@ -0,0 +1,176 @@
+package main
+
+/*
+ * Just enough PDF to print claim receipts: A4 pages carrying lines of
+ * Helvetica text and JPG photos. JPGs are embedded as they are, PDF
+ * understands them natively, so nothing needs decoding beyond the size.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"strings"
+)
+
+const (
+	pdfPageWidth  = 595 // A4 in points
+	pdfPageHeight = 842
+	pdfMargin     = 40
+	pdfFontSize   = 11
+	pdfLeading    = 15
+)
+
+type pdfDoc struct {
+	objs  [][]byte // Object 1 is the catalog, 2 the page tree and 3 the font
+	pages []int
+	page  *bytes.Buffer // Content of the current page
+	xobjs []int         // Images used on the current page
+	y     float64       // Next free line, down from the top
+}
+
+func newPDF() *pdfDoc {
+
+	d := &pdfDoc{}
+	d.add("<< /Type /Catalog /Pages 2 0 R >>")
+	d.add("") // Pages, filled in when finished
+	d.add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	d.newPage()
+	return d
+
+}
+
+func (d *pdfDoc) add(obj string) int {
+
+	d.objs = append(d.objs, []byte(obj))
+	return len(d.objs)
+
+}
+
+func (d *pdfDoc) endPage() {
+
+	if d.page == nil {
+		return
+	}
+	content := d.page.String()
+	cid := d.add(fmt.Sprintf("<< /Length %v >>\nstream\n%v\nendstream", len(content), content))
+	var res strings.Builder
+	for i, x := range d.xobjs {
+		fmt.Fprintf(&res, " /Im%v %v 0 R", i+1, x)
+	}
+	pid := d.add(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %v %v] /Contents %v 0 R /Resources << /Font << /F1 3 0 R >> /XObject <<%v >> >> >>",
+		pdfPageWidth, pdfPageHeight, cid, res.String()))
+	d.pages = append(d.pages, pid)
+	d.page = nil
+
+}
+
+func (d *pdfDoc) newPage() {
+
+	d.endPage()
+	d.page = &bytes.Buffer{}
+	d.xobjs = nil
+	d.y = pdfPageHeight - pdfMargin
+
+}
+
+// pdfString escapes text for use in a content stream, dropping what Helvetica can't show.
+func pdfString(s string) string {
+
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		case r >= 32 && r < 127:
+			sb.WriteRune(r)
+		case r >= 160 && r < 256:
+			fmt.Fprintf(&sb, "\\%03o", r)
+		default:
+			sb.WriteRune('?')
+		}
+	}
+	return sb.String()
+
+}
+
+// text adds a line of text.
+func (d *pdfDoc) text(s string) {
+
+	if d.y-pdfLeading < pdfMargin {
+		d.newPage()
+	}
+	d.y -= pdfLeading
+	fmt.Fprintf(d.page, "BT /F1 %v Tf %v %.1f Td (%v) Tj ET\n", pdfFontSize, pdfMargin, d.y, pdfString(s))
+
+}
+
+// jpeg adds a JPG scaled to fit the page width and maxHeight.
+func (d *pdfDoc) jpeg(pic []byte, maxHeight float64) error {
+
+	ic, format, err := image.DecodeConfig(bytes.NewReader(pic))
+	if err != nil {
+		return err
+	}
+	if format != "jpeg" {
+		return fmt.Errorf("%v isn't a JPG", format)
+	}
+	cs := "/DeviceRGB"
+	switch ic.ColorModel {
+	case color.GrayModel:
+		cs = "/DeviceGray"
+	case color.CMYKModel:
+		cs = "/DeviceCMYK"
+	}
+	w := float64(pdfPageWidth - 2*pdfMargin)
+	h := w * float64(ic.Height) / float64(ic.Width)
+	if h > maxHeight {
+		w, h = w*maxHeight/h, maxHeight
+	}
+	if d.y-h-pdfLeading < pdfMargin {
+		d.newPage()
+	}
+	var obj bytes.Buffer
+	fmt.Fprintf(&obj, "<< /Type /XObject /Subtype /Image /Width %v /Height %v /ColorSpace %v /BitsPerComponent 8 /Filter /DCTDecode /Length %v >>\nstream\n",
+		ic.Width, ic.Height, cs, len(pic))
+	obj.Write(pic)
+	obj.WriteString("\nendstream")
+	d.xobjs = append(d.xobjs, d.add(obj.String()))
+	d.y -= h + pdfLeading/2
+	fmt.Fprintf(d.page, "q %.1f 0 0 %.1f %v %.1f cm /Im%v Do Q\n", w, h, pdfMargin, d.y, len(d.xobjs))
+	return nil
+
+}
+
+// bytes finishes the document.
+func (d *pdfDoc) bytes() []byte {
+
+	d.endPage()
+	var kids []string
+	for _, p := range d.pages {
+		kids = append(kids, fmt.Sprintf("%v 0 R", p))
+	}
+	d.objs[1] = []byte(fmt.Sprintf("<< /Type /Pages /Kids [%v] /Count %v >>", strings.Join(kids, " "), len(d.pages)))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(d.objs))
+	for i, obj := range d.objs {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%v 0 obj\n", i+1)
+		out.Write(obj)
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %v\n0000000000 65535 f \n", len(d.objs)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %v /Root 1 0 R >>\nstartxref\n%v\n%%%%EOF\n", len(d.objs)+1, xref)
+	return out.Bytes()
+
+}
@@ -0,0 +1,343 @@
+package main
+
+/*
+ * I gather the photos from an email, attached or embedded, into a single
+ * list so that they can be vetted before being counted and stored.
+ *
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// emailPhoto is an image found in an email
+type emailPhoto struct {
+	Name               string // Filename, used to guess timestamps
+	Filename           string // Filename or Content-Disposition, passed to writeImage
+	ContentType        string
+	ContentDisposition string
+	Embedded           bool
+	Data               []byte
+	Hash               string // SHA-256 of Data
+	SourceURL          string // Link the photo was downloaded from
+	Err                error  // Error reading the image data
+	Kind               string // attachmentPDF, attachmentVideo or "" for a photo
+	Prepared           []byte // JPG ready to store, converted or shrunk in advance
+}
+
+// defaultIgnoreImageTypes are content types which are never claim photos
+var defaultIgnoreImageTypes = []string{"image/gif", "image/x-icon", "image/vnd.microsoft.icon", "image/svg+xml"}
+
+// extractPhotos returns the photos attached to, embedded in or linked from
+// an email, omitting signature logos, emojis and the like. Some clients include the
+// same photo both as an attachment and as an embedded CID part, so
+// duplicates are collapsed leaving the attachment.
+func extractPhotos(m Email, emailid uint32) []emailPhoto {
+
+	var res []emailPhoto
+	for _, a := range m.Attachments {
+		p := emailPhoto{Name: a.Filename, Filename: a.Filename, ContentType: a.ContentType, ContentDisposition: a.ContentDisposition}
+		p.Data, p.Err = readAttachment(a.Data)
+		res = appendPhoto(res, p)
+	}
+	for _, a := range m.EmbeddedFiles {
+		p := emailPhoto{Name: nameFromContentType(a.ContentType), Filename: a.ContentDisposition, ContentType: a.ContentType, ContentDisposition: a.ContentDisposition, Embedded: true}
+		p.Data, p.Err = readAttachment(a.Data)
+		res = appendPhoto(res, p)
+	}
+	for _, p := range linkedPhotos(m, emailid) {
+		res = appendPhoto(res, p)
+	}
+	return res
+
+}
+
+func appendPhoto(photos []emailPhoto, p emailPhoto) []emailPhoto {
+
+	if p.Err == nil {
+		p.Kind = attachmentKind(p)
+		if trivial, why := isTrivialImage(p.Data, p.ContentType); trivial && p.Kind == "" {
+			if debugging(debugPhotos) {
+				fmt.Printf("%s ignoring image %v (%v)\n", logts(), p.Name, why)
+			}
+			return photos
+		}
+		sum := sha256.Sum256(p.Data)
+		p.Hash = hex.EncodeToString(sum[:])
+		for _, x := range photos {
+			if x.Hash == p.Hash {
+				if debugging(debugPhotos) {
+					fmt.Printf("%s ignoring duplicate image %v\n", logts(), p.Name)
+				}
+				return photos
+			}
+		}
+	}
+	return append(photos, p)
+
+}
+
+// isTrivialImage identifies images too small, or of the wrong type, to be claim photos.
+func isTrivialImage(pic []byte, contentType string) (bool, string) {
+
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	ignore := cfg.IgnoreImageTypes
+	if ignore == nil {
+		ignore = defaultIgnoreImageTypes
+	}
+	for _, t := range ignore {
+		if strings.EqualFold(ct, t) {
+			return true, ct
+		}
+	}
+	if cfg.MinPhotoBytes > 0 && len(pic) < cfg.MinPhotoBytes {
+		return true, fmt.Sprintf("%v bytes", len(pic))
+	}
+	if cfg.MinPhotoPixels > 0 {
+		ic, _, err := image.DecodeConfig(bytes.NewReader(pic))
+		if err == nil && (ic.Width < cfg.MinPhotoPixels || ic.Height < cfg.MinPhotoPixels) {
+			return true, fmt.Sprintf("%vx%v", ic.Width, ic.Height)
+		}
+	}
+	return false, ""
+
+}
+
+// assignPhotos decides which photos belong to which claim when an email
+// carries more than one claim. A photo whose filename contains a claim's
+// bonus code belongs to that claim. Any others are paired in filename
+// order with the claims still lacking photos if the numbers match up,
+// otherwise they're shared by every claim. The result holds, for each
+// bonus, the indexes of its photos.
+func assignPhotos(bonuses []string, photos []emailPhoto) [][]int {
+
+	res := make([][]int, len(bonuses))
+	if len(bonuses) == 1 {
+		for i := range photos {
+			res[0] = append(res[0], i)
+		}
+		return res
+	}
+
+	var spare []int
+	for i, p := range photos {
+		matched := false
+		for c, b := range bonuses {
+			if b != "" && nameHasBonus(p.Name, b) {
+				res[c] = append(res[c], i)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			spare = append(spare, i)
+		}
+	}
+	if len(spare) == 0 {
+		return res
+	}
+
+	var needy []int
+	for c := range bonuses {
+		if len(res[c]) == 0 {
+			needy = append(needy, c)
+		}
+	}
+	if len(needy) == len(spare) {
+		sort.SliceStable(spare, func(i, j int) bool { return photos[spare[i]].Name < photos[spare[j]].Name })
+		for n, c := range needy {
+			res[c] = append(res[c], spare[n])
+		}
+		return res
+	}
+	for c := range bonuses {
+		res[c] = append(res[c], spare...)
+	}
+	return res
+
+}
+
+// nameHasBonus checks for a bonus code appearing as a word within a filename.
+func nameHasBonus(name string, bonus string) bool {
+
+	re := regexp.MustCompile(`(?i)(^|[^a-z0-9])` + regexp.QuoteMeta(bonus) + `($|[^a-z0-9])`)
+	return re.MatchString(name)
+
+}
+
+// photoDetails summarises an image for ebcphotos: its size, the camera
+// which took it and when. Screenshots and downloads usually lack the last two.
+func photoDetails(pic []byte) (width int, height int, camera string, taken time.Time) {
+
+	ic, _, err := image.DecodeConfig(bytes.NewReader(pic))
+	if err == nil {
+		width, height = ic.Width, ic.Height
+	}
+	ex, ok := readExif(pic)
+	if !ok {
+		return
+	}
+	if width == 0 {
+		width, height = ex.Width, ex.Height
+	}
+	camera = ex.Model
+	if ex.Make != "" && !strings.HasPrefix(strings.ToLower(ex.Model), strings.ToLower(ex.Make)) {
+		camera = strings.TrimSpace(ex.Make + " " + ex.Model)
+	}
+	taken = ex.CaptureTime
+	return
+
+}
+
+// pendingPhoto is a photo whose files are written, under a temporary
+// name, but which isn't yet in ebcphotos. Its row is added in the same
+// transaction as the claim, then the files are renamed or removed
+// according to whether that was committed.
+type pendingPhoto struct {
+	entrant     int
+	bonus       string
+	emailid     uint32
+	temp        string   // Name the files are written under, less extension
+	exts        []string // Files written in the image folder
+	image       string   // Extension of the one ScoreMaster shows
+	original    string   // Extension of the original kept, if any
+	width       int
+	height      int
+	camera      string
+	captured    string
+	lat, lon    interface{}
+	sourceURL   string
+	unconverted bool
+	id          int // Once stored
+}
+
+type pendingPhotos []*pendingPhoto
+
+var pendingPhotoSeq int64
+
+// pendingPhotoName is a temporary name for a photo's files, unique to this run.
+func pendingPhotoName(emailid uint32) string {
+	return fmt.Sprintf("pending-%v-%v-%v", os.Getpid(), emailid, atomic.AddInt64(&pendingPhotoSeq, 1))
+}
+
+// final is the proper name of the photo's file with extension ext.
+func (pp *pendingPhoto) final(ext string) string {
+	return imageFilename(pp.id, pp.entrant, pp.bonus, ext)
+}
+
+// store adds the photo's row within tx, numbering it.
+func (pp *pendingPhoto) store(tx *sql.Tx) error {
+
+	res, err := tx.Exec("INSERT INTO ebcphotos(EntrantID,BonusID,EmailID) VALUES(?,?,?)", pp.entrant, pp.bonus, pp.emailid)
+	if err != nil {
+		return err
+	}
+	rowid, _ := res.LastInsertId()
+	pp.id = int(rowid)
+	original := ""
+	if pp.original != "" {
+		original = filepath.Join(cfg.ImageFolder, originalsFolder, pp.final(pp.original))
+	}
+	sqlx := "UPDATE ebcphotos SET image=?,Width=?,Height=?,CameraModel=?,CaptureTime=?,Latitude=?,Longitude=?,Original=?,SourceURL=?,Unconverted=? WHERE rowid=?"
+	_, err = tx.Exec(sqlx, filepath.Join(cfg.ImageFolder, pp.final(pp.image)), pp.width, pp.height, pp.camera, pp.captured,
+		pp.lat, pp.lon, original, pp.sourceURL, pp.unconverted, pp.id)
+	return err
+
+}
+
+// keep gives the files of a stored photo their proper names.
+func (pp *pendingPhoto) keep() {
+
+	dir := filepath.Join(cfg.Path2SM, cfg.ImageFolder)
+	for _, ext := range pp.exts {
+		if err := os.Rename(filepath.Join(dir, pp.temp+ext), filepath.Join(dir, pp.final(ext))); err != nil {
+			fmt.Printf("%v can't rename image - error:%v\n", logts(), err)
+		}
+	}
+	if pp.original != "" {
+		dir = filepath.Join(dir, originalsFolder)
+		if err := os.Rename(filepath.Join(dir, pp.temp+pp.original), filepath.Join(dir, pp.final(pp.original))); err != nil {
+			fmt.Printf("%v can't rename original image - error:%v\n", logts(), err)
+		}
+	}
+	fireHook(hookEvent{Event: hookPhotoStored, EmailID: pp.emailid, EntrantID: pp.entrant, BonusID: pp.bonus, PhotoID: pp.id,
+		Image: filepath.Join(cfg.ImageFolder, pp.final(pp.image))})
+
+}
+
+// discard removes the files of a photo which wasn't stored.
+func (pp *pendingPhoto) discard() {
+
+	dir := filepath.Join(cfg.Path2SM, cfg.ImageFolder)
+	for _, ext := range pp.exts {
+		os.Remove(filepath.Join(dir, pp.temp+ext))
+	}
+	if pp.original != "" {
+		os.Remove(filepath.Join(dir, originalsFolder, pp.temp+pp.original))
+	}
+
+}
+
+// store adds the photos' rows within tx, returning their rowids.
+func (pps pendingPhotos) store(tx *sql.Tx) ([]string, error) {
+
+	var ids []string
+	for _, pp := range pps {
+		if err := pp.store(tx); err != nil {
+			return nil, err
+		}
+		ids = append(ids, strconv.Itoa(pp.id))
+	}
+	return ids, nil
+
+}
+
+func (pps pendingPhotos) keep() {
+	for _, pp := range pps {
+		pp.keep()
+	}
+}
+
+func (pps pendingPhotos) discard() {
+	for _, pp := range pps {
+		pp.discard()
+	}
+}
+
+// photoPosition returns where a photo was taken, if its EXIF says.
+func photoPosition(pic []byte) (lat float64, lon float64, ok bool) {
+
+	ex, exok := readExif(pic)
+	if !exok || !ex.HasGPS {
+		return 0, 0, false
+	}
+	return ex.Latitude, ex.Longitude, true
+
+}
+
+// photoTakenAt says when a photo was taken, from its EXIF if it has any,
+// otherwise guessing from its filename or Content-Disposition.
+func photoTakenAt(p emailPhoto) time.Time {
+
+	if ex, ok := readExif(p.Data); ok && !ex.CaptureTime.IsZero() {
+		return ex.CaptureTime
+	}
+	return timeFromPhoto(p.Name, p.ContentDisposition)
+
+}
@@ -0,0 +1,166 @@
+package main
+
+/*
+ * Phones send photos of 12MB or more, far bigger than anyone judging a
+ * claim needs, and they fill the image folder and slow the judging pages.
+ *
+ * Attachments bigger than MaxAttachmentMB aren't read at all, the claim is
+ * left needing attention as for any other unreadable attachment. Photos
+ * whose longer edge exceeds MaxPhotoEdge pixels are shrunk to fit and
+ * stored as JPGs at JpegQuality, keeping their EXIF so that where and when
+ * they were taken isn't lost. With KeepOriginals set the photo as sent is
+ * also saved, in the originals folder within the ImageFolder, and recorded
+ * in ebcphotos.Original.
+ *
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const originalsFolder = "originals"
+
+// readAttachment reads an attachment, refusing any larger than cfg.MaxAttachmentMB.
+func readAttachment(r io.Reader) ([]byte, error) {
+
+	if cfg.MaxAttachmentMB <= 0 {
+		return io.ReadAll(r)
+	}
+	limit := int64(cfg.MaxAttachmentMB) << 20
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(data)) > limit {
+		return nil, fmt.Errorf("attachment bigger than %vMB", cfg.MaxAttachmentMB)
+	}
+	return data, err
+
+}
+
+// downscalePhoto shrinks a photo to fit within cfg.MaxPhotoEdge, reporting
+// whether it needed to.
+func downscalePhoto(pic []byte) ([]byte, bool) {
+
+	if cfg.MaxPhotoEdge <= 0 {
+		return pic, false
+	}
+	ic, _, err := image.DecodeConfig(bytes.NewReader(pic))
+	if err != nil || (ic.Width <= cfg.MaxPhotoEdge && ic.Height <= cfg.MaxPhotoEdge) {
+		return pic, false
+	}
+	img, _, err := image.Decode(bytes.NewReader(pic))
+	if err != nil {
+		return pic, false
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, shrinkImage(img, cfg.MaxPhotoEdge), &jpeg.Options{Quality: jpegQuality()}); err != nil {
+		return pic, false
+	}
+	return withExif(buf.Bytes(), exifSegment(pic)), true
+
+}
+
+// shrinkImage scales an image down so its longer edge is edge pixels,
+// averaging the pixels each new one covers.
+func shrinkImage(img image.Image, edge int) *image.RGBA {
+
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := edge, sh*edge/sw
+	if sh > sw {
+		dw, dh = sw*edge/sh, edge
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	src := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			o := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[o+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+
+}
+
+// withExif puts a photo's EXIF, as found by exifSegment, into a JPG just encoded.
+func withExif(jpg []byte, tiff []byte) []byte {
+
+	seglen := 2 + 6 + len(tiff)
+	if tiff == nil || seglen > 0xFFFF || !bytes.HasPrefix(jpg, []byte{0xFF, 0xD8}) {
+		return jpg
+	}
+	res := make([]byte, 0, len(jpg)+seglen+2)
+	res = append(res, 0xFF, 0xD8, 0xFF, 0xE1, 0, 0)
+	binary.BigEndian.PutUint16(res[4:], uint16(seglen))
+	res = append(res, "Exif\x00\x00"...)
+	res = append(res, tiff...)
+	return append(res, jpg[2:]...)
+
+}
+
+// keepOriginal saves a photo as sent before it was shrunk, returning its
+// path within the ScoreMaster folder.
+func keepOriginal(fname string, pic []byte) (string, error) {
+
+	dir := filepath.Join(cfg.Path2SM, cfg.ImageFolder, originalsFolder)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, fname), pic, 0644); err != nil {
+		return "", err
+	}
+	return filepath.Join(cfg.ImageFolder, originalsFolder, fname), nil
+
+}
+
+// downscaleStored shrinks a JPG already stored, one converted from a HEIC
+// say, returning the shrunken image if it needed shrinking.
+func downscaleStored(jpg string) []byte {
+
+	if cfg.MaxPhotoEdge <= 0 {
+		return nil
+	}
+	x := filepath.Join(cfg.Path2SM, jpg)
+	pic, err := os.ReadFile(x)
+	if err != nil {
+		return nil
+	}
+	small, ok := downscalePhoto(pic)
+	if !ok {
+		return nil
+	}
+	if err := os.WriteFile(x, small, 0644); err != nil {
+		fmt.Printf("%v can't write image %v - error:%v\n", logts(), x, err)
+		return nil
+	}
+	return small
+
+}
@@ -0,0 +1,54 @@
+package main
+
+/*
+ * Two-up entries sometimes have the pillion sending claims, either under
+ * the rider's number or under their own. Where the pillion has their own
+ * entrants record, entrants.PillionOf gives the rider's EntrantID so that
+ * claims are credited to the riding pair and the pillion's addresses are
+ * accepted for the rider's claims.
+ *
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pillionOf returns the rider an entrant is pillion to, or zero.
+func pillionOf(entrant int) int {
+
+	if !hasColumn("entrants", "PillionOf") {
+		return 0
+	}
+	var rider int
+	dbh.QueryRow("SELECT IfNull("+col("entrants", "PillionOf")+",0) FROM entrants WHERE "+col("entrants", "EntrantID")+"=?", entrant).Scan(&rider)
+	return rider
+
+}
+
+// pillionsOf returns the pillions riding with any of the entrants.
+func pillionsOf(entrants []int) []int {
+
+	if len(entrants) < 1 || !hasColumn("entrants", "PillionOf") {
+		return nil
+	}
+	var ids []string
+	for _, id := range entrants {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	rows, err := dbh.Query("SELECT " + col("entrants", "EntrantID") + " FROM entrants WHERE " + col("entrants", "PillionOf") + " IN (" + strings.Join(ids, ",") + ")")
+	if err != nil {
+		fmt.Printf("%v pillions %v\n", logts(), err)
+		return nil
+	}
+	defer rows.Close()
+	var res []int
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		res = append(res, id)
+	}
+	return res
+
+}
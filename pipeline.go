@@ -0,0 +1,164 @@
+package main
+
+/*
+ * A burst of claims arriving at a checkpoint used to be handled one at a
+ * time, each waiting while the one before was parsed, its photos decoded,
+ * downloaded, shrunk and converted. Most of that needs nothing from the
+ * database so a pool of cfg.Workers goroutines now does it for the emails
+ * ahead of the one being handled.
+ *
+ * Everything else, checking the claim, storing it and deciding what becomes
+ * of the email, is still done by processMessages one email at a time in the
+ * order the server sent them, and all writes still go through the single
+ * writer in dbwriter.go. So claims are stored, and their emails flagged, in
+ * the same order as before and checks such as duplicate detection see the
+ * claims before them.
+ *
+ * Photos are only prepared for emails from entrants' addresses, strangers
+ * can't make me download anything, and not in test mode, where nothing is
+ * stored. Workers=1 prepares nothing in advance.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/emersion/go-imap"
+)
+
+const maxDefaultWorkers = 4
+
+// preparedMessage is an email fetched, parsed and its photos made ready to store.
+type preparedMessage struct {
+	msg         *imap.Message
+	raw         []byte
+	m           Email
+	readErr     error // Couldn't read the body
+	parseErr    error // Couldn't parse it
+	photos      []emailPhoto
+	photosReady bool
+	panicked    interface{} // Preparing it panicked, for processMessages to quarantine
+}
+
+// pipelineWorkers is how many emails are prepared at once.
+func pipelineWorkers() int {
+
+	if cfg.Workers > 0 {
+		return cfg.Workers
+	}
+	n := runtime.NumCPU()
+	if n > maxDefaultWorkers {
+		n = maxDefaultWorkers
+	}
+	return n
+
+}
+
+// prepareMessages reads and parses the emails as they're fetched, preparing
+// their photos, and delivers them in the order they arrived.
+func prepareMessages(messages chan *imap.Message, section *imap.BodySectionName) chan *preparedMessage {
+
+	workers := pipelineWorkers()
+	out := make(chan *preparedMessage)
+	slots := make(chan chan *preparedMessage, workers)
+	sem := make(chan struct{}, workers)
+	go func() {
+		for msg := range messages {
+			slot := make(chan *preparedMessage, 1)
+			slots <- slot
+			sem <- struct{}{}
+			go func(msg *imap.Message) {
+				defer func() { <-sem }()
+				slot <- prepareMessage(msg, section, workers > 1)
+			}(msg)
+		}
+		close(slots)
+	}()
+	go func() {
+		for slot := range slots {
+			out <- <-slot
+		}
+		close(out)
+	}()
+	return out
+
+}
+
+// prepareMessage does as much for an email as can be done out of turn.
+func prepareMessage(msg *imap.Message, section *imap.BodySectionName, early bool) (pm *preparedMessage) {
+
+	pm = &preparedMessage{msg: msg}
+	defer func() {
+		if p := recover(); p != nil {
+			pm.panicked = p
+		}
+	}()
+	if stopRequested() {
+		return
+	}
+	r := msg.GetBody(section)
+	if r == nil {
+		pm.readErr = fmt.Errorf("Server didn't return message body")
+		return
+	}
+	pm.raw, pm.readErr = io.ReadAll(r)
+	if pm.readErr != nil {
+		return
+	}
+	pm.m, pm.parseErr = Parse(bytes.NewReader(pm.raw))
+	if pm.parseErr != nil || !early || cfg.TestMode || len(entrantsByEmail(pm.m.Header.Get("From"))) == 0 {
+		return
+	}
+	pm.photos = extractPhotos(pm.m, msg.Uid)
+	for i := range pm.photos {
+		preparePhoto(&pm.photos[i])
+	}
+	pm.photosReady = true
+	return
+
+}
+
+// preparePhoto converts or shrinks a photo ready for writeImage to store.
+func preparePhoto(p *emailPhoto) {
+
+	if p.Err != nil || p.Kind != "" {
+		return
+	}
+	ext := contentImageExt(p.Data, p.Filename)
+	converter := converterFor(ext)
+	if !isHeicExt(ext) && converter == "" {
+		if small, ok := downscalePhoto(p.Data); ok {
+			p.Prepared = small
+		}
+		return
+	}
+	if converter == "" && !nativeHeic(ext) {
+		return // Stored as it is
+	}
+	imgdir := filepath.Join(cfg.Path2SM, cfg.ImageFolder)
+	tmp, err := os.MkdirTemp(imgdir, "prepare")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	rel, _ := filepath.Rel(cfg.Path2SM, tmp)
+	original, jpg := filepath.Join(rel, "photo"+ext), filepath.Join(rel, "photo.jpg")
+	if os.WriteFile(filepath.Join(cfg.Path2SM, original), p.Data, 0644) != nil {
+		return
+	}
+	if convertStored(ext, converter, original, jpg) != nil {
+		return // writeImage will try again and record the failure
+	}
+	if pic, err := os.ReadFile(filepath.Join(cfg.Path2SM, jpg)); err == nil {
+		if small, ok := downscalePhoto(pic); ok {
+			pic = small
+		}
+		p.Prepared = pic
+	}
+
+}
@@ -0,0 +1,118 @@
+package main
+
+/*
+ * One sleepseconds doesn't suit a whole rally: the last few hours want
+ * claims answered within seconds while overnight, or the week before, every
+ * few minutes is plenty. cfg.PollSchedule gives intervals for particular
+ * periods and the first whose period includes now is used, otherwise
+ * sleepseconds as usual.
+ *
+ *		PollSchedule:
+ *		  - {Every: 15s, From: finish-3h, Until: finish+1h}
+ *		  - {Every: 5m, From: "23:00", Until: "06:00"}
+ *		  - {Every: 1h, From: start-168h, Until: start-24h}
+ *
+ * From and Until may be start or finish, optionally plus or minus a
+ * duration, a date and time as 2006-01-02T15:04, or a time of day as
+ * 15:04 which applies every day, wrapping round midnight if need be. Either
+ * may be left out to leave that end open.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type pollPeriod struct {
+	Every time.Duration `yaml:"Every"`
+	From  string        `yaml:"From"`
+	Until string        `yaml:"Until"`
+}
+
+// pollMoment resolves a From or Until relative to the rally, or reports
+// it as a time of day.
+func pollMoment(s string) (t time.Time, daily bool, err error) {
+
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, base := range []struct {
+		name string
+		at   time.Time
+	}{{"start", cfg.RallyStart}, {"finish", cfg.RallyFinish}} {
+		if !strings.HasPrefix(s, base.name) {
+			continue
+		}
+		rest := strings.TrimSpace(s[len(base.name):])
+		if rest == "" {
+			return base.at, false, nil
+		}
+		d, err := time.ParseDuration(strings.TrimPrefix(strings.ReplaceAll(rest, " ", ""), "+"))
+		return base.at.Add(d), false, err
+	}
+	if t, err = time.ParseInLocation("15:04", s, cfg.LocalTZ); err == nil {
+		return t, true, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02T15:04", s, cfg.LocalTZ)
+	return t, false, err
+
+}
+
+// includes reports whether now falls within the period.
+func (pp pollPeriod) includes(now time.Time) (bool, error) {
+
+	var from, until time.Time
+	var fromDaily, untilDaily bool
+	var err error
+	if pp.From != "" {
+		if from, fromDaily, err = pollMoment(pp.From); err != nil {
+			return false, err
+		}
+	}
+	if pp.Until != "" {
+		if until, untilDaily, err = pollMoment(pp.Until); err != nil {
+			return false, err
+		}
+	}
+	if fromDaily || untilDaily {
+		if !(fromDaily && untilDaily) {
+			return false, fmt.Errorf("%v to %v mixes a time of day with a date", pp.From, pp.Until)
+		}
+		local := now.In(cfg.LocalTZ)
+		mins := local.Hour()*60 + local.Minute()
+		f, u := from.Hour()*60+from.Minute(), until.Hour()*60+until.Minute()
+		if f <= u {
+			return mins >= f && mins < u, nil
+		}
+		return mins >= f || mins < u, nil // Overnight
+	}
+	return (from.IsZero() || !now.Before(from)) && (until.IsZero() || now.Before(until)), nil
+
+}
+
+// pollInterval returns how long to wait before the next look at the mailbox.
+func pollInterval(now time.Time) time.Duration {
+
+	for _, pp := range cfg.PollSchedule {
+		if ok, _ := pp.includes(now); ok && pp.Every > 0 {
+			return pp.Every
+		}
+	}
+	return time.Duration(cfg.SleepSeconds) * time.Second
+
+}
+
+// checkPollSchedule finds mistakes in cfg.PollSchedule.
+func checkPollSchedule() error {
+
+	for i, pp := range cfg.PollSchedule {
+		if pp.Every <= 0 {
+			return fmt.Errorf("PollSchedule %v has no Every", i+1)
+		}
+		if _, err := pp.includes(time.Now()); err != nil {
+			return fmt.Errorf("PollSchedule %v: %v", i+1, err)
+		}
+	}
+	return nil
+
+}
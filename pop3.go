@@ -0,0 +1,156 @@
+package main
+
+/*
+ * Just enough POP3, RFC 1939 over TLS, to fetch claims from mailboxes that
+ * offer nothing else. Emails are known by their UIDL. POP3 has no flags so
+ * what became of each is kept in ebcremotemail and, with POP3Delete, claims
+ * and ignored emails are deleted from the server once dealt with. Rejected
+ * ones are always left for a human to look at.
+ *
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pop3Dial connects to a POP3 server, replaced when testing.
+var pop3Dial = func(server string, timeout time.Duration) (net.Conn, error) {
+
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", server, nil)
+
+}
+
+// pop3Source is a mailbox reached by POP3.
+type pop3Source struct {
+	server, login, password string
+	conn                    net.Conn
+	tp                      *textproto.Conn
+}
+
+// cmd sends a command, returning the rest of the +OK line.
+func (p *pop3Source) cmd(format string, args ...interface{}) (string, error) {
+
+	p.conn.SetDeadline(time.Now().Add(imapTimeout()))
+	if err := p.tp.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return p.reply()
+
+}
+
+// reply reads a status line.
+func (p *pop3Source) reply() (string, error) {
+
+	line, err := p.tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	return "", fmt.Errorf("POP3: %v", line)
+
+}
+
+func (p *pop3Source) Connect() error {
+
+	if debugging(debugIMAP) {
+		fmt.Printf("%s connecting to %v as %v by POP3\n", logts(), p.server, p.login)
+	}
+	c, err := pop3Dial(p.server, imapTimeout())
+	if err != nil {
+		return fmt.Errorf("POP3 dial: %v", err)
+	}
+	p.conn, p.tp = c, textproto.NewConn(c)
+	p.conn.SetDeadline(time.Now().Add(imapTimeout()))
+	if _, err = p.reply(); err == nil {
+		if _, err = p.cmd("USER %s", p.login); err == nil {
+			_, err = p.cmd("PASS %s", p.password)
+		}
+	}
+	if err != nil {
+		p.tp.Close()
+		return fmt.Errorf("POP3 login: %v", err)
+	}
+	return nil
+
+}
+
+func (p *pop3Source) Waiting() ([]remoteEmail, error) {
+
+	if _, err := p.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := p.tp.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+	var res []remoteEmail
+	for _, l := range lines {
+		f := strings.Fields(l)
+		if len(f) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(f[0])
+		if err != nil {
+			continue
+		}
+		res = append(res, remoteEmail{ID: f[1], Num: n}) // UIDL doesn't say when, receivedAt does
+	}
+	return res, nil
+
+}
+
+// receivedAt is when an email arrived in the mailbox, from the topmost
+// Received header, which the server holding it added, or now if there
+// isn't one I can read.
+func receivedAt(raw []byte) time.Time {
+
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if rcvd := h["Received"]; len(rcvd) > 0 {
+		if t := parseTime(extractTime(rcvd[0])); !t.IsZero() {
+			return t
+		}
+	}
+	return time.Now()
+
+}
+
+func (p *pop3Source) Retrieve(e remoteEmail) ([]byte, error) {
+
+	if _, err := p.cmd("RETR %d", e.Num); err != nil {
+		return nil, err
+	}
+	return p.tp.ReadDotBytes()
+
+}
+
+func (p *pop3Source) Dispose(e remoteEmail, state int) error {
+
+	if !cfg.POP3Delete || (state != mailClaimed && state != mailIgnored) {
+		return nil
+	}
+	if debugging(debugIMAP) {
+		fmt.Printf("%s deleting %v from %v\n", logts(), e.ID, p.server)
+	}
+	_, err := p.cmd("DELE %d", e.Num)
+	return err
+
+}
+
+// Close logs out, which is when the server deletes what it's been told to.
+func (p *pop3Source) Close() error {
+
+	_, err := p.cmd("QUIT")
+	p.tp.Close()
+	return err
+
+}
@@ -0,0 +1,117 @@
+package main
+
+/*
+ * Organisers want to see how the test response reads, with their own
+ * TestResponseGood, TestResponseBad, TestResponseAdvice and so on, without
+ * sending themselves real test claims.
+ *
+ *		ebcfetch preview-response --good --bad -out preview.html
+ *		ebcfetch preview-response --bad -to me@example.com
+ *
+ * renders the response to a made up claim, a good one, a bad one or both,
+ * and writes it to an HTML file or emails it. The bad claim is rejected by
+ * a rule and flagged so every part of the response is shown.
+ *
+ */
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	smtp "github.com/xhit/go-simple-mail/v2"
+)
+
+// previewClaim makes up a claim and what I'd make of it.
+func previewClaim(good bool) (testResponse, fourFields) {
+
+	ct := time.Now().In(cfg.LocalTZ).Truncate(time.Minute)
+	f4 := fourFields{ok: true, EntrantID: 1, BonusID: "A1", OdoReading: 12345, OdoOk: true,
+		ClaimTime: ct, HHmm: ct.Format("1504"), TimeOk: true, TimeHH: ct.Hour(), TimeMM: ct.Minute()}
+	tr := testResponse{AddressIsRegistered: true, EntrantID: 1, ValidEntrantID: true, BonusID: "A1",
+		BonusIsReal: true, BonusDesc: "Sample bonus", OdoReading: 12345, HHmm: f4.HHmm, ClaimDateTime: ct,
+		PhotoPresent: 1, Requirements: defaultRequirements, SentAt: ct, ClaimIsGood: true, ClaimIsPerfect: true}
+	if good {
+		tr.ClaimSubject = fmt.Sprintf("1 A1 12345 %v", f4.HHmm)
+		return tr, f4
+	}
+	f4.OdoOk, f4.TimeOk = false, false
+	tr.ClaimSubject = "1 A1 odo 12.3"
+	tr.AddressIsRegistered = false
+	tr.PhotoPresent = 0
+	tr.TimeTyped = "quarter past"
+	tr.Rejection = "Photo bonus without a photo"
+	tr.Flags.add(flagMapPinFar)
+	tr.ClaimIsGood, tr.ClaimIsPerfect = false, false
+	return tr, f4
+
+}
+
+// previewResponses renders the chosen responses as one HTML page.
+func previewResponses(good bool, bad bool) (string, string) {
+
+	var subjects []string
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>" + cfg.RallyTitle + " test responses</title></head><body>\n")
+	for _, g := range []bool{true, false} {
+		if (g && !good) || (!g && !bad) {
+			continue
+		}
+		tr, f4 := previewClaim(g)
+		subject, body := testResponseHTML(tr, &f4)
+		subjects = append(subjects, subject)
+		sb.WriteString("<h2>Subject: " + subject + "</h2>\n" + body + "\n<hr>\n")
+	}
+	sb.WriteString("</body></html>\n")
+	return strings.Join(subjects, " / "), sb.String()
+
+}
+
+// runPreviewResponse is the preview-response subcommand.
+func runPreviewResponse(args []string) int {
+
+	fs := flag.NewFlagSet("preview-response", flag.ContinueOnError)
+	good := fs.Bool("good", false, "Show the response to a good claim")
+	bad := fs.Bool("bad", false, "Show the response to a bad claim")
+	out := fs.String("out", "ebcfetch-preview.html", "File to write")
+	to := fs.String("to", "", "Email the preview here instead")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	if !*good && !*bad {
+		*good, *bad = true, true
+	}
+
+	subject, page := previewResponses(*good, *bad)
+	if *to == "" {
+		if err := os.WriteFile(*out, []byte(page), 0644); err != nil {
+			fmt.Printf("%s: can't write preview %v\n", apptitle, err)
+			return 1
+		}
+		if !*silent {
+			fmt.Printf("%s: preview written to %v\n", apptitle, *out)
+		}
+		return 0
+	}
+
+	conn, err := newSMTPServer().Connect()
+	if err == nil {
+		msg := smtp.NewMSG()
+		msg.AddTo(*to)
+		msg.SetFrom(cfg.ImapLogin)
+		msg.SetSubject("Preview: " + subject)
+		msg.SetBody(smtp.TextHTML, page)
+		err = msg.Send(conn)
+	}
+	if err != nil {
+		fmt.Printf("%s: can't send preview to %v %v\n", apptitle, *to, err)
+		return 1
+	}
+	if !*silent {
+		fmt.Printf("%s: preview sent to %v\n", apptitle, *to)
+	}
+	return 0
+
+}
@@ -0,0 +1,85 @@
+package main
+
+/*
+ * Some bonuses have a QR code posted at the location. If cfg.QRCommand is
+ * set, zbarimg for example, I ask it to decode any QR codes in the claim's
+ * photos. It's called as:- QRCommand imagefile
+ * and should write each payload it finds on a line of its own, eg
+ *
+ *		QRCommand: zbarimg --raw -q
+ *
+ * A payload matches if it equals bonuses.QRCode or, where that's empty,
+ * the BonusID. The payload is stored in ebclaims.QRCode and the claim
+ * flagged either way.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// qrPayloads decodes any QR codes in an image.
+func qrPayloads(pic []byte, filename string) ([]string, error) {
+
+	out, err := runImageCommand(cfg.QRCommand, pic, filename)
+	if err != nil && len(out) == 0 {
+		return nil, err // zbarimg exits 4 when it finds nothing
+	}
+	var res []string
+	for _, ln := range strings.Split(string(out), "\n") {
+		if ln = strings.TrimSpace(ln); ln != "" {
+			res = append(res, ln)
+		}
+	}
+	return res, nil
+
+}
+
+// expectedQRCode is the payload posted at a bonus.
+func expectedQRCode(bonus string) string {
+
+	var res string
+	if hasColumn("bonuses", "QRCode") {
+		dbh.QueryRow("SELECT IfNull("+col("bonuses", "QRCode")+",'') FROM bonuses WHERE "+col("bonuses", "BonusID")+"=?", bonus).Scan(&res)
+	}
+	if res = strings.TrimSpace(res); res == "" {
+		res = bonus
+	}
+	return res
+
+}
+
+// checkQRPhotos looks for the bonus's QR code in the photos, returning the
+// payload to record with the claim.
+func checkQRPhotos(photos []emailPhoto, bonus string, flags *claimFlags) string {
+
+	want := expectedQRCode(bonus)
+	found := ""
+	for _, p := range photos {
+		if p.Err != nil {
+			continue
+		}
+		payloads, err := qrPayloads(p.Data, p.Name)
+		if err != nil {
+			if *verbose {
+				fmt.Printf("%s QR %v %v\n", logts(), cfg.QRCommand, err)
+			}
+			continue
+		}
+		for _, x := range payloads {
+			if strings.EqualFold(x, want) {
+				flags.add(flagQRCodeOk)
+				return x
+			}
+			if found == "" {
+				found = x
+			}
+		}
+	}
+	if found != "" {
+		flags.add(flagQRCodeMismatch)
+	}
+	return found
+
+}
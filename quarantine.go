@@ -0,0 +1,67 @@
+package main
+
+/*
+ * One malformed email mustn't take the whole fetcher down mid-rally. If
+ * handling a message panics I recover, save the raw message in the
+ * QuarantineFolder for someone to look at later, record what happened in
+ * the audit log, leave the email flagged and carry on with the rest.
+ * Emails which fail for good, rather than just for now, end up here too.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+const defaultQuarantineFolder = "quarantine"
+
+// quarantineMessage saves the raw text of an email which couldn't be handled,
+// returning the path of the saved copy.
+func quarantineMessage(uid uint32, raw []byte) (string, error) {
+
+	folder := cfg.QuarantineFolder
+	if folder == "" {
+		folder = defaultQuarantineFolder
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return "", err
+	}
+	fn := filepath.Join(folder, fmt.Sprintf("%v-%v.eml", time.Now().Format("20060102150405"), uid))
+	return fn, os.WriteFile(fn, raw, 0644)
+
+}
+
+// recoverMessage deals with a panic raised while handling one email.
+func recoverMessage(uid uint32, raw []byte, p interface{}) {
+
+	log.Printf("PANIC handling email [%v] %v\n%s", uid, p, debug.Stack())
+	quarantineEmail(uid, raw, fmt.Sprintf("panic: %v", p))
+
+}
+
+// quarantineEmail saves an email which will never be processable and
+// records why in the audit log.
+func quarantineEmail(uid uint32, raw []byte, reason string) {
+
+	fn, err := quarantineMessage(uid, raw)
+	if err != nil {
+		log.Printf("can't quarantine email [%v] %v\n", uid, err)
+	} else {
+		reason += "; saved as " + fn
+	}
+
+	// The parser may be what failed so I only trust the bare headers here
+	var from, subject string
+	if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		from, subject = m.Header.Get("From"), m.Header.Get("Subject")
+	}
+	writeAudit(uid, from, subject, auditQuarantined, reason)
+
+}
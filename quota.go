@@ -0,0 +1,114 @@
+package main
+
+/*
+ * A full mailbox silently bounces riders' claims so, if the server supports
+ * the IMAP QUOTA extension, I check the INBOX's storage each cycle and tell
+ * the AdminAddresses once it's more than QuotaWarnPercent full. The alert
+ * is repeated no more than every quotaAlertInterval while it stays that way.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+const quotaAlertInterval = 6 * time.Hour
+
+var lastQuotaAlert time.Time
+
+// getQuotaRoot is the RFC 2087 GETQUOTAROOT command.
+type getQuotaRoot struct {
+	Mailbox string
+}
+
+func (cmd *getQuotaRoot) Command() *imap.Command {
+	return &imap.Command{Name: "GETQUOTAROOT", Arguments: []interface{}{imap.FormatMailboxName(cmd.Mailbox)}}
+}
+
+// quotaHandler collects the STORAGE figures, in KB, from QUOTA responses.
+type quotaHandler struct {
+	Used  uint32
+	Limit uint32
+	Found bool
+}
+
+func (h *quotaHandler) Handle(resp imap.Resp) error {
+
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+	switch name {
+	case "QUOTAROOT":
+		return nil
+	case "QUOTA":
+	default:
+		return responses.ErrUnhandled
+	}
+	if len(fields) < 2 {
+		return nil
+	}
+	list, _ := fields[1].([]interface{})
+	for i := 0; i+2 < len(list); i += 3 {
+		res, _ := list[i].(string)
+		if !strings.EqualFold(res, "STORAGE") {
+			continue
+		}
+		h.Used, _ = imap.ParseNumber(list[i+1])
+		h.Limit, _ = imap.ParseNumber(list[i+2])
+		h.Found = true
+	}
+	return nil
+
+}
+
+// fetchQuota asks the server how full the INBOX is, in KB.
+func fetchQuota(c *client.Client) (uint32, uint32, bool) {
+
+	if ok, _ := c.Support("QUOTA"); !ok {
+		return 0, 0, false
+	}
+	h := &quotaHandler{}
+	st, err := c.Execute(&getQuotaRoot{Mailbox: "INBOX"}, h)
+	if err == nil {
+		err = st.Err()
+	}
+	if err != nil {
+		if *verbose {
+			fmt.Printf("%s quota %v\n", logts(), err)
+		}
+		return 0, 0, false
+	}
+	return h.Used, h.Limit, h.Found && h.Limit > 0
+
+}
+
+// checkQuota records mailbox usage and raises the alarm if it's nearly full.
+func checkQuota(c *client.Client) {
+
+	if cfg.QuotaWarnPercent < 1 {
+		return
+	}
+	used, limit, ok := fetchQuota(c)
+	if !ok {
+		return
+	}
+	pc := int(uint64(used) * 100 / uint64(limit))
+	status.quota(pc)
+	if pc < cfg.QuotaWarnPercent || time.Since(lastQuotaAlert) < quotaAlertInterval {
+		return
+	}
+	lastQuotaAlert = time.Now()
+	msg := fmt.Sprintf("Mailbox %v is %v%% full (%v of %v MB). Claims will bounce when it's full.", cfg.ImapLogin, pc, used/1024, limit/1024)
+	fmt.Printf("%s %v\n", logts(), msg)
+	for _, a := range cfg.AdminAddresses {
+		sendPlainMail(a, apptitle+": mailbox nearly full", msg)
+	}
+
+}
@@ -0,0 +1,27 @@
+package main
+
+/*
+ * The period during which emails are fetched is given by NotBefore and
+ * NotAfter. If these aren't set explicitly they can be derived from the
+ * rally's own start and finish times: LeadTime before the start, to allow
+ * for a testing period, until LagTime after the finish, to allow for late
+ * arrivals during the grace period.
+ *
+ */
+
+import "time"
+
+// fetchWindow returns the effective NotBefore and NotAfter, either of
+// which may be zero meaning no limit.
+func fetchWindow() (time.Time, time.Time) {
+
+	nb, na := cfg.NotBefore, cfg.NotAfter
+	if nb.IsZero() && cfg.LeadTime > 0 && !cfg.RallyStart.IsZero() {
+		nb = cfg.RallyStart.Add(-cfg.LeadTime)
+	}
+	if na.IsZero() && cfg.LagTime > 0 && !cfg.RallyFinish.IsZero() {
+		na = cfg.RallyFinish.Add(cfg.LagTime)
+	}
+	return nb, na
+
+}
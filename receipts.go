@@ -0,0 +1,83 @@
+package main
+
+/*
+ * If cfg.ReceiptsFolder is set, each stored claim also produces a printable
+ * PDF giving the claim's details and its photos. These are filed in a
+ * folder per entrant so that a rider's evidence pack can simply be printed
+ * at the finish, or a single claim pulled out when there's a protest.
+ *
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const receiptPhotoHeight = 320 // points, two photos to a page
+
+// receiptPath is where a claim's receipt is filed.
+func receiptPath(c apiClaim) string {
+
+	name := fmt.Sprintf("claim-%v-%v-%v.pdf", c.EntrantID, c.BonusID, c.RowID)
+	return filepath.Join(cfg.Path2SM, cfg.ReceiptsFolder, strconv.Itoa(c.EntrantID), name)
+
+}
+
+// claimReceipt builds the PDF for a stored claim.
+func claimReceipt(c apiClaim) []byte {
+
+	var rider string
+	dbh.QueryRow("SELECT IfNull("+col("entrants", "RiderName")+",'') FROM entrants WHERE "+col("entrants", "EntrantID")+"=?", c.EntrantID).Scan(&rider)
+	desc := validateBonus(fourFields{BonusID: c.BonusID})
+
+	pdf := newPDF()
+	pdf.text(cfg.RallyTitle + " - claim receipt")
+	pdf.text("")
+	pdf.text(fmt.Sprintf("Entrant: %v %v", c.EntrantID, rider))
+	pdf.text(fmt.Sprintf("Bonus: %v %v", c.BonusID, desc))
+	pdf.text(fmt.Sprintf("Odo: %v", c.OdoReading))
+	pdf.text("Claim time: " + c.ClaimTime)
+	pdf.text("Subject: " + c.Subject)
+	if c.Extra != "" {
+		pdf.text("Extra: " + c.Extra)
+	}
+	if c.Flags != "" {
+		for _, f := range claimFlags(strings.Split(c.Flags, ",")).describe() {
+			pdf.text("Warning: " + f)
+		}
+	}
+	pdf.text(fmt.Sprintf("Logged: %v   ebclaims row %v", c.LoggedAt, c.RowID))
+	if c.PhotoIDs != "" {
+		for _, id := range strings.Split(c.PhotoIDs, ",") {
+			var image string
+			dbh.QueryRow("SELECT IfNull(image,'') FROM ebcphotos WHERE rowid=?", id).Scan(&image)
+			pic, err := os.ReadFile(filepath.Join(cfg.Path2SM, image))
+			if err == nil {
+				err = pdf.jpeg(pic, receiptPhotoHeight)
+			}
+			if err != nil {
+				pdf.text(fmt.Sprintf("Photo %v (%v) can't be shown: %v", id, image, err))
+			}
+		}
+	}
+	return pdf.bytes()
+
+}
+
+// writeClaimReceipt files the PDF receipt for a stored claim.
+func writeClaimReceipt(rowid int64) error {
+
+	c, err := scanClaim(dbh.QueryRow(apiClaimSelect+" WHERE rowid=?", rowid))
+	if err != nil {
+		return err
+	}
+	fname := receiptPath(c)
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(fname, claimReceipt(c), 0644)
+
+}
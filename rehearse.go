@@ -0,0 +1,178 @@
+package main
+
+/*
+ * New scoring volunteers learn far more from a realistic stream of claims
+ * than from a handful of test emails. Given a folder of claim emails saved
+ * from an earlier rally as .eml files:-
+ *
+ *		ebcfetch -db sm/ScoreMaster.db rehearse -from bbr24 -speed 20 -out rehearsal
+ *
+ * replays them through the normal claim process in the order they were
+ * sent, -speed times faster than they really arrived, into a copy of the
+ * database in the -out folder. The claims get the same flags as they did
+ * first time round and the volunteers can judge them in ScoreMaster using
+ * that copy. Claims already in the copy are cleared first unless -keep is
+ * given. Nothing is sent to anyone.
+ *
+ */
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// rehearsalEmail is one email to be replayed.
+type rehearsalEmail struct {
+	Name string
+	Sent time.Time
+	Raw  []byte
+}
+
+// loadRehearsal reads the .eml files in a folder, or the emails in a
+// Maildir, in the order they were sent.
+func loadRehearsal(folder string) ([]rehearsalEmail, error) {
+
+	var files []string
+	var err error
+	if isMaildir(folder) {
+		for _, sub := range []string{"new", "cur"} {
+			var entries []os.DirEntry
+			if entries, err = os.ReadDir(filepath.Join(folder, sub)); err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.Type().IsRegular() {
+					files = append(files, filepath.Join(folder, sub, e.Name()))
+				}
+			}
+		}
+	} else if files, err = filepath.Glob(filepath.Join(folder, "*.eml")); err != nil {
+		return nil, err
+	}
+	var res []rehearsalEmail
+	for _, fn := range files {
+		raw, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		re := rehearsalEmail{Name: filepath.Base(fn), Raw: raw}
+		if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+			re.Sent, _ = m.Header.Date()
+		}
+		res = append(res, re)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Sent.Before(res[j].Sent) })
+	return res, nil
+
+}
+
+// rehearsalDelays gives the pause before each email, the real gap since the
+// one before divided by speed but never more than maxGap.
+func rehearsalDelays(emails []rehearsalEmail, speed float64, maxGap time.Duration) []time.Duration {
+
+	res := make([]time.Duration, len(emails))
+	for i := 1; i < len(emails); i++ {
+		if emails[i].Sent.IsZero() || emails[i-1].Sent.IsZero() {
+			continue
+		}
+		gap := time.Duration(float64(emails[i].Sent.Sub(emails[i-1].Sent)) / speed)
+		if gap > maxGap {
+			gap = maxGap
+		}
+		res[i] = gap
+	}
+	return res
+
+}
+
+// replayEmails feeds the emails through processMessages at the given pace.
+func replayEmails(emails []rehearsalEmail, delays []time.Duration) (claimed, dealtwith, ignored, skipped *imap.SeqSet) {
+
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message)
+	claimed, dealtwith, ignored, skipped = new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet)
+	done := make(chan bool)
+	prepared := prepareMessages(messages, section)
+	go func() {
+		for !processMessages(prepared, claimed, dealtwith, ignored, skipped) {
+			// One of them panicked, carry on with the rest
+		}
+		done <- true
+	}()
+	for i, re := range emails {
+		time.Sleep(delays[i])
+		sent := re.Sent
+		if sent.IsZero() {
+			sent = time.Now()
+		}
+		body := map[*imap.BodySectionName]imap.Literal{{}: bytes.NewBuffer(re.Raw)}
+		messages <- &imap.Message{Uid: uint32(i + 1), InternalDate: sent, Body: body}
+	}
+	close(messages)
+	<-done
+	return
+
+}
+
+func runRehearse(args []string) int {
+
+	fs := flag.NewFlagSet("rehearse", flag.ContinueOnError)
+	from := fs.String("from", "", "Folder of .eml files to replay")
+	speed := fs.Float64("speed", 10, "How many times faster than real life")
+	maxGap := fs.Duration("maxgap", 5*time.Minute, "Longest pause between emails")
+	out := fs.String("out", "rehearsal", "Folder for the copy of the database and its photos")
+	keep := fs.Bool("keep", false, "Keep claims already in the database")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	if *from == "" || *speed <= 0 {
+		fmt.Printf("%s: rehearse needs -from and a positive -speed\n", apptitle)
+		return 1
+	}
+	emails, err := loadRehearsal(*from)
+	if err != nil || len(emails) == 0 {
+		fmt.Printf("%s: no emails to replay in %v %v\n", apptitle, *from, err)
+		return 1
+	}
+	if err = os.MkdirAll(*out, 0755); err != nil {
+		fmt.Printf("%s: rehearse %v\n", apptitle, err)
+		return 1
+	}
+	if err = useSandbox(*out); err != nil {
+		fmt.Printf("%s: rehearse can't copy database %v\n", apptitle, err)
+		return 1
+	}
+	if !*keep {
+		dbExec("DELETE FROM ebclaims")
+	}
+	if *speed != 1 {
+		cfg.ClaimRateLimit = 0 // Rates would be exaggerated by the acceleration
+	}
+
+	delays := rehearsalDelays(emails, *speed, *maxGap)
+	var total time.Duration
+	for _, d := range delays {
+		total += d
+	}
+	fmt.Printf("%s: replaying %v emails from %v over about %v\n", apptitle, len(emails), *from, total.Round(time.Second))
+	claimed, dealtwith, ignored, skipped := replayEmails(emails, delays)
+	var names []string
+	for _, uid := range seqSetNums(dealtwith) {
+		names = append(names, emails[uid-1].Name)
+	}
+	fmt.Printf("%s: stored %v, rejected %v, ignored %v, failed %v\n", apptitle, seqSetLen(claimed), seqSetLen(dealtwith), seqSetLen(ignored), seqSetLen(skipped))
+	if len(names) > 0 {
+		fmt.Printf("%s: rejected %v\n", apptitle, strings.Join(names, ", "))
+	}
+	return 0
+
+}
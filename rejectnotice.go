@@ -0,0 +1,122 @@
+package main
+
+/*
+ * Outside test mode an email I can't make a claim of is just set aside for
+ * the organiser to deal with, so the rider doesn't know to try again. With
+ * RejectionNotices set, the sender is told what was wrong:-
+ *
+ *		format	the Subject line couldn't be read
+ *		entrant	the entrant number isn't in the rally
+ *		address	the email didn't come from the entrant's registered address
+ *		rule	a bonus rule rejected the claim
+ *		photo	the claim was stored but lacks the photo the bonus needs
+ *
+ * Each notice can be replaced using RejectionTemplates, keyed by the names
+ * above, in which {subject}, {entrant}, {bonus}, {reason} and {example}
+ * are filled in. {example} is the first valid SubjectExample, if any.
+ *
+ * Format notices only go to addresses registered to entrants; anyone else
+ * sending something unreadable is probably not a rider at all. Nothing is
+ * sent to my own address and ThrottleResponses applies as for test
+ * responses.
+ *
+ */
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// Reasons for rejection notices
+const (
+	rejectFormat  = "format"
+	rejectEntrant = "entrant"
+	rejectAddress = "address"
+	rejectRule    = "rule"
+	rejectPhoto   = "photo"
+)
+
+const defaultSubjectExample = "12 A4 10423 1432"
+
+var defaultRejectionTemplates = map[string]string{
+	rejectFormat: "I couldn't read the Subject line of your claim \"{subject}\".\n\n" +
+		"Please send it again with the entrant number, bonus code, odo reading and time, eg:-\n\n\t{example}",
+	rejectEntrant: "Your claim \"{subject}\" is for entrant {entrant} who isn't in this rally.\n\n" +
+		"Please check the entrant number and send it again.",
+	rejectAddress: "Your claim \"{subject}\" didn't come from the email address registered for entrant {entrant}.\n\n" +
+		"Please send it again from your registered address.",
+	rejectRule:  "Your claim \"{subject}\" for bonus {bonus} can't be accepted: {reason}",
+	rejectPhoto: "Your claim \"{subject}\" for bonus {bonus} arrived without the photo the bonus needs.",
+}
+
+// rejectionReason decides why an email couldn't be made a claim.
+func rejectionReason(f4 fourFields, ve bool, vea bool) string {
+
+	switch {
+	case !f4.ok:
+		return rejectFormat
+	case !ve:
+		return rejectEntrant
+	case !vea:
+		return rejectAddress
+	}
+	return ""
+
+}
+
+// subjectExampleText returns an example of a good Subject line.
+func subjectExampleText() string {
+
+	for _, x := range cfg.SubjectExamples {
+		if x.Valid && !x.Strict {
+			return x.Subject
+		}
+	}
+	return defaultSubjectExample
+
+}
+
+// rejectionText fills in the notice for a reason.
+func rejectionText(reason string, subject string, f4 *fourFields, detail string) string {
+
+	tmpl, ok := cfg.RejectionTemplates[reason]
+	if !ok || strings.TrimSpace(tmpl) == "" {
+		tmpl = defaultRejectionTemplates[reason]
+	}
+	entrant := ""
+	if f4.EntrantID > 0 {
+		entrant = strconv.Itoa(f4.EntrantID)
+	}
+	text := strings.NewReplacer("{subject}", subject, "{entrant}", entrant, "{bonus}", f4.BonusID,
+		"{reason}", detail, "{example}", subjectExampleText()).Replace(tmpl)
+	if reason == rejectPhoto && followUpWindow() > 0 {
+		text += fmt.Sprintf("\n\nSend the photo on its own within %v minutes and it will be added to this claim.", int(followUpWindow().Minutes()))
+	}
+	return text
+
+}
+
+// sendRejection tells the sender why their email wasn't accepted, if they're to be told.
+func sendRejection(from string, subject string, reason string, f4 *fourFields, detail string) {
+
+	if !cfg.RejectionNotices || cfg.TestMode || reason == "" {
+		return
+	}
+	a, err := mail.ParseAddress(from)
+	if err != nil || strings.EqualFold(a.Address, cfg.ImapLogin) {
+		return
+	}
+	if reason == rejectFormat && len(entrantsByEmail(from)) == 0 {
+		return
+	}
+	title := "Claim not accepted: "
+	if reason == rejectPhoto {
+		title = "Photo missing: "
+	}
+	if sendPlainMail(from, title+subject, rejectionText(reason, subject, f4, detail)) == nil && !*silent {
+		fmt.Printf("%v told %v why [%v] wasn't accepted, %v\n", logts(), a.Address, subject, reason)
+	}
+
+}
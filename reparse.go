@@ -0,0 +1,121 @@
+package main
+
+/*
+ * After correcting a bad timezone or Subject regex mid-rally, the claims
+ * already stored can be reparsed with:-
+ *
+ *		ebcfetch -db x.db reparse [-apply]
+ *
+ * Differences are listed and, with -apply, written back to ebclaims. Only
+ * what the Subject says is reparsed: a pillion's claim stays with the rider,
+ * an entrant found from the sender's phone stays found and a claim time
+ * taken from the photo's EXIF is kept.
+ *
+ */
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type storedClaim struct {
+	RowID      int
+	EntrantID  int
+	BonusID    string
+	OdoReading int
+	ClaimHH    int
+	ClaimMM    int
+	ClaimTime  string
+	Subject    string
+	DateTime   string
+	Flags      string // EbcFlags
+}
+
+// reparseClaim applies the current parsing rules to a stored claim.
+func reparseClaim(sc storedClaim) (*fourFields, bool) {
+
+	f4 := parseSubject(sc.Subject, false)
+	if !f4.ok {
+		return f4, false
+	}
+	if f4.EntrantID == 0 {
+		f4.EntrantID = sc.EntrantID // Not from the Subject
+	} else if rider := pillionOf(f4.EntrantID); rider > 0 {
+		f4.EntrantID = rider
+	}
+	if claimFlags(strings.Split(sc.Flags, ",")).has(flagExifTime) {
+		ct, err := time.Parse(timefmt, sc.ClaimTime)
+		if err != nil {
+			return f4, false
+		}
+		f4.ClaimTime = ct
+	}
+	if f4.ClaimTime.IsZero() {
+		sent, err := time.Parse(time.RFC3339, sc.DateTime)
+		if err != nil {
+			return f4, false
+		}
+		f4.ClaimTime = calcClaimDate(f4.TimeHH, f4.TimeMM, sent)
+	}
+	return f4, true
+
+}
+
+func runReparse(args []string) int {
+
+	fs := flag.NewFlagSet("reparse", flag.ContinueOnError)
+	apply := fs.Bool("apply", false, "Update the stored claims")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+
+	rows, err := dbh.Query("SELECT rowid,EntrantID,BonusID,IfNull(OdoReading,0),IfNull(ClaimHH,0),IfNull(ClaimMM,0),IfNull(ClaimTime,''),IfNull(Subject,''),IfNull(DateTime,''),IfNull(EbcFlags,'') FROM ebclaims ORDER BY rowid")
+	if err != nil {
+		fmt.Printf("%s: reparse failed %v\n", apptitle, err)
+		return 1
+	}
+	var claims []storedClaim
+	for rows.Next() {
+		var sc storedClaim
+		rows.Scan(&sc.RowID, &sc.EntrantID, &sc.BonusID, &sc.OdoReading, &sc.ClaimHH, &sc.ClaimMM, &sc.ClaimTime, &sc.Subject, &sc.DateTime, &sc.Flags)
+		claims = append(claims, sc)
+	}
+	rows.Close()
+
+	changed, failed := 0, 0
+	for _, sc := range claims {
+		f4, ok := reparseClaim(sc)
+		if !ok {
+			failed++
+			fmt.Printf("%v: [ %v ] no longer parses\n", sc.RowID, sc.Subject)
+			continue
+		}
+		ct := storeTimeDB(f4.ClaimTime)
+		if f4.EntrantID == sc.EntrantID && f4.BonusID == sc.BonusID && f4.OdoReading == sc.OdoReading &&
+			f4.TimeHH == sc.ClaimHH && f4.TimeMM == sc.ClaimMM && ct == sc.ClaimTime {
+			continue
+		}
+		changed++
+		fmt.Printf("%v: [ %v ]\n", sc.RowID, sc.Subject)
+		fmt.Printf("    was %v %v %v %02d%02d %v\n", sc.EntrantID, sc.BonusID, sc.OdoReading, sc.ClaimHH, sc.ClaimMM, sc.ClaimTime)
+		fmt.Printf("    now %v %v %v %02d%02d %v\n", f4.EntrantID, f4.BonusID, f4.OdoReading, f4.TimeHH, f4.TimeMM, ct)
+		if *apply {
+			sqlx := "UPDATE ebclaims SET EntrantID=?,BonusID=?,OdoReading=?,ClaimHH=?,ClaimMM=?,ClaimTime=? WHERE rowid=?"
+			_, err := dbExec(sqlx, f4.EntrantID, f4.BonusID, f4.OdoReading, f4.TimeHH, f4.TimeMM, ct, sc.RowID)
+			if err != nil {
+				fmt.Printf("%s: can't update claim %v %v\n", apptitle, sc.RowID, err)
+			}
+		}
+	}
+	if !*silent {
+		verb := "would change"
+		if *apply {
+			verb = "changed"
+		}
+		fmt.Printf("%s: %v claims reparsed, %v %v, %v unparseable\n", apptitle, len(claims), verb, changed, failed)
+	}
+	return 0
+
+}
@@ -0,0 +1,130 @@
+package main
+
+/*
+ * retry-flagged only reruns the emails flagged for attention. To put emails
+ * through again whatever became of them, after fixing the entrants list
+ * once a claim had been filed as a non-claim say:-
+ *
+ *		ebcfetch reprocess -uid 1234-1300
+ *		ebcfetch reprocess -since 2025-07-01 [-dryrun]
+ *
+ * picks out the emails in the INBOX by UID and/or date, clears whatever
+ * marks I've left on them and runs a fetch cycle to process them as new.
+ * Emails which already have a claim in ebclaims are left alone, as are
+ * resent claims recognised by their fingerprint. Emails moved to
+ * ArchiveMailbox aren't in the INBOX, and those outside notbefore/notafter
+ * aren't fetched, so neither can be reprocessed.
+ *
+ */
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// reprocessCriteria builds the search for the emails asked for.
+func reprocessCriteria(uids string, since string) (*imap.SearchCriteria, error) {
+
+	criteria := imap.NewSearchCriteria()
+	if uids == "" && since == "" {
+		return nil, fmt.Errorf("say which emails with -uid and/or -since")
+	}
+	if uids != "" {
+		set, err := imap.ParseSeqSet(strings.ReplaceAll(uids, "-", ":"))
+		if err != nil {
+			return nil, fmt.Errorf("-uid %v", err)
+		}
+		criteria.Uid = set
+	}
+	if since != "" {
+		t, err := time.ParseInLocation("2006-01-02", since, cfg.LocalTZ)
+		if err != nil {
+			return nil, fmt.Errorf("-since %v", err)
+		}
+		criteria.Since = t
+	}
+	return criteria, nil
+
+}
+
+// clearMarks lists whatever marks I may have left on emails.
+func clearMarks() []interface{} {
+
+	if labelMode() {
+		flags := []interface{}{stateLabel(mailClaimed), stateLabel(mailRejected)}
+		if cfg.GmailLabels {
+			flags = append(flags, stateLabel(mailIgnored), stateLabel(mailRetry))
+		}
+		return flags
+	}
+	return []interface{}{imap.SeenFlag, imap.FlaggedFlag}
+
+}
+
+// runReprocess is the reprocess subcommand.
+func runReprocess(args []string) int {
+
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	uidlist := fs.String("uid", "", "UIDs to reprocess, eg 1234-1300 or 17,21")
+	since := fs.String("since", "", "Reprocess emails received since this date, yyyy-mm-dd")
+	dryrun := fs.Bool("dryrun", false, "Just list the emails which would be reprocessed")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	criteria, err := reprocessCriteria(*uidlist, *since)
+	if err != nil {
+		fmt.Printf("%s: %v\n", apptitle, err)
+		return 1
+	}
+	if !monitoringOK() {
+		fmt.Printf("%s: monitoring is not possible, check configuration\n", apptitle)
+		return 1
+	}
+
+	c, err := imapConnect()
+	if err != nil {
+		fmt.Printf("%s: %v\n", apptitle, err)
+		return 1
+	}
+	found, err := c.UidSearch(criteria)
+	if err != nil {
+		c.Logout()
+		fmt.Printf("%s: Search: %v\n", apptitle, err)
+		return 1
+	}
+	uids := new(imap.SeqSet)
+	skipped := 0
+	for _, uid := range found {
+		if claimedUID(uid) {
+			skipped++
+			continue
+		}
+		uids.AddNum(uid)
+	}
+	if !*silent {
+		fmt.Printf("%s: reprocessing %v email(s), %v already claimed\n", apptitle, seqSetLen(uids), skipped)
+	}
+	if *dryrun || uids.Empty() {
+		if *dryrun && !uids.Empty() {
+			fmt.Printf("%s: would reprocess UIDs %v\n", apptitle, uids)
+		}
+		c.Logout()
+		return 0
+	}
+	item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+	err = c.UidStore(uids, item, clearMarks(), nil)
+	c.Logout()
+	if err != nil {
+		fmt.Printf("%s: can't clear marks %v\n", apptitle, err)
+		return 1
+	}
+
+	cfg.FetchPageSize = -1 // All of them now, not a page at a time
+	fetchNewClaims()
+	return 0
+
+}
@@ -0,0 +1,234 @@
+package main
+
+/*
+ * Test responses are rendered from an html/template so that rallies can
+ * word them as they like and, on the continent, reply in each rider's own
+ * language. The template is looked for, in order:-
+ *
+ *		ResponseTemplates[lang]				from the config
+ *		ResponseTemplateDir/testresponse.lang.html
+ *		ResponseTemplates[""]
+ *		ResponseTemplateDir/testresponse.html
+ *
+ * falling back to my own English one, defaultResponseTemplate. lang comes
+ * from the entrant's Language column, mapped with Columns as usual, eg
+ * "entrants.Language: Lang". A template may {{define "subject"}} to set the
+ * response's Subject, otherwise TestResponseSubject is used as before.
+ *
+ * A template which won't parse or execute is reported and mine used instead,
+ * riders always get an answer.
+ *
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultResponseTemplate = `{{define "row"}}</td></tr><tr><td style="{{lblstyle}}">{{end -}}
+<p>{{if .Good}}{{.GoodText}}{{else}}{{.BadText}}{{end}} [ {{.RallyTitle}} (TZ={{.LocalTimezone}} {{.OffsetTZ}}) {{.TestModeLiteral}} ]</p>
+<table><tr><td style="{{lblstyle}}">Subject</td><td>{{.ClaimSubject}}{{if .SubjectFromBody}} &#x2611;{{end}} {{yesno .SubjectOk}}
+{{- template "row"}}Entrant#</td><td>{{.F4.EntrantID}}{{yesno .ValidEntrantID}}
+{{- if .ValidEntrantID}}{{template "row"}}Email = Entrant Email</td><td>{{yesno .AddressIsRegistered}} {{if .AddressIsRegistered}}{{.GoodEmailText}}{{else}}{{.BadEmailText}}{{end}}{{if .EmailMatched}} [{{.EmailMatched}}]{{end}}{{end}}
+{{- template "row"}}Bonus</td><td>{{.BonusID}}
+{{- if .BonusIsReal}} - {{.BonusDesc}}{{yesno true}}{{if .WindowText}} (available {{.WindowText}}){{end}}
+{{- range .Combos}}<br>Counts towards {{.Name}}, with {{.Needs}}{{end}}
+{{- else}}{{yesno false}}{{if .IsCombo}} {{.ComboName}} is a combination, scored once you've claimed {{.ComboNeeds}}. Claim those bonuses instead{{end}}{{end}}
+{{- template "row"}}Odo</td><td>{{.OdoReading}}{{yesno .OdoOk}}
+{{- template "row"}}hhmm '{{.HHmm}}'</td><td>{{yesno .F4.TimeOk}}{{if .TimeTyped}} read from '{{.TimeTyped}}'{{end}} {{.ClaimUnix}} / {{.ClaimRFC}}
+{{- if or .ExtraField .AnswerNeeded}}{{template "row"}}&#x270D;</td><td>{{.ExtraField}}{{if .AnswerNeeded}}{{yesno .AnswerOk}}{{end}}{{end}}
+{{- template "row"}}Photo</td><td>{{if gt .PhotoPresent 1}} x {{.PhotoPresent}} {{end}}{{yesno .PhotoOk}}{{if gt .PhotoPresent .MaxPhoto}}  (max = {{.MaxPhoto}}){{end}}
+{{- range .Attachments}}{{template "row"}}&#x1F4CE;</td><td>{{.}}{{end}}
+{{- range .Warnings}}{{template "row"}}&#x26A0;</td><td>{{.}}{{end}}
+{{- if .Rejection}}{{template "row"}}&#x274C;</td><td>{{.Rejection}}{{end -}}
+</td></tr></table>
+{{- range .Advice}}<p>{{.}}</p>{{end}}
+<p>ScoreMaster [{{.Version}} :]</p>`
+
+// responseCombo is a combination as shown in a test response.
+type responseCombo struct {
+	Name  string
+	Needs string
+}
+
+// responseData is what response templates are given to work with.
+type responseData struct {
+	testResponse
+	F4                          fourFields
+	Good, SubjectOk, PhotoOk    bool
+	OdoOk                       bool
+	MaxPhoto                    int
+	Language                    string
+	RallyTitle, LocalTimezone   string
+	OffsetTZ, TestModeLiteral   string
+	GoodText, BadText           template.HTML // TestResponseGood, TestResponseBad
+	GoodEmailText, BadEmailText template.HTML // TestResponseGoodEmail, TestResponseBadEmail
+	WindowText                  string
+	Combos                      []responseCombo
+	ComboName, ComboNeeds       string
+	ClaimUnix, ClaimRFC         string
+	Warnings                    []template.HTML // The claim's flags described
+	Advice                      []template.HTML // About clocks and the like, then TestResponseAdvice
+	Version                     string
+}
+
+var responseFuncs = template.FuncMap{
+	"yesno":    func(x bool) template.HTML { return template.HTML(yesno(x)) },
+	"lblstyle": func() template.CSS { return template.CSS(ResponseStyleLbl) },
+}
+
+// entrantLanguage returns an entrant's preferred language, "" if not known.
+func entrantLanguage(entrant int) string {
+
+	if entrant < 1 || !hasColumn("entrants", "Language") {
+		return ""
+	}
+	var lang string
+	dbh.QueryRow("SELECT IfNull("+col("entrants", "Language")+",'') FROM entrants WHERE EntrantID=?", entrant).Scan(&lang)
+	return strings.ToLower(strings.TrimSpace(lang))
+
+}
+
+// responseTemplateText finds the template for a language.
+func responseTemplateText(lang string) string {
+
+	look := func(lang string, fname string) string {
+		if t, ok := cfg.ResponseTemplates[lang]; ok && t != "" {
+			return t
+		}
+		if cfg.ResponseTemplateDir != "" {
+			if t, err := os.ReadFile(filepath.Join(cfg.ResponseTemplateDir, fname)); err == nil {
+				return string(t)
+			}
+		}
+		return ""
+	}
+	if lang != "" {
+		if t := look(lang, "testresponse."+lang+".html"); t != "" {
+			return t
+		}
+	}
+	if t := look("", "testresponse.html"); t != "" {
+		return t
+	}
+	return defaultResponseTemplate
+
+}
+
+// newResponseData gathers what a response template needs.
+func newResponseData(tr testResponse, f4 *fourFields) responseData {
+
+	rd := responseData{testResponse: tr, F4: *f4}
+	rd.MaxPhoto = 1 + cfg.MaxExtraPhotos
+	rd.PhotoOk = tr.PhotoPresent <= rd.MaxPhoto && (tr.PhotoPresent > 0 || (tr.PhotoPresent == 0 && !tr.Requirements.Photo))
+	rd.OdoOk = f4.OdoOk || !tr.Requirements.Odo
+	rd.Good = tr.ClaimIsGood && rd.PhotoOk && rd.OdoOk
+	rd.SubjectOk = f4.ok && f4.TimeOk
+	rd.Language = entrantLanguage(f4.EntrantID)
+	rd.RallyTitle, rd.LocalTimezone, rd.OffsetTZ, rd.TestModeLiteral = cfg.RallyTitle, cfg.LocalTimezone, cfg.OffsetTZ, cfg.TestModeLiteral
+	rd.GoodText, rd.BadText = template.HTML(cfg.TestResponseGood), template.HTML(cfg.TestResponseBad)
+	rd.GoodEmailText, rd.BadEmailText = template.HTML(cfg.TestResponseGoodEmail), template.HTML(cfg.TestResponseBadEmail)
+	if tr.Window.isSet() {
+		rd.WindowText = tr.Window.String()
+	}
+	for _, ci := range tr.Combos {
+		rd.Combos = append(rd.Combos, responseCombo{ci.String(), ci.needs()})
+	}
+	if tr.IsCombo {
+		rd.ComboName, rd.ComboNeeds = tr.Combo.String(), tr.Combo.needs()
+	}
+	rd.ClaimUnix, rd.ClaimRFC = tr.ClaimDateTime.Format(time.UnixDate), tr.ClaimDateTime.Format(time.RFC3339)
+	for _, w := range tr.Flags.describe() {
+		rd.Warnings = append(rd.Warnings, template.HTML(w))
+	}
+	for _, a := range []string{clockSkewAdvice(tr.ClockSkew, tr.ClockSamples), deviceZoneAdvice(tr.SentAt), cfg.TestResponseAdvice} {
+		if a != "" {
+			rd.Advice = append(rd.Advice, template.HTML(a))
+		}
+	}
+	rd.Version = apptitle + " v" + appversion
+	return rd
+
+}
+
+// renderResponse executes a response template, returning its subject, if
+// it defines one, and body.
+func renderResponse(text string, rd responseData) (string, string, error) {
+
+	t, err := template.New("response").Funcs(responseFuncs).Parse(text)
+	if err != nil {
+		return "", "", err
+	}
+	var body bytes.Buffer
+	if err = t.Execute(&body, rd); err != nil {
+		return "", "", err
+	}
+	subject := ""
+	if t.Lookup("subject") != nil {
+		var sb bytes.Buffer
+		if err = t.ExecuteTemplate(&sb, "subject", rd); err != nil {
+			return "", "", err
+		}
+		subject = strings.TrimSpace(html2text(sb.String()))
+	}
+	return subject, body.String(), nil
+
+}
+
+// html2text undoes the escaping html/template applies to a subject.
+func html2text(s string) string {
+
+	r := strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&#34;", `"`, "&#39;", "'", "&quot;", `"`)
+	return r.Replace(s)
+
+}
+
+// testResponseHTML renders the test response, returning its subject and body.
+func testResponseHTML(tr testResponse, f4 *fourFields) (string, string) {
+
+	rd := newResponseData(tr, f4)
+	subject, body, err := renderResponse(responseTemplateText(rd.Language), rd)
+	if err != nil {
+		fmt.Printf("%s test response template [%v] %v\n", logts(), rd.Language, err)
+		subject, body, _ = renderResponse(defaultResponseTemplate, rd)
+	}
+	if subject == "" {
+		subject = cfg.TestResponseSubject
+	}
+	if subject == "" && rd.Good {
+		subject = "EBC test: " + cfg.TestResponseGood
+	} else if subject == "" {
+		subject = "EBC test: " + cfg.TestResponseBad
+	}
+	return subject, body
+
+}
+
+// checkResponseTemplates reports templates which won't parse, at startup.
+func checkResponseTemplates() {
+
+	texts := make(map[string]string)
+	for lang, t := range cfg.ResponseTemplates {
+		texts["ResponseTemplates["+strconv.Quote(lang)+"]"] = t
+	}
+	if cfg.ResponseTemplateDir != "" {
+		files, _ := filepath.Glob(filepath.Join(cfg.ResponseTemplateDir, "testresponse*.html"))
+		for _, fn := range files {
+			if t, err := os.ReadFile(fn); err == nil {
+				texts[fn] = string(t)
+			}
+		}
+	}
+	for name, t := range texts {
+		if _, err := template.New("response").Funcs(responseFuncs).Parse(t); err != nil {
+			fmt.Printf("%s: test response template %v won't be used, %v\n", apptitle, name, err)
+		}
+	}
+
+}
@@ -0,0 +1,108 @@
+package main
+
+/*
+ * Emails which couldn't be handled just now, the database was busy say,
+ * are left to be picked up again next cycle. If I'm restarted before that
+ * happens, and meanwhile someone has opened or flagged them, they could
+ * be stranded so I keep a note of them in ebcretries. When I start I clear
+ * whatever flags would stop them being fetched so they get another go.
+ *
+ * UIDs only mean anything within one UIDVALIDITY of the INBOX so notes
+ * from an earlier one are thrown away. Each mailbox I fetch from has its own.
+ *
+ */
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// inboxValidity is the UIDVALIDITY of the INBOX, or other source, as last selected.
+var inboxValidity uint32
+
+// retriesReleased notes the sources whose pending retries have been released.
+var retriesReleased = make(map[string]bool)
+
+// seqSetNums lists the numbers in a set built by AddNum.
+func seqSetNums(s *imap.SeqSet) []uint32 {
+
+	var res []uint32
+	for _, x := range s.Set {
+		for n := x.Start; n <= x.Stop && n != 0; n++ {
+			res = append(res, n)
+		}
+	}
+	return res
+
+}
+
+// rememberRetries records emails which are to be tried again.
+func rememberRetries(uids *imap.SeqSet) {
+
+	now := storeTimeDB(time.Now())
+	for _, uid := range seqSetNums(uids) {
+		_, err := dbExec("INSERT OR IGNORE INTO ebcretries (EmailID,UidValidity,SkippedAt,Source) VALUES(?,?,?,?)", uid, inboxValidity, now, source.key())
+		if err != nil {
+			log.Printf("can't record retry [%v] %v\n", uid, err)
+		}
+	}
+
+}
+
+// forgetRetries drops the notes of emails which have now been dealt with.
+func forgetRetries(sets ...*imap.SeqSet) {
+
+	for _, s := range sets {
+		for _, uid := range seqSetNums(s) {
+			dbExec("DELETE FROM ebcretries WHERE EmailID=? AND UidValidity=? AND IfNull(Source,'')=?", uid, inboxValidity, source.key())
+		}
+	}
+
+}
+
+// pendingRetries returns the UIDs of emails still to be retried.
+func pendingRetries() *imap.SeqSet {
+
+	uids := new(imap.SeqSet)
+	dbExec("DELETE FROM ebcretries WHERE UidValidity<>? AND IfNull(Source,'')=?", inboxValidity, source.key())
+	rows, err := dbh.Query("SELECT EmailID FROM ebcretries WHERE UidValidity=? AND IfNull(Source,'')=?", inboxValidity, source.key())
+	if err != nil {
+		log.Printf("can't load retries %v\n", err)
+		return uids
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid uint32
+		rows.Scan(&uid)
+		uids.AddNum(uid)
+	}
+	return uids
+
+}
+
+// releaseRetries makes sure emails left over from before I was started
+// will be fetched again.
+func releaseRetries(c *client.Client) {
+
+	uids := pendingRetries()
+	if !uids.Empty() && len(selectionExcludes()) > 0 {
+		var flags []interface{}
+		for _, f := range selectionExcludes() {
+			flags = append(flags, f)
+		}
+		if !*silent {
+			fmt.Printf("%s releasing %v email(s) left for retry\n", logts(), seqSetLen(uids))
+		}
+		item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+		if err := c.UidStore(uids, item, flags, nil); err != nil {
+			log.Printf("can't release retries %v\n", err)
+			return
+		}
+	}
+	retriesReleased[source.key()] = true
+
+}
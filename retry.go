@@ -0,0 +1,114 @@
+package main
+
+/*
+ * Emails I couldn't deal with are left flagged for manual attention. Once
+ * the reason has been fixed, a corrected Subject regex or a missing entrant
+ * added, they can be put back through the normal process by:-
+ *
+ *		ebcfetch -db x.db retry-flagged
+ *
+ * Those moved to RejectedMailbox are moved back to the INBOX first.
+ *
+ */
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// unflagForRetry clears the flags of previously flagged emails so that
+// the next fetch treats them as new, returning how many were found.
+func unflagForRetry() (int, error) {
+
+	c, err := imapConnect()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Logout()
+
+	if cfg.RejectedMailbox != "" {
+		if err := recallRejected(c); err != nil {
+			return 0, err
+		}
+	}
+
+	flagged := imap.FlaggedFlag
+	if labelMode() {
+		flagged = stateLabel(mailRejected)
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{flagged}
+	notBefore, notAfter := fetchWindow()
+	if !notBefore.IsZero() {
+		criteria.SentSince = notBefore
+	}
+	if !notAfter.IsZero() {
+		criteria.SentBefore = notAfter
+	}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return 0, fmt.Errorf("Search: %v", err)
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+	flags := []interface{}{flagged, imap.SeenFlag}
+	if labelMode() {
+		flags = []interface{}{flagged}
+	}
+	if *verbose {
+		fmt.Printf("%s releasing %v %v %v\n", logts(), seqset, item, flags)
+	}
+	err = c.UidStore(seqset, item, flags, nil)
+	return len(uids), err
+
+}
+
+// runRetryFlagged reruns flagged emails through the normal claim process.
+func runRetryFlagged(args []string) int {
+
+	if !monitoringOK() {
+		fmt.Printf("%s: monitoring is not possible, check configuration\n", apptitle)
+		return 1
+	}
+	n, err := unflagForRetry()
+	if err != nil {
+		fmt.Printf("%s: retry failed %v\n", apptitle, err)
+		return 1
+	}
+	if !*silent {
+		fmt.Printf("%s: retrying %v flagged email(s)\n", apptitle, n)
+	}
+	if n > 0 {
+		fetchNewClaims()
+	}
+	return 0
+
+}
+
+// recallRejected moves everything in RejectedMailbox back to the INBOX,
+// leaving the INBOX selected.
+func recallRejected(c *client.Client) error {
+
+	mbox, err := c.Select(cfg.RejectedMailbox, false)
+	if err != nil || mbox.Messages == 0 {
+		_, err = c.Select(source.Mailbox, false)
+		return err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, mbox.Messages)
+	if debugging(debugIMAP) {
+		fmt.Printf("%s moving %v email(s) back from %v\n", logts(), mbox.Messages, cfg.RejectedMailbox)
+	}
+	if err := c.Move(seqset, source.Mailbox); err != nil {
+		return fmt.Errorf("Move: %v", err)
+	}
+	_, err = c.Select(source.Mailbox, false)
+	return err
+
+}
@@ -0,0 +1,83 @@
+package main
+
+/*
+ * Riders worried that a claim went astray can email STATUS from their
+ * registered address and get back a list of what I've recorded for them so
+ * far, saving a phone call to rally HQ.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isStatusQuery recognises a rider's STATUS request.
+func isStatusQuery(subject string) bool {
+	return strings.EqualFold(strings.TrimSpace(subject), "STATUS")
+}
+
+// claimState describes how far the scorer has got with a claim.
+func claimState(processed int, decision int, cancelled int) string {
+
+	switch {
+	case cancelled != 0:
+		return "cancelled by you"
+	case processed == 0 || decision < 0:
+		return "awaiting judging"
+	case decision == 0:
+		return "accepted"
+	}
+	return fmt.Sprintf("rejected (reason %v)", decision)
+
+}
+
+// riderStatusText lists the claims recorded for an entrant.
+func riderStatusText(entrant int) string {
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Claims recorded for entrant %v in %v\n\n", entrant, cfg.RallyTitle)
+	rows, err := dbh.Query("SELECT IfNull(BonusID,''),IfNull(ClaimTime,''),IfNull(PhotoIDs,''),IfNull(Processed,0),IfNull(Decision,-1),IfNull(RiderCancelled,0) FROM ebclaims WHERE EntrantID=? ORDER BY ClaimTime,rowid", entrant)
+	if err != nil {
+		fmt.Printf("%s rider status %v\n", logts(), err)
+		sb.WriteString("Sorry, I can't read the claims just now.\n")
+		return sb.String()
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var bonus, claimtime, photos string
+		var processed, decision, cancelled int
+		rows.Scan(&bonus, &claimtime, &photos, &processed, &decision, &cancelled)
+		np := 0
+		if photos != "" {
+			np = len(strings.Split(photos, ","))
+		}
+		fmt.Fprintf(&sb, "%-8v %v  photos: %v  %v\n", bonus, claimtime, np, claimState(processed, decision, cancelled))
+		n++
+	}
+	if n == 0 {
+		sb.WriteString("None yet.\n")
+	}
+	return sb.String()
+
+}
+
+// handleStatusQuery replies to a rider's STATUS request, reporting whether
+// the sender is registered to any entrant.
+func handleStatusQuery(emailid uint32, from string, subject string) bool {
+
+	entrants := entrantsByEmail(from)
+	if len(entrants) == 0 {
+		writeAudit(emailid, from, subject, auditRejected, "status query from unregistered address")
+		return false
+	}
+	var body []string
+	for _, e := range entrants {
+		body = append(body, riderStatusText(e))
+	}
+	sendPlainMail(from, cfg.RallyTitle+": your claims", strings.Join(body, "\n"))
+	writeAudit(emailid, from, subject, auditStatus, fmt.Sprintf("claims listed for %v", entrants))
+	return true
+
+}
@@ -0,0 +1,415 @@
+package main
+
+/*
+ * Rallies keep inventing one-off rules which don't belong in the code. An
+ * organiser can instead write them in cfg.Rules as simple expressions which
+ * are evaluated against each claim. A rule which holds adds its Flag to the
+ * claim or, if it has a Reject reason, rejects the claim altogether.
+ *
+ *		Rules:
+ *		  - When: BonusID in ("CAFE1", "CAFE2") && ClaimHH < 7
+ *		    Flag: CAF
+ *		    Desc: Cafe bonus claimed before opening time
+ *		  - When: Photos == 0 && BonusID =~ "^P"
+ *		    Reject: Photo bonus without a photo
+ *
+ * Expressions may use the claim's fields, see ruleVars, numbers, "strings",
+ * true and false, parentheses, the operators
+ *
+ *		||  &&  !  ==  !=  <  <=  >  >=  +  -  in (list)  =~ "regex"
+ *
+ * and "and", "or" and "not" as words. Strings compare without regard to case.
+ *
+ * The rules are checked when the configuration is loaded. I won't start
+ * with one I can't evaluate, and a reload which brings one keeps the rules
+ * I had.
+ *
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type claimRule struct {
+	When   string `yaml:"When"`
+	Flag   string `yaml:"Flag"`   // Added to the claim's flags
+	Desc   string `yaml:"Desc"`   // Describes Flag in test responses
+	Reject string `yaml:"Reject"` // Reason for rejecting the claim
+}
+
+// ruleVars gives the names available to rule expressions.
+func ruleVars(f4 fourFields, from string, subject string, photos int) map[string]interface{} {
+
+	vars := map[string]interface{}{
+		"EntrantID":  float64(f4.EntrantID),
+		"BonusID":    f4.BonusID,
+		"OdoReading": float64(f4.OdoReading),
+		"ClaimHH":    float64(f4.TimeHH),
+		"ClaimMM":    float64(f4.TimeMM),
+		"ClaimTime":  storeTimeDB(f4.ClaimTime),
+		"Weekday":    f4.ClaimTime.Weekday().String(),
+		"Extra":      f4.Extra,
+		"Subject":    subject,
+		"From":       from,
+		"Photos":     float64(photos),
+		"Leg":        float64(legOfClaim(f4.ClaimTime)),
+		"BonusLeg":   float64(fetchBonusLeg(f4.BonusID)),
+		"TeamID":     float64(fetchTeamID(f4.EntrantID)),
+	}
+	var rider string
+	dbh.QueryRow("SELECT IfNull("+col("entrants", "RiderName")+",'') FROM entrants WHERE "+col("entrants", "EntrantID")+"=?", f4.EntrantID).Scan(&rider)
+	vars["RiderName"] = rider
+	return vars
+
+}
+
+// checkRules makes sure every rule can be evaluated, its names known and
+// its syntax sound, so that a mistake is found when the configuration is
+// loaded rather than claim by claim.
+func checkRules() error {
+
+	if len(cfg.Rules) == 0 {
+		return nil
+	}
+	vars := ruleVars(fourFields{}, "", "", 0)
+	for i, r := range cfg.Rules {
+		if strings.TrimSpace(r.When) == "" {
+			return fmt.Errorf("rule %v has no When", i+1)
+		}
+		if r.Flag == "" && r.Reject == "" {
+			return fmt.Errorf("rule %v [%v] has neither Flag nor Reject", i+1, r.When)
+		}
+		if _, err := evalRule(r.When, vars); err != nil {
+			return fmt.Errorf("rule %v [%v] %v", i+1, r.When, err)
+		}
+	}
+	return nil
+
+}
+
+// applyRules evaluates cfg.Rules, adding flags, and returns the reason
+// for rejecting the claim if any rule says so.
+func applyRules(vars map[string]interface{}, flags *claimFlags) string {
+
+	for _, r := range cfg.Rules {
+		ok, err := evalRule(r.When, vars)
+		if err != nil {
+			if !*silent {
+				fmt.Printf("%s rule [%v] %v\n", logts(), r.When, err)
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if r.Flag != "" {
+			flags.add(r.Flag)
+		}
+		if r.Reject != "" {
+			return r.Reject
+		}
+	}
+	return ""
+
+}
+
+// ruleDescription finds the description of a flag added by a rule.
+func ruleDescription(flag string) (string, bool) {
+
+	for _, r := range cfg.Rules {
+		if r.Flag == flag && r.Desc != "" {
+			return r.Desc, true
+		}
+	}
+	return "", false
+
+}
+
+// evalRule evaluates an expression which must produce true or false.
+func evalRule(expr string, vars map[string]interface{}) (bool, error) {
+
+	toks, err := ruleTokens(expr)
+	if err != nil {
+		return false, err
+	}
+	p := &ruleParser{toks: toks, vars: vars}
+	v, err := p.or()
+	if err != nil {
+		return false, err
+	}
+	if p.pos < len(p.toks) {
+		return false, fmt.Errorf("unexpected %v", p.toks[p.pos])
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("result %v isn't true or false", v)
+	}
+	return b, nil
+
+}
+
+var ruleTokenRE = regexp.MustCompile(`^(?:\s+|(\d+(?:\.\d+)?)|("[^"]*"|'[^']*')|([A-Za-z_]\w*)|(==|!=|<=|>=|=~|&&|\|\||[<>!(),+-]))`)
+
+type ruleToken struct {
+	kind byte // n=number, s=string, i=identifier, o=operator
+	text string
+}
+
+func (t ruleToken) String() string {
+	return t.text
+}
+
+func ruleTokens(expr string) ([]ruleToken, error) {
+
+	var res []ruleToken
+	for len(expr) > 0 {
+		x := ruleTokenRE.FindStringSubmatch(expr)
+		if x == nil {
+			return nil, fmt.Errorf("can't understand %q", expr)
+		}
+		switch {
+		case x[1] != "":
+			res = append(res, ruleToken{'n', x[1]})
+		case x[2] != "":
+			res = append(res, ruleToken{'s', x[2][1 : len(x[2])-1]})
+		case x[3] != "":
+			switch strings.ToLower(x[3]) {
+			case "and":
+				res = append(res, ruleToken{'o', "&&"})
+			case "or":
+				res = append(res, ruleToken{'o', "||"})
+			case "not":
+				res = append(res, ruleToken{'o', "!"})
+			case "in":
+				res = append(res, ruleToken{'o', "in"})
+			default:
+				res = append(res, ruleToken{'i', x[3]})
+			}
+		case x[4] != "":
+			res = append(res, ruleToken{'o', x[4]})
+		}
+		expr = expr[len(x[0]):]
+	}
+	return res, nil
+
+}
+
+// ruleParser is a recursive descent evaluator, one method per precedence level.
+type ruleParser struct {
+	toks []ruleToken
+	pos  int
+	vars map[string]interface{}
+}
+
+func (p *ruleParser) accept(op string) bool {
+
+	if p.pos < len(p.toks) && p.toks[p.pos].kind == 'o' && p.toks[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+
+}
+
+func (p *ruleParser) or() (interface{}, error) {
+
+	l, err := p.and()
+	for err == nil && p.accept("||") {
+		var r interface{}
+		r, err = p.and()
+		if err == nil {
+			l = truthy(l) || truthy(r)
+		}
+	}
+	return l, err
+
+}
+
+func (p *ruleParser) and() (interface{}, error) {
+
+	l, err := p.not()
+	for err == nil && p.accept("&&") {
+		var r interface{}
+		r, err = p.not()
+		if err == nil {
+			l = truthy(l) && truthy(r)
+		}
+	}
+	return l, err
+
+}
+
+func (p *ruleParser) not() (interface{}, error) {
+
+	if p.accept("!") {
+		v, err := p.not()
+		return !truthy(v), err
+	}
+	return p.compare()
+
+}
+
+func (p *ruleParser) compare() (interface{}, error) {
+
+	l, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("in") {
+		if !p.accept("(") {
+			return nil, fmt.Errorf("in needs a (list)")
+		}
+		found := false
+		for {
+			r, err := p.sum()
+			if err != nil {
+				return nil, err
+			}
+			found = found || ruleCompare(l, r) == 0
+			if p.accept(")") {
+				return found, nil
+			}
+			if !p.accept(",") {
+				return nil, fmt.Errorf("in list needs commas")
+			}
+		}
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "=~"} {
+		if !p.accept(op) {
+			continue
+		}
+		r, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if op == "=~" {
+			re, err := regexp.Compile("(?i)" + fmt.Sprint(r))
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(fmt.Sprint(l)), nil
+		}
+		c := ruleCompare(l, r)
+		switch op {
+		case "==":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">=":
+			return c >= 0, nil
+		case "<":
+			return c < 0, nil
+		default:
+			return c > 0, nil
+		}
+	}
+	return l, nil
+
+}
+
+func (p *ruleParser) sum() (interface{}, error) {
+
+	l, err := p.primary()
+	for err == nil {
+		neg := false
+		if p.accept("-") {
+			neg = true
+		} else if !p.accept("+") {
+			break
+		}
+		var r interface{}
+		r, err = p.primary()
+		ln, lok := l.(float64)
+		rn, rok := r.(float64)
+		if err == nil && !(lok && rok) {
+			err = fmt.Errorf("can only add or subtract numbers")
+		}
+		if neg {
+			rn = -rn
+		}
+		l = ln + rn
+	}
+	return l, err
+
+}
+
+func (p *ruleParser) primary() (interface{}, error) {
+
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch t.kind {
+	case 'n':
+		return strconv.ParseFloat(t.text, 64)
+	case 's':
+		return t.text, nil
+	case 'i':
+		switch strings.ToLower(t.text) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		v, ok := p.vars[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown name %v", t.text)
+		}
+		return v, nil
+	}
+	if t.text == "(" {
+		v, err := p.or()
+		if err == nil && !p.accept(")") {
+			err = fmt.Errorf("missing )")
+		}
+		return v, err
+	}
+	if t.text == "-" {
+		v, err := p.primary()
+		n, ok := v.(float64)
+		if err == nil && !ok {
+			err = fmt.Errorf("can only negate numbers")
+		}
+		return -n, err
+	}
+	return nil, fmt.Errorf("unexpected %v", t.text)
+
+}
+
+func truthy(v interface{}) bool {
+
+	switch x := v.(type) {
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	}
+	return false
+
+}
+
+// ruleCompare compares numbers numerically and anything else as case-insensitive text.
+func ruleCompare(l interface{}, r interface{}) int {
+
+	ln, lok := l.(float64)
+	rn, rok := r.(float64)
+	if lok && rok {
+		switch {
+		case ln < rn:
+			return -1
+		case ln > rn:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(strings.ToLower(fmt.Sprint(l)), strings.ToLower(fmt.Sprint(r)))
+
+}
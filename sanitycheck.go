@@ -0,0 +1,46 @@
+package main
+
+/*
+ * Some claims simply can't be right: timed before the rally started or
+ * after it finished, or with an odo reading lower than the entrant's claim
+ * before it. They're still stored, a typo in the hhmm is the usual cause and
+ * the judges can put it right, but flagged so they're seen straight away.
+ * The codes are also stored on their own in ebclaims.SanityFlags so that
+ * impossible claims can be picked out without picking through EbcFlags.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateClaimSanity flags impossible claim times and odo readings,
+// returning the codes of those found.
+func validateClaimSanity(f4 fourFields, flags *claimFlags) claimFlags {
+
+	var res claimFlags
+	if !f4.ClaimTime.IsZero() && cfg.RallyStart.Before(cfg.RallyFinish) {
+		if f4.ClaimTime.Before(cfg.RallyStart) {
+			res.add(flagBeforeStart)
+		} else if f4.ClaimTime.After(cfg.RallyFinish) {
+			res.add(flagAfterFinish)
+		}
+	}
+	if f4.OdoOk && !f4.ClaimTime.IsZero() {
+		if odo, ct, ok := neighbourClaim(f4.EntrantID, f4.ClaimTime, true); ok && f4.OdoReading < odo {
+			res.add(flagOdoBackwards)
+			if *verbose {
+				fmt.Printf("%s entrant %v odo %v is less than %v at %v\n", logts(), f4.EntrantID, f4.OdoReading, odo, ct.Format(myTimeFormat))
+			}
+		}
+	}
+	for _, f := range res {
+		flags.add(f)
+	}
+	if len(res) > 0 && *verbose {
+		fmt.Printf("%s entrant %v bonus %v at %v: %v\n", logts(), f4.EntrantID, f4.BonusID, f4.ClaimTime.Format(myTimeFormat), strings.Join(res.describe(), "; "))
+	}
+	return res
+
+}
@@ -0,0 +1,176 @@
+package main
+
+/*
+ * Matching the From address against the entrant's is no defence against
+ * someone who knows it, From is trivially forged. The mail server which
+ * received the claim will have checked its DKIM signature and SPF and
+ * recorded what it found in an Authentication-Results header, eg:-
+ *
+ *		Authentication-Results: mx.google.com; dkim=pass header.i=@example.com;
+ *		   spf=pass smtp.mailfrom=bob@example.com; dmarc=pass header.from=example.com
+ *
+ * With CheckSenderAuth set I read that and, if nothing vouches for the From
+ * address, flag the claim. A sender can add a header of their own, and
+ * not every receiving server adds one, so none is believed unless
+ * SenderAuthServers lists the authserv-ids, mx.google.com above, to trust.
+ * The sender is vouched for by dmarc=pass or by a pass from dkim or spf for
+ * the From address's domain. RejectUnauthenticated treats claims which
+ * fail as not from the entrant at all.
+ *
+ * Whatever the headers say I also verify the email's DKIM signature myself,
+ * fetching the signer's key from DNS, so a signature by the From address's
+ * domain vouches for the sender even without SenderAuthServers. The same
+ * check applies to admin commands, see admin.go.
+ *
+ * ebclaims.AuthOk records 1 for a pass, 0 for a failure and is left empty
+ * when there was nothing to go on.
+ *
+ */
+
+import (
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/toorop/go-dkim"
+)
+
+// dkimLookupTXT fetches DKIM keys, replaced when testing.
+var dkimLookupTXT = net.LookupTXT
+
+// senderAuthResult is what the receiving server found.
+type senderAuthResult struct {
+	Checked bool   // Results were found for DKIM, SPF or DMARC
+	Pass    bool   // One of them vouches for the From address
+	Summary string // eg dkim=pass spf=fail verified-dkim=pass
+}
+
+// authCommentRE matches the comments in an Authentication-Results header.
+var authCommentRE = regexp.MustCompile(`\([^)]*\)`)
+
+// domainOf returns the domain of an address or DKIM identity.
+func domainOf(addr string) string {
+
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		addr = addr[i+1:]
+	}
+	return strings.ToLower(strings.Trim(addr, " <>."))
+
+}
+
+// authAligned reports whether an authenticated domain speaks for the From domain.
+func authAligned(d string, from string) bool {
+
+	d = domainOf(d)
+	return d != "" && (d == from || strings.HasSuffix(from, "."+d) || strings.HasSuffix(d, "."+from))
+
+}
+
+// trustedAuthResults picks the Authentication-Results header to believe.
+func trustedAuthResults(h mail.Header) (string, bool) {
+
+	if len(cfg.SenderAuthServers) == 0 {
+		return "", false // Perhaps the sender's own
+	}
+	for _, ar := range h["Authentication-Results"] {
+		ar = authCommentRE.ReplaceAllString(ar, "")
+		id := strings.Fields(strings.SplitN(ar, ";", 2)[0])
+		if len(id) > 0 && containsFold(cfg.SenderAuthServers, id[0]) {
+			return ar, true
+		}
+	}
+	return "", false
+
+}
+
+// verifyDKIM checks the email's DKIM signature, reporting whether there was
+// one which could be checked and whether it's valid and by the From domain.
+func verifyDKIM(raw []byte, from string) (bool, bool) {
+
+	if len(raw) == 0 {
+		return false, false
+	}
+	email := append([]byte{}, raw...) // Verify may alter it
+	status, _ := dkim.Verify(&email, dkim.DNSOptLookupTXT(dkimLookupTXT))
+	switch status {
+	case dkim.SUCCESS:
+		sig, err := dkim.GetHeader(&email)
+		return true, err == nil && authAligned(sig.Domain, from)
+	case dkim.PERMFAIL:
+		return true, false
+	}
+	return false, false // Unsigned, or the key couldn't be fetched just now
+
+}
+
+// senderAuth decides whether the email's DKIM signature, or the receiving
+// server, vouched for the From address.
+func senderAuth(h mail.Header, raw []byte) senderAuthResult {
+
+	var res senderAuthResult
+	from := ""
+	if a, err := mail.ParseAddress(h.Get("From")); err == nil {
+		from = domainOf(a.Address)
+	}
+	var summary []string
+	if checked, pass := verifyDKIM(raw, from); checked {
+		res.Checked, res.Pass = true, pass
+		if pass {
+			summary = append(summary, "verified-dkim=pass")
+		} else {
+			summary = append(summary, "verified-dkim=fail")
+		}
+	}
+	ar, ok := trustedAuthResults(h)
+	if !ok {
+		res.Summary = strings.Join(summary, " ")
+		return res
+	}
+	var results []string
+	for _, part := range strings.Split(ar, ";")[1:] {
+		f := strings.Fields(part)
+		if len(f) == 0 {
+			continue
+		}
+		mr := strings.SplitN(strings.ToLower(f[0]), "=", 2)
+		if len(mr) != 2 || (mr[0] != "dkim" && mr[0] != "spf" && mr[0] != "dmarc") {
+			continue
+		}
+		res.Checked = true
+		results = append(results, mr[0]+"="+mr[1])
+		if mr[1] != "pass" {
+			continue
+		}
+		props := make(map[string]string)
+		for _, p := range f[1:] {
+			if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+				props[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+		switch mr[0] {
+		case "dmarc":
+			res.Pass = true
+		case "dkim":
+			res.Pass = res.Pass || authAligned(props["header.d"], from) || authAligned(props["header.i"], from)
+		case "spf":
+			res.Pass = res.Pass || authAligned(props["smtp.mailfrom"], from)
+		}
+	}
+	res.Summary = strings.Join(append(results, summary...), " ")
+	return res
+
+}
+
+// authOk gives the value stored in ebclaims.AuthOk.
+func (sa senderAuthResult) authOk() interface{} {
+
+	switch {
+	case !sa.Checked:
+		return nil
+	case sa.Pass:
+		return 1
+	}
+	return 0
+
+}
@@ -0,0 +1,274 @@
+package main
+
+/*
+ * The switchable settings can be changed from the dashboard's /settings
+ * page rather than by editing the configuration in the database. A change
+ * is kept in ebcoverrides, so it survives restarts and configuration
+ * reloads, and applied on top of whatever the configuration says. Every
+ * change is logged in ebcsettingslog with who made it, the dashboard login
+ * if there is one, otherwise the address it came from.
+ *
+ * The dashboard runs alongside claim processing, so a change is queued and
+ * the main loop, woken for it, makes it between cycles as it does TESTMODE.
+ *
+ * MaxFetch is FetchPageSize, the most emails fetched each cycle.
+ *
+ */
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// switchableSetting is a setting which may be changed while I'm running.
+type switchableSetting struct {
+	Name  string
+	Desc  string
+	Bool  bool
+	get   func() string
+	check func(string) (string, error) // Returns the value as get would
+	set   func(string)                 // A checked value, only by the main loop
+}
+
+// Changes from the dashboard waiting for the main loop, by setting name
+var pendingSettings = struct {
+	sync.Mutex
+	values map[string]string
+}{values: map[string]string{}}
+
+func boolSetting(p *bool) (func() string, func(string) (string, error), func(string)) {
+
+	return func() string { return strconv.FormatBool(*p) },
+		func(s string) (string, error) {
+			b, err := strconv.ParseBool(s)
+			return strconv.FormatBool(b), err
+		},
+		func(s string) { *p, _ = strconv.ParseBool(s) }
+
+}
+
+func intSetting(p *int, valid func(int) bool) (func() string, func(string) (string, error), func(string)) {
+
+	return func() string { return strconv.Itoa(*p) },
+		func(s string) (string, error) {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || !valid(n) {
+				return "", fmt.Errorf("%q isn't allowed", s)
+			}
+			return strconv.Itoa(n), nil
+		},
+		func(s string) { *p, _ = strconv.Atoi(s) }
+
+}
+
+// switchableSettings lists what may be changed, in the order shown.
+func switchableSettings() []switchableSetting {
+
+	var res []switchableSetting
+	add := func(name string, desc string, isBool bool, get func() string, check func(string) (string, error), set func(string)) {
+		res = append(res, switchableSetting{Name: name, Desc: desc, Bool: isBool, get: get, check: check, set: set})
+	}
+	g, c, s := boolSetting(&cfg.TestMode)
+	add("TestMode", "Reply to every claim with what I made of it", true, g, c, s)
+	g, c, s = boolSetting(&cfg.DontRun)
+	add("DontRun", "Stop fetching claims", true, g, c, s)
+	g, c, s = boolSetting(&cfg.Acknowledge)
+	add("Acknowledge", "Email riders when their claims arrive, outside test mode", true, g, c, s)
+	g, c, s = boolSetting(&cfg.MatchEmail)
+	add("MatchEmail", "Only accept claims from entrants' registered addresses", true, g, c, s)
+	g, c, s = intSetting(&cfg.FetchPageSize, func(n int) bool { return n == -1 || n > 0 })
+	add("MaxFetch", "Most emails fetched each cycle, -1 for no limit", false, g, c, s)
+	g, c, s = intSetting(&cfg.SleepSeconds, func(n int) bool { return n > 0 })
+	add("SleepSeconds", "Seconds between looks at the mailbox", false, g, c, s)
+	return res
+
+}
+
+// findSetting returns the switchable setting with this name.
+func findSetting(name string) (switchableSetting, bool) {
+
+	for _, s := range switchableSettings() {
+		if strings.EqualFold(s.Name, name) {
+			return s, true
+		}
+	}
+	return switchableSetting{}, false
+
+}
+
+// applySettingOverrides applies the changes made from the dashboard. Only
+// the main loop calls this.
+func applySettingOverrides() {
+
+	rows, err := dbh.Query("SELECT Setting,Value FROM ebcoverrides")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		rows.Scan(&name, &value)
+		if s, ok := findSetting(name); ok {
+			if v, err := s.check(value); err != nil {
+				fmt.Printf("%s: ignoring %v override %v\n", apptitle, name, err)
+			} else {
+				s.set(v)
+			}
+		}
+	}
+
+}
+
+// applySettingChanges makes the changes queued by changeSetting, reporting
+// whether there were any. Only the main loop calls this.
+func applySettingChanges() bool {
+
+	pendingSettings.Lock()
+	changes := pendingSettings.values
+	pendingSettings.values = map[string]string{}
+	pendingSettings.Unlock()
+	for name, value := range changes {
+		if s, ok := findSetting(name); ok {
+			s.set(value)
+		}
+	}
+	return len(changes) > 0
+
+}
+
+// currentSetting is the value a setting has, or will have once the main
+// loop makes the change waiting for it.
+func currentSetting(s switchableSetting) string {
+
+	pendingSettings.Lock()
+	defer pendingSettings.Unlock()
+	if v, ok := pendingSettings.values[s.Name]; ok {
+		return v
+	}
+	return s.get()
+
+}
+
+// changeSetting changes a setting, recording the change and who made it,
+// and leaves it for the main loop to make.
+func changeSetting(name string, value string, who string) error {
+
+	s, ok := findSetting(name)
+	if !ok {
+		return fmt.Errorf("%v can't be changed", name)
+	}
+	value, err := s.check(value)
+	if err != nil {
+		return fmt.Errorf("%v: %v", s.Name, err)
+	}
+	old := currentSetting(s)
+	if value == old {
+		return nil
+	}
+	if s.Name == "TestMode" {
+		forgetTestMode() // Superseded
+	}
+	now := storeTimeDB(time.Now())
+	if _, err := dbExec("INSERT OR REPLACE INTO ebcoverrides (Setting,Value,ChangedBy,ChangedAt) VALUES(?,?,?,?)", s.Name, value, who, now); err != nil {
+		return err
+	}
+	dbExec("INSERT INTO ebcsettingslog (ChangedAt,ChangedBy,Setting,OldValue,NewValue) VALUES(?,?,?,?,?)", now, who, s.Name, old, value)
+	pendingSettings.Lock()
+	pendingSettings.values[s.Name] = value
+	pendingSettings.Unlock()
+	signalMail()
+	if !*silent {
+		fmt.Printf("%s %v changed %v from %v to %v\n", logts(), who, s.Name, old, value)
+	}
+	return nil
+
+}
+
+// settingChange is one entry in ebcsettingslog.
+type settingChange struct {
+	ChangedAt, ChangedBy, Setting, OldValue, NewValue string
+}
+
+// recentSettingChanges lists the latest changes, newest first.
+func recentSettingChanges(n int) []settingChange {
+
+	var res []settingChange
+	rows, err := dbh.Query("SELECT ChangedAt,ChangedBy,Setting,OldValue,NewValue FROM ebcsettingslog ORDER BY rowid DESC LIMIT ?", n)
+	if err != nil {
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c settingChange
+		rows.Scan(&c.ChangedAt, &c.ChangedBy, &c.Setting, &c.OldValue, &c.NewValue)
+		res = append(res, c)
+	}
+	return res
+
+}
+
+var settingsTemplate = template.Must(template.New("settings").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>body{font-family:sans-serif} td{padding:2px 8px} .err{color:red}</style>
+</head><body>
+<h1>{{.Title}}</h1>
+<p><a href="/">&larr; claims</a></p>
+{{range .Errors}}<p class="err">{{.}}</p>{{end}}
+<form method="post" action="/settings"><table>
+{{range .Settings}}<tr><td>{{.Name}}</td><td>{{if .Bool}}<select name="{{.Name}}"><option{{if eq .Value "true"}} selected{{end}}>true</option><option{{if eq .Value "false"}} selected{{end}}>false</option></select>{{else}}<input name="{{.Name}}" value="{{.Value}}" size="6">{{end}}</td><td>{{.Desc}}</td></tr>
+{{end}}</table>
+<p><input type="submit" value="Save"></p></form>
+<h2>Changes</h2>
+<table><tr><th>When</th><th>Who</th><th>Setting</th><th>From</th><th>To</th></tr>
+{{range .Changes}}<tr><td>{{.ChangedAt}}</td><td>{{.ChangedBy}}</td><td>{{.Setting}}</td><td>{{.OldValue}}</td><td>{{.NewValue}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// requestedBy identifies who made a dashboard request.
+func requestedBy(r *http.Request) string {
+
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return "token@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+
+}
+
+// dashSettingsPage shows the switchable settings and changes them.
+func dashSettingsPage(w http.ResponseWriter, r *http.Request) {
+
+	var errs []string
+	if r.Method == http.MethodPost {
+		if crossSiteRequest(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		r.ParseForm()
+		for _, s := range switchableSettings() {
+			if v, ok := r.PostForm[s.Name]; ok && len(v) > 0 {
+				if err := changeSetting(s.Name, v[0], requestedBy(r)); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+		}
+	}
+	type shown struct {
+		Name, Desc, Value string
+		Bool              bool
+	}
+	var settings []shown
+	for _, s := range switchableSettings() {
+		settings = append(settings, shown{s.Name, s.Desc, currentSetting(s), s.Bool})
+	}
+	settingsTemplate.Execute(w, map[string]interface{}{"Title": cfg.RallyTitle + " settings", "Settings": settings, "Errors": errs, "Changes": recentSettingChanges(50)})
+
+}
@@ -0,0 +1,69 @@
+package main
+
+/*
+ * Killed mid-fetch, I could leave emails read but never stored. On SIGINT
+ * or SIGTERM I finish the email in hand, leave the rest of the batch for
+ * retry, set the flags of those I've dealt with as usual and then release
+ * my claim on the database, close it and exit. A second signal stops me
+ * at once. Losing the database to another copy of me stops me the same way.
+ *
+ */
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// stopping is closed once I've been asked to stop.
+var stopping = make(chan struct{})
+var stopOnce sync.Once
+
+// requestStop asks me to stop once the current email is dealt with.
+func requestStop() {
+	stopOnce.Do(func() { close(stopping) })
+}
+
+// stopRequested reports whether I've been asked to stop.
+func stopRequested() bool {
+
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+
+}
+
+// handleSignals arranges for SIGINT and SIGTERM to stop me gracefully.
+func handleSignals() {
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Printf("%s %v received, stopping once the current email is dealt with\n", logts(), sig)
+		requestStop()
+		sig = <-sigs
+		fmt.Printf("%s %v received, stopping now\n", logts(), sig)
+		osExit(1)
+	}()
+
+}
+
+// shutdown tidies up after a graceful stop.
+func shutdown() {
+
+	releaseInstance()
+	if err := dbh.Close(); err != nil {
+		fmt.Printf("%s closing database %v\n", logts(), err)
+	}
+	if !*silent {
+		fmt.Printf("%s: stopped\n", apptitle)
+	}
+	osExit(0)
+
+}
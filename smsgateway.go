@@ -0,0 +1,111 @@
+package main
+
+/*
+ * Riders without data coverage sometimes text their claims to the rally
+ * address. Carrier SMS-to-email gateways deliver these from an address such
+ * as 5551234567@txt.att.net with no subject and the text of the message
+ * wrapped in the carrier's boilerplate.
+ *
+ * I recognise the gateway by its domain, dig the claim out of the body and
+ * use the phone number to confirm, or if necessary identify, the entrant.
+ * Phone numbers are matched against entrants.Phone if ScoreMaster has it.
+ *
+ */
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// defaultSMSGateways is used unless cfg.SMSGateways is set
+var defaultSMSGateways = []string{
+	"txt.att.net", "mms.att.net", "vtext.com", "vzwpix.com", "tmomail.net",
+	"messaging.sprintpcs.com", "pm.sprint.com", "mms.cricketwireless.net",
+	"sms.myboostmobile.com", "myboostmobile.com", "mymetropcs.com",
+	"msg.fi.google.com", "email.uscc.net", "txt.bell.ca", "pcs.rogers.com",
+	"msg.telus.com", "vmobl.com",
+}
+
+// smsGatewayPhone returns the sending phone number if the email came via
+// an SMS gateway, otherwise "".
+func smsGatewayPhone(from string) string {
+
+	v, err := mail.ParseAddress(from)
+	if err != nil {
+		return ""
+	}
+	at := strings.LastIndex(v.Address, "@")
+	if at < 1 {
+		return ""
+	}
+	domain := strings.ToLower(v.Address[at+1:])
+	gateways := cfg.SMSGateways
+	if len(gateways) == 0 {
+		gateways = defaultSMSGateways
+	}
+	for _, g := range gateways {
+		if domain == strings.ToLower(g) {
+			return phoneDigits(v.Address[:at])
+		}
+	}
+	return ""
+
+}
+
+// phoneDigits strips everything but digits, leaving at most the last ten
+// so that country prefixes don't matter.
+func phoneDigits(s string) string {
+
+	var sb strings.Builder
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			sb.WriteRune(c)
+		}
+	}
+	res := sb.String()
+	if len(res) > 10 {
+		res = res[len(res)-10:]
+	}
+	return res
+
+}
+
+// smsClaimText finds the line of the gateway's text containing the claim.
+func smsClaimText(body string) string {
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && parseSubject(line, false).ok {
+			return line
+		}
+	}
+	return ""
+
+}
+
+// entrantByPhone returns the only entrant registered with this phone number.
+func entrantByPhone(phone string) (int, bool) {
+
+	if phone == "" || !hasColumn("entrants", "Phone") {
+		return 0, false
+	}
+	rows, err := dbh.Query("SELECT " + col("entrants", "EntrantID") + ",IfNull(" + col("entrants", "Phone") + ",'') FROM entrants")
+	if err != nil {
+		return 0, false
+	}
+	defer rows.Close()
+	var res []int
+	for rows.Next() {
+		var id int
+		var ph string
+		rows.Scan(&id, &ph)
+		if d := phoneDigits(ph); d != "" && d == phone {
+			res = append(res, id)
+		}
+	}
+	if len(res) != 1 {
+		return 0, false
+	}
+	return res[0], true
+
+}
@@ -0,0 +1,91 @@
+package main
+
+/*
+ * A wrongly typed hhmm or odo digit usually shows up as an impossible
+ * average speed between one claim and the entrant's claims either side of
+ * it. MaxAvgSpeed is in odo units (miles or km) per hour, zero disables.
+ *
+ */
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// neighbourClaim returns the odo and claim time of the entrant's stored
+// claim immediately before (or after) the given time.
+func neighbourClaim(entrant int, ct time.Time, before bool) (int, time.Time, bool) {
+
+	sqlx := "SELECT OdoReading,ClaimTime FROM ebclaims WHERE EntrantID=? AND ClaimTime"
+	if before {
+		sqlx += "<? ORDER BY ClaimTime DESC"
+	} else {
+		sqlx += ">? ORDER BY ClaimTime"
+	}
+	sqlx += " LIMIT 1"
+	var odo int
+	var cts string
+	err := dbh.QueryRow(sqlx, entrant, storeTimeDB(ct)).Scan(&odo, &cts)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	t, err := time.ParseInLocation(time.RFC3339, cts, cfg.LocalTZ)
+	return odo, t, err == nil
+
+}
+
+// impliedSpeed is the average speed needed to get from one claim to another.
+// Claim times are only to the minute so claims closer than that are taken
+// to be a minute apart, any distance between them still counting.
+func impliedSpeed(odo1 int, t1 time.Time, odo2 int, t2 time.Time) float64 {
+
+	hrs := math.Abs(t2.Sub(t1).Hours())
+	if hrs < 1.0/60 {
+		hrs = 1.0 / 60
+	}
+	return math.Abs(float64(odo2-odo1)) / hrs
+
+}
+
+// sameTimeClaim returns the odo of another of the entrant's stored claims
+// made at the same time but with a different reading.
+func sameTimeClaim(entrant int, ct time.Time, odo int) (int, bool) {
+
+	var other int
+	err := dbh.QueryRow("SELECT OdoReading FROM ebclaims WHERE EntrantID=? AND ClaimTime=? AND OdoReading<>? LIMIT 1", entrant, storeTimeDB(ct), odo).Scan(&other)
+	return other, err == nil
+
+}
+
+// validateAvgSpeed flags claims implying an implausible speed from or to a neighbouring claim.
+func validateAvgSpeed(f4 fourFields, flags *claimFlags) {
+
+	if cfg.MaxAvgSpeed <= 0 || !f4.OdoOk || f4.ClaimTime.IsZero() {
+		return
+	}
+	if odo, ok := sameTimeClaim(f4.EntrantID, f4.ClaimTime, f4.OdoReading); ok {
+		if spd := impliedSpeed(odo, f4.ClaimTime, f4.OdoReading, f4.ClaimTime); spd > float64(cfg.MaxAvgSpeed) {
+			if *verbose {
+				fmt.Printf("%s entrant %v odo %v at the same time as odo %v\n", logts(), f4.EntrantID, f4.OdoReading, odo)
+			}
+			flags.add(flagSpeed)
+			return
+		}
+	}
+	for _, before := range []bool{true, false} {
+		odo, ct, ok := neighbourClaim(f4.EntrantID, f4.ClaimTime, before)
+		if !ok {
+			continue
+		}
+		spd := impliedSpeed(odo, ct, f4.OdoReading, f4.ClaimTime)
+		if spd > float64(cfg.MaxAvgSpeed) {
+			if *verbose {
+				fmt.Printf("%s entrant %v implied speed %.0f from odo %v at %v\n", logts(), f4.EntrantID, spd, odo, ct.Format(myTimeFormat))
+			}
+			flags.add(flagSpeed)
+			return
+		}
+	}
+
+}
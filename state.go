@@ -0,0 +1,240 @@
+package main
+
+/*
+ * If the HQ laptop dies mid-rally the fetcher has to carry on from a backup
+ * machine without reprocessing or losing anything. Whether an email has
+ * been dealt with is recorded on the server, in its flags, but the rest of
+ * my state lives in the database alongside ScoreMaster's:-
+ *
+ *		ebcpaging		where paging through the INBOX had got to (UID tracking)
+ *		ebcretries		emails waiting to be retried
+ *		ebcsummaries	entrants already sent their summary
+ *		ebcautostop		whether monitoring has been stopped
+ *		ebcclockskew	what's known about riders' phone clocks
+ *		ebcmaintenance	when the database was last checked
+ *		ebcoauth		OAuth2 tokens for the IMAP account
+ *		ebcremotemail	the UIDs given to POP3 and Graph emails, and what became of them
+ *
+ * together with the Fingerprint, MessageID and Source of each claim, by which
+ * resent claims are recognised as duplicates.
+ *
+ *		ebcfetch state export -to state.json
+ *		ebcfetch state import -from state.json
+ *
+ * writes these out and reads them into the backup's database, replacing
+ * whatever state it had. Claims themselves are ScoreMaster's and travel
+ * with its database; any in the state file which the backup's database
+ * doesn't have are reported. There's no outbox to move: responses are sent
+ * as each email is handled and anything kept only in memory, the CONDSTORE
+ * sync point say, is rebuilt by the first full cycle.
+ *
+ */
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const stateVersion = 1
+
+// stateTables are my tables which hold state rather than records.
+var stateTables = []string{"ebcpaging", "ebcretries", "ebcsummaries", "ebcautostop", "ebcclockskew", "ebcmaintenance", "ebcoauth", "ebcremotemail"}
+
+// stateClaim is what's needed to recognise duplicates of a stored claim.
+type stateClaim struct {
+	EmailID     int64
+	Source      string `json:",omitempty"` // The mailbox EmailID is the UID in
+	EntrantID   int
+	BonusID     string
+	Fingerprint string
+	MessageID   string
+}
+
+// stateFile is the exported state.
+type stateFile struct {
+	Version    int
+	ExportedAt string
+	Tables     map[string][]map[string]interface{}
+	Claims     []stateClaim
+}
+
+// exportTable reads every row of one of my tables.
+func exportTable(table string) ([]map[string]interface{}, error) {
+
+	res := []map[string]interface{}{}
+	rows, err := dbh.Query("SELECT * FROM " + table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{})
+		for i, c := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				row[c] = string(b)
+			} else {
+				row[c] = vals[i]
+			}
+		}
+		res = append(res, row)
+	}
+	return res, rows.Err()
+
+}
+
+// exportState gathers up my state.
+func exportState() (stateFile, error) {
+
+	sf := stateFile{Version: stateVersion, ExportedAt: storeTimeDB(time.Now()), Tables: make(map[string][]map[string]interface{})}
+	for _, t := range stateTables {
+		rows, err := exportTable(t)
+		if err != nil {
+			return sf, fmt.Errorf("%v: %w", t, err)
+		}
+		sf.Tables[t] = rows
+	}
+	rows, err := dbh.Query("SELECT IfNull(EmailID,0),IfNull(Source,''),EntrantID,BonusID,IfNull(Fingerprint,''),IfNull(MessageID,'') FROM ebclaims WHERE IfNull(Fingerprint,'')<>'' OR IfNull(MessageID,'')<>'' ORDER BY rowid")
+	if err != nil {
+		return sf, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c stateClaim
+		rows.Scan(&c.EmailID, &c.Source, &c.EntrantID, &c.BonusID, &c.Fingerprint, &c.MessageID)
+		sf.Claims = append(sf.Claims, c)
+	}
+	return sf, rows.Err()
+
+}
+
+// importState replaces my state with that exported, returning how many of
+// the exported claims this database doesn't have.
+func importState(sf stateFile) (int, error) {
+
+	if sf.Version != stateVersion {
+		return 0, fmt.Errorf("state file version %v, expected %v", sf.Version, stateVersion)
+	}
+	for _, t := range stateTables {
+		for _, row := range sf.Tables[t] {
+			for c := range row {
+				if !columnExists(t, c) {
+					return 0, fmt.Errorf("%v has no column %v", t, c)
+				}
+			}
+		}
+	}
+	missing := 0
+	err := dbWriteTx(func(tx *sql.Tx) error {
+		for _, t := range stateTables {
+			rows, ok := sf.Tables[t]
+			if !ok {
+				continue
+			}
+			if _, err := tx.Exec("DELETE FROM " + t); err != nil {
+				return fmt.Errorf("%v: %w", t, err)
+			}
+			for _, row := range rows {
+				var cols []string
+				var args []interface{}
+				for c, v := range row {
+					cols = append(cols, c)
+					args = append(args, v)
+				}
+				sqlx := "INSERT INTO " + t + " (" + strings.Join(cols, ",") + ") VALUES(?" + strings.Repeat(",?", len(cols)-1) + ")"
+				if _, err := tx.Exec(sqlx, args...); err != nil {
+					return fmt.Errorf("%v: %w", t, err)
+				}
+			}
+		}
+		missing = 0
+		for _, c := range sf.Claims {
+			sqlx := "UPDATE ebclaims SET Fingerprint=?,MessageID=? WHERE EmailID=? AND EntrantID=? AND BonusID=?"
+			args := []interface{}{c.Fingerprint, c.MessageID, c.EmailID, c.EntrantID, c.BonusID}
+			if c.Source != "" { // Files exported before Source was recorded don't say
+				sqlx += " AND IfNull(Source,'')=?"
+				args = append(args, c.Source)
+			}
+			res, err := tx.Exec(sqlx, args...)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				missing++
+			}
+		}
+		return nil
+	})
+	return missing, err
+
+}
+
+// runState is the state subcommand.
+func runState(args []string) int {
+
+	if len(args) < 1 || (args[0] != "export" && args[0] != "import") {
+		fmt.Printf("%s: state export -to file, or state import -from file\n", apptitle)
+		return 1
+	}
+	fs := flag.NewFlagSet("state", flag.ContinueOnError)
+	to := fs.String("to", "ebcfetch-state.json", "File to export to")
+	from := fs.String("from", "ebcfetch-state.json", "File to import from")
+	if fs.Parse(args[1:]) != nil {
+		return 1
+	}
+
+	if args[0] == "export" {
+		sf, err := exportState()
+		if err == nil {
+			var data []byte
+			data, err = json.MarshalIndent(sf, "", "  ")
+			if err == nil {
+				err = os.WriteFile(*to, data, 0600)
+			}
+		}
+		if err != nil {
+			fmt.Printf("%s: can't export state %v\n", apptitle, err)
+			return 1
+		}
+		if !*silent {
+			fmt.Printf("%s: state exported to %v\n", apptitle, *to)
+		}
+		return 0
+	}
+
+	var sf stateFile
+	data, err := os.ReadFile(*from)
+	if err == nil {
+		err = json.Unmarshal(data, &sf)
+	}
+	if err != nil {
+		fmt.Printf("%s: can't read state from %v %v\n", apptitle, *from, err)
+		return 1
+	}
+	missing, err := importState(sf)
+	if err != nil {
+		fmt.Printf("%s: can't import state %v\n", apptitle, err)
+		return 1
+	}
+	if missing > 0 {
+		fmt.Printf("%s: WARNING %v claims in %v aren't in this database, copy the ScoreMaster database too\n", apptitle, missing, *from)
+	}
+	if !*silent {
+		fmt.Printf("%s: state imported from %v, exported %v\n", apptitle, *from, sf.ExportedAt)
+	}
+	return 0
+
+}
@@ -0,0 +1,80 @@
+package main
+
+/*
+ * /api/stats gives the rolling claim counters as JSON for external tools,
+ * the live claims ticker on the results projector for instance.
+ *
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type entrantCount struct {
+	EntrantID int
+	Claims    int
+}
+
+type claimStats struct {
+	Generated     string
+	ClaimsTotal   int
+	ClaimsToday   int
+	ClaimsLastHr  int
+	Rejected      int            // Claims judged and rejected in ScoreMaster
+	NotClaims     map[string]int // Emails not stored as claims, by decision from ebcaudit
+	EntrantTotals []entrantCount
+	Unconverted   int   // Photos stored as received because they couldn't be converted
+	ConvertFailed int64 // Conversions which have failed since I started
+}
+
+// fetchClaimStats gathers the current counters from the database.
+func fetchClaimStats(now time.Time) claimStats {
+
+	res := claimStats{Generated: storeTimeDB(now), NotClaims: make(map[string]int)}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	dbh.QueryRow("SELECT count(*) FROM ebclaims").Scan(&res.ClaimsTotal)
+	dbh.QueryRow("SELECT count(*) FROM ebclaims WHERE LoggedAt>=?", storeTimeDB(midnight)).Scan(&res.ClaimsToday)
+	dbh.QueryRow("SELECT count(*) FROM ebclaims WHERE LoggedAt>=?", storeTimeDB(now.Add(-time.Hour))).Scan(&res.ClaimsLastHr)
+	dbh.QueryRow("SELECT count(*) FROM ebclaims WHERE Decision>0").Scan(&res.Rejected)
+	dbh.QueryRow("SELECT count(*) FROM ebcphotos WHERE Unconverted=1").Scan(&res.Unconverted)
+	res.ConvertFailed = atomic.LoadInt64(&conversionFailures)
+
+	rows, err := dbh.Query("SELECT Decision,count(*) FROM ebcaudit WHERE Decision<>? GROUP BY Decision", auditClaimed)
+	if err == nil {
+		for rows.Next() {
+			var d string
+			var n int
+			rows.Scan(&d, &n)
+			res.NotClaims[d] = n
+		}
+		rows.Close()
+	}
+
+	rows, err = dbh.Query("SELECT EntrantID,count(*) FROM ebclaims GROUP BY EntrantID ORDER BY EntrantID")
+	if err == nil {
+		for rows.Next() {
+			var ec entrantCount
+			rows.Scan(&ec.EntrantID, &ec.Claims)
+			res.EntrantTotals = append(res.EntrantTotals, ec)
+		}
+		rows.Close()
+	}
+	return res
+
+}
+
+func dashStatsAPI(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // The projector page is served from elsewhere
+	err := json.NewEncoder(w).Encode(fetchClaimStats(time.Now()))
+	if err != nil {
+		fmt.Printf("%s stats %v\n", logts(), err)
+	}
+
+}
@@ -0,0 +1,94 @@
+package main
+
+/*
+ * Subject regexes are easy to get subtly wrong so the config can carry
+ * example Subject lines together with what they should parse as:-
+ *
+ *		SubjectExamples:
+ *		  - {Subject: "12 A4 10423 1432", Valid: true, Entrant: 12, Bonus: A4, Odo: 10423, Time: "1432"}
+ *		  - {Subject: "Hello from the road", Valid: false}
+ *
+ * Only the fields given are checked. If any example doesn't come out as
+ * expected I refuse to start; "ebcfetch check" lists every example and how
+ * it fared.
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// subjectExample is one line from cfg.SubjectExamples.
+type subjectExample struct {
+	Subject string `yaml:"Subject"`
+	Strict  bool   `yaml:"Strict"` // Parse using the strict regex
+	Valid   bool   `yaml:"Valid"`
+	Entrant int    `yaml:"Entrant"`
+	Bonus   string `yaml:"Bonus"`
+	Odo     int    `yaml:"Odo"`
+	Time    string `yaml:"Time"` // HHMM
+	Extra   string `yaml:"Extra"`
+}
+
+// check parses the example, returning what was wrong with the result if anything.
+func (x subjectExample) check() string {
+
+	f4 := parseSubject(x.Subject, x.Strict)
+	var wrong []string
+	if f4.ok != x.Valid {
+		wrong = append(wrong, fmt.Sprintf("valid=%v", f4.ok))
+	}
+	if !x.Valid {
+		return strings.Join(wrong, ", ")
+	}
+	if x.Entrant != 0 && f4.EntrantID != x.Entrant {
+		wrong = append(wrong, fmt.Sprintf("entrant=%v", f4.EntrantID))
+	}
+	if x.Bonus != "" && !strings.EqualFold(f4.BonusID, x.Bonus) {
+		wrong = append(wrong, fmt.Sprintf("bonus=%v", f4.BonusID))
+	}
+	if x.Odo != 0 && f4.OdoReading != x.Odo {
+		wrong = append(wrong, fmt.Sprintf("odo=%v", f4.OdoReading))
+	}
+	if hhmm := fmt.Sprintf("%02d%02d", f4.TimeHH, f4.TimeMM); x.Time != "" && hhmm != x.Time {
+		wrong = append(wrong, fmt.Sprintf("time=%v", hhmm))
+	}
+	if x.Extra != "" && strings.TrimSpace(f4.Extra) != x.Extra {
+		wrong = append(wrong, fmt.Sprintf("extra=%q", f4.Extra))
+	}
+	return strings.Join(wrong, ", ")
+
+}
+
+// subjectExamplesOK runs all the examples, reporting failures or, if
+// verbose, every result.
+func subjectExamplesOK(verbose bool) bool {
+
+	ok := true
+	for _, x := range cfg.SubjectExamples {
+		wrong := x.check()
+		if wrong != "" {
+			ok = false
+			fmt.Printf("%s: FAILED %q parsed as %v\n", apptitle, x.Subject, wrong)
+		} else if verbose {
+			fmt.Printf("%s: ok     %q\n", apptitle, x.Subject)
+		}
+	}
+	return ok
+
+}
+
+// runCheck lists how each of the SubjectExamples fares.
+func runCheck(args []string) int {
+
+	if len(cfg.SubjectExamples) == 0 {
+		fmt.Printf("%s: no SubjectExamples configured\n", apptitle)
+		return 0
+	}
+	if !subjectExamplesOK(true) {
+		return 1
+	}
+	return 0
+
+}
@@ -0,0 +1,22 @@
+package main
+
+/*
+ * Mail clients decorate subjects with reply and forward prefixes in the
+ * user's own language, Fwd:, WG:, TR:, VS:, 回复: and so on, often several
+ * deep when a claim has been passed around. None of it is part of the
+ * claim so I strip it off before the four fields are parsed.
+ *
+ */
+
+import "regexp"
+
+// subjectPrefixRE matches any run of reply/forward prefixes, including
+// numbered ones like Re[2]: and full-width colons.
+var subjectPrefixRE = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|wg|tr|vs|vl|sv|vb|rv|enc|res|antw|doorst|odp|pd|ynt|ilt|fs|απ|πρθ|отв|ответ|пересл|回复|回覆|答复|转发|轉寄|返信|転送)\s*(\[\d+\])?\s*[:：]\s*)+`)
+
+// stripSubjectPrefixes removes reply/forward prefixes from a subject.
+func stripSubjectPrefixes(subject string) string {
+
+	return subjectPrefixRE.ReplaceAllString(subject, "")
+
+}
@@ -0,0 +1,97 @@
+package main
+
+/*
+ * The configured subject REs are exact about layout and riders are not.
+ * "12, A4, 10423, 17:13", "#12/A4/10423mi/5:13 pm" and "12 bonus A4 odo
+ * 10423 time 1713" are all perfectly clear to a human but end up in the
+ * manual pile. When no RE matches I fall back on splitting the subject
+ * into tokens at any separator, dropping filler words and units, and
+ * checking each token is the right kind of thing for its place: an entrant
+ * number, a bonus which actually exists, a plain odo reading and a valid
+ * time, in that order. Anything else, fields missing, out of order or an
+ * unknown bonus, is still rejected rather than guessed at.
+ *
+ */
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subjectTokenRE finds the tokens, anything between separators.
+var subjectTokenRE = regexp.MustCompile(`[^\s,;/|#]+`)
+
+// subjectFillerWords are labels riders put in front of the fields.
+var subjectFillerWords = []string{"entrant", "rider", "bonus", "odo", "odometer", "miles", "mi", "km", "kms", "time", "at", "no", "nr"}
+
+var odoTokenRE = regexp.MustCompile(`(?i)^\d[\d.]*(?:mi|miles|km|kms)?$`)
+var hhmmRE = regexp.MustCompile(`^\d\d\d\d$`)
+var ampmTokenRE = regexp.MustCompile(`(?i)^[ap]\.?m\.?$`)
+
+// knownBonus reports whether a bonus with this ID exists.
+func knownBonus(b string) bool {
+
+	var n int
+	dbh.QueryRow("SELECT count(*) FROM bonuses WHERE "+col("bonuses", "BonusID")+"=?", b).Scan(&n)
+	return n > 0
+
+}
+
+// timeToken reports whether s is a claim time in any of the accepted forms.
+func timeToken(s string) bool {
+
+	if _, err := time.Parse(time.RFC3339, s); err == nil {
+		return true
+	}
+	hm := strings.NewReplacer(":", "", ".", "").Replace(normaliseTime(s))
+	if len(hm) == 3 {
+		hm = "0" + hm
+	}
+	if !hhmmRE.MatchString(hm) {
+		return false
+	}
+	n, _ := strconv.Atoi(hm)
+	return n/100 < 24 && n%100 < 60
+
+}
+
+// tokeniseSubject picks the fields out of a subject no RE matched,
+// returning nil unless they're all present and unambiguous.
+func tokeniseSubject(s string) map[string]string {
+
+	var tokens []string
+	var ends []int // Where each token finishes in s
+	for _, loc := range subjectTokenRE.FindAllStringIndex(s, -1) {
+		tok := s[loc[0]:loc[1]]
+		if containsFold(subjectFillerWords, tok) && !knownBonus(strings.ToUpper(tok)) {
+			continue
+		}
+		tokens = append(tokens, tok)
+		ends = append(ends, loc[1])
+	}
+	if len(tokens) < 4 {
+		return nil
+	}
+
+	if extractEntrantID(tokens[0]) == 0 || !knownBonus(strings.ToUpper(tokens[1])) {
+		return nil
+	}
+	if !odoTokenRE.MatchString(tokens[2]) {
+		return nil
+	}
+	if _, ok := odoReading(tokens[2]); !ok {
+		return nil
+	}
+	tm, last := tokens[3], 3
+	if len(tokens) > 4 && ampmTokenRE.MatchString(tokens[4]) {
+		tm, last = tm+tokens[4], 4
+	}
+	if !timeToken(tm) {
+		return nil
+	}
+	extra := strings.TrimLeft(s[ends[last]:], " \t,;/|#")
+	return map[string]string{"entrant": tokens[0], "bonus": tokens[1], "odo": tokens[2], "time": tm, "extra": extra}
+
+}
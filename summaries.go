@@ -0,0 +1,84 @@
+package main
+
+/*
+ * Once the rally is over, SummaryDelay after RallyFinish, and if
+ * SendSummaries is set, each entrant is sent a list of every claim I
+ * recorded for them so that anything missing comes to light before they
+ * reach the scoring table. Each entrant is only sent one automatically;
+ * they can be sent (again) on demand with:-
+ *
+ *		ebcfetch -db x.db summaries [-resend]
+ *
+ */
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var summariesDone bool
+
+// summariesDue reports whether it's time to send the automatic summaries.
+func summariesDue() bool {
+	return cfg.SendSummaries && !summariesDone && !cfg.RallyFinish.IsZero() && time.Now().After(cfg.RallyFinish.Add(cfg.SummaryDelay))
+}
+
+// pendingSummaries lists the entrants still to be sent a summary.
+func pendingSummaries(resend bool) []int {
+
+	sqlx := "SELECT " + col("entrants", "EntrantID") + " FROM entrants"
+	if !resend {
+		sqlx += " WHERE " + col("entrants", "EntrantID") + " NOT IN (SELECT EntrantID FROM ebcsummaries)"
+	}
+	rows, err := dbh.Query(sqlx + " ORDER BY 1")
+	if err != nil {
+		fmt.Printf("%s summaries %v\n", logts(), err)
+		return nil
+	}
+	defer rows.Close()
+	var res []int
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		res = append(res, id)
+	}
+	return res
+
+}
+
+// sendSummaries emails each entrant their claims, returning how many were sent.
+func sendSummaries(resend bool) int {
+
+	n := 0
+	for _, e := range pendingSummaries(resend) {
+		sent := false
+		for _, em := range entrantEmails([]int{e}) {
+			if sendPlainMail(em, cfg.RallyTitle+": your claims", riderStatusText(e)) == nil {
+				sent = true
+			}
+		}
+		if sent {
+			dbExec("INSERT OR REPLACE INTO ebcsummaries (EntrantID,SentAt) VALUES(?,?)", e, storeTimeDB(time.Now()))
+			n++
+		}
+	}
+	if !*silent && n > 0 {
+		fmt.Printf("%s sent %v claim summaries\n", logts(), n)
+	}
+	return n
+
+}
+
+// runSummaries sends the summaries on demand.
+func runSummaries(args []string) int {
+
+	fs := flag.NewFlagSet("summaries", flag.ContinueOnError)
+	resend := fs.Bool("resend", false, "Include entrants already sent a summary")
+	if fs.Parse(args) != nil {
+		return 1
+	}
+	sendSummaries(*resend)
+	return 0
+
+}
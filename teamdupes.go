@@ -0,0 +1,83 @@
+package main
+
+/*
+ * In team rallies only one member of a team should claim each bonus. When
+ * a second member claims a bonus the team already has, every copy is
+ * flagged for the judges and, if cfg.TeamDuplicateNotice is set, the team
+ * is sent a courtesy email so that they can withdraw the spare.
+ *
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// teamDuplicates returns the rowids of live claims for the bonus by the entrant's teammates.
+func teamDuplicates(entrant int, bonus string) []int64 {
+
+	team := fetchTeamID(entrant)
+	if team < 1 {
+		return nil
+	}
+	sqlx := "SELECT rowid FROM ebclaims WHERE BonusID=? AND EntrantID<>? AND IfNull(RiderCancelled,0)=0"
+	sqlx += " AND EntrantID IN (SELECT " + col("entrants", "EntrantID") + " FROM entrants WHERE " + col("entrants", "TeamID") + "=?)"
+	rows, err := dbh.Query(sqlx, bonus, entrant, team)
+	if err != nil {
+		fmt.Printf("%s team duplicates %v\n", logts(), err)
+		return nil
+	}
+	defer rows.Close()
+	var res []int64
+	for rows.Next() {
+		var rowid int64
+		rows.Scan(&rowid)
+		res = append(res, rowid)
+	}
+	return res
+
+}
+
+// flagTeamDuplicates marks the earlier copies, within the transaction
+// storing the new one.
+func flagTeamDuplicates(tx *sql.Tx, dupes []int64) error {
+
+	for _, rowid := range dupes {
+		if err := flagStoredClaim(tx, rowid, flagTeamDuplicate); err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// noticeTeamDuplicates tells the team, if wanted, once the claim is stored.
+func noticeTeamDuplicates(entrant int, bonus string) {
+
+	if !cfg.TeamDuplicateNotice {
+		return
+	}
+	team := fetchTeamID(entrant)
+	var members []int
+	rows, err := dbh.Query("SELECT "+col("entrants", "EntrantID")+" FROM entrants WHERE "+col("entrants", "TeamID")+"=?", team)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		members = append(members, id)
+	}
+	rows.Close()
+	var ids []string
+	for _, id := range members {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	body := fmt.Sprintf("Bonus %v has now been claimed by more than one member of your team (entrants %v). Only one claim will be scored; please CANCEL any spares.", bonus, strings.Join(ids, ", "))
+	for _, em := range entrantEmails(members) {
+		sendPlainMail(em, cfg.RallyTitle+": team duplicate "+bonus, body)
+	}
+
+}
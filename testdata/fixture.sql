@@ -0,0 +1,62 @@
+-- The database the tests run against, in place of a live ScoreMaster.db:
+-- the tables ScoreMaster creates, as ebcfetch leaves them, and a one-bonus
+-- rally with one entrant and a claim. ebcfetch creates its own tables when
+-- the database is opened, all but entrant_emails which is needed here for
+-- the entrant's address. Rebuild testdata/corpus with go test -run Golden -update
+-- after changing it.
+
+CREATE TABLE rallyparams (RallyTitle TEXT, StartTime TEXT, FinishTime TEXT, LocalTZ TEXT, ebcsettings TEXT, EmailParams TEXT, DBVersion INTEGER);
+CREATE TABLE entrants (EntrantID INTEGER PRIMARY KEY, RiderName TEXT, Email TEXT, TeamID INTEGER DEFAULT 0, PillionOf INTEGER DEFAULT 0);
+CREATE TABLE bonuses (BonusID TEXT PRIMARY KEY, BriefDesc TEXT, Points INTEGER, ExpectedAnswer TEXT DEFAULT '', PhotoRequired INTEGER DEFAULT 1, OdoRequired INTEGER DEFAULT 1, AnswerRequired INTEGER DEFAULT 0, RestMinutes INTEGER DEFAULT 0, AvailableFrom TEXT DEFAULT '', AvailableUntil TEXT DEFAULT '', OpensAt TEXT DEFAULT '', ClosesAt TEXT DEFAULT '', DaylightOnly INTEGER DEFAULT 0, Latitude REAL, Longitude REAL, QRCode TEXT DEFAULT '');
+CREATE TABLE ebclaims (LoggedAt TEXT, DateTime TEXT, EntrantID INTEGER, BonusID TEXT, OdoReading INTEGER, FinalTime TEXT, EmailID INTEGER, ClaimHH INTEGER, ClaimMM INTEGER, ClaimTime TEXT, Subject TEXT, ExtraField TEXT, StrictOk INTEGER, AttachmentTime TEXT, FirstTime TEXT, PhotoID INTEGER, Processed INTEGER DEFAULT 0, Decision INTEGER DEFAULT -1, EbcFlags TEXT DEFAULT '', PhotoIDs TEXT DEFAULT '', CorrectsRowID INTEGER DEFAULT 0, RiderCancelled INTEGER DEFAULT 0, QRCode TEXT DEFAULT '', Fingerprint TEXT DEFAULT '', MessageID TEXT DEFAULT '', InReplyTo TEXT DEFAULT '', MsgReferences TEXT DEFAULT '', ResendOf INTEGER DEFAULT 0, PinLatitude REAL, PinLongitude REAL, Source TEXT, OdoValue REAL, OdoText TEXT DEFAULT '', AuthOk INTEGER, SanityFlags TEXT DEFAULT '');
+CREATE TABLE entrant_emails (EntrantID INTEGER, Email TEXT COLLATE NOCASE, PRIMARY KEY (EntrantID,Email));
+CREATE TABLE ebcphotos (EntrantID INTEGER, BonusID TEXT, EmailID INTEGER, image TEXT, Width INTEGER DEFAULT 0, Height INTEGER DEFAULT 0, CameraModel TEXT DEFAULT '', CaptureTime TEXT DEFAULT '', SourceURL TEXT DEFAULT '', Unconverted INTEGER DEFAULT 0, Latitude REAL, Longitude REAL, Original TEXT DEFAULT '');
+
+INSERT INTO rallyparams VALUES('Test Rally','2024-06-01T08:00','2024-06-02T18:00','Europe/London','imapserver: imap.gmail.com:993
+login: ibaukebc@gmail.com
+password: 
+
+# Sleep this long between mailbox inspections
+sleepseconds: 10
+
+# Don''t fetch emails older (imap.internaldate) than this date
+notbefore: 2021-07-01
+
+# Fetch emails without any of these flags
+selectflags: ["\\Flagged", "\\Seen"]
+
+
+# ScoreMaster compatible database including ebc tables
+db: ebcfetch.db
+
+# Acceptable subject line RE. This accepts decorated entrant number, commas as separators, various time formats, optional odo/time
+subject: ''^(?:\w+:\s*)?(\S+)\s+([a-zA-Z0-9\-]+)\s+(\d+)\s+(\S+)\s*(.*)$''
+
+# Subject line RE to measure strict adherence to standard
+strict: ''^\s*(\d+)\s+([a-zA-Z0-9\-]+)\s+(\d+)\s+(\d\d\d\d)''
+checkstrict: true
+
+# Filesystem path to ScoreMaster folder
+path2sm: sm
+
+# Path from ScoreMaster folder to EBC image folder
+imagefolder: ebcimg
+
+# If true, only process emails sent from entrant''s registered address
+matchemail: true
+
+# Executable to convert HEIC image files to JPG
+# The arguments are expected to be:- filename.HEIC filename.JPG
+# Will be called at BOJ with no arguments to validate installation
+# This uses the ImageMagick package which must be installed on the server
+heic2jpg: magick
+
+convertheic2jpg: true
+
+#Allow four fields in body rather than Subject
+allowbody: true','{"Port":587,"Host":"smtp.example.com"}',10);
+INSERT INTO entrants VALUES(1,'Bob','bob@example.com',0,0);
+INSERT INTO entrant_emails VALUES(1,'bob@example.com');
+INSERT INTO bonuses VALUES('A1','Alpha',10,'',1,1,0,0,'','','','',0,NULL,NULL,'');
+INSERT INTO ebclaims (DateTime,EntrantID,BonusID,OdoReading,EmailID,ClaimTime,Subject) VALUES('2024-06-01T10:05:00+01:00',1,'A1',99,5,'2024-06-01T10:00:00+01:00','1 A1 100 1000');
+INSERT INTO ebcphotos (EntrantID,BonusID,EmailID,image) VALUES(1,'A1',5,'ebcimg/img-1-A1-1.jpg');
@@ -0,0 +1,81 @@
+package main
+
+/*
+ * A rider who thinks a claim got lost often replies to it, or forwards it
+ * to themselves and on again, rather than typing it afresh. Matching the
+ * resend to the original by its fields alone is unreliable, especially
+ * across midnight, but the email headers say exactly which message it
+ * follows. So every claim records its Message-ID, In-Reply-To and
+ * References and, when a new claim for the same entrant and bonus refers to
+ * an earlier claim's Message-ID, or has the same one, it's linked to that
+ * claim by ebclaims.ResendOf and takes its claim date.
+ *
+ */
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// messageThread is the threading information from a claim's headers.
+type messageThread struct {
+	MessageID  string
+	InReplyTo  []string
+	References []string
+}
+
+// threadOf picks the threading headers out of an email.
+func threadOf(m Email) messageThread {
+
+	return messageThread{MessageID: m.MessageID, InReplyTo: m.InReplyTo, References: m.References}
+
+}
+
+// ids lists every Message-ID which might identify an earlier claim.
+func (mt messageThread) ids() []string {
+
+	var res []string
+	for _, id := range append(append([]string{mt.MessageID}, mt.InReplyTo...), mt.References...) {
+		id = strings.Trim(id, "<> \t\r\n")
+		if id != "" && !containsFold(res, id) {
+			res = append(res, id)
+		}
+	}
+	return res
+
+}
+
+// threadedClaim finds the entrant's earliest live claim for the bonus which
+// this email follows, returning its rowid and claim time, or 0.
+func threadedClaim(entrant int, bonus string, mt messageThread) (int64, time.Time) {
+
+	var rowid int64
+	var ct time.Time
+	ids := mt.ids()
+	if len(ids) == 0 {
+		return 0, ct
+	}
+	args := []interface{}{entrant, bonus}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	sqlx := "SELECT rowid,IfNull(ClaimTime,'') FROM ebclaims WHERE EntrantID=? AND BonusID=? AND IfNull(RiderCancelled,0)=0"
+	sqlx += " AND MessageID IN (?" + strings.Repeat(",?", len(ids)-1) + ") ORDER BY rowid LIMIT 1"
+	var s string
+	if dbh.QueryRow(sqlx, args...).Scan(&rowid, &s) != nil {
+		return 0, ct
+	}
+	ct, _ = time.ParseInLocation(time.RFC3339, s, cfg.LocalTZ)
+	return rowid, ct
+
+}
+
+// storeThread records a claim's threading headers and the claim it resends, if any.
+func storeThread(tx *sql.Tx, rowid int64, mt messageThread, resendOf int64) error {
+
+	_, err := tx.Exec("UPDATE ebclaims SET MessageID=?,InReplyTo=?,MsgReferences=?,ResendOf=? WHERE rowid=?",
+		strings.Trim(mt.MessageID, "<> "), strings.Join(mt.InReplyTo, " "), strings.Join(mt.References, " "), resendOf, rowid)
+	return err
+
+}
@@ -0,0 +1,101 @@
+package main
+
+/*
+ * When a rider says their claim wasn't read properly, the organiser needs
+ * the email exactly as it arrived. With TrapMails set, or -trap folder on
+ * the commandline, I save the raw text of every email I fetch in TrapPath
+ * as a .eml file named for when it was fetched, its mailbox and its UID.
+ *
+ * Trapped emails, or any others saved as .eml files, can be fed back
+ * through the normal claim process with:-
+ *
+ *		ebcfetch -db sm/ScoreMaster.db -replay trapped
+ *		ebcfetch -db sm/ScoreMaster.db -replay trapped/20250705141203-INBOX-1234.eml
+ *
+ * Replayed claims are stored in the database as if they'd just arrived, so
+ * the usual duplicate checks apply. Nothing is sent to anyone and replayed
+ * emails aren't trapped again. Use rehearse to replay into a copy instead.
+ *
+ */
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// trapNameRE matches the characters I don't want in trap filenames.
+var trapNameRE = regexp.MustCompile(`[^A-Za-z0-9_.@-]+`)
+
+// trapEmail saves the raw text of an email in TrapPath, returning the path
+// of the saved copy. Names never collide so nothing trapped is overwritten.
+func trapEmail(uid uint32, raw []byte) (string, error) {
+
+	if err := os.MkdirAll(cfg.TrapPath, 0755); err != nil {
+		return "", err
+	}
+	mbox := strings.Trim(trapNameRE.ReplaceAllString(source.Name(), "_"), "_")
+	if source.key() == "" {
+		mbox = "INBOX"
+	}
+	base := fmt.Sprintf("%v-%v-%v", time.Now().Format("20060102150405"), mbox, uid)
+	for n := 0; ; n++ {
+		fn := filepath.Join(cfg.TrapPath, base+".eml")
+		if n > 0 {
+			fn = filepath.Join(cfg.TrapPath, fmt.Sprintf("%v-%v.eml", base, n))
+		}
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(raw)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return fn, err
+	}
+
+}
+
+// loadReplay reads a single .eml file or all those in a folder, in the
+// order they were sent.
+func loadReplay(path string) ([]rehearsalEmail, error) {
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return loadRehearsal(path)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return []rehearsalEmail{{Name: filepath.Base(path), Raw: raw}}, nil
+
+}
+
+func runReplay(path string) int {
+
+	emails, err := loadReplay(path)
+	if err != nil || len(emails) == 0 {
+		fmt.Printf("%s: no emails to replay in %v %v\n", apptitle, path, err)
+		return 1
+	}
+	cfg.TrapMails = false
+	cfg.SmtpStuff, cfg.Hooks = EmailSettings{}, nil
+
+	fmt.Printf("%s: replaying %v email(s) from %v\n", apptitle, len(emails), path)
+	claimed, dealtwith, ignored, skipped := replayEmails(emails, make([]time.Duration, len(emails)))
+	reportReplay(emails, claimed, dealtwith, ignored, skipped)
+	return 0
+
+}
@@ -0,0 +1,135 @@
+package main
+
+/*
+ * With -tui the console shows a full-screen status display, redrawn after
+ * each cycle, rather than a stream of log lines. It's meant for the
+ * volunteer minding the laptop, who wants to know that all is well and
+ * roughly what's been happening, not the details.
+ *
+ */
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const tuiRecentClaims = 15
+
+type cycleStatus struct {
+	mu           sync.Mutex
+	Connected    bool
+	LastError    string
+	LastCycle    time.Time
+	Claimed      int // During the last cycle
+	Rejected     int
+	Ignored      int
+	Skipped      int
+	TotalClaimed int // Since startup
+	TotalSkipped int
+	Recent       []string
+	QuotaPercent int // How full the mailbox is, -1 if unknown
+}
+
+var status = cycleStatus{QuotaPercent: -1}
+
+// seqSetLen counts the UIDs in a set.
+func seqSetLen(s *imap.SeqSet) int {
+
+	n := 0
+	for _, x := range s.Set {
+		n += int(x.Stop-x.Start) + 1
+	}
+	return n
+
+}
+
+func (s *cycleStatus) connected(err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Connected = err == nil
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+
+}
+
+func (s *cycleStatus) cycleDone(claimed, rejected, ignored, skipped int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastCycle = time.Now()
+	s.Claimed, s.Rejected, s.Ignored, s.Skipped = claimed, rejected, ignored, skipped
+	s.TotalClaimed += claimed
+	s.TotalSkipped += skipped
+
+}
+
+func (s *cycleStatus) quota(pc int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.QuotaPercent = pc
+
+}
+
+func (s *cycleStatus) addClaim(subject string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Recent = append(s.Recent, time.Now().Format("15:04")+"  "+strings.TrimSpace(subject))
+	if len(s.Recent) > tuiRecentClaims {
+		s.Recent = s.Recent[len(s.Recent)-tuiRecentClaims:]
+	}
+
+}
+
+// drawStatus clears the terminal and shows the current status.
+func drawStatus(w io.Writer, monitoring bool) {
+
+	status.mu.Lock()
+	defer status.mu.Unlock()
+
+	fmt.Fprint(w, "\033[H\033[2J") // Home and clear screen
+	fmt.Fprintf(w, "%v v%v  -  %v\n", apptitle, appversion, cfg.RallyTitle)
+	fmt.Fprintln(w, strings.Repeat("=", 60))
+	mode := "LIVE"
+	if cfg.TestMode {
+		mode = "TEST MODE"
+	}
+	if isPaused() {
+		mode = "PAUSED"
+	}
+	if !monitoring {
+		mode = "SUSPENDED"
+	}
+	fmt.Fprintf(w, "Mailbox      %v  [ %v ]\n", cfg.ImapLogin, mode)
+	switch {
+	case status.LastError != "":
+		fmt.Fprintf(w, "Connection   FAILED  %v\n", status.LastError)
+	case status.Connected:
+		fmt.Fprintln(w, "Connection   ok")
+	default:
+		fmt.Fprintln(w, "Connection   not yet tried")
+	}
+	if !status.LastCycle.IsZero() {
+		fmt.Fprintf(w, "Last check   %v\n", status.LastCycle.Format("Mon 15:04:05"))
+		fmt.Fprintf(w, "             claimed %v, rejected %v, ignored %v, skipped %v\n", status.Claimed, status.Rejected, status.Ignored, status.Skipped)
+	}
+	fmt.Fprintf(w, "Since start  claimed %v, skipped %v\n", status.TotalClaimed, status.TotalSkipped)
+	if status.QuotaPercent >= 0 {
+		fmt.Fprintf(w, "Mailbox use  %v%%\n", status.QuotaPercent)
+	}
+	fmt.Fprintln(w, strings.Repeat("-", 60))
+	fmt.Fprintln(w, "Recent claims")
+	for i := len(status.Recent) - 1; i >= 0; i-- {
+		fmt.Fprintf(w, "  %v\n", status.Recent[i])
+	}
+
+}
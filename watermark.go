@@ -0,0 +1,47 @@
+package main
+
+/*
+ * Exported photo sets get separated from the database so, if
+ * cfg.WatermarkCommand is set, each stored JPG is stamped with the claim it
+ * belongs to. The command is a template like the converters', with {text}
+ * replaced by the caption, for example:-
+ *
+ *		magick {in} -gravity SouthEast -pointsize 24 -fill white -undercolor #00000080 -annotate +8+8 {text} {out}
+ *
+ * Only the JPG is stamped; a HEIC or other original is left untouched.
+ *
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watermarkText is the caption stamped on a photo.
+func watermarkText(entrant int, bonus string, ct time.Time, emailid uint32) string {
+	return fmt.Sprintf("#%v %v %v [%v]", entrant, bonus, ct.In(cfg.LocalTZ).Format("2006-01-02 15:04"), emailid)
+}
+
+// watermarkPhoto stamps a photo, written but not yet stored, with its caption.
+func watermarkPhoto(pp *pendingPhoto, text string) error {
+
+	image := filepath.Join(cfg.ImageFolder, pp.temp+pp.image)
+	if !strings.EqualFold(filepath.Ext(image), ".jpg") {
+		return nil
+	}
+	in := filepath.Join(cfg.Path2SM, image)
+	out := in + ".wm.jpg"
+	cmd := converterCommand(cfg.WatermarkCommand, in, out)
+	for i := range cmd.Args {
+		cmd.Args[i] = strings.ReplaceAll(cmd.Args[i], "{text}", text)
+	}
+	if err := cmd.Run(); err != nil {
+		os.Remove(out)
+		return err
+	}
+	return os.Rename(out, in)
+
+}
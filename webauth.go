@@ -0,0 +1,106 @@
+package main
+
+/*
+ * Rally HQ is often a laptop on a shared hotel network so the dashboard and
+ * API, photos and all, mustn't be open to everyone else on it.
+ *
+ * If DashboardUser and DashboardPassword are set, browsers must log in with
+ * them using basic auth. If DashboardToken is set, programs may instead send
+ * it as a bearer token; so may the APIToken, which pause and resume insist
+ * on either way. With DashboardLocalOnly the dashboard only listens on the
+ * loopback interface, whatever address was asked for.
+ *
+ */
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// dashboardAuthRequired reports whether any credentials are configured.
+func dashboardAuthRequired() bool {
+
+	return (cfg.DashboardUser != "" && cfg.DashboardPassword != "") || cfg.DashboardToken != ""
+
+}
+
+// sameSecret compares secrets in constant time.
+func sameSecret(given string, wanted string) bool {
+
+	return wanted != "" && subtle.ConstantTimeCompare([]byte(given), []byte(wanted)) == 1
+
+}
+
+// dashboardAuthorised reports whether a request carries acceptable credentials.
+func dashboardAuthorised(r *http.Request) bool {
+
+	if !dashboardAuthRequired() {
+		return true
+	}
+	if user, pass, ok := r.BasicAuth(); ok && cfg.DashboardUser != "" {
+		return sameSecret(user, cfg.DashboardUser) && sameSecret(pass, cfg.DashboardPassword)
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return sameSecret(token, cfg.DashboardToken) || sameSecret(token, cfg.APIToken)
+
+}
+
+// requireAuth refuses requests without acceptable credentials.
+func requireAuth(h http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dashboardAuthorised(r) {
+			if cfg.DashboardUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+apptitle+`", charset="UTF-8"`)
+			}
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+
+}
+
+// isLoopbackAddr reports whether a listening address is only reachable locally.
+func isLoopbackAddr(addr string) bool {
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+
+}
+
+// dashboardListenAddr is the address to listen on, confined to loopback if
+// cfg.DashboardLocalOnly is set.
+func dashboardListenAddr(addr string) string {
+
+	if !cfg.DashboardLocalOnly || isLoopbackAddr(addr) {
+		return addr
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+
+}
+
+// warnOpenDashboard says so if anyone on the network can use the dashboard.
+func warnOpenDashboard(addr string) {
+
+	if dashboardAuthRequired() || isLoopbackAddr(addr) {
+		return
+	}
+	fmt.Printf("%s: WARNING dashboard on %v needs no login, set DashboardUser/DashboardPassword or DashboardLocalOnly\n", apptitle, addr)
+
+}